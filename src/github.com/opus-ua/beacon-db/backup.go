@@ -0,0 +1,948 @@
+package beacondb
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/opus-ua/beacon-post"
+	"gopkg.in/redis.v3"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A backup is a tar archive holding, in this order:
+//
+//	manifest.json
+//	users-000001.ndjson, ...
+//	zones-000001.ndjson, ...
+//	posts-000001.ndjson, ...  posts in ascending ID order
+//	images/<id>, thumbs/<id>  JPEG blobs of beacons
+//	geo-000001.ndjson, ...
+//
+// Records are newline-delimited JSON, split into files of at most
+// BACKUP_BATCH_SIZE records so that neither backup nor restore has to
+// hold more than a batch in memory. Beacons are only added to the geo
+// index once their images are in place.
+const (
+	BACKUP_FORMAT_VERSION = 1
+	BACKUP_BATCH_SIZE     = 500
+	BACKUP_MANIFEST       = "manifest.json"
+)
+
+type BackupManifest struct {
+	Format    int    `json:"format"`
+	Schema    uint64 `json:"schema"`
+	Created   int64  `json:"created"`
+	UserCount uint64 `json:"user-count"`
+	PostCount uint64 `json:"post-count"`
+	ZoneCount uint64 `json:"zone-count"`
+}
+
+type BackupLocation struct {
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"long"`
+}
+
+type BackupUser struct {
+	ID        uint64 `json:"id"`
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	Auth      []byte `json:"auth"`
+	Created   int64  `json:"created"`
+	Renamed   int64  `json:"renamed,omitempty"`
+	Admin     bool   `json:"admin,omitempty"`
+	HeartsRec uint32 `json:"hearts-rec"`
+	HeartsSub uint32 `json:"hearts-sub"`
+	FlagsRec  uint32 `json:"flags-rec"`
+	FlagsSub  uint32 `json:"flags-sub"`
+}
+
+type BackupZone struct {
+	ID      uint64           `json:"id"`
+	Name    string           `json:"name"`
+	Rule    string           `json:"rule"`
+	Center  BackupLocation   `json:"center"`
+	Radius  float64          `json:"radius"`
+	Polygon []BackupLocation `json:"polygon,omitempty"`
+}
+
+// A beacon or a comment. Location, ExactLocation and Precision are
+// only set for beacons, Parent only for comments.
+type BackupPost struct {
+	ID            uint64          `json:"id"`
+	Type          string          `json:"type"`
+	Poster        uint64          `json:"poster"`
+	Parent        uint64          `json:"parent,omitempty"`
+	Text          string          `json:"text"`
+	Location      *BackupLocation `json:"loc,omitempty"`
+	ExactLocation *BackupLocation `json:"exact-loc,omitempty"`
+	Precision     string          `json:"prec,omitempty"`
+	Hearts        uint32          `json:"hearts"`
+	Flags         uint32          `json:"flags"`
+	Time          int64           `json:"time"`
+	Pending       bool            `json:"pending,omitempty"`
+	HeartedBy     []uint64        `json:"hearted-by,omitempty"`
+	FlaggedBy     []uint64        `json:"flagged-by,omitempty"`
+}
+
+type BackupGeo struct {
+	ID       uint64         `json:"id"`
+	Location BackupLocation `json:"loc"`
+}
+
+// Counts of what a backup or restore has handled so far. Merged,
+// Renamed and Skipped are only counted by restores.
+type BackupStats struct {
+	Users   int
+	Zones   int
+	Posts   int
+	Images  int
+	Geo     int
+	Merged  int
+	Renamed int
+	Skipped int
+}
+
+func toBackupLocation(loc Geotag) BackupLocation {
+	return BackupLocation{Latitude: loc.Latitude, Longitude: loc.Longitude}
+}
+
+func (loc BackupLocation) Geotag() Geotag {
+	return Geotag{Latitude: loc.Latitude, Longitude: loc.Longitude}
+}
+
+func backupBatchName(kind string, batch int) string {
+	return fmt.Sprintf("%s-%06d.ndjson", kind, batch)
+}
+
+// Returns the sorted IDs of every key matching pattern that is named
+// after an ID alone, such as {u:3} or z:3.
+func (db *DBClient) scanIDsRedis(pattern string) ([]uint64, error) {
+	ids := uint64Slice{}
+	err := db.scanRedis(pattern, BACKUP_BATCH_SIZE, func(keys []string) error {
+		for _, key := range keys {
+			parts := splitRedisKey(key)
+			if len(parts) != 2 {
+				continue
+			}
+			id, err := strconv.ParseUint(parts[1], REDIS_INT_BASE, 64)
+			if err != nil {
+				continue
+			}
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return ids, err
+	}
+	sort.Sort(ids)
+	// SCAN may return a key more than once.
+	unique := ids[:0]
+	for i, id := range ids {
+		if i == 0 || id != ids[i-1] {
+			unique = append(unique, id)
+		}
+	}
+	return unique, nil
+}
+
+func (db *DBClient) getCountRedis(key string) (uint64, error) {
+	count, err := RedisParseUInt64(db.redis.Get(key).Result())
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return count, err
+}
+
+func (db *DBClient) getMemberIDsRedis(key string) ([]uint64, error) {
+	ids, err := db.GetUserPostSetRedis(key)
+	if len(ids) == 0 {
+		return nil, err
+	}
+	return ids, err
+}
+
+type backup struct {
+	db       *DBClient
+	tw       *tar.Writer
+	created  time.Time
+	progress func(BackupStats)
+	stats    BackupStats
+}
+
+func (b *backup) writeEntry(name string, data []byte) error {
+	err := b.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: b.created,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = b.tw.Write(data)
+	return err
+}
+
+func (b *backup) writeRecords(name string, records []interface{}) error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	if err := b.writeEntry(name, buf.Bytes()); err != nil {
+		return err
+	}
+	if b.progress != nil {
+		b.progress(b.stats)
+	}
+	return nil
+}
+
+// Writes records read by fetch for each of ids, in batches. fetch
+// returns nil for records that have disappeared since the scan.
+func (b *backup) writeBatches(kind string, ids []uint64, fetch func(id uint64) (interface{}, error)) error {
+	batch := 0
+	for start := 0; start < len(ids); start += BACKUP_BATCH_SIZE {
+		end := start + BACKUP_BATCH_SIZE
+		if end > len(ids) {
+			end = len(ids)
+		}
+		records := []interface{}{}
+		for _, id := range ids[start:end] {
+			record, err := fetch(id)
+			if err != nil {
+				return fmt.Errorf("%s %d: %s", kind, id, err.Error())
+			}
+			if record != nil {
+				records = append(records, record)
+			}
+		}
+		batch++
+		if err := b.writeRecords(backupBatchName(kind, batch), records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *backup) fetchUser(admins map[string]bool) func(id uint64) (interface{}, error) {
+	return func(id uint64) (interface{}, error) {
+		res, err := b.db.redis.HGetAllMap(GetRedisUserKey(id)).Result()
+		if err != nil || len(res) == 0 {
+			return nil, err
+		}
+		created, err := RedisParseTime(res["created"], err)
+		heartsRec, err := RedisParseUInt32(res["hearts-rec"], err)
+		heartsSub, err := RedisParseUInt32(res["hearts-sub"], err)
+		flagsRec, err := RedisParseUInt32(res["flags-rec"], err)
+		flagsSub, err := RedisParseUInt32(res["flags-sub"], err)
+		if err != nil {
+			return nil, err
+		}
+		user := BackupUser{
+			ID:        id,
+			Username:  res["username"],
+			Email:     res["email"],
+			Auth:      []byte(res["auth"]),
+			Created:   created.Unix(),
+			Admin:     admins[strconv.FormatUint(id, REDIS_INT_BASE)],
+			HeartsRec: heartsRec,
+			HeartsSub: heartsSub,
+			FlagsRec:  flagsRec,
+			FlagsSub:  flagsSub,
+		}
+		if renamed, ok := res["renamed"]; ok {
+			if user.Renamed, err = strconv.ParseInt(renamed, REDIS_INT_BASE, 64); err != nil {
+				return nil, err
+			}
+		}
+		b.stats.Users++
+		return user, nil
+	}
+}
+
+func toBackupZone(zone Zone) BackupZone {
+	record := BackupZone{
+		ID:     zone.ID,
+		Name:   zone.Name,
+		Rule:   zone.Rule.String(),
+		Center: toBackupLocation(zone.Center),
+		Radius: zone.Radius,
+	}
+	for _, vertex := range zone.Polygon {
+		record.Polygon = append(record.Polygon, toBackupLocation(vertex))
+	}
+	return record
+}
+
+func (record BackupZone) Zone() (Zone, error) {
+	rule, err := ParseZoneRule(record.Rule)
+	if err != nil {
+		return Zone{}, err
+	}
+	zone := Zone{
+		ID:     record.ID,
+		Name:   record.Name,
+		Rule:   rule,
+		Center: record.Center.Geotag(),
+		Radius: record.Radius,
+	}
+	for _, vertex := range record.Polygon {
+		zone.Polygon = append(zone.Polygon, vertex.Geotag())
+	}
+	return zone, nil
+}
+
+func (b *backup) fetchZone(id uint64) (interface{}, error) {
+	zone, err := b.db.GetZoneRedis(id)
+	if err != nil {
+		return nil, err
+	}
+	zone.ID = id
+	b.stats.Zones++
+	return toBackupZone(zone), nil
+}
+
+func (b *backup) fetchPost(beacons *[]uint64) func(id uint64) (interface{}, error) {
+	return func(id uint64) (interface{}, error) {
+		key := GetRedisPostKey(id)
+		fields, err := b.db.redis.HMGet(key, "type", "poster", "parent", "desc", "text",
+			"loc", "exact-loc", "prec", "hearts", "flags", "time", "pending").Result()
+		if err != nil {
+			return nil, err
+		}
+		res := make([]string, len(fields))
+		for i, field := range fields {
+			res[i], _ = field.(string)
+		}
+		if res[0] == "" {
+			// A post hash without a type is left over from a failed
+			// write and holds nothing worth restoring.
+			return nil, nil
+		}
+		post := BackupPost{ID: id, Type: res[0], Pending: fields[11] != nil}
+		post.Poster, err = RedisParseUInt64(res[1], nil)
+		post.Hearts, err = RedisParseUInt32(res[8], err)
+		post.Flags, err = RedisParseUInt32(res[9], err)
+		postTime, err := RedisParseTime(res[10], err)
+		post.Time = postTime.Unix()
+		switch post.Type {
+		case "beacon":
+			var loc Geotag
+			err = RedisParseBinary(res[5], &loc, err)
+			location := toBackupLocation(loc)
+			post.Location = &location
+			if fields[6] != nil {
+				var exact Geotag
+				err = RedisParseBinary(res[6], &exact, err)
+				exactLocation := toBackupLocation(exact)
+				post.ExactLocation = &exactLocation
+			}
+			post.Precision = res[7]
+			post.Text = res[3]
+			*beacons = append(*beacons, id)
+		case "comment":
+			post.Parent, err = RedisParseUInt64(res[2], err)
+			post.Text = res[4]
+		default:
+			return nil, fmt.Errorf("Unknown post type '%s'.", post.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		post.HeartedBy, err = b.db.getMemberIDsRedis(GetRedisUserHeartedKey(id))
+		if err != nil {
+			return nil, err
+		}
+		post.FlaggedBy, err = b.db.getMemberIDsRedis(GetRedisUserFlaggedKey(id))
+		if err != nil {
+			return nil, err
+		}
+		b.stats.Posts++
+		return post, nil
+	}
+}
+
+func (b *backup) writeImages(beacons []uint64) error {
+	for _, id := range beacons {
+		res, err := b.db.redis.HMGet(GetRedisPostKey(id), "img", "thumb").Result()
+		if err != nil {
+			return err
+		}
+		for i, dir := range []string{"images", "thumbs"} {
+			blob, _ := res[i].(string)
+			if blob == "" {
+				continue
+			}
+			if err = b.writeEntry(fmt.Sprintf("%s/%d", dir, id), []byte(blob)); err != nil {
+				return err
+			}
+			b.stats.Images++
+		}
+	}
+	return nil
+}
+
+const geoPosScript = `
+return redis.call("GEOPOS", KEYS[1], unpack(ARGV))
+`
+
+func (b *backup) writeGeo() error {
+	batch := 0
+	for start := int64(0); ; start += BACKUP_BATCH_SIZE {
+		members, err := b.db.redis.ZRange(GEOTAG_KEY, start, start+BACKUP_BATCH_SIZE-1).Result()
+		if err != nil {
+			return err
+		}
+		if len(members) == 0 {
+			return nil
+		}
+		res, err := b.db.redis.Eval(geoPosScript, []string{GEOTAG_KEY}, members).Result()
+		if err != nil {
+			return err
+		}
+		positions, _ := res.([]interface{})
+		records := []interface{}{}
+		for i, member := range members {
+			if i >= len(positions) {
+				break
+			}
+			pos, _ := positions[i].([]interface{})
+			if len(pos) != 2 {
+				continue
+			}
+			lngStr, _ := pos[0].(string)
+			latStr, _ := pos[1].(string)
+			id, err := RedisParseUInt64(member, nil)
+			lng, err := RedisParseFloat64(lngStr, err)
+			lat, err := RedisParseFloat64(latStr, err)
+			if err != nil {
+				return fmt.Errorf("geo %s: %s", member, err.Error())
+			}
+			records = append(records, BackupGeo{
+				ID:       id,
+				Location: BackupLocation{Latitude: lat, Longitude: lng},
+			})
+			b.stats.Geo++
+		}
+		batch++
+		if err = b.writeRecords(backupBatchName("geo", batch), records); err != nil {
+			return err
+		}
+	}
+}
+
+// Streams every user, zone, post, heart and flag set and the geo
+// index to w as a tar archive. The backup is not a snapshot: writes
+// made while it runs may or may not be included, but every record in
+// it is whole. Ephemeral data such as rate limits, device fixes and
+// pending exports is left out.
+func (db *DBClient) BackupRedis(w io.Writer, progress func(BackupStats)) (BackupStats, error) {
+	b := &backup{
+		db:       db,
+		tw:       tar.NewWriter(w),
+		created:  time.Now(),
+		progress: progress,
+	}
+	manifest := BackupManifest{Format: BACKUP_FORMAT_VERSION, Created: b.created.Unix()}
+	var err error
+	manifest.Schema, err = db.GetSchemaVersionRedis()
+	if err != nil {
+		return b.stats, err
+	}
+	counts := map[string]*uint64{
+		USER_COUNT_KEY: &manifest.UserCount,
+		POST_COUNT_KEY: &manifest.PostCount,
+		ZONE_COUNT_KEY: &manifest.ZoneCount,
+	}
+	for key, count := range counts {
+		if *count, err = db.getCountRedis(key); err != nil {
+			return b.stats, err
+		}
+	}
+	manifestJson, err := json.Marshal(manifest)
+	if err != nil {
+		return b.stats, err
+	}
+	if err = b.writeEntry(BACKUP_MANIFEST, manifestJson); err != nil {
+		return b.stats, err
+	}
+	admins := map[string]bool{}
+	members, err := db.redis.SMembers(ADMIN_POOL_KEY).Result()
+	if err != nil {
+		return b.stats, err
+	}
+	for _, member := range members {
+		admins[member] = true
+	}
+	userIDs, err := db.scanIDsRedis("{u:*")
+	if err != nil {
+		return b.stats, err
+	}
+	if err = b.writeBatches("users", userIDs, b.fetchUser(admins)); err != nil {
+		return b.stats, err
+	}
+	zoneIDs, err := db.scanIDsRedis("z:*")
+	if err != nil {
+		return b.stats, err
+	}
+	if err = b.writeBatches("zones", zoneIDs, b.fetchZone); err != nil {
+		return b.stats, err
+	}
+	postIDs, err := db.scanIDsRedis("{p:*")
+	if err != nil {
+		return b.stats, err
+	}
+	beacons := []uint64{}
+	if err = b.writeBatches("posts", postIDs, b.fetchPost(&beacons)); err != nil {
+		return b.stats, err
+	}
+	if err = b.writeImages(beacons); err != nil {
+		return b.stats, err
+	}
+	if err = b.writeGeo(); err != nil {
+		return b.stats, err
+	}
+	if err = b.tw.Close(); err != nil {
+		return b.stats, err
+	}
+	if progress != nil {
+		progress(b.stats)
+	}
+	return b.stats, nil
+}
+
+// Handles the manifest of a backup and then each of its records, in
+// the order they are in the archive. batch is called after each file
+// of records.
+type backupHandlers struct {
+	manifest func(manifest *BackupManifest) error
+	user     func(user *BackupUser) error
+	zone     func(zone *BackupZone) error
+	post     func(post *BackupPost) error
+	image    func(id uint64, field string, blob []byte) error
+	geo      func(geo *BackupGeo) error
+	batch    func()
+}
+
+// Reads a backup written by BackupRedis or BackupPostgres, checking
+// its manifest before handing it and every record after it to h.
+func readBackup(r io.Reader, h backupHandlers) error {
+	tr := tar.NewReader(r)
+	hasManifest := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Name == BACKUP_MANIFEST {
+			err = readBackupManifest(tr, h)
+			hasManifest = err == nil
+		} else if !hasManifest {
+			err = errors.New("Backup does not start with a manifest.")
+		} else {
+			err = readBackupEntry(hdr.Name, tr, h)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", hdr.Name, err.Error())
+		}
+		if h.batch != nil && strings.HasSuffix(hdr.Name, ".ndjson") {
+			h.batch()
+		}
+	}
+	if !hasManifest {
+		return errors.New("Backup has no manifest.")
+	}
+	return nil
+}
+
+func readBackupManifest(r io.Reader, h backupHandlers) error {
+	manifest := &BackupManifest{}
+	if err := json.NewDecoder(r).Decode(manifest); err != nil {
+		return err
+	}
+	if manifest.Format != BACKUP_FORMAT_VERSION {
+		return fmt.Errorf("Backup format %d is not supported.", manifest.Format)
+	}
+	if manifest.Schema > LatestSchemaVersion() {
+		return fmt.Errorf("Backup schema version %d is newer than this build knows about.", manifest.Schema)
+	}
+	return h.manifest(manifest)
+}
+
+func readBackupEntry(name string, r io.Reader, h backupHandlers) error {
+	if strings.HasPrefix(name, "images/") || strings.HasPrefix(name, "thumbs/") {
+		parts := strings.Split(name, "/")
+		id, err := RedisParseUInt64(parts[len(parts)-1], nil)
+		if err != nil {
+			return err
+		}
+		blob, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		field := "img"
+		if parts[0] == "thumbs" {
+			field = "thumb"
+		}
+		return h.image(id, field, blob)
+	}
+	var record interface{}
+	var restoreFn func() error
+	switch kind := strings.SplitN(name, "-", 2)[0]; kind {
+	case "users":
+		user := &BackupUser{}
+		record, restoreFn = user, func() error { return h.user(user) }
+	case "zones":
+		zone := &BackupZone{}
+		record, restoreFn = zone, func() error { return h.zone(zone) }
+	case "posts":
+		post := &BackupPost{}
+		record, restoreFn = post, func() error { return h.post(post) }
+	case "geo":
+		geo := &BackupGeo{}
+		record, restoreFn = geo, func() error { return h.geo(geo) }
+	default:
+		return errors.New("Unknown backup entry.")
+	}
+	dec := json.NewDecoder(r)
+	for {
+		err := dec.Decode(record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = restoreFn(); err != nil {
+			return err
+		}
+	}
+}
+
+type restore struct {
+	db    *DBClient
+	merge bool
+	stats BackupStats
+	users map[uint64]uint64
+	zones map[string]bool
+	posts map[uint64]uint64
+}
+
+// Reads a backup written by BackupRedis into the db. Without merge the
+// db must be empty, and every record keeps its ID. With merge, records
+// are added to a live db under new IDs: users whose email is already
+// registered are merged into the existing account, users whose
+// username is taken get their old ID appended to it, and zones whose
+// name is already in use are skipped. A merge must be into a db at the
+// same schema version as the backup.
+func (db *DBClient) RestoreRedis(r io.Reader, merge bool, progress func(BackupStats)) (BackupStats, error) {
+	rs := &restore{
+		db:    db,
+		merge: merge,
+		users: map[uint64]uint64{},
+		zones: map[string]bool{},
+		posts: map[uint64]uint64{},
+	}
+	err := readBackup(r, backupHandlers{
+		manifest: rs.startRestore,
+		user:     rs.restoreUser,
+		zone:     rs.restoreZone,
+		post:     rs.restorePost,
+		image:    rs.restoreImage,
+		geo:      rs.restoreGeo,
+		batch: func() {
+			if progress != nil {
+				progress(rs.stats)
+			}
+		},
+	})
+	if err != nil {
+		return rs.stats, err
+	}
+	if progress != nil {
+		progress(rs.stats)
+	}
+	return rs.stats, nil
+}
+
+func (rs *restore) startRestore(manifest *BackupManifest) error {
+	if rs.merge {
+		version, err := rs.db.GetSchemaVersionRedis()
+		if err != nil {
+			return err
+		}
+		if version != manifest.Schema {
+			return fmt.Errorf("Backup is at schema version %d but the db is at %d. "+
+				"Restore it into an empty db and migrate it first.", manifest.Schema, version)
+		}
+		zones, err := rs.db.GetZonesRedis()
+		if err != nil {
+			return err
+		}
+		for _, zone := range zones {
+			rs.zones[zone.Name] = true
+		}
+		return nil
+	}
+	for _, key := range []string{USER_COUNT_KEY, POST_COUNT_KEY, ZONE_COUNT_KEY} {
+		exists, err := rs.db.redis.Exists(key).Result()
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errors.New("Db is not empty. Restore with merge to add to it.")
+		}
+	}
+	counts := map[string]uint64{
+		USER_COUNT_KEY:     manifest.UserCount,
+		POST_COUNT_KEY:     manifest.PostCount,
+		ZONE_COUNT_KEY:     manifest.ZoneCount,
+		SCHEMA_VERSION_KEY: manifest.Schema,
+	}
+	for key, count := range counts {
+		err := rs.db.redis.Set(key, strconv.FormatUint(count, REDIS_INT_BASE), 0).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs *restore) restoreUser(user *BackupUser) error {
+	if rs.merge {
+		existing, err := rs.db.GetUserIDByEmailRedis(user.Email)
+		if err == nil {
+			return rs.mergeUser(user, existing)
+		}
+		if err != redis.Nil {
+			return err
+		}
+	}
+	fields := []string{"created", RedisFormatTime(time.Unix(user.Created, 0)),
+		"hearts-rec", strconv.FormatUint(uint64(user.HeartsRec), REDIS_INT_BASE),
+		"hearts-sub", strconv.FormatUint(uint64(user.HeartsSub), REDIS_INT_BASE),
+		"flags-rec", strconv.FormatUint(uint64(user.FlagsRec), REDIS_INT_BASE),
+		"flags-sub", strconv.FormatUint(uint64(user.FlagsSub), REDIS_INT_BASE),
+		"auth", string(user.Auth),
+		"email", user.Email}
+	if user.Renamed != 0 {
+		fields = append(fields, "renamed", strconv.FormatInt(user.Renamed, REDIS_INT_BASE))
+	}
+	id := user.ID
+	usernames := []string{user.Username}
+	if rs.merge {
+		var err error
+		if id, err = rs.db.nextIDRedis(USER_COUNT_KEY); err != nil {
+			return err
+		}
+		usernames = append(usernames, fmt.Sprintf("%s-%d", user.Username, user.ID))
+	}
+	for i, username := range usernames {
+		err := rs.db.fileUserRedis(id, username, user.Email, fields)
+		if err == ErrUsernameTaken {
+			continue
+		}
+		if err == ErrEmailTaken {
+			return fmt.Errorf("Email of user %d is already registered.", user.ID)
+		}
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			rs.stats.Renamed++
+		}
+		rs.users[user.ID] = id
+		rs.stats.Users++
+		if user.Admin {
+			return rs.db.SetAdminRedis(id, true)
+		}
+		return nil
+	}
+	return fmt.Errorf("Username of user %d is already taken.", user.ID)
+}
+
+func (rs *restore) mergeUser(user *BackupUser, existing uint64) error {
+	key := GetRedisUserKey(existing)
+	counters := map[string]uint32{
+		"hearts-rec": user.HeartsRec,
+		"hearts-sub": user.HeartsSub,
+		"flags-rec":  user.FlagsRec,
+		"flags-sub":  user.FlagsSub,
+	}
+	for field, count := range counters {
+		if err := rs.db.redis.HIncrBy(key, field, int64(count)).Err(); err != nil {
+			return err
+		}
+	}
+	if user.Admin {
+		if err := rs.db.SetAdminRedis(existing, true); err != nil {
+			return err
+		}
+	}
+	rs.users[user.ID] = existing
+	rs.stats.Users++
+	rs.stats.Merged++
+	return nil
+}
+
+func (rs *restore) restoreZone(record *BackupZone) error {
+	zone, err := record.Zone()
+	if err != nil {
+		return err
+	}
+	if !rs.merge {
+		err = rs.db.SetZoneRedis(&zone)
+	} else if rs.zones[zone.Name] {
+		rs.stats.Skipped++
+		return nil
+	} else {
+		_, err = rs.db.AddZoneRedis(&zone)
+	}
+	if err != nil {
+		return err
+	}
+	rs.zones[zone.Name] = true
+	rs.stats.Zones++
+	return nil
+}
+
+// Returns the ID a backed up user was restored under. When restoring
+// into an empty db, IDs are kept even for users missing from the
+// backup.
+func (rs *restore) userID(id uint64) (uint64, bool) {
+	if !rs.merge {
+		return id, true
+	}
+	mapped, ok := rs.users[id]
+	return mapped, ok
+}
+
+func (rs *restore) restorePost(post *BackupPost) error {
+	poster, ok := rs.userID(post.Poster)
+	if !ok {
+		poster = DeletedUserID
+	}
+	fields := []string{"poster", strconv.FormatUint(poster, REDIS_INT_BASE),
+		"hearts", strconv.FormatUint(uint64(post.Hearts), REDIS_INT_BASE),
+		"flags", strconv.FormatUint(uint64(post.Flags), REDIS_INT_BASE),
+		"time", RedisFormatTime(time.Unix(post.Time, 0)),
+		"type", post.Type}
+	indexKey := GetRedisUserPostsKey(poster)
+	threadKey := ""
+	switch post.Type {
+	case "beacon":
+		if post.Location == nil {
+			return fmt.Errorf("Beacon %d has no location.", post.ID)
+		}
+		precision, err := ParsePrecision(post.Precision)
+		if err != nil {
+			return err
+		}
+		loc := post.Location.Geotag()
+		locBytes, _ := loc.MarshalBinary()
+		fields = append(fields, "img", "", "thumb", "",
+			"loc", string(locBytes),
+			"prec", precision.String(),
+			"desc", post.Text)
+		if post.ExactLocation != nil {
+			exact := post.ExactLocation.Geotag()
+			exactBytes, _ := exact.MarshalBinary()
+			fields = append(fields, "exact-loc", string(exactBytes))
+		}
+	case "comment":
+		parent, ok := rs.posts[post.Parent]
+		if !ok {
+			rs.stats.Skipped++
+			return nil
+		}
+		fields = append(fields, "parent", strconv.FormatUint(parent, REDIS_INT_BASE),
+			"text", post.Text)
+		indexKey = GetRedisUserCommentsKey(poster)
+		threadKey = GetRedisCommentListKey(parent)
+	default:
+		return fmt.Errorf("Unknown post type '%s'.", post.Type)
+	}
+	id := post.ID
+	if rs.merge {
+		var err error
+		if id, err = rs.db.nextIDRedis(POST_COUNT_KEY); err != nil {
+			return err
+		}
+	}
+	if poster == DeletedUserID {
+		indexKey = ""
+	}
+	// The geo index is restored from its own records.
+	err := rs.db.filePostRedis(id, fields, post.Pending, indexKey, threadKey)
+	if err != nil {
+		return err
+	}
+	rs.posts[post.ID] = id
+	if err = rs.restoreMembers(id, post.HeartedBy, GetRedisUserHeartedKey, GetRedisUserHeartListKey); err != nil {
+		return err
+	}
+	if err = rs.restoreMembers(id, post.FlaggedBy, GetRedisUserFlaggedKey, GetRedisUserFlagListKey); err != nil {
+		return err
+	}
+	rs.stats.Posts++
+	return nil
+}
+
+// Restores who hearted or flagged a post. A merge leaves out users
+// that are not in the backup.
+func (rs *restore) restoreMembers(postID uint64, userIDs []uint64, setKey func(uint64) string, listKey func(uint64) string) error {
+	postIDStr := strconv.FormatUint(postID, REDIS_INT_BASE)
+	for _, userID := range userIDs {
+		mapped, ok := rs.userID(userID)
+		if !ok {
+			continue
+		}
+		err := rs.db.redis.SAdd(setKey(postID), strconv.FormatUint(mapped, REDIS_INT_BASE)).Err()
+		if err != nil {
+			return err
+		}
+		if err = rs.db.redis.SAdd(listKey(mapped), postIDStr).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs *restore) restoreImage(oldID uint64, field string, blob []byte) error {
+	id, ok := rs.posts[oldID]
+	if !ok {
+		return fmt.Errorf("Image belongs to unknown post %d.", oldID)
+	}
+	if err := rs.db.redis.HSet(GetRedisPostKey(id), field, string(blob)).Err(); err != nil {
+		return err
+	}
+	rs.stats.Images++
+	return nil
+}
+
+func (rs *restore) restoreGeo(geo *BackupGeo) error {
+	id, ok := rs.posts[geo.ID]
+	if !ok {
+		rs.stats.Skipped++
+		return nil
+	}
+	if err := rs.db.IndexBeaconRedis(id, geo.Location.Geotag()); err != nil {
+		return err
+	}
+	rs.stats.Geo++
+	return nil
+}
@@ -0,0 +1,179 @@
+package beacondb
+
+import (
+	"gopkg.in/redis.v3"
+	"strings"
+	"time"
+)
+
+// The commands DBClient sends, which a single server, a client
+// following sentinels and a cluster client all answer. In a cluster
+// every script and multi-key command must name keys in one hash slot,
+// which is why post and user keys carry hash tags. Writes spanning
+// several slots run as one script everywhere else; see clustered.
+type RedisClient interface {
+	Close() error
+	PoolStats() *redis.PoolStats
+	Pipeline() RedisPipeline
+	// Calls fn once with a client for each master, so that keyless
+	// commands such as SCAN and FLUSHDB reach the whole keyspace.
+	forEachNode(fn func(node *redis.Client) error) error
+
+	Ping() *redis.StatusCmd
+	FlushDb() *redis.StatusCmd
+	Eval(script string, keys []string, args []string) *redis.Cmd
+	Scan(cursor int64, match string, count int64) *redis.ScanCmd
+
+	Del(keys ...string) *redis.IntCmd
+	Exists(key string) *redis.BoolCmd
+	Expire(key string, expiration time.Duration) *redis.BoolCmd
+	PTTL(key string) *redis.DurationCmd
+	Rename(key, newkey string) *redis.StatusCmd
+
+	Get(key string) *redis.StringCmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	Incr(key string) *redis.IntCmd
+
+	HDel(key string, fields ...string) *redis.IntCmd
+	HGet(key, field string) *redis.StringCmd
+	HGetAllMap(key string) *redis.StringStringMapCmd
+	HIncrBy(key, field string, incr int64) *redis.IntCmd
+	HMGet(key string, fields ...string) *redis.SliceCmd
+	HMSet(key, field, value string, pairs ...string) *redis.StatusCmd
+	HSet(key, field, value string) *redis.BoolCmd
+
+	LLen(key string) *redis.IntCmd
+	LPush(key string, values ...string) *redis.IntCmd
+	LRange(key string, start, stop int64) *redis.StringSliceCmd
+	LRem(key string, count int64, value interface{}) *redis.IntCmd
+	RPush(key string, values ...string) *redis.IntCmd
+
+	SAdd(key string, members ...string) *redis.IntCmd
+	SCard(key string) *redis.IntCmd
+	SIsMember(key string, member interface{}) *redis.BoolCmd
+	SMembers(key string) *redis.StringSliceCmd
+	SRem(key string, members ...string) *redis.IntCmd
+
+	ZRange(key string, start, stop int64) *redis.StringSliceCmd
+	ZRem(key string, members ...string) *redis.IntCmd
+	ZScan(key string, cursor int64, match string, count int64) *redis.ScanCmd
+
+	GeoAdd(key string, geoLocation ...*redis.GeoLocation) *redis.IntCmd
+	GeoRadius(key string, longitude, latitude float64, query *redis.GeoRadiusQuery) *redis.GeoLocationCmd
+
+	PFCount(keys ...string) *redis.IntCmd
+}
+
+// The commands sent through pipelines. A cluster pipeline splits the
+// commands by node, so they need not share a hash slot.
+type RedisPipeline interface {
+	Exec() ([]redis.Cmder, error)
+	Close() error
+
+	Del(keys ...string) *redis.IntCmd
+	Expire(key string, expiration time.Duration) *redis.BoolCmd
+	Get(key string) *redis.StringCmd
+	HGet(key, field string) *redis.StringCmd
+	HGetAllMap(key string) *redis.StringStringMapCmd
+	HMGet(key string, fields ...string) *redis.SliceCmd
+	LRange(key string, start, stop int64) *redis.StringSliceCmd
+	PFAdd(key string, fields ...string) *redis.IntCmd
+	SIsMember(key string, member interface{}) *redis.BoolCmd
+}
+
+// A single server, or the master a failover client follows.
+type singleClient struct {
+	*redis.Client
+	// Set when the master is found by sentinelDialer rather than by
+	// the failover client.
+	sentinels *sentinelDialer
+}
+
+func (c singleClient) Pipeline() RedisPipeline {
+	return c.Client.Pipeline()
+}
+
+func (c singleClient) forEachNode(fn func(node *redis.Client) error) error {
+	return fn(c.Client)
+}
+
+func (c singleClient) Close() error {
+	if c.sentinels != nil {
+		c.sentinels.Close()
+	}
+	return c.Client.Close()
+}
+
+type clusterClient struct {
+	*redis.ClusterClient
+	// Used to reach each master on its own. See forEachNode.
+	options redis.Options
+}
+
+func (c clusterClient) Pipeline() RedisPipeline {
+	return c.ClusterClient.Pipeline()
+}
+
+func (c clusterClient) forEachNode(fn func(node *redis.Client) error) error {
+	slots, err := c.ClusterSlots().Result()
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, slot := range slots {
+		if len(slot.Addrs) == 0 || seen[slot.Addrs[0]] {
+			continue
+		}
+		seen[slot.Addrs[0]] = true
+		options := c.options
+		options.Addr = slot.Addrs[0]
+		node := redis.NewClient(&options)
+		err = fn(node)
+		node.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether db talks to a cluster. A write touching keys in several hash
+// slots can't be one script there, so it runs as a step per slot, in
+// an order that leaves nothing fsck can't repair if a step fails.
+// Elsewhere the same write runs as a single script.
+func (db *DBClient) clustered() bool {
+	return len(db.redisConfig.ClusterAddrs) > 0
+}
+
+// Calls fn with each batch of keys matching pattern, on every master.
+// Like SCAN itself, a key may be passed more than once.
+func (db *DBClient) scanRedis(pattern string, count int64, fn func(keys []string) error) error {
+	return db.redis.forEachNode(func(node *redis.Client) error {
+		cursor := int64(0)
+		for {
+			next, keys, err := node.Scan(cursor, pattern, count).Result()
+			if err != nil {
+				return err
+			}
+			if err = fn(keys); err != nil {
+				return err
+			}
+			if next == 0 {
+				return nil
+			}
+			cursor = next
+		}
+	})
+}
+
+// Splits a key into its colon separated parts, ignoring the braces of
+// its hash tag, so "{p:12}:c" gives "p", "12" and "c".
+func splitRedisKey(key string) []string {
+	if strings.HasPrefix(key, "{") {
+		if end := strings.Index(key, "}"); end > 0 {
+			key = key[1:end] + key[end+1:]
+		}
+	}
+	return strings.Split(key, ":")
+}
@@ -0,0 +1,173 @@
+package beacondb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"gopkg.in/redis.v3"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// The database tests run against, so they never touch real data.
+const TESTING_REDIS_DB = 11
+
+// How to reach Redis. A client talks to Addr unless SentinelAddrs is
+// set, in which case it asks the sentinels for the current master of
+// SentinelMaster and follows it through failovers, or ClusterAddrs is
+// set, in which case it learns the rest of the cluster from those
+// nodes.
+type RedisConfig struct {
+	Addr     string `toml:"addr"`
+	Password string `toml:"password"`
+	DB       int64  `toml:"db"`
+	// Connects over TLS, verifying the server against TLSCAFile if it
+	// is set and the system roots otherwise.
+	TLS       bool   `toml:"tls"`
+	TLSCAFile string `toml:"tls_ca"`
+
+	PoolSize     int           `toml:"pool_size"`
+	DialTimeout  time.Duration `toml:"dial_timeout"`
+	ReadTimeout  time.Duration `toml:"read_timeout"`
+	WriteTimeout time.Duration `toml:"write_timeout"`
+	PoolTimeout  time.Duration `toml:"pool_timeout"`
+	IdleTimeout  time.Duration `toml:"idle_timeout"`
+
+	SentinelMaster string   `toml:"sentinel_master"`
+	SentinelAddrs  []string `toml:"sentinels"`
+	ClusterAddrs   []string `toml:"cluster"`
+
+	// How long cached threads, pending exports and the last device fix
+	// of each user are kept. Redis counts expiries in whole seconds.
+	ThreadCacheTTL time.Duration `toml:"thread_cache_ttl"`
+	ExportExpiry   time.Duration `toml:"export_expiry"`
+	LastFixExpiry  time.Duration `toml:"last_fix_expiry"`
+}
+
+var DefaultRedisConfig = RedisConfig{
+	Addr:         "localhost:6379",
+	PoolSize:     10,
+	DialTimeout:  5 * time.Second,
+	ReadTimeout:  3 * time.Second,
+	WriteTimeout: 3 * time.Second,
+	PoolTimeout:  4 * time.Second,
+	IdleTimeout:  5 * time.Minute,
+
+	ThreadCacheTTL: 10 * time.Minute,
+	ExportExpiry:   24 * time.Hour,
+	LastFixExpiry:  24 * time.Hour,
+}
+
+func (config RedisConfig) Validate() error {
+	if len(config.ClusterAddrs) > 0 {
+		if len(config.SentinelAddrs) > 0 {
+			return errors.New("Sentinels and cluster nodes can't both be given.")
+		}
+		if config.DB != 0 {
+			return errors.New("A Redis cluster only has database 0.")
+		}
+		// The cluster client of redis.v3 takes no dialer.
+		if config.TLS {
+			return errors.New("TLS is not supported with a Redis cluster.")
+		}
+	} else if len(config.SentinelAddrs) > 0 {
+		if config.SentinelMaster == "" {
+			return errors.New("Sentinels were given without the name of the master.")
+		}
+	} else if config.Addr == "" {
+		return errors.New("No Redis address was given.")
+	}
+	if config.DB < 0 {
+		return fmt.Errorf("Redis database %d is negative.", config.DB)
+	}
+	if config.PoolSize < 0 {
+		return fmt.Errorf("Redis pool size %d is negative.", config.PoolSize)
+	}
+	if config.ThreadCacheTTL < time.Second || config.ExportExpiry < time.Second || config.LastFixExpiry < time.Second {
+		return errors.New("Redis expiries must be at least a second.")
+	}
+	return nil
+}
+
+func (config RedisConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if config.TLSCAFile == "" {
+		return tlsConfig, nil
+	}
+	pem, err := ioutil.ReadFile(config.TLSCAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.RootCAs = x509.NewCertPool()
+	if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in '%s'.", config.TLSCAFile)
+	}
+	return tlsConfig, nil
+}
+
+// Returns a client for the configured server. Nothing is dialed until
+// the first command.
+func (config RedisConfig) NewClient() (RedisClient, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	options := redis.Options{
+		Addr:         config.Addr,
+		Password:     config.Password,
+		DB:           config.DB,
+		PoolSize:     config.PoolSize,
+		DialTimeout:  config.DialTimeout,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		PoolTimeout:  config.PoolTimeout,
+		IdleTimeout:  config.IdleTimeout,
+	}
+	if len(config.ClusterAddrs) > 0 {
+		return clusterClient{
+			ClusterClient: redis.NewClusterClient(&redis.ClusterOptions{
+				Addrs:        config.ClusterAddrs,
+				Password:     config.Password,
+				PoolSize:     config.PoolSize,
+				DialTimeout:  config.DialTimeout,
+				ReadTimeout:  config.ReadTimeout,
+				WriteTimeout: config.WriteTimeout,
+				PoolTimeout:  config.PoolTimeout,
+				IdleTimeout:  config.IdleTimeout,
+			}),
+			options: options,
+		}, nil
+	}
+	if len(config.SentinelAddrs) > 0 && !config.TLS {
+		return singleClient{Client: redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    config.SentinelMaster,
+			SentinelAddrs: config.SentinelAddrs,
+			Password:      config.Password,
+			DB:            config.DB,
+			PoolSize:      config.PoolSize,
+			DialTimeout:   config.DialTimeout,
+			ReadTimeout:   config.ReadTimeout,
+			WriteTimeout:  config.WriteTimeout,
+			PoolTimeout:   config.PoolTimeout,
+			IdleTimeout:   config.IdleTimeout,
+		})}, nil
+	}
+	if !config.TLS {
+		return singleClient{Client: redis.NewClient(&options)}, nil
+	}
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if len(config.SentinelAddrs) > 0 {
+		sentinels := newSentinelDialer(config, tlsConfig)
+		options.Dialer = sentinels.Dial
+		return singleClient{Client: redis.NewClient(&options), sentinels: sentinels}, nil
+	}
+	options.Dialer = func() (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: config.DialTimeout}
+		return tls.DialWithDialer(dialer, "tcp", config.Addr, tlsConfig)
+	}
+	return singleClient{Client: redis.NewClient(&options)}, nil
+}
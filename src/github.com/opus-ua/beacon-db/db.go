@@ -1,96 +1,267 @@
 package beacondb
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	. "github.com/opus-ua/beacon-post"
-	"gopkg.in/redis.v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"sync"
+	"time"
 )
 
 type DBClient struct {
-	redis *redis.Client
-	// postgres *postgres.Client
-	devMode bool
-	err     error
+	redis RedisClient
+	// What redis was made from. See SelectTestingTable.
+	redisConfig RedisConfig
+	// Set by UsePostgres.
+	postgres   *sql.DB
+	redisCache bool
+	devMode    bool
+	err        error
+	// Operations are traced as children of the span in ctx, if any.
+	ctx context.Context
 }
 
-func NewDB(dev bool, testing bool) *DBClient {
+// Connects to Redis as configured. Testing always uses
+// TESTING_REDIS_DB and starts it empty. Dev and testing databases are
+// filled with dummy data.
+func NewDB(config RedisConfig, dev bool, testing bool) (*DBClient, error) {
 	if testing {
-		return TestDB()
+		if len(config.ClusterAddrs) > 0 {
+			return nil, errors.New("Tests can't run against a Redis cluster, which has no spare database.")
+		}
+		config.DB = TESTING_REDIS_DB
 	}
-	if dev {
-		return DevDB()
+	client, err := config.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	db := &DBClient{
+		redis:       client,
+		redisConfig: config,
+		devMode:     dev || testing,
+	}
+	if testing {
+		db.Flush()
+	}
+	if err = db.markNewSchemaRedis(); err != nil {
+		return nil, err
+	}
+	if dev || testing {
+		AddDummy(db)
 	}
-	return DefaultDB()
+	db.registerPoolMetrics()
+	return db, nil
 }
 
-func DefaultDB() *DBClient {
-	return &DBClient{
-		redis:   DefaultRedisDB(),
-		devMode: false,
+var (
+	dbOperationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "beacon_db_operation_seconds",
+		Help:    "Time taken by database operations.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"op", "backend"})
+	dbErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "beacon_db_errors_total",
+		Help: "Database operations that returned an error, including not found.",
+	}, []string{"op", "backend"})
+	redisPool = &poolCollector{
+		conns: prometheus.NewDesc("beacon_redis_pool_connections",
+			"Open connections to Redis.", nil, nil),
+		free: prometheus.NewDesc("beacon_redis_pool_free_connections",
+			"Idle connections to Redis.", nil, nil),
+		timeouts: prometheus.NewDesc("beacon_redis_pool_timeouts_total",
+			"Times no Redis connection was free in time.", nil, nil),
 	}
+)
+
+func init() {
+	prometheus.MustRegister(dbOperationSeconds, dbErrors, redisPool)
 }
 
-func DevDB() *DBClient {
-	db := &DBClient{
-		redis:   DevRedisDB(),
-		devMode: true,
+// Returns a client sharing db's connections whose operations are
+// traced under the span in ctx.
+func (db *DBClient) WithContext(ctx context.Context) *DBClient {
+	client := *db
+	client.ctx = ctx
+	return &client
+}
+
+// The instrumentation scope of the spans beacon-db starts.
+const DB_TRACER_NAME = "github.com/opus-ua/beacon-db"
+
+// redis.v3 has no hook for individual commands, so operations are
+// timed and traced as a whole.
+func (db *DBClient) observe(op string, start time.Time, err *error) {
+	backend := "redis"
+	if db.postgres != nil {
+		backend = "postgres"
+	}
+	dbOperationSeconds.WithLabelValues(op, backend).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		dbErrors.WithLabelValues(op, backend).Inc()
+	}
+	if db.ctx != nil && trace.SpanFromContext(db.ctx).IsRecording() {
+		_, span := otel.Tracer(DB_TRACER_NAME).Start(db.ctx, "db."+op,
+			trace.WithSpanKind(trace.SpanKindClient), trace.WithTimestamp(start),
+			trace.WithAttributes(attribute.String("db.system", backend), attribute.String("db.operation", op)))
+		if *err != nil {
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		span.End()
+	}
+}
+
+// Reports the connection pool of the latest DBClient made.
+type poolCollector struct {
+	conns    *prometheus.Desc
+	free     *prometheus.Desc
+	timeouts *prometheus.Desc
+	mutex    sync.Mutex
+	db       *DBClient
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.conns
+	ch <- c.free
+	ch <- c.timeouts
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	db := c.db
+	c.mutex.Unlock()
+	if db == nil {
+		return
 	}
-	AddDummy(db)
+	stats := db.redis.PoolStats()
+	ch <- prometheus.MustNewConstMetric(c.conns, prometheus.GaugeValue, float64(stats.TotalConns))
+	ch <- prometheus.MustNewConstMetric(c.free, prometheus.GaugeValue, float64(stats.FreeConns))
+	ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(stats.Timeouts))
+}
+
+func (db *DBClient) registerPoolMetrics() {
+	redisPool.mutex.Lock()
+	redisPool.db = db
+	redisPool.mutex.Unlock()
+}
+
+func DefaultDB() *DBClient {
+	db, _ := NewDB(DefaultRedisConfig, false, false)
+	return db
+}
+
+func DevDB() *DBClient {
+	db, _ := NewDB(DefaultRedisConfig, true, false)
 	return db
 }
 
 func TestDB() *DBClient {
-	db := &DBClient{
-		redis:   DevRedisDB(),
-		devMode: true,
-	}
-	db.SelectTestingTable()
-	db.Flush()
-	AddDummy(db)
+	db, _ := NewDB(DefaultRedisConfig, true, true)
 	return db
 }
 
-func (db *DBClient) GetThread(id uint64) (Beacon, error) {
-	return db.GetThreadRedis(id)
-	/*
-	   if post, err = GetPostGres(id, gresClient); err == nil {
-	       return post, nil
-	   }
-	*/
+func (db *DBClient) GetThread(id uint64) (_ Beacon, err error) {
+	defer db.observe("GetThread", time.Now(), &err)
+	if db.postgres != nil {
+		return db.getThreadCachedPostgres(id)
+	}
+	return db.GetThreadCachedRedis(id)
 }
 
-func (db *DBClient) AddBeacon(post *Beacon, userID uint64) (uint64, error) {
-	id, err := db.AddBeaconRedis(post, userID)
-	// post.AddPostGres()
+func (db *DBClient) AddBeacon(post *Beacon, userID uint64) (_ uint64, err error) {
+	defer db.observe("AddBeacon", time.Now(), &err)
+	if db.postgres == nil {
+		return db.AddBeaconRedis(post, userID)
+	}
+	id, err := db.AddBeaconPostgres(post, userID)
+	if err == nil {
+		db.writeThroughThread(id)
+	}
 	return id, err
 }
 
-func (db *DBClient) AddComment(comment *Comment, userID uint64) error {
-	db.AddCommentRedis(comment, userID)
-	// comment.AddPostGres()
-	return nil
+func (db *DBClient) AddComment(comment *Comment, userID uint64) (err error) {
+	defer db.observe("AddComment", time.Now(), &err)
+	if db.postgres == nil {
+		return db.AddCommentRedis(comment, userID)
+	}
+	err = db.AddCommentPostgres(comment, userID)
+	if err == nil {
+		db.writeThroughThread(comment.BeaconID)
+	}
+	return err
 }
 
-func (db *DBClient) HeartPost(postID uint64, userID uint64) error {
-	return db.HeartPostRedis(postID, userID)
+func (db *DBClient) HeartPost(postID uint64, userID uint64) (err error) {
+	defer db.observe("HeartPost", time.Now(), &err)
+	if db.postgres == nil {
+		return db.HeartPostRedis(postID, userID)
+	}
+	err = db.HeartPostPostgres(postID, userID)
+	if err == nil {
+		db.writeThroughReaction(postID, userID)
+	}
+	return err
 }
 
-func (db *DBClient) UnheartPost(postID uint64, userID uint64) error {
-	return db.UnheartPostRedis(postID, userID)
+func (db *DBClient) UnheartPost(postID uint64, userID uint64) (err error) {
+	defer db.observe("UnheartPost", time.Now(), &err)
+	if db.postgres == nil {
+		return db.UnheartPostRedis(postID, userID)
+	}
+	err = db.UnheartPostPostgres(postID, userID)
+	if err == nil {
+		db.writeThroughReaction(postID, userID)
+	}
+	return err
 }
 
-func (db *DBClient) FlagPost(postID uint64, userID uint64) error {
-	return db.FlagPostRedis(postID, userID)
+func (db *DBClient) FlagPost(postID uint64, userID uint64) (err error) {
+	defer db.observe("FlagPost", time.Now(), &err)
+	if db.postgres == nil {
+		return db.FlagPostRedis(postID, userID)
+	}
+	err = db.FlagPostPostgres(postID, userID)
+	if err == nil {
+		db.writeThroughReaction(postID, userID)
+	}
+	return err
 }
 
-func (db *DBClient) CreateUser(username string, authkey []byte, email string) (uint64, error) {
-	return db.CreateUserRedis(username, authkey, email)
+func (db *DBClient) CreateUser(username string, authkey []byte, email string) (_ uint64, err error) {
+	defer db.observe("CreateUser", time.Now(), &err)
+	if db.postgres == nil {
+		return db.CreateUserRedis(username, authkey, email)
+	}
+	userID, err := db.CreateUserPostgres(username, authkey, email)
+	if err == nil {
+		db.writeThroughUser(userID)
+	}
+	return userID, err
 }
 
-func (db *DBClient) UserExists(userid uint64) (bool, error) {
-	return db.UserExistsRedis(userid)
+func (db *DBClient) UserExists(userid uint64) (_ bool, err error) {
+	defer db.observe("UserExists", time.Now(), &err)
+	if db.postgres == nil {
+		return db.UserExistsRedis(userid)
+	}
+	if db.redisCache {
+		if exists, err := db.UserExistsRedis(userid); err == nil && exists {
+			return true, nil
+		}
+	}
+	return db.UserExistsPostgres(userid)
 }
 
-func (db *DBClient) UserAuthenticated(userid uint64, authkey []byte) (bool, error) {
+func (db *DBClient) UserAuthenticated(userid uint64, authkey []byte) (_ bool, err error) {
+	defer db.observe("UserAuthenticated", time.Now(), &err)
 	exists, err := db.UserExists(userid)
 	if err != nil {
 		return false, err
@@ -101,33 +272,118 @@ func (db *DBClient) UserAuthenticated(userid uint64, authkey []byte) (bool, erro
 	if db.devMode {
 		return true, nil
 	}
-	return db.UserAuthenticatedRedis(userid, authkey)
+	if db.postgres == nil {
+		return db.UserAuthenticatedRedis(userid, authkey)
+	}
+	if !db.redisCache {
+		return db.UserAuthenticatedPostgres(userid, authkey)
+	}
+	user, err := db.getUserCachedPostgres(userid)
+	if err != nil {
+		return false, err
+	}
+	return string(user.AuthKey) == string(authkey), nil
 }
 
-func (db *DBClient) GetUsername(userid uint64) (string, error) {
-	return db.GetUsernameRedis(userid)
+func (db *DBClient) GetUsername(userid uint64) (_ string, err error) {
+	defer db.observe("GetUsername", time.Now(), &err)
+	if db.postgres == nil {
+		return db.GetUsernameRedis(userid)
+	}
+	if !db.redisCache || userid == DeletedUserID {
+		return db.GetUsernamePostgres(userid)
+	}
+	user, err := db.getUserCachedPostgres(userid)
+	return user.Username, err
+}
+
+func (db *DBClient) GetUsernames(userIDs []uint64) (_ map[uint64]string, err error) {
+	defer db.observe("GetUsernames", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetUsernamesPostgres(userIDs)
+	}
+	return db.GetUsernamesRedis(userIDs)
 }
 
-func (db *DBClient) UsernameExists(username string) (bool, error) {
+func (db *DBClient) UsernameExists(username string) (_ bool, err error) {
+	defer db.observe("UsernameExists", time.Now(), &err)
+	if db.postgres != nil {
+		return db.UsernameExistsPostgres(username)
+	}
 	return db.UsernameExistsRedis(username)
 }
 
-func (db *DBClient) EmailExists(email string) (bool, error) {
+func (db *DBClient) EmailExists(email string) (_ bool, err error) {
+	defer db.observe("EmailExists", time.Now(), &err)
+	if db.postgres != nil {
+		return db.EmailExistsPostgres(email)
+	}
 	return db.EmailExistsRedis(email)
 }
 
-func (db *DBClient) GetUserIDByEmail(email string) (uint64, error) {
+func (db *DBClient) GetUserIDByEmail(email string) (_ uint64, err error) {
+	defer db.observe("GetUserIDByEmail", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetUserIDByEmailPostgres(email)
+	}
 	return db.GetUserIDByEmailRedis(email)
 }
 
-func (db *DBClient) SetUserAuthKey(userid uint64, authkey []byte) error {
-	return db.SetUserAuthKeyRedis(userid, authkey)
+func (db *DBClient) SetUserAuthKey(userid uint64, authkey []byte) (err error) {
+	defer db.observe("SetUserAuthKey", time.Now(), &err)
+	if db.postgres == nil {
+		return db.SetUserAuthKeyRedis(userid, authkey)
+	}
+	err = db.SetUserAuthKeyPostgres(userid, authkey)
+	if err == nil {
+		db.writeThroughUser(userid)
+	}
+	return err
 }
 
-func (db *DBClient) HasHearted(postid uint64, userid uint64) (bool, error) {
+func (db *DBClient) HasHearted(postid uint64, userid uint64) (_ bool, err error) {
+	defer db.observe("HasHearted", time.Now(), &err)
+	if db.postgres != nil {
+		return db.HasHeartedPostgres(postid, userid)
+	}
 	return db.HasHeartedRedis(postid, userid)
 }
 
+func (db *DBClient) HasHeartedPosts(postIDs []uint64, userid uint64) (_ map[uint64]bool, err error) {
+	defer db.observe("HasHeartedPosts", time.Now(), &err)
+	if db.postgres != nil {
+		return db.HasHeartedPostsPostgres(postIDs, userid)
+	}
+	return db.HasHeartedPostsRedis(postIDs, userid)
+}
+
+func (db *DBClient) PingRedis() error {
+	return db.redis.Ping().Err()
+}
+
+func (db *DBClient) UsesPostgres() bool {
+	return db.postgres != nil
+}
+
+// Does nothing unless UsePostgres was called.
+func (db *DBClient) PingPostgres(ctx context.Context) error {
+	if db.postgres == nil {
+		return nil
+	}
+	return db.postgres.PingContext(ctx)
+}
+
+// Active users are always tracked in Redis.
+func (db *DBClient) MarkActive(userID uint64) (err error) {
+	defer db.observe("MarkActive", time.Now(), &err)
+	return db.MarkActiveRedis(userID, time.Now())
+}
+
+func (db *DBClient) CountActiveUsers() (_ uint64, err error) {
+	defer db.observe("CountActiveUsers", time.Now(), &err)
+	return db.CountActiveUsersRedis(time.Now())
+}
+
 func (db *DBClient) Flush() error {
 	return db.FlushRedis()
 }
@@ -136,10 +392,332 @@ func (db *DBClient) SelectTestingTable() error {
 	return db.SelectTestingTableRedis()
 }
 
-func (db *DBClient) GetLocal(loc Geotag, radius float64) ([]Beacon, error) {
+// Closes the connections to Redis and, if in use, Postgres.
+func (db *DBClient) Close() error {
+	err := db.redis.Close()
+	if db.postgres != nil {
+		if pgErr := db.postgres.Close(); err == nil {
+			err = pgErr
+		}
+	}
+	return err
+}
+
+func (db *DBClient) GetLocal(loc Geotag, radius float64) (_ []Beacon, err error) {
+	defer db.observe("GetLocal", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetLocalPostgres(loc, radius)
+	}
 	return db.GetLocalRedis(loc, radius)
 }
 
-func (db *DBClient) GetCommentCount(postID uint64) (uint64, error) {
+func (db *DBClient) GetCommentCount(postID uint64) (_ uint64, err error) {
+	defer db.observe("GetCommentCount", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetCommentCountPostgres(postID)
+	}
 	return db.GetCommentCountRedis(postID)
 }
+
+func (db *DBClient) TakeToken(bucket string, capacity int, interval time.Duration) (_ bool, _ time.Duration, err error) {
+	defer db.observe("TakeToken", time.Now(), &err)
+	return db.TakeTokenRedis(bucket, capacity, interval)
+}
+
+func (db *DBClient) IsAdmin(userID uint64) (_ bool, err error) {
+	defer db.observe("IsAdmin", time.Now(), &err)
+	if db.postgres != nil {
+		return db.IsAdminPostgres(userID)
+	}
+	return db.IsAdminRedis(userID)
+}
+
+func (db *DBClient) SetAdmin(userID uint64, admin bool) (err error) {
+	defer db.observe("SetAdmin", time.Now(), &err)
+	if db.postgres != nil {
+		return db.SetAdminPostgres(userID, admin)
+	}
+	return db.SetAdminRedis(userID, admin)
+}
+
+func (db *DBClient) GetPending() (_ []uint64, err error) {
+	defer db.observe("GetPending", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetPendingPostgres()
+	}
+	return db.GetPendingRedis()
+}
+
+func (db *DBClient) ApproveBeacon(id uint64) (err error) {
+	defer db.observe("ApproveBeacon", time.Now(), &err)
+	if db.postgres == nil {
+		return db.ApproveBeaconRedis(id)
+	}
+	err = db.ApproveBeaconPostgres(id)
+	if err == nil {
+		db.writeThroughPost(id)
+	}
+	return err
+}
+
+func (db *DBClient) RejectBeacon(id uint64) (err error) {
+	defer db.observe("RejectBeacon", time.Now(), &err)
+	if db.postgres == nil {
+		return db.RejectBeaconRedis(id)
+	}
+	threadID, err := db.getThreadIDPostgres(id)
+	if err != nil {
+		return err
+	}
+	err = db.RejectBeaconPostgres(id)
+	if err == nil {
+		db.writeThroughThread(threadID)
+	}
+	return err
+}
+
+func (db *DBClient) AddZone(zone *Zone) (_ uint64, err error) {
+	defer db.observe("AddZone", time.Now(), &err)
+	if db.postgres != nil {
+		return db.AddZonePostgres(zone)
+	}
+	return db.AddZoneRedis(zone)
+}
+
+func (db *DBClient) SetZone(zone *Zone) (err error) {
+	defer db.observe("SetZone", time.Now(), &err)
+	if db.postgres != nil {
+		return db.SetZonePostgres(zone)
+	}
+	return db.SetZoneRedis(zone)
+}
+
+func (db *DBClient) ZoneExists(id uint64) (_ bool, err error) {
+	defer db.observe("ZoneExists", time.Now(), &err)
+	if db.postgres != nil {
+		return db.ZoneExistsPostgres(id)
+	}
+	return db.ZoneExistsRedis(id)
+}
+
+func (db *DBClient) GetZones() (_ []Zone, err error) {
+	defer db.observe("GetZones", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetZonesPostgres()
+	}
+	return db.GetZonesRedis()
+}
+
+func (db *DBClient) DeleteZone(id uint64) (err error) {
+	defer db.observe("DeleteZone", time.Now(), &err)
+	if db.postgres != nil {
+		return db.DeleteZonePostgres(id)
+	}
+	return db.DeleteZoneRedis(id)
+}
+
+func (db *DBClient) SetLastFix(userID uint64, fix Geotag, t time.Time) (err error) {
+	defer db.observe("SetLastFix", time.Now(), &err)
+	return db.SetLastFixRedis(userID, fix, t)
+}
+
+func (db *DBClient) GetLastFix(userID uint64) (_ Geotag, _ time.Time, _ bool, err error) {
+	defer db.observe("GetLastFix", time.Now(), &err)
+	return db.GetLastFixRedis(userID)
+}
+
+func (db *DBClient) GetUser(userID uint64) (_ User, err error) {
+	defer db.observe("GetUser", time.Now(), &err)
+	if db.postgres != nil {
+		return db.getUserCachedPostgres(userID)
+	}
+	return db.GetUserRedis(userID)
+}
+
+func (db *DBClient) GetUserPostCount(userID uint64) (_ uint64, err error) {
+	defer db.observe("GetUserPostCount", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetUserPostCountPostgres(userID)
+	}
+	return db.GetUserPostCountRedis(userID)
+}
+
+// Beacons held for review are left out of the profile unless
+// withPending is set.
+func (db *DBClient) GetUserProfile(userID uint64, offset uint64, count uint64, withPending bool) (_ UserProfile, err error) {
+	defer db.observe("GetUserProfile", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetUserProfilePostgres(userID, offset, count, withPending)
+	}
+	return db.GetUserProfileRedis(userID, offset, count, withPending)
+}
+
+func (db *DBClient) ChangeUsername(userID uint64, username string, cooldown time.Duration) (_ time.Duration, err error) {
+	defer db.observe("ChangeUsername", time.Now(), &err)
+	if db.postgres == nil {
+		return db.ChangeUsernameRedis(userID, username, cooldown)
+	}
+	wait, err := db.ChangeUsernamePostgres(userID, username, cooldown)
+	if err == nil {
+		db.writeThroughUser(userID)
+	}
+	return wait, err
+}
+
+func (db *DBClient) DeleteUser(userID uint64, policy DeletePolicy) (err error) {
+	defer db.observe("DeleteUser", time.Now(), &err)
+	if db.postgres == nil {
+		return db.DeleteUserRedis(userID, policy)
+	}
+	threads, err := db.getUserThreadIDsPostgres(userID)
+	if err != nil {
+		return err
+	}
+	if err = db.DeleteUserPostgres(userID, policy); err != nil {
+		return err
+	}
+	for _, id := range threads {
+		db.writeThroughThread(id)
+	}
+	db.writeThroughUser(userID)
+	return nil
+}
+
+func (db *DBClient) GetUserRecord(userID uint64) (_ map[string]string, err error) {
+	defer db.observe("GetUserRecord", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetUserRecordPostgres(userID)
+	}
+	return db.GetUserRecordRedis(userID)
+}
+
+func (db *DBClient) GetUserBeaconIDs(userID uint64) (_ []uint64, err error) {
+	defer db.observe("GetUserBeaconIDs", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetUserBeaconIDsPostgres(userID)
+	}
+	return db.GetUserPostIDsRedis(GetRedisUserPostsKey(userID))
+}
+
+func (db *DBClient) GetUserCommentIDs(userID uint64) (_ []uint64, err error) {
+	defer db.observe("GetUserCommentIDs", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetUserCommentIDsPostgres(userID)
+	}
+	return db.GetUserPostIDsRedis(GetRedisUserCommentsKey(userID))
+}
+
+func (db *DBClient) GetUserHearted(userID uint64) (_ []uint64, err error) {
+	defer db.observe("GetUserHearted", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetUserHeartedPostgres(userID)
+	}
+	return db.GetUserPostSetRedis(GetRedisUserHeartListKey(userID))
+}
+
+func (db *DBClient) GetUserFlagged(userID uint64) (_ []uint64, err error) {
+	defer db.observe("GetUserFlagged", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetUserFlaggedPostgres(userID)
+	}
+	return db.GetUserPostSetRedis(GetRedisUserFlagListKey(userID))
+}
+
+func (db *DBClient) GetBeacon(id uint64) (_ Beacon, err error) {
+	defer db.observe("GetBeacon", time.Now(), &err)
+	if db.postgres == nil {
+		return db.GetBeaconRedis(id)
+	}
+	if db.redisCache {
+		if post, err := db.GetBeaconRedis(id); err == nil {
+			return post, nil
+		}
+	}
+	return db.GetBeaconPostgres(id)
+}
+
+func (db *DBClient) GetCommentByID(id uint64) (_ Comment, err error) {
+	defer db.observe("GetCommentByID", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetCommentByIDPostgres(id)
+	}
+	return db.GetCommentByIDRedis(id)
+}
+
+func (db *DBClient) AddExport(token string, userID uint64) (err error) {
+	defer db.observe("AddExport", time.Now(), &err)
+	return db.AddExportRedis(token, userID)
+}
+
+func (db *DBClient) FinishExport(token string, status ExportStatus, data []byte) (err error) {
+	defer db.observe("FinishExport", time.Now(), &err)
+	return db.FinishExportRedis(token, status, data)
+}
+
+func (db *DBClient) TakeExport(token string, userID uint64) (_ ExportStatus, _ []byte, _ bool, err error) {
+	defer db.observe("TakeExport", time.Now(), &err)
+	return db.TakeExportRedis(token, userID)
+}
+
+func (db *DBClient) GetPostType(id uint64) (_ string, err error) {
+	defer db.observe("GetPostType", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetPostTypePostgres(id)
+	}
+	return db.GetPostTypeRedis(id)
+}
+
+func (db *DBClient) GetHeartCount(id uint64) (_ uint32, err error) {
+	defer db.observe("GetHeartCount", time.Now(), &err)
+	if db.postgres != nil {
+		return db.GetHeartCountPostgres(id)
+	}
+	return db.GetHeartCountRedis(id)
+}
+
+// Returned by fsck, migrate and merging restores, which only know the
+// Redis keyspace.
+var ErrRedisOnly = errors.New("Only supported when users and posts are kept in Redis, not Postgres.")
+
+func (db *DBClient) Fsck(repair bool, report func(FsckIssue)) (FsckResult, error) {
+	if db.postgres != nil {
+		return FsckResult{}, ErrRedisOnly
+	}
+	return db.FsckRedis(repair, report)
+}
+
+func (db *DBClient) GetSchemaVersion() (uint64, error) {
+	if db.postgres != nil {
+		return 0, ErrRedisOnly
+	}
+	return db.GetSchemaVersionRedis()
+}
+
+// Only users and posts kept in Redis have a schema to check.
+func (db *DBClient) CheckSchema() error {
+	if db.postgres != nil {
+		return nil
+	}
+	return db.CheckSchemaRedis()
+}
+
+func (db *DBClient) Migrate(dryRun bool, progress func(MigrateProgress)) (uint64, error) {
+	if db.postgres != nil {
+		return 0, ErrRedisOnly
+	}
+	return db.MigrateRedis(dryRun, progress)
+}
+
+func (db *DBClient) Backup(w io.Writer, progress func(BackupStats)) (BackupStats, error) {
+	if db.postgres != nil {
+		return db.BackupPostgres(w, progress)
+	}
+	return db.BackupRedis(w, progress)
+}
+
+func (db *DBClient) Restore(r io.Reader, merge bool, progress func(BackupStats)) (BackupStats, error) {
+	if db.postgres != nil {
+		return db.RestorePostgres(r, merge, progress)
+	}
+	return db.RestoreRedis(r, merge, progress)
+}
@@ -845,6 +845,7 @@ func AddDummy(db *DBClient) {
 		db.CreateUser("dev1", []byte(""), "1@gmail.com")
 		db.CreateUser("dev2", []byte(""), "2@gmail.com")
 		db.CreateUser("dev3", []byte(""), "3@gmail.com")
+		db.SetAdmin(1, true)
 		imgData := strings.Replace(dennyImgData, "\n", "", -1)
 		imgBytes, err := hex.DecodeString(imgData)
 		if err != nil {
@@ -0,0 +1,679 @@
+package beacondb
+
+import (
+	"fmt"
+	. "github.com/opus-ua/beacon-post"
+	"gopkg.in/redis.v3"
+	"sort"
+	"strconv"
+)
+
+const FSCK_SCAN_COUNT = 500
+
+// Kinds of inconsistency found by Fsck.
+const (
+	FsckStrayPost       = "stray-post"
+	FsckOrphanedComment = "orphaned-comment"
+	FsckOrphanedThread  = "orphaned-thread"
+	FsckMissingComment  = "missing-comment"
+	FsckHeartCount      = "heart-count"
+	FsckFlagCount       = "flag-count"
+	FsckOrphanedSet     = "orphaned-set"
+	FsckGeoOrphan       = "geo-orphan"
+	FsckGeoMissing      = "geo-missing"
+	FsckPendingOrphan   = "pending-orphan"
+	FsckEmailOrphan     = "email-orphan"
+	FsckIndexOrphan     = "index-orphan"
+	FsckUnindexedPost   = "unindexed-post"
+	FsckUnqueuedPost    = "unqueued-post"
+	FsckUnthreaded      = "unthreaded-comment"
+	FsckUserCount       = "user-count"
+)
+
+type FsckIssue struct {
+	Kind     string
+	Key      string
+	Detail   string
+	Repaired bool
+}
+
+// Counts of issues found and repaired, by kind.
+type FsckResult struct {
+	Found    map[string]int
+	Repaired map[string]int
+}
+
+func (res FsckResult) Total() int {
+	total := 0
+	for _, count := range res.Found {
+		total += count
+	}
+	return total
+}
+
+func (res FsckResult) Kinds() []string {
+	kinds := []string{}
+	for kind := range res.Found {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+type fsck struct {
+	db     *DBClient
+	repair bool
+	report func(FsckIssue)
+	result FsckResult
+	// What the indexes name, gathered by the earlier checks so the
+	// last one can find posts missing from them.
+	indexed  map[uint64]bool
+	queued   map[uint64]bool
+	threaded map[uint64]bool
+	// The last post ID taken when the scan started. Posts after it
+	// may be filed after the indexes were read.
+	lastPostID uint64
+}
+
+// Scans the keyspace for inconsistencies, passing each to report as
+// it is found. With repair set, each one is also fixed. Repairs check
+// the inconsistency again as they make it, in the same script where
+// it lies within one hash slot and just before otherwise, so a post
+// written while the scan runs is not mistaken for damage. Post IDs are
+// never reused, which makes it safe to drop references to missing
+// posts.
+func (db *DBClient) FsckRedis(repair bool, report func(FsckIssue)) (FsckResult, error) {
+	f := &fsck{
+		db:       db,
+		repair:   repair,
+		report:   report,
+		result:   FsckResult{Found: map[string]int{}, Repaired: map[string]int{}},
+		indexed:  map[uint64]bool{},
+		queued:   map[uint64]bool{},
+		threaded: map[uint64]bool{},
+	}
+	lastPostID, err := db.getCountRedis(POST_COUNT_KEY)
+	if err != nil {
+		return f.result, err
+	}
+	f.lastPostID = lastPostID
+	checks := []func() error{
+		f.checkPosts,
+		f.checkSets,
+		f.checkGeo,
+		f.checkPending,
+		f.checkEmails,
+		f.checkUserIndexes,
+		f.checkUsers,
+		f.checkFiling,
+	}
+	for _, check := range checks {
+		if err := check(); err != nil {
+			return f.result, err
+		}
+	}
+	return f.result, nil
+}
+
+func (f *fsck) found(kind string, key string, detail string, fix func() (bool, error)) error {
+	issue := FsckIssue{Kind: kind, Key: key, Detail: detail}
+	f.result.Found[kind]++
+	if f.repair {
+		fixed, err := fix()
+		if err != nil {
+			return err
+		}
+		if fixed {
+			issue.Repaired = true
+			f.result.Repaired[kind]++
+		}
+	}
+	if f.report != nil {
+		f.report(issue)
+	}
+	return nil
+}
+
+// Calls fn with every key matching pattern.
+func (f *fsck) scan(pattern string, fn func(key string) error) error {
+	return f.db.scanRedis(pattern, FSCK_SCAN_COUNT, func(keys []string) error {
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (f *fsck) postExists(id uint64) (bool, error) {
+	return f.db.redis.Exists(GetRedisPostKey(id)).Result()
+}
+
+func (f *fsck) evalFixed(script string, keys []string, args []string) (bool, error) {
+	res, err := f.db.redis.Eval(script, keys, args).Result()
+	if err != nil {
+		return false, err
+	}
+	fixed, _ := res.(int64)
+	return fixed == 1, nil
+}
+
+// Deletes a post hash, but only if it still has no type.
+const dropStrayPostScript = `
+if redis.call("EXISTS", KEYS[1]) == 1 and redis.call("HEXISTS", KEYS[1], "type") == 0 then
+	redis.call("DEL", KEYS[1])
+	return 1
+end
+return 0
+`
+
+// Sets the counter ARGV[1] of a post or user to the size of the set
+// KEYS[2].
+const fixCountScript = `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], redis.call("SCARD", KEYS[2]))
+return 1
+`
+
+func (f *fsck) checkPosts() error {
+	return f.scan("{p:*", func(key string) error {
+		parts := splitRedisKey(key)
+		id, err := strconv.ParseUint(parts[1], REDIS_INT_BASE, 64)
+		if err != nil {
+			return nil
+		}
+		if len(parts) == 3 && parts[2] == "c" {
+			return f.checkThread(id)
+		}
+		if len(parts) != 2 {
+			return nil
+		}
+		return f.checkPost(id)
+	})
+}
+
+func (f *fsck) checkPost(id uint64) error {
+	key := GetRedisPostKey(id)
+	res, err := f.db.redis.HMGet(key, "type", "parent", "hearts", "flags").Result()
+	if err != nil {
+		return err
+	}
+	postType, _ := res[0].(string)
+	if postType == "" {
+		return f.found(FsckStrayPost, key, "Post has no type.", func() (bool, error) {
+			return f.evalFixed(dropStrayPostScript, []string{key}, []string{})
+		})
+	}
+	if postType == "comment" {
+		parentStr, _ := res[1].(string)
+		parent, err := RedisParseUInt64(parentStr, nil)
+		if err != nil {
+			return err
+		}
+		parentType, err := f.db.GetPostTypeRedis(parent)
+		if err != nil && err != ErrPostNotFound {
+			return err
+		}
+		if parentType != "beacon" {
+			detail := fmt.Sprintf("Comment belongs to missing beacon %d.", parent)
+			return f.found(FsckOrphanedComment, key, detail, func() (bool, error) {
+				return true, f.db.DeleteCommentRedis(id)
+			})
+		}
+	}
+	counters := []struct {
+		kind  string
+		field string
+		set   string
+		value interface{}
+	}{
+		{FsckHeartCount, "hearts", GetRedisUserHeartedKey(id), res[2]},
+		{FsckFlagCount, "flags", GetRedisUserFlaggedKey(id), res[3]},
+	}
+	for _, counter := range counters {
+		members, err := f.db.redis.SCard(counter.set).Result()
+		if err != nil {
+			return err
+		}
+		valueStr, _ := counter.value.(string)
+		if valueStr == strconv.FormatInt(members, REDIS_INT_BASE) {
+			continue
+		}
+		detail := fmt.Sprintf("Post has %s '%s' but %d members in %s.", counter.field, valueStr, members, counter.set)
+		set, field := counter.set, counter.field
+		err = f.found(counter.kind, key, detail, func() (bool, error) {
+			fixed, err := f.evalFixed(fixCountScript, []string{key, set}, []string{field})
+			if fixed {
+				f.db.InvalidateThreadRedis(id)
+			}
+			return fixed, err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fsck) checkThread(id uint64) error {
+	listKey := GetRedisCommentListKey(id)
+	exists, err := f.postExists(id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return f.found(FsckOrphanedThread, listKey, "Comment list belongs to missing beacon.", func() (bool, error) {
+			return true, f.db.DeleteBeaconRedis(id)
+		})
+	}
+	comments, err := f.db.GetCommentListRedis(id)
+	if err != nil {
+		return err
+	}
+	for _, commentID := range comments {
+		f.threaded[commentID] = true
+		exists, err := f.postExists(commentID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		detail := fmt.Sprintf("Comment list refers to missing comment %d.", commentID)
+		member := strconv.FormatUint(commentID, REDIS_INT_BASE)
+		err = f.found(FsckMissingComment, listKey, detail, func() (bool, error) {
+			return true, f.db.redis.LRem(listKey, 0, member).Err()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes a heart or flag set if its post is still missing.
+const dropSetScript = `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+redis.call("DEL", KEYS[2])
+return 1
+`
+
+func (f *fsck) checkSets() error {
+	for _, pattern := range []string{"{p:*}:h", "{p:*}:f"} {
+		err := f.scan(pattern, func(key string) error {
+			parts := splitRedisKey(key)
+			if len(parts) != 3 {
+				return nil
+			}
+			id, err := strconv.ParseUint(parts[1], REDIS_INT_BASE, 64)
+			if err != nil {
+				return nil
+			}
+			postKey := GetRedisPostKey(id)
+			exists, err := f.db.redis.Exists(postKey).Result()
+			if err != nil || exists {
+				return err
+			}
+			return f.found(FsckOrphanedSet, key, "Set belongs to missing post.", func() (bool, error) {
+				return f.evalFixed(dropSetScript, []string{postKey, key}, []string{})
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether a post is a beacon that isn't held, and so belongs in the
+// geo index.
+func (f *fsck) visibleBeacon(key string) (bool, error) {
+	res, err := f.db.redis.HMGet(key, "type", "pending").Result()
+	if err != nil {
+		return false, err
+	}
+	postType, _ := res[0].(string)
+	return postType == "beacon" && res[1] == nil, nil
+}
+
+func (f *fsck) checkGeo() error {
+	indexed := map[string]bool{}
+	cursor := int64(0)
+	for {
+		next, pairs, err := f.db.redis.ZScan(GEOTAG_KEY, cursor, "", FSCK_SCAN_COUNT).Result()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(pairs); i += 2 {
+			member := pairs[i]
+			indexed[member] = true
+			id, err := strconv.ParseUint(member, REDIS_INT_BASE, 64)
+			if err != nil {
+				continue
+			}
+			key := GetRedisPostKey(id)
+			visible, err := f.visibleBeacon(key)
+			if err != nil {
+				return err
+			}
+			if visible {
+				continue
+			}
+			detail := fmt.Sprintf("Geo index refers to %d, which is not a visible beacon.", id)
+			err = f.found(FsckGeoOrphan, GEOTAG_KEY, detail, func() (bool, error) {
+				// The post and the index lie in different slots.
+				visible, err := f.visibleBeacon(key)
+				if err != nil || visible {
+					return false, err
+				}
+				return true, f.db.redis.ZRem(GEOTAG_KEY, member).Err()
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	return f.scan("{p:*", func(key string) error {
+		parts := splitRedisKey(key)
+		if len(parts) != 2 || indexed[parts[1]] {
+			return nil
+		}
+		id, err := strconv.ParseUint(parts[1], REDIS_INT_BASE, 64)
+		if err != nil {
+			return nil
+		}
+		visible, err := f.visibleBeacon(key)
+		if err != nil || !visible {
+			return err
+		}
+		return f.found(FsckGeoMissing, key, "Beacon is missing from the geo index.", func() (bool, error) {
+			visible, err := f.visibleBeacon(key)
+			if err != nil || !visible {
+				return false, err
+			}
+			post, err := f.db.GetBeaconRedis(id)
+			if err != nil {
+				return false, err
+			}
+			return true, f.db.IndexBeaconRedis(id, post.Location)
+		})
+	})
+}
+
+func (f *fsck) checkPending() error {
+	pending, err := f.db.GetPendingRedis()
+	if err != nil {
+		return err
+	}
+	for _, id := range pending {
+		f.queued[id] = true
+		exists, err := f.postExists(id)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		member := strconv.FormatUint(id, REDIS_INT_BASE)
+		detail := fmt.Sprintf("Review queue refers to missing post %d.", id)
+		err = f.found(FsckPendingOrphan, PENDING_POOL_KEY, detail, func() (bool, error) {
+			return true, f.db.redis.SRem(PENDING_POOL_KEY, member).Err()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes the email mapping KEYS[1] if it still points to user
+// ARGV[1].
+const dropEmailScript = `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[1])
+return 1
+`
+
+func (f *fsck) checkEmails() error {
+	return f.scan("email:*", func(key string) error {
+		idStr, err := f.db.redis.Get(key).Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		id, err := RedisParseUInt64(idStr, nil)
+		if err != nil {
+			return err
+		}
+		userKey := GetRedisUserKey(id)
+		exists, err := f.db.redis.Exists(userKey).Result()
+		if err != nil || exists {
+			return err
+		}
+		detail := fmt.Sprintf("Email is mapped to missing user %d.", id)
+		return f.found(FsckEmailOrphan, key, detail, func() (bool, error) {
+			// The mapping and the user lie in different slots.
+			exists, err := f.db.redis.Exists(userKey).Result()
+			if err != nil || exists {
+				return false, err
+			}
+			return f.evalFixed(dropEmailScript, []string{key}, []string{idStr})
+		})
+	})
+}
+
+func (f *fsck) checkUserIndexes() error {
+	return f.scan("{u:*", func(key string) error {
+		parts := splitRedisKey(key)
+		if len(parts) != 3 || (parts[2] != "p" && parts[2] != "c") {
+			return nil
+		}
+		ids, err := f.db.GetUserPostIDsRedis(key)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			f.indexed[id] = true
+			exists, err := f.postExists(id)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			detail := fmt.Sprintf("User index refers to missing post %d.", id)
+			member := strconv.FormatUint(id, REDIS_INT_BASE)
+			err = f.found(FsckIndexOrphan, key, detail, func() (bool, error) {
+				return true, f.db.redis.LRem(key, 0, member).Err()
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Checks that each user's counts of hearts and flags given match their
+// lists of what they hearted and flagged.
+func (f *fsck) checkUsers() error {
+	return f.scan("{u:*", func(key string) error {
+		parts := splitRedisKey(key)
+		if len(parts) != 2 {
+			return nil
+		}
+		id, err := strconv.ParseUint(parts[1], REDIS_INT_BASE, 64)
+		if err != nil {
+			return nil
+		}
+		res, err := f.db.redis.HMGet(key, "hearts-sub", "flags-sub").Result()
+		if err != nil {
+			return err
+		}
+		counters := []struct {
+			field string
+			list  string
+			value interface{}
+		}{
+			{"hearts-sub", GetRedisUserHeartListKey(id), res[0]},
+			{"flags-sub", GetRedisUserFlagListKey(id), res[1]},
+		}
+		for _, counter := range counters {
+			members, err := f.db.redis.SCard(counter.list).Result()
+			if err != nil {
+				return err
+			}
+			valueStr, _ := counter.value.(string)
+			if valueStr == strconv.FormatInt(members, REDIS_INT_BASE) {
+				continue
+			}
+			detail := fmt.Sprintf("User has %s '%s' but %d members in %s.", counter.field, valueStr, members, counter.list)
+			list, field := counter.list, counter.field
+			err = f.found(FsckUserCount, key, detail, func() (bool, error) {
+				return f.evalFixed(fixCountScript, []string{key, list}, []string{field})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Inserts ARGV[1] into the comment list KEYS[1], keeping it in order
+// of ID, unless it is already there.
+const threadCommentScript = `
+local id = tonumber(ARGV[1])
+for _, member in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
+	local memberID = tonumber(member)
+	if memberID == id then
+		return 0
+	end
+	if memberID and memberID > id then
+		redis.call("LINSERT", KEYS[1], "BEFORE", member, ARGV[1])
+		return 1
+	end
+end
+redis.call("RPUSH", KEYS[1], ARGV[1])
+return 1
+`
+
+// In a cluster, posts are written before they are filed in their
+// poster's index, the review queue and their thread, each in another
+// hash slot, so a write cut short leaves a post missing from some of
+// them. Posts created since the scan started are left alone, since
+// they may be filed after the indexes were read.
+func (f *fsck) checkFiling() error {
+	return f.scan("{p:*", func(key string) error {
+		parts := splitRedisKey(key)
+		if len(parts) != 2 {
+			return nil
+		}
+		id, err := strconv.ParseUint(parts[1], REDIS_INT_BASE, 64)
+		if err != nil || id > f.lastPostID {
+			return nil
+		}
+		filing, err := f.readFiling(key)
+		if err != nil || filing.postType == "" {
+			return err
+		}
+		idStr := parts[1]
+		if !f.indexed[id] && filing.poster != DeletedUserID {
+			exists, err := f.db.UserExistsRedis(filing.poster)
+			if err != nil {
+				return err
+			}
+			if exists {
+				indexKey := GetRedisUserCommentsKey(filing.poster)
+				if filing.postType == "beacon" {
+					indexKey = GetRedisUserPostsKey(filing.poster)
+				}
+				detail := fmt.Sprintf("Post is missing from the index of user %d.", filing.poster)
+				err = f.found(FsckUnindexedPost, key, detail, func() (bool, error) {
+					res, err := f.db.redis.Eval(mergeIndexScript, []string{indexKey}, []string{idStr}).Result()
+					added, _ := res.(int64)
+					return added > 0, err
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if filing.pending && !f.queued[id] {
+			err = f.found(FsckUnqueuedPost, key, "Held post is missing from the review queue.", func() (bool, error) {
+				// The post and the queue lie in different slots.
+				filing, err := f.readFiling(key)
+				if err != nil || !filing.pending {
+					return false, err
+				}
+				return true, f.db.redis.SAdd(PENDING_POOL_KEY, idStr).Err()
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if filing.postType != "comment" || filing.pending || f.threaded[id] {
+			return nil
+		}
+		parentType, err := f.db.GetPostTypeRedis(filing.parent)
+		if err != nil && err != ErrPostNotFound {
+			return err
+		}
+		if parentType != "beacon" {
+			// Left to checkPost, which drops the comment.
+			return nil
+		}
+		detail := fmt.Sprintf("Comment is missing from the thread of beacon %d.", filing.parent)
+		return f.found(FsckUnthreaded, key, detail, func() (bool, error) {
+			filing, err := f.readFiling(key)
+			if err != nil || filing.postType != "comment" || filing.pending {
+				return false, err
+			}
+			fixed, err := f.evalFixed(threadCommentScript, []string{GetRedisCommentListKey(filing.parent)}, []string{idStr})
+			if fixed {
+				f.db.InvalidateThreadRedis(filing.parent)
+			}
+			return fixed, err
+		})
+	})
+}
+
+type postFiling struct {
+	postType string
+	poster   uint64
+	parent   uint64
+	pending  bool
+}
+
+func (f *fsck) readFiling(key string) (postFiling, error) {
+	res, err := f.db.redis.HMGet(key, "type", "poster", "parent", "pending").Result()
+	if err != nil {
+		return postFiling{}, err
+	}
+	filing := postFiling{pending: res[3] != nil}
+	filing.postType, _ = res[0].(string)
+	if posterStr, ok := res[1].(string); ok {
+		if filing.poster, err = RedisParseUInt64(posterStr, nil); err != nil {
+			return postFiling{}, err
+		}
+	}
+	if parentStr, ok := res[2].(string); ok {
+		if filing.parent, err = RedisParseUInt64(parentStr, nil); err != nil {
+			return postFiling{}, err
+		}
+	}
+	return filing, nil
+}
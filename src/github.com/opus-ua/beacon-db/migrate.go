@@ -0,0 +1,532 @@
+package beacondb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	. "github.com/opus-ua/beacon-post"
+	"gopkg.in/redis.v3"
+	"image"
+	_ "image/jpeg"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SCHEMA_VERSION_KEY = "schema-version"
+	MIGRATE_SCAN_COUNT = 500
+)
+
+// A migration brings the schema from Version-1 to Version. It must be
+// idempotent, so that a run interrupted partway can simply be run
+// again, and must make no changes while run.DryRun is set.
+type Migration struct {
+	Version uint64
+	Name    string
+	Run     func(run *MigrationRun) error
+}
+
+// Migrations in the order they are applied. Versions must count up
+// from 1 without gaps.
+var Migrations = []Migration{
+	{1, "0.15 to 0.16: unix timestamps and 200x300 thumbnails", migrateTimesAndThumbnails},
+	{2, "Reserve usernames in lowercase", migrateUsernamePool},
+	{3, "Index posts, hearts and flags by user", migrateUserIndexes},
+	{4, "Tag post and user keys with their hash slot", migrateHashTags},
+}
+
+type MigrateProgress struct {
+	Migration *Migration
+	Scanned   int
+	Changed   int
+	Done      bool
+}
+
+// State of a migration while it runs.
+type MigrationRun struct {
+	DB        *DBClient
+	DryRun    bool
+	progress  func(MigrateProgress)
+	migration *Migration
+	scanned   int
+	changed   int
+}
+
+func (run *MigrationRun) report(done bool) {
+	if run.progress == nil {
+		return
+	}
+	run.progress(MigrateProgress{
+		Migration: run.migration,
+		Scanned:   run.scanned,
+		Changed:   run.changed,
+		Done:      done,
+	})
+}
+
+// Counts a change. In a dry run this counts a change that would have
+// been made.
+func (run *MigrationRun) Changed() {
+	run.changed++
+}
+
+// Calls fn with every key matching pattern, in batches of
+// MIGRATE_SCAN_COUNT, reporting progress after each batch.
+func (run *MigrationRun) Scan(pattern string, fn func(key string) error) error {
+	return run.DB.scanRedis(pattern, MIGRATE_SCAN_COUNT, func(keys []string) error {
+		for _, key := range keys {
+			run.scanned++
+			if err := fn(key); err != nil {
+				return fmt.Errorf("%s: %s", key, err.Error())
+			}
+		}
+		run.report(false)
+		return nil
+	})
+}
+
+// Calls fn with the ID of every post.
+func (run *MigrationRun) ScanPosts(fn func(id uint64, key string) error) error {
+	return run.Scan("{p:*", func(key string) error {
+		parts := splitRedisKey(key)
+		if len(parts) != 2 {
+			return nil
+		}
+		id, err := strconv.ParseUint(parts[1], REDIS_INT_BASE, 64)
+		if err != nil {
+			return nil
+		}
+		return fn(id, key)
+	})
+}
+
+// Keys of posts and users were named like p:12 and u:3 until
+// migration 4 tagged them, and migrations before it read them so.
+func (run *MigrationRun) scanLegacyPosts(fn func(id uint64, key string) error) error {
+	return run.Scan("p:*", func(key string) error {
+		parts := strings.Split(key, ":")
+		if len(parts) != 2 {
+			return nil
+		}
+		id, err := strconv.ParseUint(parts[1], REDIS_INT_BASE, 64)
+		if err != nil {
+			return nil
+		}
+		return fn(id, key)
+	})
+}
+
+func legacyUserKey(id uint64) string {
+	return fmt.Sprintf("u:%d", id)
+}
+
+func legacyUserListKey(id uint64, list string) string {
+	return fmt.Sprintf("%s:%s", legacyUserKey(id), list)
+}
+
+func (db *DBClient) GetSchemaVersionRedis() (uint64, error) {
+	version, err := RedisParseUInt64(db.redis.Get(SCHEMA_VERSION_KEY).Result())
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return version, err
+}
+
+func (db *DBClient) SetSchemaVersionRedis(version uint64) error {
+	return db.redis.Set(SCHEMA_VERSION_KEY, strconv.FormatUint(version, REDIS_INT_BASE), 0).Err()
+}
+
+// The version the schema is at once every migration has been applied.
+func LatestSchemaVersion() uint64 {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// Records the latest schema version on a database with no users or
+// posts yet, which has nothing to migrate.
+func (db *DBClient) markNewSchemaRedis() error {
+	for _, key := range []string{USER_COUNT_KEY, POST_COUNT_KEY} {
+		exists, err := db.redis.Exists(key).Result()
+		if err != nil || exists {
+			return err
+		}
+	}
+	return db.redis.SetNX(SCHEMA_VERSION_KEY, strconv.FormatUint(LatestSchemaVersion(), REDIS_INT_BASE), 0).Err()
+}
+
+// Returns an error unless every migration has been applied, since
+// this build can't find data kept under an older schema.
+func (db *DBClient) CheckSchemaRedis() error {
+	version, err := db.GetSchemaVersionRedis()
+	if err != nil {
+		return err
+	}
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("Schema version %d is newer than this build knows about.", version)
+	}
+	if version < LatestSchemaVersion() {
+		return fmt.Errorf("Schema is at version %d, not %d. Run 'beacon migrate' first.",
+			version, LatestSchemaVersion())
+	}
+	return nil
+}
+
+// Applies every migration newer than the recorded schema version, in
+// order, recording the version after each. A dry run reports what
+// would change without changing anything. Returns the version the
+// schema was left at.
+func (db *DBClient) MigrateRedis(dryRun bool, progress func(MigrateProgress)) (uint64, error) {
+	version, err := db.GetSchemaVersionRedis()
+	if err != nil {
+		return 0, err
+	}
+	if version > LatestSchemaVersion() {
+		return version, fmt.Errorf("Schema version %d is newer than this build knows about.", version)
+	}
+	for i := range Migrations {
+		migration := &Migrations[i]
+		if migration.Version <= version {
+			continue
+		}
+		if migration.Version != version+1 {
+			return version, errors.New("Migration versions are not consecutive.")
+		}
+		run := &MigrationRun{
+			DB:        db,
+			DryRun:    dryRun,
+			progress:  progress,
+			migration: migration,
+		}
+		if err = migration.Run(run); err != nil {
+			return version, fmt.Errorf("Migration %d failed. %s", migration.Version, err.Error())
+		}
+		run.report(true)
+		version = migration.Version
+		if dryRun {
+			continue
+		}
+		if err = db.SetSchemaVersionRedis(version); err != nil {
+			return version, err
+		}
+	}
+	return version, nil
+}
+
+// Layouts times were written in before they were stored as unix
+// timestamps.
+var legacyTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	time.RFC3339Nano,
+	time.RFC1123Z,
+	time.RFC1123,
+	time.UnixDate,
+}
+
+func parseLegacyTime(res string) (time.Time, error) {
+	for _, layout := range legacyTimeLayouts {
+		if t, err := time.Parse(layout, res); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Could not parse time '%s'.", res)
+}
+
+func sameImageSize(a []byte, b []byte) bool {
+	aConf, _, errA := image.DecodeConfig(bytes.NewReader(a))
+	bConf, _, errB := image.DecodeConfig(bytes.NewReader(b))
+	return errA == nil && errB == nil && aConf.Width == bConf.Width && aConf.Height == bConf.Height
+}
+
+// Stores post times as unix timestamps and remakes beacon thumbnails
+// at the current thumbnail size.
+func migrateTimesAndThumbnails(run *MigrationRun) error {
+	return run.scanLegacyPosts(func(id uint64, key string) error {
+		res, err := run.DB.redis.HMGet(key, "time", "type").Result()
+		if err != nil {
+			return err
+		}
+		timeStr, _ := res[0].(string)
+		fields := []string{}
+		if _, err := strconv.ParseInt(timeStr, 10, 64); err != nil && timeStr != "" {
+			t, err := parseLegacyTime(timeStr)
+			if err != nil {
+				return err
+			}
+			fields = append(fields, "time", RedisFormatTime(t))
+		}
+		if postType, _ := res[1].(string); postType == "beacon" {
+			imgs, err := run.DB.redis.HMGet(key, "img", "thumb").Result()
+			if err != nil {
+				return err
+			}
+			img, _ := imgs[0].(string)
+			oldThumb, _ := imgs[1].(string)
+			// An image that can't be decoded can't be given a new
+			// thumbnail either, so its old one is kept.
+			thumb, err := MakeThumbnail([]byte(img))
+			if err == nil && !sameImageSize(thumb, []byte(oldThumb)) {
+				fields = append(fields, "thumb", string(thumb))
+			}
+		}
+		if len(fields) == 0 {
+			return nil
+		}
+		run.Changed()
+		if run.DryRun {
+			return nil
+		}
+		return run.DB.redis.HMSet(key, fields[0], fields[1], fields[2:]...).Err()
+	})
+}
+
+// Usernames used to be reserved as typed, which let names differing
+// only in case both be taken.
+func migrateUsernamePool(run *MigrationRun) error {
+	return run.Scan("u:*", func(key string) error {
+		if strings.Count(key, ":") != 1 {
+			return nil
+		}
+		username, err := run.DB.redis.HGet(key, "username").Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		reserved, err := run.DB.redis.SIsMember(USERNAME_POOL_KEY, UsernameKey(username)).Result()
+		if err != nil {
+			return err
+		}
+		legacy := false
+		if username != UsernameKey(username) {
+			legacy, err = run.DB.redis.SIsMember(USERNAME_POOL_KEY, username).Result()
+			if err != nil {
+				return err
+			}
+		}
+		if reserved && !legacy {
+			return nil
+		}
+		run.Changed()
+		if run.DryRun {
+			return nil
+		}
+		err = run.DB.redis.SAdd(USERNAME_POOL_KEY, UsernameKey(username)).Err()
+		if err != nil || !legacy {
+			return err
+		}
+		return run.DB.redis.SRem(USERNAME_POOL_KEY, username).Err()
+	})
+}
+
+// Merges post IDs into a user's post index, keeping it newest first.
+const mergeIndexScript = `
+local ids = {}
+local seen = {}
+for _, id in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
+	seen[id] = true
+	table.insert(ids, tonumber(id))
+end
+local added = 0
+for _, id in ipairs(ARGV) do
+	if not seen[id] then
+		seen[id] = true
+		added = added + 1
+		table.insert(ids, tonumber(id))
+	end
+end
+if added == 0 then
+	return 0
+end
+table.sort(ids, function(a, b) return a > b end)
+redis.call("DEL", KEYS[1])
+for _, id in ipairs(ids) do
+	redis.call("RPUSH", KEYS[1], id)
+end
+return added
+`
+
+type userPostIndex struct {
+	beacons  []string
+	comments []string
+}
+
+// Posts made before users had post, heart and flag indexes are added
+// to them.
+func migrateUserIndexes(run *MigrationRun) error {
+	indexes := map[uint64]*userPostIndex{}
+	err := run.scanLegacyPosts(func(id uint64, key string) error {
+		res, err := run.DB.redis.HMGet(key, "type", "poster").Result()
+		if err != nil {
+			return err
+		}
+		posterStr, _ := res[1].(string)
+		poster, err := RedisParseUInt64(posterStr, nil)
+		if err != nil || poster == DeletedUserID {
+			return nil
+		}
+		index, ok := indexes[poster]
+		if !ok {
+			index = &userPostIndex{}
+			indexes[poster] = index
+		}
+		idStr := strconv.FormatUint(id, REDIS_INT_BASE)
+		switch postType, _ := res[0].(string); postType {
+		case "beacon":
+			index.beacons = append(index.beacons, idStr)
+		case "comment":
+			index.comments = append(index.comments, idStr)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for userID, index := range indexes {
+		exists, err := run.DB.redis.Exists(legacyUserKey(userID)).Result()
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		lists := map[string][]string{
+			legacyUserListKey(userID, "p"): index.beacons,
+			legacyUserListKey(userID, "c"): index.comments,
+		}
+		for listKey, ids := range lists {
+			if len(ids) == 0 {
+				continue
+			}
+			if run.DryRun {
+				current, err := run.DB.redis.LRange(listKey, 0, -1).Result()
+				if err != nil {
+					return err
+				}
+				listed := map[string]bool{}
+				for _, id := range current {
+					listed[id] = true
+				}
+				for _, id := range ids {
+					if !listed[id] {
+						run.Changed()
+						break
+					}
+				}
+				continue
+			}
+			res, err := run.DB.redis.Eval(mergeIndexScript, []string{listKey}, ids).Result()
+			if err != nil {
+				return err
+			}
+			if added, _ := res.(int64); added > 0 {
+				run.Changed()
+			}
+		}
+	}
+	for _, pattern := range []string{"h:*", "f:*"} {
+		err = run.Scan(pattern, func(key string) error {
+			parts := strings.Split(key, ":")
+			if len(parts) != 2 {
+				return nil
+			}
+			members, err := run.DB.redis.SMembers(key).Result()
+			if err != nil {
+				return err
+			}
+			for _, member := range members {
+				userID, err := RedisParseUInt64(member, nil)
+				if err != nil {
+					return err
+				}
+				exists, err := run.DB.redis.Exists(legacyUserKey(userID)).Result()
+				if err != nil {
+					return err
+				}
+				if !exists {
+					continue
+				}
+				listKey := legacyUserListKey(userID, parts[0])
+				listed, err := run.DB.redis.SIsMember(listKey, parts[1]).Result()
+				if err != nil || listed {
+					return err
+				}
+				run.Changed()
+				if run.DryRun {
+					continue
+				}
+				if err = run.DB.redis.SAdd(listKey, parts[1]).Err(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the key a legacy key moves to by migration 4, or "" if it is
+// dropped. ok is false for keys that were never named after an ID.
+func taggedKey(key string) (newKey string, ok bool) {
+	parts := strings.Split(key, ":")
+	if len(parts) < 2 {
+		return "", false
+	}
+	if _, err := strconv.ParseUint(parts[1], REDIS_INT_BASE, 64); err != nil {
+		return "", false
+	}
+	switch {
+	case parts[0] == "p" || parts[0] == "u":
+		rest := ""
+		if len(parts) > 2 {
+			rest = ":" + strings.Join(parts[2:], ":")
+		}
+		return fmt.Sprintf("{%s:%s}%s", parts[0], parts[1], rest), true
+	case len(parts) != 2:
+		return "", false
+	case parts[0] == "h" || parts[0] == "f":
+		return fmt.Sprintf("{p:%s}:%s", parts[1], parts[0]), true
+	case parts[0] == "active":
+		return fmt.Sprintf("{active}:%s", parts[1]), true
+	case parts[0] == "t":
+		// Cached threads are refilled on the next read.
+		return "", true
+	}
+	return "", false
+}
+
+// Gives every key of a post or user its ID as a hash tag, so that a
+// cluster keeps the keys one script touches in one hash slot. Keys
+// without tags were only ever written to a single server, where RENAME
+// may move a key to another slot, so this must run before the data is
+// moved into a cluster.
+func migrateHashTags(run *MigrationRun) error {
+	for _, pattern := range []string{"p:*", "h:*", "f:*", "u:*", "active:*", "t:*"} {
+		err := run.Scan(pattern, func(key string) error {
+			newKey, ok := taggedKey(key)
+			if !ok {
+				return nil
+			}
+			run.Changed()
+			if run.DryRun {
+				return nil
+			}
+			if newKey == "" {
+				return run.DB.redis.Del(key).Err()
+			}
+			err := run.DB.redis.Rename(key, newKey).Err()
+			if err != nil && err.Error() == "ERR no such key" {
+				// Deleted since it was scanned.
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
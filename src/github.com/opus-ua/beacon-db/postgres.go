@@ -0,0 +1,968 @@
+package beacondb
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	. "github.com/opus-ua/beacon-post"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	METERS_PER_MILE = 1609.344
+	// Postgres error codes.
+	PG_UNIQUE_VIOLATION      = "23505"
+	PG_FOREIGN_KEY_VIOLATION = "23503"
+)
+
+// Beacons and comments draw their IDs from one sequence, like the
+// post-count key in Redis, so a post ID alone names a post. GetLocal
+// searches the earthdistance index on beacon locations.
+const postgresSchema = `
+CREATE EXTENSION IF NOT EXISTS cube;
+CREATE EXTENSION IF NOT EXISTS earthdistance;
+CREATE SEQUENCE IF NOT EXISTS post_ids;
+CREATE TABLE IF NOT EXISTS users (
+	id BIGSERIAL PRIMARY KEY,
+	username TEXT NOT NULL,
+	username_key TEXT NOT NULL,
+	email TEXT NOT NULL,
+	auth BYTEA NOT NULL,
+	created TIMESTAMPTZ NOT NULL,
+	renamed TIMESTAMPTZ,
+	admin BOOLEAN NOT NULL DEFAULT FALSE,
+	hearts_rec INTEGER NOT NULL DEFAULT 0,
+	hearts_sub INTEGER NOT NULL DEFAULT 0,
+	flags_rec INTEGER NOT NULL DEFAULT 0,
+	flags_sub INTEGER NOT NULL DEFAULT 0,
+	CONSTRAINT users_username_unique UNIQUE (username_key),
+	CONSTRAINT users_email_unique UNIQUE (email)
+);
+CREATE TABLE IF NOT EXISTS beacons (
+	id BIGINT PRIMARY KEY DEFAULT nextval('post_ids'),
+	poster BIGINT NOT NULL,
+	description TEXT NOT NULL,
+	image BYTEA NOT NULL,
+	thumbnail BYTEA NOT NULL,
+	latitude DOUBLE PRECISION NOT NULL,
+	longitude DOUBLE PRECISION NOT NULL,
+	exact_latitude DOUBLE PRECISION,
+	exact_longitude DOUBLE PRECISION,
+	prec TEXT NOT NULL,
+	hearts INTEGER NOT NULL DEFAULT 0,
+	flags INTEGER NOT NULL DEFAULT 0,
+	created TIMESTAMPTZ NOT NULL,
+	pending BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE INDEX IF NOT EXISTS beacons_poster ON beacons (poster, id);
+CREATE INDEX IF NOT EXISTS beacons_location ON beacons
+	USING gist (ll_to_earth(latitude, longitude)) WHERE NOT pending;
+CREATE TABLE IF NOT EXISTS comments (
+	id BIGINT PRIMARY KEY DEFAULT nextval('post_ids'),
+	beacon BIGINT NOT NULL REFERENCES beacons (id) ON DELETE CASCADE,
+	poster BIGINT NOT NULL,
+	text TEXT NOT NULL,
+	hearts INTEGER NOT NULL DEFAULT 0,
+	flags INTEGER NOT NULL DEFAULT 0,
+	created TIMESTAMPTZ NOT NULL,
+	pending BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE INDEX IF NOT EXISTS comments_beacon ON comments (beacon, id);
+CREATE INDEX IF NOT EXISTS comments_poster ON comments (poster, id);
+CREATE TABLE IF NOT EXISTS hearts (
+	post BIGINT NOT NULL,
+	user_id BIGINT NOT NULL,
+	PRIMARY KEY (post, user_id)
+);
+CREATE INDEX IF NOT EXISTS hearts_user ON hearts (user_id);
+CREATE TABLE IF NOT EXISTS flags (
+	post BIGINT NOT NULL,
+	user_id BIGINT NOT NULL,
+	PRIMARY KEY (post, user_id)
+);
+CREATE INDEX IF NOT EXISTS flags_user ON flags (user_id);
+CREATE TABLE IF NOT EXISTS zones (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	rule TEXT NOT NULL,
+	center_latitude DOUBLE PRECISION NOT NULL,
+	center_longitude DOUBLE PRECISION NOT NULL,
+	radius DOUBLE PRECISION NOT NULL,
+	polygon DOUBLE PRECISION[] NOT NULL DEFAULT '{}'
+);
+`
+
+// Makes Postgres the store of record for users, posts, hearts, flags
+// and zones. Redis keeps rate limits, device fixes and exports. With
+// redisCache set, threads and users are also kept in Redis, written
+// through on every change and read from there first.
+func (db *DBClient) UsePostgres(dsn string, redisCache bool) error {
+	pg, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	if err = pg.Ping(); err != nil {
+		pg.Close()
+		return err
+	}
+	if _, err = pg.Exec(postgresSchema); err != nil {
+		pg.Close()
+		return err
+	}
+	db.postgres = pg
+	db.redisCache = redisCache
+	return nil
+}
+
+func (db *DBClient) UsingPostgres() bool {
+	return db.postgres != nil
+}
+
+func isPostgresError(err error, code string) (*pq.Error, bool) {
+	pgErr, ok := err.(*pq.Error)
+	if !ok || string(pgErr.Code) != code {
+		return nil, false
+	}
+	return pgErr, true
+}
+
+// Times are kept to the second, as in Redis, so that a post reads the
+// same whichever store it comes from.
+func postgresTime(t time.Time) time.Time {
+	return time.Unix(t.Unix(), 0)
+}
+
+// Runs fn in a transaction, committing if it returns nil.
+func (db *DBClient) inTxPostgres(fn func(tx *sql.Tx) error) error {
+	tx, err := db.postgres.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+const beaconColumnsPostgres = `id, poster, description, image, thumbnail, latitude, longitude,
+	exact_latitude, exact_longitude, prec, hearts, flags, created, pending`
+
+func scanBeaconPostgres(row rowScanner) (Beacon, error) {
+	var post Beacon
+	var exactLat, exactLong sql.NullFloat64
+	var precision string
+	var created time.Time
+	err := row.Scan(&post.ID, &post.PosterID, &post.Description, &post.Image, &post.Thumbnail,
+		&post.Location.Latitude, &post.Location.Longitude, &exactLat, &exactLong,
+		&precision, &post.Hearts, &post.Flags, &created, &post.Pending)
+	if err != nil {
+		return Beacon{}, err
+	}
+	if exactLat.Valid && exactLong.Valid {
+		post.ExactLocation = &Geotag{Latitude: exactLat.Float64, Longitude: exactLong.Float64}
+	}
+	post.Time = postgresTime(created)
+	post.Precision, err = ParsePrecision(precision)
+	return post, err
+}
+
+const commentColumnsPostgres = `id, beacon, poster, text, hearts, flags, created, pending`
+
+func scanCommentPostgres(row rowScanner) (Comment, error) {
+	var comment Comment
+	var created time.Time
+	err := row.Scan(&comment.ID, &comment.BeaconID, &comment.PosterID, &comment.Text,
+		&comment.Hearts, &comment.Flags, &created, &comment.Pending)
+	comment.Time = postgresTime(created)
+	return comment, err
+}
+
+func (db *DBClient) GetBeaconPostgres(id uint64) (Beacon, error) {
+	row := db.postgres.QueryRow(`SELECT `+beaconColumnsPostgres+` FROM beacons WHERE id = $1`, id)
+	post, err := scanBeaconPostgres(row)
+	if err == sql.ErrNoRows {
+		return Beacon{}, ErrPostNotFound
+	}
+	return post, err
+}
+
+func (db *DBClient) GetThreadPostgres(id uint64) (Beacon, error) {
+	post, err := db.GetBeaconPostgres(id)
+	if err != nil {
+		return Beacon{}, err
+	}
+	rows, err := db.postgres.Query(`SELECT `+commentColumnsPostgres+` FROM comments
+		WHERE beacon = $1 AND NOT pending ORDER BY id`, id)
+	if err != nil {
+		return Beacon{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		comment, err := scanCommentPostgres(rows)
+		if err != nil {
+			return Beacon{}, err
+		}
+		post.Comments = append(post.Comments, comment)
+	}
+	return post, rows.Err()
+}
+
+func (db *DBClient) GetCommentByIDPostgres(id uint64) (Comment, error) {
+	row := db.postgres.QueryRow(`SELECT `+commentColumnsPostgres+` FROM comments WHERE id = $1`, id)
+	comment, err := scanCommentPostgres(row)
+	if err == sql.ErrNoRows {
+		return Comment{}, errors.New("Comment not found in db.")
+	}
+	return comment, err
+}
+
+func (db *DBClient) AddBeaconPostgres(post *Beacon, userID uint64) (uint64, error) {
+	fuzzBeacon(post)
+	var exactLat, exactLong sql.NullFloat64
+	if post.ExactLocation != nil {
+		exactLat = sql.NullFloat64{Float64: post.ExactLocation.Latitude, Valid: true}
+		exactLong = sql.NullFloat64{Float64: post.ExactLocation.Longitude, Valid: true}
+	}
+	err := db.postgres.QueryRow(`INSERT INTO beacons (poster, description, image, thumbnail,
+		latitude, longitude, exact_latitude, exact_longitude, prec, hearts, flags, created, pending)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id`,
+		post.PosterID, post.Description, post.Image, post.Thumbnail,
+		post.Location.Latitude, post.Location.Longitude, exactLat, exactLong,
+		post.Precision.String(), post.Hearts, post.Flags, postgresTime(time.Now()),
+		post.Pending).Scan(&post.ID)
+	if err != nil {
+		return 0, err
+	}
+	return post.ID, nil
+}
+
+func (db *DBClient) AddCommentPostgres(comment *Comment, userID uint64) error {
+	err := db.postgres.QueryRow(`INSERT INTO comments (beacon, poster, text, hearts, flags,
+		created, pending) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		comment.BeaconID, comment.PosterID, comment.Text, comment.Hearts, comment.Flags,
+		postgresTime(time.Now()), comment.Pending).Scan(&comment.ID)
+	if _, ok := isPostgresError(err, PG_FOREIGN_KEY_VIOLATION); ok {
+		return ErrPostNotFound
+	}
+	return err
+}
+
+// Returns "beacon" or "comment", or ErrPostNotFound if there is no
+// post with the ID.
+func (db *DBClient) GetPostTypePostgres(id uint64) (string, error) {
+	var postType string
+	err := db.postgres.QueryRow(`SELECT 'beacon' FROM beacons WHERE id = $1
+		UNION ALL SELECT 'comment' FROM comments WHERE id = $1`, id).Scan(&postType)
+	if err == sql.ErrNoRows {
+		return "", ErrPostNotFound
+	}
+	return postType, err
+}
+
+// Returns the beacon a post belongs to: itself for a beacon, its
+// parent for a comment.
+func (db *DBClient) getThreadIDPostgres(id uint64) (uint64, error) {
+	var threadID uint64
+	err := db.postgres.QueryRow(`SELECT id FROM beacons WHERE id = $1
+		UNION ALL SELECT beacon FROM comments WHERE id = $1`, id).Scan(&threadID)
+	if err == sql.ErrNoRows {
+		return 0, ErrPostNotFound
+	}
+	return threadID, err
+}
+
+func (db *DBClient) GetHeartCountPostgres(id uint64) (uint32, error) {
+	var hearts uint32
+	err := db.postgres.QueryRow(`SELECT hearts FROM beacons WHERE id = $1
+		UNION ALL SELECT hearts FROM comments WHERE id = $1`, id).Scan(&hearts)
+	if err == sql.ErrNoRows {
+		return 0, ErrPostNotFound
+	}
+	return hearts, err
+}
+
+func (db *DBClient) GetCommentCountPostgres(postID uint64) (uint64, error) {
+	var count uint64
+	err := db.postgres.QueryRow(`SELECT (SELECT count(*) FROM comments
+		WHERE beacon = beacons.id AND NOT pending) FROM beacons WHERE id = $1`, postID).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, errors.New("Cannot get comment count of non-beacon post.")
+	}
+	return count, err
+}
+
+// Adds or removes a user's heart or flag on a post, changing the
+// post's count and the counters of the user and the poster only if
+// the user's membership changed. table is "hearts" or "flags".
+func (db *DBClient) reactPostgres(postID uint64, userID uint64, table string, delta int) error {
+	return db.inTxPostgres(func(tx *sql.Tx) error {
+		postTable := "beacons"
+		var poster uint64
+		err := tx.QueryRow(`SELECT poster FROM beacons WHERE id = $1 FOR UPDATE`, postID).Scan(&poster)
+		if err == sql.ErrNoRows {
+			postTable = "comments"
+			err = tx.QueryRow(`SELECT poster FROM comments WHERE id = $1 FOR UPDATE`, postID).Scan(&poster)
+		}
+		if err == sql.ErrNoRows {
+			return ErrPostNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var res sql.Result
+		if delta > 0 {
+			res, err = tx.Exec(`INSERT INTO `+table+` (post, user_id) VALUES ($1, $2)
+				ON CONFLICT DO NOTHING`, postID, userID)
+		} else {
+			res, err = tx.Exec(`DELETE FROM `+table+` WHERE post = $1 AND user_id = $2`, postID, userID)
+		}
+		if err != nil {
+			return err
+		}
+		if changed, err := res.RowsAffected(); err != nil || changed == 0 {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE `+postTable+` SET `+table+` = `+table+` + $2 WHERE id = $1`, postID, delta)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE users SET `+table+`_sub = `+table+`_sub + $2 WHERE id = $1`, userID, delta)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE users SET `+table+`_rec = `+table+`_rec + $2 WHERE id = $1`, poster, delta)
+		return err
+	})
+}
+
+func (db *DBClient) HeartPostPostgres(postID uint64, userID uint64) error {
+	return db.reactPostgres(postID, userID, "hearts", 1)
+}
+
+func (db *DBClient) UnheartPostPostgres(postID uint64, userID uint64) error {
+	return db.reactPostgres(postID, userID, "hearts", -1)
+}
+
+func (db *DBClient) FlagPostPostgres(postID uint64, userID uint64) error {
+	return db.reactPostgres(postID, userID, "flags", 1)
+}
+
+func (db *DBClient) HasHeartedPostgres(postID uint64, userID uint64) (bool, error) {
+	var hearted bool
+	err := db.postgres.QueryRow(`SELECT EXISTS (SELECT 1 FROM hearts
+		WHERE post = $1 AND user_id = $2)`, postID, userID).Scan(&hearted)
+	return hearted, err
+}
+
+func (db *DBClient) HasHeartedPostsPostgres(postIDs []uint64, userID uint64) (map[uint64]bool, error) {
+	hearted := map[uint64]bool{}
+	for _, postID := range postIDs {
+		hearted[postID] = false
+	}
+	if len(postIDs) == 0 {
+		return hearted, nil
+	}
+	ids, err := db.queryIDsPostgres(`SELECT post FROM hearts WHERE user_id = $1 AND post = ANY($2)`,
+		userID, pq.Array(int64sPostgres(postIDs)))
+	for _, id := range ids {
+		hearted[id] = true
+	}
+	return hearted, err
+}
+
+// Radius is in miles, as in GetLocalRedis.
+func (db *DBClient) GetLocalPostgres(loc Geotag, radius float64) ([]Beacon, error) {
+	rows, err := db.postgres.Query(`SELECT `+beaconColumnsPostgres+` FROM beacons
+		WHERE NOT pending
+		AND earth_box(ll_to_earth($1, $2), $3) @> ll_to_earth(latitude, longitude)
+		AND earth_distance(ll_to_earth($1, $2), ll_to_earth(latitude, longitude)) <= $3`,
+		loc.Latitude, loc.Longitude, radius*METERS_PER_MILE)
+	if err != nil {
+		return []Beacon{}, err
+	}
+	defer rows.Close()
+	var resPosts []Beacon
+	for rows.Next() {
+		post, err := scanBeaconPostgres(rows)
+		if err != nil {
+			return resPosts, err
+		}
+		resPosts = append(resPosts, post)
+	}
+	return resPosts, rows.Err()
+}
+
+func (db *DBClient) CreateUserPostgres(username string, authkey []byte, email string) (uint64, error) {
+	var userID uint64
+	err := db.postgres.QueryRow(`INSERT INTO users (username, username_key, email, auth, created)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		username, UsernameKey(username), email, authkey, postgresTime(time.Now())).Scan(&userID)
+	if pgErr, ok := isPostgresError(err, PG_UNIQUE_VIOLATION); ok {
+		if pgErr.Constraint == "users_email_unique" {
+			return 0, ErrEmailTaken
+		}
+		return 0, ErrUsernameTaken
+	}
+	if err != nil {
+		return 0, errors.New("Could not add user to db.")
+	}
+	return userID, nil
+}
+
+func (db *DBClient) UserExistsPostgres(userID uint64) (bool, error) {
+	var exists bool
+	err := db.postgres.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists)
+	return exists, err
+}
+
+func (db *DBClient) UserAuthenticatedPostgres(userID uint64, authkey []byte) (bool, error) {
+	var storedKey []byte
+	err := db.postgres.QueryRow(`SELECT auth FROM users WHERE id = $1`, userID).Scan(&storedKey)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(storedKey) == string(authkey), nil
+}
+
+func (db *DBClient) GetUsernamePostgres(userID uint64) (string, error) {
+	if userID == DeletedUserID {
+		return DeletedUsername, nil
+	}
+	var username string
+	err := db.postgres.QueryRow(`SELECT username FROM users WHERE id = $1`, userID).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", errors.New("User not found in db.")
+	}
+	return username, err
+}
+
+// Postgres has no unsigned integers, so ID arrays are sent as int64.
+func int64sPostgres(ids []uint64) []int64 {
+	ints := make([]int64, len(ids))
+	for i, id := range ids {
+		ints[i] = int64(id)
+	}
+	return ints
+}
+
+func (db *DBClient) GetUsernamesPostgres(userIDs []uint64) (map[uint64]string, error) {
+	usernames := map[uint64]string{}
+	wanted := 0
+	for _, userID := range userIDs {
+		if userID == DeletedUserID {
+			usernames[userID] = DeletedUsername
+		} else if _, ok := usernames[userID]; !ok {
+			usernames[userID] = ""
+			wanted++
+		}
+	}
+	if wanted == 0 {
+		return usernames, nil
+	}
+	rows, err := db.postgres.Query(`SELECT id, username FROM users WHERE id = ANY($1)`,
+		pq.Array(int64sPostgres(userIDs)))
+	if err != nil {
+		return usernames, err
+	}
+	defer rows.Close()
+	found := 0
+	for rows.Next() {
+		var userID uint64
+		var username string
+		if err = rows.Scan(&userID, &username); err != nil {
+			return usernames, err
+		}
+		usernames[userID] = username
+		found++
+	}
+	if err = rows.Err(); err != nil {
+		return usernames, err
+	}
+	if found < wanted {
+		return usernames, errors.New("User not found in db.")
+	}
+	return usernames, nil
+}
+
+func (db *DBClient) UsernameExistsPostgres(username string) (bool, error) {
+	var exists bool
+	err := db.postgres.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE username_key = $1)`,
+		UsernameKey(username)).Scan(&exists)
+	return exists, err
+}
+
+func (db *DBClient) EmailExistsPostgres(email string) (bool, error) {
+	var exists bool
+	err := db.postgres.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE email = $1)`, email).Scan(&exists)
+	return exists, err
+}
+
+func (db *DBClient) GetUserIDByEmailPostgres(email string) (uint64, error) {
+	var userID uint64
+	err := db.postgres.QueryRow(`SELECT id FROM users WHERE email = $1`, email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errors.New("User not found in db.")
+	}
+	return userID, err
+}
+
+func (db *DBClient) SetUserAuthKeyPostgres(userID uint64, authkey []byte) error {
+	_, err := db.postgres.Exec(`UPDATE users SET auth = $2 WHERE id = $1`, userID, authkey)
+	return err
+}
+
+func (db *DBClient) GetUserPostgres(userID uint64) (User, error) {
+	user := User{ID: userID}
+	var created time.Time
+	err := db.postgres.QueryRow(`SELECT username, created, flags_rec, hearts_rec, flags_sub,
+		hearts_sub, auth, email FROM users WHERE id = $1`, userID).Scan(&user.Username, &created,
+		&user.FlagsReceived, &user.HeartsReceived, &user.FlagsSubmitted, &user.HeartsSubmitted,
+		&user.AuthKey, &user.Email)
+	if err == sql.ErrNoRows {
+		return User{}, errors.New("User not found in db.")
+	}
+	user.AccountCreated = postgresTime(created)
+	return user, err
+}
+
+// Returns every field stored for a user except their auth key, named
+// and formatted as GetUserRecordRedis does.
+func (db *DBClient) GetUserRecordPostgres(userID uint64) (map[string]string, error) {
+	user, err := db.GetUserPostgres(userID)
+	if err != nil {
+		return map[string]string{}, err
+	}
+	record := map[string]string{
+		"id":         strconv.FormatUint(userID, REDIS_INT_BASE),
+		"username":   user.Username,
+		"email":      user.Email,
+		"created":    RedisFormatTime(user.AccountCreated),
+		"hearts-rec": strconv.FormatUint(uint64(user.HeartsReceived), REDIS_INT_BASE),
+		"hearts-sub": strconv.FormatUint(uint64(user.HeartsSubmitted), REDIS_INT_BASE),
+		"flags-rec":  strconv.FormatUint(uint64(user.FlagsReceived), REDIS_INT_BASE),
+		"flags-sub":  strconv.FormatUint(uint64(user.FlagsSubmitted), REDIS_INT_BASE),
+	}
+	var renamed pq.NullTime
+	err = db.postgres.QueryRow(`SELECT renamed FROM users WHERE id = $1`, userID).Scan(&renamed)
+	if err != nil {
+		return map[string]string{}, err
+	}
+	if renamed.Valid {
+		record["renamed"] = RedisFormatTime(renamed.Time)
+	}
+	return record, nil
+}
+
+func (db *DBClient) GetUserPostCountPostgres(userID uint64) (uint64, error) {
+	var count uint64
+	err := db.postgres.QueryRow(`SELECT count(*) FROM beacons WHERE poster = $1`, userID).Scan(&count)
+	return count, err
+}
+
+// Returns the user along with up to count of their beacons, newest
+// first, skipping the first offset, and how many there are. Beacons
+// held for review are left out unless withPending is set.
+func (db *DBClient) GetUserProfilePostgres(userID uint64, offset uint64, count uint64, withPending bool) (UserProfile, error) {
+	user, err := db.GetUserPostgres(userID)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	profile := UserProfile{User: user, Beacons: []Beacon{}}
+	err = db.postgres.QueryRow(`SELECT count(*) FROM beacons
+		WHERE poster = $1 AND ($2 OR NOT pending)`, userID, withPending).Scan(&profile.BeaconCount)
+	if err != nil || count == 0 {
+		return profile, err
+	}
+	rows, err := db.postgres.Query(`SELECT `+beaconColumnsPostgres+` FROM beacons
+		WHERE poster = $1 AND ($4 OR NOT pending) ORDER BY id DESC LIMIT $2 OFFSET $3`,
+		userID, count, offset, withPending)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		post, err := scanBeaconPostgres(rows)
+		if err != nil {
+			return UserProfile{}, err
+		}
+		profile.Beacons = append(profile.Beacons, post)
+	}
+	return profile, rows.Err()
+}
+
+func (db *DBClient) queryIDsPostgres(query string, args ...interface{}) ([]uint64, error) {
+	rows, err := db.postgres.Query(query, args...)
+	if err != nil {
+		return []uint64{}, err
+	}
+	defer rows.Close()
+	ids := []uint64{}
+	for rows.Next() {
+		var id uint64
+		if err = rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Newest first, as in the user's Redis index.
+func (db *DBClient) GetUserBeaconIDsPostgres(userID uint64) ([]uint64, error) {
+	return db.queryIDsPostgres(`SELECT id FROM beacons WHERE poster = $1 ORDER BY id DESC`, userID)
+}
+
+func (db *DBClient) GetUserCommentIDsPostgres(userID uint64) ([]uint64, error) {
+	return db.queryIDsPostgres(`SELECT id FROM comments WHERE poster = $1 ORDER BY id DESC`, userID)
+}
+
+func (db *DBClient) GetUserHeartedPostgres(userID uint64) ([]uint64, error) {
+	return db.queryIDsPostgres(`SELECT post FROM hearts WHERE user_id = $1 ORDER BY post`, userID)
+}
+
+func (db *DBClient) GetUserFlaggedPostgres(userID uint64) ([]uint64, error) {
+	return db.queryIDsPostgres(`SELECT post FROM flags WHERE user_id = $1 ORDER BY post`, userID)
+}
+
+// Changes a user's username. If the user renamed themselves less than
+// cooldown ago, returns ErrUsernameCooldown along with how long they
+// still have to wait.
+func (db *DBClient) ChangeUsernamePostgres(userID uint64, username string, cooldown time.Duration) (time.Duration, error) {
+	var wait time.Duration
+	err := db.inTxPostgres(func(tx *sql.Tx) error {
+		var renamed pq.NullTime
+		err := tx.QueryRow(`SELECT renamed FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&renamed)
+		if err == sql.ErrNoRows {
+			return errors.New("User not found in db.")
+		}
+		if err != nil {
+			return err
+		}
+		now := postgresTime(time.Now())
+		if renamed.Valid && renamed.Time.Add(cooldown).After(now) {
+			wait = renamed.Time.Add(cooldown).Sub(now)
+			return ErrUsernameCooldown
+		}
+		_, err = tx.Exec(`UPDATE users SET username = $2, username_key = $3, renamed = $4
+			WHERE id = $1`, userID, username, UsernameKey(username), now)
+		if _, ok := isPostgresError(err, PG_UNIQUE_VIOLATION); ok {
+			return ErrUsernameTaken
+		}
+		return err
+	})
+	if err == ErrUsernameCooldown {
+		return wait, err
+	}
+	return 0, err
+}
+
+// Returns the IDs of the threads a user's posts are in: their own
+// beacons and the beacons they commented on.
+func (db *DBClient) getUserThreadIDsPostgres(userID uint64) ([]uint64, error) {
+	return db.queryIDsPostgres(`SELECT id FROM beacons WHERE poster = $1
+		UNION SELECT beacon FROM comments WHERE poster = $1`, userID)
+}
+
+// Removes a user's account and anonymizes or deletes their posts
+// according to policy.
+func (db *DBClient) DeleteUserPostgres(userID uint64, policy DeletePolicy) error {
+	return db.inTxPostgres(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM users WHERE id = $1`, userID)
+		if err != nil {
+			return err
+		}
+		if deleted, err := res.RowsAffected(); err != nil || deleted == 0 {
+			if err == nil {
+				err = errors.New("User not found in db.")
+			}
+			return err
+		}
+		if policy != DeletePosts {
+			_, err = tx.Exec(`UPDATE beacons SET poster = $2, exact_latitude = NULL,
+				exact_longitude = NULL WHERE poster = $1`, userID, DeletedUserID)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`UPDATE comments SET poster = $2 WHERE poster = $1`, userID, DeletedUserID)
+			return err
+		}
+		for _, table := range []string{"hearts", "flags"} {
+			_, err = tx.Exec(`DELETE FROM `+table+` WHERE post IN (
+				SELECT id FROM beacons WHERE poster = $1
+				UNION SELECT id FROM comments WHERE poster = $1
+				OR beacon IN (SELECT id FROM beacons WHERE poster = $1))`, userID)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err = tx.Exec(`DELETE FROM comments WHERE poster = $1`, userID); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM beacons WHERE poster = $1`, userID)
+		return err
+	})
+}
+
+func (db *DBClient) IsAdminPostgres(userID uint64) (bool, error) {
+	var admin bool
+	err := db.postgres.QueryRow(`SELECT admin FROM users WHERE id = $1`, userID).Scan(&admin)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return admin, err
+}
+
+func (db *DBClient) SetAdminPostgres(userID uint64, admin bool) error {
+	_, err := db.postgres.Exec(`UPDATE users SET admin = $2 WHERE id = $1`, userID, admin)
+	return err
+}
+
+func (db *DBClient) GetPendingPostgres() ([]uint64, error) {
+	return db.queryIDsPostgres(`SELECT id FROM beacons WHERE pending
+		UNION ALL SELECT id FROM comments WHERE pending ORDER BY id`)
+}
+
+func (db *DBClient) ApproveBeaconPostgres(id uint64) error {
+	return db.inTxPostgres(func(tx *sql.Tx) error {
+		for _, table := range []string{"beacons", "comments"} {
+			res, err := tx.Exec(`UPDATE `+table+` SET pending = FALSE WHERE id = $1 AND pending`, id)
+			if err != nil {
+				return err
+			}
+			if approved, err := res.RowsAffected(); err != nil || approved > 0 {
+				return err
+			}
+		}
+		var exists bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM beacons WHERE id = $1
+			UNION ALL SELECT 1 FROM comments WHERE id = $1)`, id).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrPostNotFound
+		}
+		return errors.New("Post is not awaiting review.")
+	})
+}
+
+func (db *DBClient) RejectBeaconPostgres(id uint64) error {
+	return db.inTxPostgres(func(tx *sql.Tx) error {
+		for _, table := range []string{"beacons", "comments"} {
+			res, err := tx.Exec(`DELETE FROM `+table+` WHERE id = $1 AND pending`, id)
+			if err != nil {
+				return err
+			}
+			rejected, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if rejected == 0 {
+				continue
+			}
+			for _, reactions := range []string{"hearts", "flags"} {
+				if _, err = tx.Exec(`DELETE FROM `+reactions+` WHERE post = $1`, id); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return errors.New("Post is not awaiting review.")
+	})
+}
+
+const zoneColumnsPostgres = `id, name, rule, center_latitude, center_longitude, radius, polygon`
+
+func scanZonePostgres(row rowScanner) (Zone, error) {
+	var zone Zone
+	var rule string
+	var polygon pq.Float64Array
+	err := row.Scan(&zone.ID, &zone.Name, &rule, &zone.Center.Latitude, &zone.Center.Longitude,
+		&zone.Radius, &polygon)
+	if err != nil {
+		return Zone{}, err
+	}
+	for i := 0; i+1 < len(polygon); i += 2 {
+		zone.Polygon = append(zone.Polygon, Geotag{Latitude: polygon[i], Longitude: polygon[i+1]})
+	}
+	zone.Rule, err = ParseZoneRule(rule)
+	return zone, err
+}
+
+// Polygons are stored flattened, as latitude, longitude pairs.
+func formatPolygonPostgres(poly []Geotag) pq.Float64Array {
+	flat := pq.Float64Array{}
+	for _, vertex := range poly {
+		flat = append(flat, vertex.Latitude, vertex.Longitude)
+	}
+	return flat
+}
+
+func (db *DBClient) AddZonePostgres(zone *Zone) (uint64, error) {
+	err := db.postgres.QueryRow(`INSERT INTO zones (name, rule, center_latitude, center_longitude,
+		radius, polygon) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		zone.Name, zone.Rule.String(), zone.Center.Latitude, zone.Center.Longitude,
+		zone.Radius, formatPolygonPostgres(zone.Polygon)).Scan(&zone.ID)
+	if err != nil {
+		return 0, err
+	}
+	return zone.ID, nil
+}
+
+func (db *DBClient) SetZonePostgres(zone *Zone) error {
+	_, err := db.postgres.Exec(`INSERT INTO zones (`+zoneColumnsPostgres+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (id) DO UPDATE SET
+		name = $2, rule = $3, center_latitude = $4, center_longitude = $5, radius = $6, polygon = $7`,
+		zone.ID, zone.Name, zone.Rule.String(), zone.Center.Latitude, zone.Center.Longitude,
+		zone.Radius, formatPolygonPostgres(zone.Polygon))
+	return err
+}
+
+func (db *DBClient) ZoneExistsPostgres(id uint64) (bool, error) {
+	var exists bool
+	err := db.postgres.QueryRow(`SELECT EXISTS (SELECT 1 FROM zones WHERE id = $1)`, id).Scan(&exists)
+	return exists, err
+}
+
+func (db *DBClient) GetZonesPostgres() ([]Zone, error) {
+	rows, err := db.postgres.Query(`SELECT ` + zoneColumnsPostgres + ` FROM zones ORDER BY id`)
+	if err != nil {
+		return []Zone{}, err
+	}
+	defer rows.Close()
+	zones := []Zone{}
+	for rows.Next() {
+		zone, err := scanZonePostgres(rows)
+		if err != nil {
+			return zones, err
+		}
+		zones = append(zones, zone)
+	}
+	return zones, rows.Err()
+}
+
+func (db *DBClient) DeleteZonePostgres(id uint64) error {
+	_, err := db.postgres.Exec(`DELETE FROM zones WHERE id = $1`, id)
+	return err
+}
+
+// Writes a thread through to the Redis cache after it changed in
+// Postgres. A thread that is gone, or that can't be written, is
+// dropped from the cache so that it is read from Postgres instead of
+// served stale.
+func (db *DBClient) writeThroughThread(id uint64) {
+	if !db.redisCache {
+		return
+	}
+	post, err := db.GetThreadPostgres(id)
+	if err == nil {
+		if err = db.StoreThreadRedis(post); err == nil {
+			return
+		}
+		log.Printf("Could not write thread %d through to cache. %s", id, err.Error())
+	}
+	if err = db.EvictThreadRedis(id); err != nil {
+		log.Printf("Could not evict thread %d from cache. %s", id, err.Error())
+	}
+}
+
+// Writes through the thread a post belongs to.
+func (db *DBClient) writeThroughPost(id uint64) {
+	if !db.redisCache {
+		return
+	}
+	threadID, err := db.getThreadIDPostgres(id)
+	if err != nil {
+		log.Printf("Could not find thread of post %d to write through. %s", id, err.Error())
+		return
+	}
+	db.writeThroughThread(threadID)
+}
+
+func (db *DBClient) writeThroughUser(userID uint64) {
+	if !db.redisCache || userID == DeletedUserID {
+		return
+	}
+	user, err := db.GetUserPostgres(userID)
+	if err == nil {
+		if err = db.StoreUserRedis(user); err == nil {
+			return
+		}
+		log.Printf("Could not write user %d through to cache. %s", userID, err.Error())
+	}
+	if err = db.EvictUserRedis(userID); err != nil {
+		log.Printf("Could not evict user %d from cache. %s", userID, err.Error())
+	}
+}
+
+func (db *DBClient) getPosterPostgres(postID uint64) (uint64, error) {
+	var poster uint64
+	err := db.postgres.QueryRow(`SELECT poster FROM beacons WHERE id = $1
+		UNION ALL SELECT poster FROM comments WHERE id = $1`, postID).Scan(&poster)
+	if err == sql.ErrNoRows {
+		return 0, ErrPostNotFound
+	}
+	return poster, err
+}
+
+// Writes through everything a heart or flag changes: the thread and
+// the counters of the user and the poster.
+func (db *DBClient) writeThroughReaction(postID uint64, userID uint64) {
+	if !db.redisCache {
+		return
+	}
+	db.writeThroughPost(postID)
+	db.writeThroughUser(userID)
+	poster, err := db.getPosterPostgres(postID)
+	if err != nil {
+		log.Printf("Could not find poster of post %d to write through. %s", postID, err.Error())
+		return
+	}
+	db.writeThroughUser(poster)
+}
+
+// Reads a thread from the cache, falling back to Postgres and filling
+// the cache on a miss.
+func (db *DBClient) getThreadCachedPostgres(id uint64) (Beacon, error) {
+	if !db.redisCache {
+		return db.GetThreadPostgres(id)
+	}
+	if post, err := db.GetThreadRedis(id); err == nil {
+		return post, nil
+	}
+	post, err := db.GetThreadPostgres(id)
+	if err != nil {
+		return Beacon{}, err
+	}
+	if err = db.StoreThreadRedis(post); err != nil {
+		log.Printf("Could not cache thread %d. %s", id, err.Error())
+	}
+	return post, nil
+}
+
+func (db *DBClient) getUserCachedPostgres(userID uint64) (User, error) {
+	if !db.redisCache {
+		return db.GetUserPostgres(userID)
+	}
+	if user, err := db.GetUserRedis(userID); err == nil {
+		return user, nil
+	}
+	user, err := db.GetUserPostgres(userID)
+	if err != nil {
+		return User{}, err
+	}
+	if err = db.StoreUserRedis(user); err != nil {
+		log.Printf("Could not cache user %d. %s", userID, err.Error())
+	}
+	return user, nil
+}
@@ -0,0 +1,465 @@
+package beacondb
+
+import (
+	"archive/tar"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	. "github.com/opus-ua/beacon-post"
+	"io"
+	"log"
+	"time"
+)
+
+type postgresBackup struct {
+	*backup
+	tx *sql.Tx
+}
+
+// Writes what query returns BACKUP_BATCH_SIZE rows at a time, as the
+// files of kind. query is given the ID to start after and the number
+// of rows to return, and scan returns the ID and record of a row. fill
+// may add to the records of a batch before it is written.
+func (pb *postgresBackup) writePages(kind string, query string,
+	scan func(rows *sql.Rows) (uint64, interface{}, error), fill func(records []interface{}) error) error {
+	last := uint64(0)
+	for batch := 1; ; batch++ {
+		rows, err := pb.tx.Query(query, last, BACKUP_BATCH_SIZE)
+		if err != nil {
+			return err
+		}
+		records := []interface{}{}
+		for rows.Next() {
+			id, record, err := scan(rows)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("%s after %d: %s", kind, last, err.Error())
+			}
+			last = id
+			records = append(records, record)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		if fill != nil {
+			if err = fill(records); err != nil {
+				return err
+			}
+		}
+		if err = pb.writeRecords(backupBatchName(kind, batch), records); err != nil {
+			return err
+		}
+	}
+}
+
+func (pb *postgresBackup) scanUser(rows *sql.Rows) (uint64, interface{}, error) {
+	var user BackupUser
+	var created time.Time
+	var renamed pq.NullTime
+	err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Auth, &created, &renamed,
+		&user.Admin, &user.HeartsRec, &user.HeartsSub, &user.FlagsRec, &user.FlagsSub)
+	if err != nil {
+		return 0, nil, err
+	}
+	user.Created = created.Unix()
+	if renamed.Valid {
+		user.Renamed = renamed.Time.Unix()
+	}
+	pb.stats.Users++
+	return user.ID, user, nil
+}
+
+func (pb *postgresBackup) scanZone(rows *sql.Rows) (uint64, interface{}, error) {
+	zone, err := scanZonePostgres(rows)
+	if err != nil {
+		return 0, nil, err
+	}
+	pb.stats.Zones++
+	return zone.ID, toBackupZone(zone), nil
+}
+
+func (pb *postgresBackup) scanPost(beacons *[]uint64) func(rows *sql.Rows) (uint64, interface{}, error) {
+	return func(rows *sql.Rows) (uint64, interface{}, error) {
+		post := &BackupPost{}
+		var lat, long, exactLat, exactLong sql.NullFloat64
+		var created time.Time
+		err := rows.Scan(&post.ID, &post.Type, &post.Poster, &post.Parent, &post.Text, &lat, &long,
+			&exactLat, &exactLong, &post.Precision, &post.Hearts, &post.Flags, &created, &post.Pending)
+		if err != nil {
+			return 0, nil, err
+		}
+		post.Time = created.Unix()
+		if post.Type == "beacon" {
+			post.Location = &BackupLocation{Latitude: lat.Float64, Longitude: long.Float64}
+			if exactLat.Valid && exactLong.Valid {
+				post.ExactLocation = &BackupLocation{Latitude: exactLat.Float64, Longitude: exactLong.Float64}
+			}
+			*beacons = append(*beacons, post.ID)
+		}
+		pb.stats.Posts++
+		return post.ID, post, nil
+	}
+}
+
+// Adds who hearted and flagged each post of a batch.
+func (pb *postgresBackup) fillMembers(records []interface{}) error {
+	posts := map[uint64]*BackupPost{}
+	ids := []uint64{}
+	for _, record := range records {
+		post := record.(*BackupPost)
+		posts[post.ID] = post
+		ids = append(ids, post.ID)
+	}
+	for _, table := range []string{"hearts", "flags"} {
+		rows, err := pb.tx.Query(`SELECT post, user_id FROM `+table+`
+			WHERE post = ANY($1) ORDER BY post, user_id`, pq.Array(int64sPostgres(ids)))
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var postID, userID uint64
+			if err = rows.Scan(&postID, &userID); err != nil {
+				rows.Close()
+				return err
+			}
+			if table == "hearts" {
+				posts[postID].HeartedBy = append(posts[postID].HeartedBy, userID)
+			} else {
+				posts[postID].FlaggedBy = append(posts[postID].FlaggedBy, userID)
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pb *postgresBackup) writeImages(beacons []uint64) error {
+	for _, id := range beacons {
+		var image, thumbnail []byte
+		err := pb.tx.QueryRow(`SELECT image, thumbnail FROM beacons WHERE id = $1`, id).Scan(&image, &thumbnail)
+		if err != nil {
+			return err
+		}
+		for i, blob := range [][]byte{image, thumbnail} {
+			if len(blob) == 0 {
+				continue
+			}
+			dir := []string{"images", "thumbs"}[i]
+			if err = pb.writeEntry(fmt.Sprintf("%s/%d", dir, id), blob); err != nil {
+				return err
+			}
+			pb.stats.Images++
+		}
+	}
+	return nil
+}
+
+func (pb *postgresBackup) scanGeo(rows *sql.Rows) (uint64, interface{}, error) {
+	var geo BackupGeo
+	err := rows.Scan(&geo.ID, &geo.Location.Latitude, &geo.Location.Longitude)
+	if err != nil {
+		return 0, nil, err
+	}
+	pb.stats.Geo++
+	return geo.ID, geo, nil
+}
+
+// The counters of the manifest are the last IDs handed out.
+var backupSequencesPostgres = []string{"users_id_seq", "post_ids", "zones_id_seq"}
+
+// Streams every user, zone, post, heart and flag in Postgres to w in
+// the format BackupRedis writes, so that a backup of either store can
+// be restored into either. Everything is read in one transaction, so
+// unlike a Redis backup this is a snapshot. The geo index is written
+// from the locations of the beacons that are not pending.
+func (db *DBClient) BackupPostgres(w io.Writer, progress func(BackupStats)) (BackupStats, error) {
+	pb := &postgresBackup{backup: &backup{
+		db:       db,
+		tw:       tar.NewWriter(w),
+		created:  time.Now(),
+		progress: progress,
+	}}
+	tx, err := db.postgres.BeginTx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return pb.stats, err
+	}
+	defer tx.Rollback()
+	pb.tx = tx
+	manifest := BackupManifest{
+		Format:  BACKUP_FORMAT_VERSION,
+		Schema:  LatestSchemaVersion(),
+		Created: pb.created.Unix(),
+	}
+	counts := []*uint64{&manifest.UserCount, &manifest.PostCount, &manifest.ZoneCount}
+	for i, seq := range backupSequencesPostgres {
+		err = tx.QueryRow(`SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM ` + seq).Scan(counts[i])
+		if err != nil {
+			return pb.stats, err
+		}
+	}
+	manifestJson, err := json.Marshal(manifest)
+	if err != nil {
+		return pb.stats, err
+	}
+	if err = pb.writeEntry(BACKUP_MANIFEST, manifestJson); err != nil {
+		return pb.stats, err
+	}
+	err = pb.writePages("users", `SELECT id, username, email, auth, created, renamed, admin,
+		hearts_rec, hearts_sub, flags_rec, flags_sub FROM users
+		WHERE id > $1 ORDER BY id LIMIT $2`, pb.scanUser, nil)
+	if err != nil {
+		return pb.stats, err
+	}
+	err = pb.writePages("zones", `SELECT `+zoneColumnsPostgres+` FROM zones
+		WHERE id > $1 ORDER BY id LIMIT $2`, pb.scanZone, nil)
+	if err != nil {
+		return pb.stats, err
+	}
+	beacons := []uint64{}
+	err = pb.writePages("posts", `SELECT id, 'beacon', poster, 0, description, latitude, longitude,
+			exact_latitude, exact_longitude, prec, hearts, flags, created, pending
+			FROM beacons WHERE id > $1
+		UNION ALL SELECT id, 'comment', poster, beacon, text, NULL, NULL, NULL, NULL, '',
+			hearts, flags, created, pending FROM comments WHERE id > $1
+		ORDER BY id LIMIT $2`, pb.scanPost(&beacons), pb.fillMembers)
+	if err != nil {
+		return pb.stats, err
+	}
+	if err = pb.writeImages(beacons); err != nil {
+		return pb.stats, err
+	}
+	err = pb.writePages("geo", `SELECT id, latitude, longitude FROM beacons
+		WHERE NOT pending AND id > $1 ORDER BY id LIMIT $2`, pb.scanGeo, nil)
+	if err != nil {
+		return pb.stats, err
+	}
+	if err = pb.tw.Close(); err != nil {
+		return pb.stats, err
+	}
+	if progress != nil {
+		progress(pb.stats)
+	}
+	return pb.stats, nil
+}
+
+type postgresRestore struct {
+	tx       *sql.Tx
+	stats    BackupStats
+	manifest *BackupManifest
+	users    []uint64
+	beacons  map[uint64]bool
+}
+
+// Reads a backup written by BackupRedis or BackupPostgres into empty
+// Postgres tables in one transaction, keeping every ID. This is how a
+// Redis db is moved to Postgres. Merging into tables that are not
+// empty is only supported in Redis, and a backup from an older schema
+// has to be restored into Redis and migrated first.
+func (db *DBClient) RestorePostgres(r io.Reader, merge bool, progress func(BackupStats)) (BackupStats, error) {
+	rs := &postgresRestore{beacons: map[uint64]bool{}}
+	if merge {
+		return rs.stats, ErrRedisOnly
+	}
+	err := db.inTxPostgres(func(tx *sql.Tx) error {
+		rs.tx = tx
+		err := readBackup(r, backupHandlers{
+			manifest: rs.startRestore,
+			user:     rs.restoreUser,
+			zone:     rs.restoreZone,
+			post:     rs.restorePost,
+			image:    rs.restoreImage,
+			geo:      rs.restoreGeo,
+			batch: func() {
+				if progress != nil {
+					progress(rs.stats)
+				}
+			},
+		})
+		if err != nil {
+			return err
+		}
+		return rs.setSequences()
+	})
+	if err != nil {
+		return rs.stats, err
+	}
+	// Whatever the cache holds under the restored IDs is left over from
+	// an earlier db.
+	if db.redisCache {
+		for _, id := range rs.users {
+			if err = db.EvictUserRedis(id); err != nil {
+				log.Printf("Could not evict user %d from cache. %s", id, err.Error())
+			}
+		}
+		for id := range rs.beacons {
+			if err = db.EvictThreadRedis(id); err != nil {
+				log.Printf("Could not evict thread %d from cache. %s", id, err.Error())
+			}
+		}
+	}
+	if progress != nil {
+		progress(rs.stats)
+	}
+	return rs.stats, nil
+}
+
+func (rs *postgresRestore) startRestore(manifest *BackupManifest) error {
+	if manifest.Schema != LatestSchemaVersion() {
+		return fmt.Errorf("Backup is at schema version %d. Restore it into Redis and migrate it "+
+			"before restoring it into Postgres.", manifest.Schema)
+	}
+	var used bool
+	err := rs.tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users) OR EXISTS (SELECT 1 FROM beacons)
+		OR EXISTS (SELECT 1 FROM comments) OR EXISTS (SELECT 1 FROM zones)`).Scan(&used)
+	if err != nil {
+		return err
+	}
+	if used {
+		return errors.New("Db is not empty. Only a Redis db can be restored into with merge.")
+	}
+	rs.manifest = manifest
+	return nil
+}
+
+// Carries on handing out IDs after those of the backup.
+func (rs *postgresRestore) setSequences() error {
+	counts := []uint64{rs.manifest.UserCount, rs.manifest.PostCount, rs.manifest.ZoneCount}
+	for i, seq := range backupSequencesPostgres {
+		_, err := rs.tx.Exec(`SELECT setval($1::regclass, GREATEST($2::bigint, 1), $2::bigint > 0)`,
+			seq, counts[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs *postgresRestore) restoreUser(user *BackupUser) error {
+	renamed := pq.NullTime{Time: time.Unix(user.Renamed, 0), Valid: user.Renamed != 0}
+	_, err := rs.tx.Exec(`INSERT INTO users (id, username, username_key, email, auth, created,
+		renamed, admin, hearts_rec, hearts_sub, flags_rec, flags_sub)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		user.ID, user.Username, UsernameKey(user.Username), user.Email, user.Auth,
+		time.Unix(user.Created, 0), renamed, user.Admin,
+		user.HeartsRec, user.HeartsSub, user.FlagsRec, user.FlagsSub)
+	if _, ok := isPostgresError(err, PG_UNIQUE_VIOLATION); ok {
+		return fmt.Errorf("Username or email of user %d is already taken.", user.ID)
+	}
+	if err != nil {
+		return err
+	}
+	rs.users = append(rs.users, user.ID)
+	rs.stats.Users++
+	return nil
+}
+
+func (rs *postgresRestore) restoreZone(record *BackupZone) error {
+	zone, err := record.Zone()
+	if err != nil {
+		return err
+	}
+	_, err = rs.tx.Exec(`INSERT INTO zones (`+zoneColumnsPostgres+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		zone.ID, zone.Name, zone.Rule.String(), zone.Center.Latitude, zone.Center.Longitude,
+		zone.Radius, formatPolygonPostgres(zone.Polygon))
+	if err != nil {
+		return err
+	}
+	rs.stats.Zones++
+	return nil
+}
+
+// Images are filled in from their own entries.
+func (rs *postgresRestore) restorePost(post *BackupPost) error {
+	var err error
+	switch post.Type {
+	case "beacon":
+		if post.Location == nil {
+			return fmt.Errorf("Beacon %d has no location.", post.ID)
+		}
+		precision, err := ParsePrecision(post.Precision)
+		if err != nil {
+			return err
+		}
+		var exactLat, exactLong sql.NullFloat64
+		if post.ExactLocation != nil {
+			exactLat = sql.NullFloat64{Float64: post.ExactLocation.Latitude, Valid: true}
+			exactLong = sql.NullFloat64{Float64: post.ExactLocation.Longitude, Valid: true}
+		}
+		_, err = rs.tx.Exec(`INSERT INTO beacons (id, poster, description, image, thumbnail,
+			latitude, longitude, exact_latitude, exact_longitude, prec, hearts, flags, created, pending)
+			VALUES ($1, $2, $3, '', '', $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+			post.ID, post.Poster, post.Text, post.Location.Latitude, post.Location.Longitude,
+			exactLat, exactLong, precision.String(), post.Hearts, post.Flags,
+			time.Unix(post.Time, 0), post.Pending)
+		if err != nil {
+			return err
+		}
+		rs.beacons[post.ID] = true
+	case "comment":
+		if !rs.beacons[post.Parent] {
+			rs.stats.Skipped++
+			return nil
+		}
+		_, err = rs.tx.Exec(`INSERT INTO comments (id, beacon, poster, text, hearts, flags,
+			created, pending) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			post.ID, post.Parent, post.Poster, post.Text, post.Hearts, post.Flags,
+			time.Unix(post.Time, 0), post.Pending)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown post type '%s'.", post.Type)
+	}
+	members := map[string][]uint64{"hearts": post.HeartedBy, "flags": post.FlaggedBy}
+	for table, userIDs := range members {
+		for _, userID := range userIDs {
+			_, err = rs.tx.Exec(`INSERT INTO `+table+` (post, user_id) VALUES ($1, $2)
+				ON CONFLICT DO NOTHING`, post.ID, userID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	rs.stats.Posts++
+	return nil
+}
+
+func (rs *postgresRestore) restoreImage(id uint64, field string, blob []byte) error {
+	if !rs.beacons[id] {
+		return fmt.Errorf("Image belongs to unknown post %d.", id)
+	}
+	column := "image"
+	if field == "thumb" {
+		column = "thumbnail"
+	}
+	if _, err := rs.tx.Exec(`UPDATE beacons SET `+column+` = $2 WHERE id = $1`, id, blob); err != nil {
+		return err
+	}
+	rs.stats.Images++
+	return nil
+}
+
+// Postgres finds beacons by the location kept with them, so the geo
+// index has nothing to add and is only counted.
+func (rs *postgresRestore) restoreGeo(geo *BackupGeo) error {
+	if !rs.beacons[geo.ID] {
+		rs.stats.Skipped++
+		return nil
+	}
+	rs.stats.Geo++
+	return nil
+}
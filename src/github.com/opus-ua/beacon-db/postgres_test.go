@@ -0,0 +1,293 @@
+package beacondb
+
+import (
+	"bytes"
+	"database/sql"
+	. "github.com/opus-ua/beacon-post"
+	"gopkg.in/redis.v3"
+	"os"
+	"testing"
+	"time"
+)
+
+// The Postgres tests need a database they may wipe, named by
+// BEACON_TEST_POSTGRES. They are skipped if it can't be reached.
+const DEFAULT_TEST_POSTGRES = "postgres://localhost/beacon_test?sslmode=disable"
+
+func PostgresTestDB(t *testing.T, redisCache bool) *DBClient {
+	dsn := os.Getenv("BEACON_TEST_POSTGRES")
+	if dsn == "" {
+		dsn = DEFAULT_TEST_POSTGRES
+	}
+	pg, err := sql.Open("postgres", dsn)
+	if err == nil {
+		err = pg.Ping()
+	}
+	if err != nil {
+		t.Skipf("Postgres is not available at '%s'. %s", dsn, err.Error())
+	}
+	_, err = pg.Exec(`DROP TABLE IF EXISTS users, beacons, comments, hearts, flags, zones CASCADE;
+		DROP SEQUENCE IF EXISTS post_ids`)
+	pg.Close()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	cache := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+		DB:   13,
+	})
+	cache.FlushDb()
+	pgDB := &DBClient{redis: singleClient{Client: cache}, redisConfig: DefaultRedisConfig}
+	if err = pgDB.UsePostgres(dsn, redisCache); err != nil {
+		t.Fatalf(err.Error())
+	}
+	return pgDB
+}
+
+func TestPostgresUsers(t *testing.T) {
+	pgDB := PostgresTestDB(t, false)
+	userID, err := pgDB.CreateUser("Postgres-User", []byte("secret"), "pg@gmail.com")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = pgDB.CreateUser("postgres-user", []byte(""), "pg2@gmail.com"); err != ErrUsernameTaken {
+		t.Fatalf("Username differing only in case was accepted.")
+	}
+	if _, err = pgDB.CreateUser("other", []byte(""), "pg@gmail.com"); err == nil {
+		t.Fatalf("Email was registered twice.")
+	}
+	if authed, err := pgDB.UserAuthenticated(userID, []byte("secret")); !authed || err != nil {
+		t.Fatalf("User could not authenticate.")
+	}
+	if authed, _ := pgDB.UserAuthenticated(userID, []byte("wrong")); authed {
+		t.Fatalf("User authenticated with the wrong key.")
+	}
+	if id, err := pgDB.GetUserIDByEmail("pg@gmail.com"); err != nil || id != userID {
+		t.Fatalf("Could not look up user by email.")
+	}
+	if _, err = pgDB.ChangeUsername(userID, "Renamed", time.Hour); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = pgDB.ChangeUsername(userID, "Again", time.Hour); err != ErrUsernameCooldown {
+		t.Fatalf("Username cooldown was not enforced.")
+	}
+	if exists, _ := pgDB.UsernameExists("postgres-user"); exists {
+		t.Fatalf("Old username was not released.")
+	}
+	if username, _ := pgDB.GetUsername(userID); username != "Renamed" {
+		t.Fatalf("Username is '%s', not 'Renamed'.", username)
+	}
+}
+
+func testPostgresPosts(t *testing.T, pgDB *DBClient) {
+	posterID, err := pgDB.CreateUser("poster", []byte(""), "poster@gmail.com")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	fanID, err := pgDB.CreateUser("fan", []byte(""), "fan@gmail.com")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	post := Beacon{
+		Image:       []byte("image"),
+		Thumbnail:   []byte("thumb"),
+		Location:    Geotag{Latitude: 40.0, Longitude: -80.0},
+		Precision:   PrecisionExact,
+		PosterID:    posterID,
+		Description: "postgres",
+	}
+	beaconID, err := pgDB.AddBeacon(&post, posterID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	comment := Comment{PosterID: fanID, BeaconID: beaconID, Text: "nice"}
+	if err = pgDB.AddComment(&comment, fanID); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if comment.ID <= beaconID {
+		t.Fatalf("Comment and beacon do not share post IDs.")
+	}
+	if err = pgDB.AddComment(&Comment{PosterID: fanID, BeaconID: 9999, Text: "lost"}, fanID); err != ErrPostNotFound {
+		t.Fatalf("Comment on a missing beacon was accepted.")
+	}
+	for i := 0; i < 2; i++ {
+		if err = pgDB.HeartPost(comment.ID, posterID); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err = pgDB.HeartPost(9999, posterID); err != ErrPostNotFound {
+		t.Fatalf("Hearted a missing post.")
+	}
+	thread, err := pgDB.GetThread(beaconID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(thread.Comments) != 1 || thread.Comments[0].Hearts != 1 {
+		t.Fatalf("Thread should have one comment with one heart: %+v", thread.Comments)
+	}
+	fan, err := pgDB.GetUser(fanID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if fan.HeartsReceived != 1 {
+		t.Fatalf("Heart was not counted for the poster of the comment.")
+	}
+	local, err := pgDB.GetLocal(Geotag{Latitude: 40.01, Longitude: -80.0}, 5)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(local) != 1 || local[0].ID != beaconID {
+		t.Fatalf("Beacon was not found nearby.")
+	}
+	if far, _ := pgDB.GetLocal(Geotag{Latitude: 41.0, Longitude: -80.0}, 5); len(far) != 0 {
+		t.Fatalf("Beacon was found 69 miles away.")
+	}
+	if err = pgDB.DeleteUser(fanID, AnonymizePosts); err != nil {
+		t.Fatalf(err.Error())
+	}
+	thread, err = pgDB.GetThread(beaconID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if thread.Comments[0].PosterID != DeletedUserID {
+		t.Fatalf("Comment of deleted user was not anonymized.")
+	}
+	if err = pgDB.DeleteUser(posterID, DeletePosts); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = pgDB.GetThread(beaconID); err != ErrPostNotFound {
+		t.Fatalf("Beacon of deleted user was not deleted.")
+	}
+	if _, err = pgDB.Fsck(false, nil); err != ErrRedisOnly {
+		t.Fatalf("Fsck ran against the Redis keyspace while posts are in Postgres.")
+	}
+	if _, err = pgDB.Restore(bytes.NewReader(nil), true, nil); err != ErrRedisOnly {
+		t.Fatalf("Backup was merged into Postgres.")
+	}
+}
+
+func TestPostgresPosts(t *testing.T) {
+	testPostgresPosts(t, PostgresTestDB(t, false))
+}
+
+func TestPostgresRedisCache(t *testing.T) {
+	pgDB := PostgresTestDB(t, true)
+	testPostgresPosts(t, pgDB)
+	posterID, err := pgDB.CreateUser("cached", []byte(""), "cached@gmail.com")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	post := Beacon{
+		Image:     []byte("image"),
+		Thumbnail: []byte("thumb"),
+		Precision: PrecisionExact,
+		PosterID:  posterID,
+	}
+	beaconID, err := pgDB.AddBeacon(&post, posterID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = pgDB.HeartPost(beaconID, posterID); err != nil {
+		t.Fatalf(err.Error())
+	}
+	cached, err := pgDB.GetThreadRedis(beaconID)
+	if err != nil {
+		t.Fatalf("Thread was not written through to the cache.")
+	}
+	if cached.Hearts != 1 {
+		t.Fatalf("Cached thread has %d hearts, not 1.", cached.Hearts)
+	}
+	if user, _ := pgDB.GetUserRedis(posterID); user.HeartsSubmitted != 1 {
+		t.Fatalf("Cached user was not updated.")
+	}
+	pgDB.redis.FlushDb()
+	if _, err = pgDB.GetThread(beaconID); err != nil {
+		t.Fatalf("Cache miss was not read from Postgres.")
+	}
+	if _, err = pgDB.GetThreadRedis(beaconID); err != nil {
+		t.Fatalf("Cache miss was not filled.")
+	}
+}
+
+// Moves a thread from Postgres to Redis and back.
+func TestPostgresBackupRestore(t *testing.T) {
+	pgDB := PostgresTestDB(t, false)
+	posterID, err := pgDB.CreateUser("archived", []byte("secret"), "archived@gmail.com")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	post := Beacon{
+		Image:       []byte("image"),
+		Thumbnail:   []byte("thumb"),
+		Location:    Geotag{Latitude: 40.0, Longitude: -80.0},
+		Precision:   PrecisionExact,
+		PosterID:    posterID,
+		Description: "archived",
+	}
+	beaconID, err := pgDB.AddBeacon(&post, posterID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	comment := Comment{PosterID: posterID, BeaconID: beaconID, Text: "kept"}
+	if err = pgDB.AddComment(&comment, posterID); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = pgDB.HeartPost(comment.ID, posterID); err != nil {
+		t.Fatalf(err.Error())
+	}
+	buf := &bytes.Buffer{}
+	backedUp, err := pgDB.Backup(buf, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if backedUp.Users != 1 || backedUp.Posts != 2 || backedUp.Images != 2 || backedUp.Geo != 1 {
+		t.Fatalf("Backup left out records: %+v", backedUp)
+	}
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+		DB:   12,
+	})
+	defer redisClient.Close()
+	redisClient.FlushDb()
+	defer redisClient.FlushDb()
+	redisDB := &DBClient{redis: singleClient{Client: redisClient}, redisConfig: DefaultRedisConfig}
+	if restored, err := redisDB.RestoreRedis(bytes.NewReader(buf.Bytes()), false, nil); err != nil || restored != backedUp {
+		t.Fatalf("Restored %+v into Redis but backed up %+v. %v", restored, backedUp, err)
+	}
+	checkThread := func(from *DBClient) {
+		thread, err := from.GetThread(beaconID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if thread.Description != "archived" || string(thread.Image) != "image" ||
+			len(thread.Comments) != 1 || thread.Comments[0].Hearts != 1 {
+			t.Fatalf("Restored thread differs from the original: %+v", thread)
+		}
+		if hearted, _ := from.HasHearted(comment.ID, posterID); !hearted {
+			t.Fatalf("Heart was not restored.")
+		}
+		if authed, _ := from.UserAuthenticated(posterID, []byte("secret")); !authed {
+			t.Fatalf("Restored user could not authenticate.")
+		}
+	}
+	checkThread(redisDB)
+	buf.Reset()
+	if _, err = redisDB.BackupRedis(buf, nil); err != nil {
+		t.Fatalf(err.Error())
+	}
+	pgDB = PostgresTestDB(t, false)
+	restored, err := pgDB.Restore(bytes.NewReader(buf.Bytes()), false, nil)
+	if err != nil || restored != backedUp {
+		t.Fatalf("Restored %+v into Postgres but backed up %+v. %v", restored, backedUp, err)
+	}
+	checkThread(pgDB)
+	if local, _ := pgDB.GetLocal(Geotag{Latitude: 40.01, Longitude: -80.0}, 5); len(local) != 1 {
+		t.Fatalf("Restored beacon was not found nearby.")
+	}
+	if _, err = pgDB.Restore(bytes.NewReader(buf.Bytes()), false, nil); err == nil {
+		t.Fatalf("Restored over a db that was not empty.")
+	}
+	if nextID, err := pgDB.AddBeacon(&post, posterID); err != nil || nextID <= comment.ID {
+		t.Fatalf("New post was given ID %d, not one after the restored posts.", nextID)
+	}
+}
@@ -2,10 +2,13 @@ package beacondb
 
 import (
 	"encoding"
+	"encoding/json"
 	"errors"
 	"fmt"
 	. "github.com/opus-ua/beacon-post"
 	"gopkg.in/redis.v3"
+	"log"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -16,36 +19,78 @@ const (
 	REDIS_INT_BASE    = 10
 	USERNAME_POOL_KEY = "usernames"
 	USER_COUNT_KEY    = "user-count"
+	POST_COUNT_KEY    = "post-count"
 	GEOTAG_KEY        = "geo"
+	ZONE_COUNT_KEY    = "zone-count"
+	ZONE_POOL_KEY     = "zones"
+	ADMIN_POOL_KEY    = "admins"
+	PENDING_POOL_KEY  = "pending"
 )
 
-func DefaultRedisDB() *redis.Client {
-	return redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-	})
-}
+var (
+	ErrPostNotFound     = errors.New("Post not found in db.")
+	ErrUsernameTaken    = errors.New("Username already exists.")
+	ErrEmailTaken       = errors.New("Email is already registered.")
+	ErrUsernameCooldown = errors.New("Username was changed too recently.")
+)
 
-func DevRedisDB() *redis.Client {
-	client := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-	})
+func DefaultRedisDB() RedisClient {
+	client, _ := DefaultRedisConfig.NewClient()
 	return client
 }
 
+func DevRedisDB() RedisClient {
+	return DefaultRedisDB()
+}
+
+func GetRedisRateLimitKey(bucket string) string {
+	return fmt.Sprintf("rl:%s", bucket)
+}
+
+func GetRedisZoneKey(id uint64) string {
+	return fmt.Sprintf("z:%d", id)
+}
+
+// Every key of a post is tagged with {p:<id>} and every key of a user
+// with {u:<id>}, so that a cluster keeps all of them in one hash slot.
 func GetRedisPostKey(id uint64) string {
-	return fmt.Sprintf("p:%d", id)
+	return fmt.Sprintf("{p:%d}", id)
 }
 
 func GetRedisCommentListKey(id uint64) string {
 	return fmt.Sprintf("%s:c", GetRedisPostKey(id))
 }
 
+func GetRedisThreadCacheKey(id uint64) string {
+	return fmt.Sprintf("%s:t", GetRedisPostKey(id))
+}
+
 func GetRedisUserKey(id uint64) string {
-	return fmt.Sprintf("u:%d", id)
+	return fmt.Sprintf("{u:%d}", id)
+}
+
+func GetRedisUserFixKey(id uint64) string {
+	return fmt.Sprintf("%s:fix", GetRedisUserKey(id))
+}
+
+func GetRedisUserPostsKey(id uint64) string {
+	return fmt.Sprintf("%s:p", GetRedisUserKey(id))
+}
+
+func GetRedisUserCommentsKey(id uint64) string {
+	return fmt.Sprintf("%s:c", GetRedisUserKey(id))
+}
+
+func GetRedisUserHeartListKey(id uint64) string {
+	return fmt.Sprintf("%s:h", GetRedisUserKey(id))
+}
+
+func GetRedisUserFlagListKey(id uint64) string {
+	return fmt.Sprintf("%s:f", GetRedisUserKey(id))
+}
+
+func GetRedisExportKey(token string) string {
+	return fmt.Sprintf("export:%s", token)
 }
 
 func GetRedisUserEmailKey(email string) string {
@@ -53,11 +98,11 @@ func GetRedisUserEmailKey(email string) string {
 }
 
 func GetRedisUserHeartedKey(postid uint64) string {
-	return fmt.Sprintf("h:%d", postid)
+	return fmt.Sprintf("%s:h", GetRedisPostKey(postid))
 }
 
 func GetRedisUserFlaggedKey(postid uint64) string {
-	return fmt.Sprintf("f:%d", postid)
+	return fmt.Sprintf("%s:f", GetRedisPostKey(postid))
 }
 
 func RedisParseFloat64(res string, err error) (float64, error) {
@@ -94,6 +139,13 @@ func RedisParseTime(res string, err error) (time.Time, error) {
 	return time.Unix(seconds, 0), nil
 }
 
+func RedisParsePrecision(res string, err error) (Precision, error) {
+	if err != nil {
+		return PrecisionExact, err
+	}
+	return ParsePrecision(res)
+}
+
 func RedisParseText(res string, obj encoding.TextUnmarshaler, err error) error {
 	if err != nil {
 		return err
@@ -120,11 +172,22 @@ func (db *DBClient) GetBeaconRedis(id uint64) (Beacon, error) {
 	if err != nil {
 		return Beacon{}, err
 	}
+	return RedisParseBeacon(id, res)
+}
+
+func RedisParseBeacon(id uint64, res map[string]string) (Beacon, error) {
 	if len(res) == 0 {
-		return Beacon{}, errors.New("Beacon not found in db.")
+		return Beacon{}, ErrPostNotFound
 	}
 	var geotag Geotag
-	err = RedisParseBinary(res["loc"], &geotag, err)
+	err := RedisParseBinary(res["loc"], &geotag, nil)
+	var exactLoc *Geotag
+	if exactStr, ok := res["exact-loc"]; ok {
+		exactLoc = &Geotag{}
+		err = RedisParseBinary(exactStr, exactLoc, err)
+	}
+	precision, err := RedisParsePrecision(res["prec"], err)
+	_, pending := res["pending"]
 	timePosted, err := RedisParseTime(res["time"], err)
 	poster, err := RedisParseUInt64(res["poster"], err)
 	hearts, err := RedisParseUInt32(res["hearts"], err)
@@ -133,15 +196,18 @@ func (db *DBClient) GetBeaconRedis(id uint64) (Beacon, error) {
 		return Beacon{}, err
 	}
 	post := Beacon{
-		ID:          id,
-		Image:       []byte(res["img"]),
-		Thumbnail:   []byte(res["thumb"]),
-		Location:    geotag,
-		PosterID:    poster,
-		Description: res["desc"],
-		Hearts:      hearts,
-		Flags:       flags,
-		Time:        timePosted,
+		ID:            id,
+		Image:         []byte(res["img"]),
+		Thumbnail:     []byte(res["thumb"]),
+		Location:      geotag,
+		ExactLocation: exactLoc,
+		Precision:     precision,
+		PosterID:      poster,
+		Description:   res["desc"],
+		Hearts:        hearts,
+		Flags:         flags,
+		Time:          timePosted,
+		Pending:       pending,
 	}
 	return post, nil
 }
@@ -149,6 +215,10 @@ func (db *DBClient) GetBeaconRedis(id uint64) (Beacon, error) {
 func (db *DBClient) GetCommentRedis(id uint64, parent uint64) (Comment, error) {
 	commentKey := GetRedisPostKey(id)
 	commHash, err := db.redis.HGetAllMap(commentKey).Result()
+	return RedisParseComment(id, parent, commHash, err)
+}
+
+func RedisParseComment(id uint64, parent uint64, commHash map[string]string, err error) (Comment, error) {
 	commentTime, err := RedisParseTime(commHash["time"], err)
 	poster, err := RedisParseUInt64(commHash["poster"], err)
 	hearts, err := RedisParseUInt32(commHash["hearts"], err)
@@ -156,6 +226,7 @@ func (db *DBClient) GetCommentRedis(id uint64, parent uint64) (Comment, error) {
 	if err != nil {
 		return Comment{}, err
 	}
+	_, pending := commHash["pending"]
 	comment := Comment{
 		ID:       id,
 		PosterID: poster,
@@ -164,13 +235,17 @@ func (db *DBClient) GetCommentRedis(id uint64, parent uint64) (Comment, error) {
 		Hearts:   hearts,
 		Flags:    flags,
 		Time:     commentTime,
+		Pending:  pending,
 	}
 	return comment, nil
 }
 
 func (db *DBClient) GetCommentListRedis(id uint64) ([]uint64, error) {
 	key := GetRedisCommentListKey(id)
-	strList, err := db.redis.LRange(key, 0, -1).Result()
+	return RedisParseIDList(db.redis.LRange(key, 0, -1).Result())
+}
+
+func RedisParseIDList(strList []string, err error) ([]uint64, error) {
 	if err != nil {
 		return []uint64{}, err
 	}
@@ -185,171 +260,628 @@ func (db *DBClient) GetCommentListRedis(id uint64) ([]uint64, error) {
 	return intList, nil
 }
 
+// Reads a thread in two round trips, one for the beacon and its
+// comment list and one for every comment on it.
 func (db *DBClient) GetThreadRedis(id uint64) (Beacon, error) {
-	post, err := db.GetBeaconRedis(id)
+	post, _, err := db.getThreadRedis(id)
+	return post, err
+}
+
+// Also returns the beacon's revision, which changes whenever the
+// thread does. See InvalidateThreadRedis.
+func (db *DBClient) getThreadRedis(id uint64) (Beacon, string, error) {
+	pipe := db.redis.Pipeline()
+	defer pipe.Close()
+	postCmd := pipe.HGetAllMap(GetRedisPostKey(id))
+	listCmd := pipe.LRange(GetRedisCommentListKey(id), 0, -1)
+	if _, err := pipe.Exec(); err != nil {
+		return Beacon{}, "", err
+	}
+	post, err := RedisParseBeacon(id, postCmd.Val())
 	if err != nil {
-		return Beacon{}, err
+		return Beacon{}, "", err
 	}
-	comments, err := db.GetCommentListRedis(id)
+	commentIDs, err := RedisParseIDList(listCmd.Val(), nil)
 	if err != nil {
-		return Beacon{}, err
+		return Beacon{}, "", err
 	}
-	for _, commentID := range comments {
-		comment, err := db.GetCommentRedis(commentID, id)
+	if len(commentIDs) == 0 {
+		return post, postCmd.Val()["rev"], nil
+	}
+	commentCmds := make([]*redis.StringStringMapCmd, len(commentIDs))
+	for i, commentID := range commentIDs {
+		commentCmds[i] = pipe.HGetAllMap(GetRedisPostKey(commentID))
+	}
+	if _, err = pipe.Exec(); err != nil {
+		return Beacon{}, "", err
+	}
+	for i, commentID := range commentIDs {
+		comment, err := RedisParseComment(commentID, id, commentCmds[i].Val(), nil)
 		if err != nil {
-			return Beacon{}, err
+			return Beacon{}, "", err
 		}
 		post.Comments = append(post.Comments, comment)
 	}
+	return post, postCmd.Val()["rev"], nil
+}
+
+// Rejects the fill if the thread changed since it was read, or if the
+// beacon is gone. A beacon with no revision yet reads as "".
+const fillThreadScript = `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+if (redis.call("HGET", KEYS[1], "rev") or "") ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[2], ARGV[2], "EX", ARGV[3])
+return 1
+`
+
+// Reads a thread from its cached copy if there is one, saving a read
+// of every comment. The copy is the same for every viewer and leaves
+// out the images, which are read from the beacon alongside it. On a
+// miss the thread is read in full and cached for ThreadCacheTTL.
+func (db *DBClient) GetThreadCachedRedis(id uint64) (Beacon, error) {
+	pipe := db.redis.Pipeline()
+	defer pipe.Close()
+	cacheCmd := pipe.Get(GetRedisThreadCacheKey(id))
+	imgCmd := pipe.HMGet(GetRedisPostKey(id), "img", "thumb")
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return Beacon{}, err
+	}
+	if cacheCmd.Err() == nil {
+		var post Beacon
+		img, imgOK := imgCmd.Val()[0].(string)
+		thumb, _ := imgCmd.Val()[1].(string)
+		if imgOK && json.Unmarshal([]byte(cacheCmd.Val()), &post) == nil {
+			post.Image = []byte(img)
+			post.Thumbnail = []byte(thumb)
+			// Times come back in the zone they were cached in rather
+			// than the local one RedisParseTime gives.
+			post.Time = post.Time.Local()
+			for i := range post.Comments {
+				post.Comments[i].Time = post.Comments[i].Time.Local()
+			}
+			return post, nil
+		}
+	}
+	post, rev, err := db.getThreadRedis(id)
+	if err != nil {
+		return Beacon{}, err
+	}
+	cached := post
+	cached.Image = nil
+	cached.Thumbnail = nil
+	data, err := json.Marshal(cached)
+	if err == nil {
+		ttl := strconv.FormatInt(int64(db.redisConfig.ThreadCacheTTL/time.Second), REDIS_INT_BASE)
+		err = db.redis.Eval(fillThreadScript, []string{GetRedisPostKey(id), GetRedisThreadCacheKey(id)},
+			[]string{rev, string(data), ttl}).Err()
+	}
+	if err != nil {
+		log.Printf("Could not cache thread %d. %s", id, err.Error())
+	}
 	return post, nil
 }
 
-func (db *DBClient) AddBeaconRedis(post *Beacon, userID uint64) (uint64, error) {
-	postID, err := db.redis.Incr("post-count").Result()
-	if postID < 0 {
-		return 0, errors.New("Retrieved post count was negative.")
+// Bumps the revision of the beacon KEYS[1], so fills of copies read
+// before the change are rejected, then drops its cached copy KEYS[2].
+// The beacon may already be deleted.
+const invalidateThreadScript = `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	redis.call("HINCRBY", KEYS[1], "rev", 1)
+end
+redis.call("DEL", KEYS[2])
+return 1
+`
+
+// Must be called after every change to a thread. postID may be the
+// beacon or one of its comments. The change has already been made, so
+// a failure here is only logged; the stale copy expires on its own.
+func (db *DBClient) InvalidateThreadRedis(postID uint64) {
+	thread := postID
+	res, err := db.redis.HMGet(GetRedisPostKey(postID), "type", "parent").Result()
+	if err == nil {
+		if postType, _ := res[0].(string); postType == "comment" {
+			parent, _ := res[1].(string)
+			thread, err = RedisParseUInt64(parent, nil)
+		}
+	}
+	if err == nil {
+		err = db.redis.Eval(invalidateThreadScript,
+			[]string{GetRedisPostKey(thread), GetRedisThreadCacheKey(thread)}, []string{}).Err()
+	}
+	if err != nil {
+		log.Printf("Could not invalidate cached thread of post %d. %s", postID, err.Error())
 	}
-	post.ID = uint64(postID)
+}
+
+// Takes the next ID from a counter such as POST_COUNT_KEY. IDs are
+// taken before the keys named after them are written, so a write that
+// fails leaves a gap in the IDs and nothing else.
+func (db *DBClient) nextIDRedis(counterKey string) (uint64, error) {
+	id, err := db.redis.Incr(counterKey).Result()
 	if err != nil {
 		return 0, err
 	}
-	key := GetRedisPostKey(post.ID)
+	if id <= 0 {
+		return 0, fmt.Errorf("Counter '%s' was not positive.", counterKey)
+	}
+	return uint64(id), nil
+}
+
+// Creates the post hash KEYS[1] for post ARGV[1], files the ID in the
+// poster's index and then either indexes the beacon by location or
+// holds it for review.
+const addBeaconScript = `
+local id = ARGV[1]
+local fieldCount = tonumber(ARGV[5])
+redis.call("HMSET", KEYS[1], unpack(ARGV, 6, 5 + 2 * fieldCount))
+redis.call("LPUSH", KEYS[2], id)
+if ARGV[2] == "1" then
+	redis.call("HSET", KEYS[1], "pending", "1")
+	redis.call("SADD", KEYS[4], id)
+else
+	redis.call("GEOADD", KEYS[3], ARGV[4], ARGV[3], id)
+end
+return 1
+`
+
+// Creates the comment hash KEYS[1] for post ARGV[1] and files the ID
+// in the poster's index and, unless it is held for review, in its
+// beacon's comment list.
+const addCommentScript = `
+local id = ARGV[1]
+local fieldCount = tonumber(ARGV[3])
+redis.call("HMSET", KEYS[1], unpack(ARGV, 4, 3 + 2 * fieldCount))
+redis.call("LPUSH", KEYS[2], id)
+if ARGV[2] == "1" then
+	redis.call("HSET", KEYS[1], "pending", "1")
+	redis.call("SADD", KEYS[4], id)
+else
+	redis.call("RPUSH", KEYS[3], id)
+end
+return 1
+`
+
+// Files a new post in a cluster, where addBeaconScript and
+// addCommentScript would span hash slots. Writes the post hash, then
+// files its ID in the poster's index under indexKey, if any, and then
+// either holds it for review or files it in its thread under
+// threadKey, if any. The post is written before anything refers to
+// it, so a step that fails leaves a post that fsck files rather than
+// an index naming a missing post.
+func (db *DBClient) filePostRedis(id uint64, fields []string, pending bool, indexKey string, threadKey string) error {
+	idStr := strconv.FormatUint(id, REDIS_INT_BASE)
+	if pending {
+		fields = append(fields, "pending", "1")
+	}
+	err := db.redis.HMSet(GetRedisPostKey(id), fields[0], fields[1], fields[2:]...).Err()
+	if err != nil {
+		return err
+	}
+	if indexKey != "" {
+		if err = db.redis.LPush(indexKey, idStr).Err(); err != nil {
+			return err
+		}
+	}
+	if pending {
+		return db.redis.SAdd(PENDING_POOL_KEY, idStr).Err()
+	}
+	if threadKey != "" {
+		return db.redis.RPush(threadKey, idStr).Err()
+	}
+	return nil
+}
+
+// The exact location is only kept if the poster asked for it by
+// setting ExactLocation. The geo index only ever sees the fuzzed one.
+func fuzzBeacon(post *Beacon) {
+	if post.Precision == PrecisionExact {
+		post.ExactLocation = nil
+	}
+	post.Location = post.Location.Fuzz(post.Precision)
+}
+
+func beaconFieldsRedis(post *Beacon, t time.Time) []string {
 	locBytes, _ := post.Location.MarshalBinary()
-	locString := string(locBytes[:])
-	now := RedisFormatTime(time.Now())
-	err = db.redis.HMSet(key, "img", string(post.Image[:]),
+	fields := []string{"img", string(post.Image[:]),
 		"thumb", string(post.Thumbnail[:]),
-		"loc", locString,
+		"loc", string(locBytes[:]),
+		"prec", post.Precision.String(),
 		"poster", strconv.FormatUint(post.PosterID, REDIS_INT_BASE),
 		"desc", post.Description,
 		"hearts", strconv.FormatUint(uint64(post.Hearts), REDIS_INT_BASE),
 		"flags", strconv.FormatUint(uint64(post.Flags), REDIS_INT_BASE),
-		"time", now,
-		"type", "beacon").Err()
+		"time", RedisFormatTime(t),
+		"type", "beacon"}
+	if post.ExactLocation != nil {
+		exactBytes, _ := post.ExactLocation.MarshalBinary()
+		fields = append(fields, "exact-loc", string(exactBytes[:]))
+	}
+	return fields
+}
+
+func (db *DBClient) AddBeaconRedis(post *Beacon, userID uint64) (uint64, error) {
+	fuzzBeacon(post)
+	fields := beaconFieldsRedis(post, time.Now())
+	pending := "0"
+	if post.Pending {
+		// Held beacons stay out of the geo index until approved.
+		pending = "1"
+	}
+	postID, err := db.nextIDRedis(POST_COUNT_KEY)
 	if err != nil {
 		return 0, err
 	}
-	// db.redis.Expire(key, REDIS_EXPIRE)
-	err = db.redis.GeoAdd(GEOTAG_KEY, &redis.GeoLocation{
-		Name:      strconv.FormatUint(uint64(postID), REDIS_INT_BASE),
-		Latitude:  post.Location.Latitude,
-		Longitude: post.Location.Longitude,
-	}).Err()
+	if db.clustered() {
+		err = db.filePostRedis(postID, fields, post.Pending, GetRedisUserPostsKey(post.PosterID), "")
+		if err == nil && !post.Pending {
+			err = db.IndexBeaconRedis(postID, post.Location)
+		}
+	} else {
+		args := append([]string{strconv.FormatUint(postID, REDIS_INT_BASE), pending,
+			strconv.FormatFloat(post.Location.Latitude, 'f', -1, 64),
+			strconv.FormatFloat(post.Location.Longitude, 'f', -1, 64),
+			strconv.Itoa(len(fields) / 2)}, fields...)
+		keys := []string{GetRedisPostKey(postID), GetRedisUserPostsKey(post.PosterID), GEOTAG_KEY, PENDING_POOL_KEY}
+		err = db.redis.Eval(addBeaconScript, keys, args).Err()
+	}
 	if err != nil {
 		return 0, err
 	}
+	post.ID = postID
+	// db.redis.Expire(key, REDIS_EXPIRE)
 	return post.ID, nil
 }
 
+func (db *DBClient) IndexBeaconRedis(id uint64, loc Geotag) error {
+	return db.redis.GeoAdd(GEOTAG_KEY, &redis.GeoLocation{
+		Name:      strconv.FormatUint(id, REDIS_INT_BASE),
+		Latitude:  loc.Latitude,
+		Longitude: loc.Longitude,
+	}).Err()
+}
+
+func commentFieldsRedis(comment *Comment, t time.Time) []string {
+	return []string{"poster", strconv.FormatUint(comment.PosterID, REDIS_INT_BASE),
+		"parent", strconv.FormatUint(comment.BeaconID, REDIS_INT_BASE),
+		"text", comment.Text,
+		"hearts", strconv.FormatUint(uint64(comment.Hearts), REDIS_INT_BASE),
+		"flags", strconv.FormatUint(uint64(comment.Flags), REDIS_INT_BASE),
+		"time", RedisFormatTime(t),
+		"type", "comment"}
+}
+
 func (db *DBClient) AddCommentRedis(comment *Comment, userID uint64) error {
-	commentID, err := db.redis.Incr("post-count").Result()
-	if commentID < 0 {
-		return errors.New("Retrieved post count was negative.")
+	fields := commentFieldsRedis(comment, time.Now())
+	pending := "0"
+	if comment.Pending {
+		// Held comments stay out of the thread until approved.
+		pending = "1"
 	}
-	comment.ID = uint64(commentID)
+	commentID, err := db.nextIDRedis(POST_COUNT_KEY)
 	if err != nil {
 		return err
 	}
-	// beaconKey := GetRedisPostKey(comment.BeaconID)
-	IDKey := GetRedisCommentListKey(comment.BeaconID)
-	db.redis.RPush(IDKey, strconv.FormatUint(comment.ID, REDIS_INT_BASE))
-	commKey := GetRedisPostKey(comment.ID)
-	now := RedisFormatTime(time.Now())
-	db.redis.HMSet(commKey, "poster", strconv.FormatUint(comment.PosterID, REDIS_INT_BASE),
-		"parent", strconv.FormatUint(comment.BeaconID, REDIS_INT_BASE),
-		"text", comment.Text,
-		"hearts", strconv.FormatUint(uint64(comment.Hearts), REDIS_INT_BASE),
-		"flags", strconv.FormatUint(uint64(comment.Flags), REDIS_INT_BASE),
-		"time", now,
-		"type", "comment")
-	// db.redis.Expire(beaconKey, REDIS_EXPIRE)
-	// db.redis.Expire(IDKey, REDIS_EXPIRE)
-	// db.redis.Expire(commKey, REDIS_EXPIRE)
+	if db.clustered() {
+		err = db.filePostRedis(commentID, fields, comment.Pending, GetRedisUserCommentsKey(comment.PosterID),
+			GetRedisCommentListKey(comment.BeaconID))
+	} else {
+		args := append([]string{strconv.FormatUint(commentID, REDIS_INT_BASE), pending,
+			strconv.Itoa(len(fields) / 2)}, fields...)
+		keys := []string{GetRedisPostKey(commentID), GetRedisUserCommentsKey(comment.PosterID),
+			GetRedisCommentListKey(comment.BeaconID), PENDING_POOL_KEY}
+		err = db.redis.Eval(addCommentScript, keys, args).Err()
+	}
+	if err != nil {
+		return err
+	}
+	comment.ID = commentID
+	if !comment.Pending {
+		db.InvalidateThreadRedis(comment.BeaconID)
+	}
 	return nil
 }
 
-func (db *DBClient) HeartPostRedis(postID uint64, userID uint64) error {
-	poolKey := GetRedisUserHeartedKey(postID)
-	setMem := fmt.Sprintf("%d", userID)
-	res, err := db.redis.SIsMember(poolKey, setMem).Result()
-	if res || err != nil {
-		return errors.New("Post has already been hearted.")
+// Returns "beacon" or "comment", or ErrPostNotFound if there is no
+// post with the ID.
+func (db *DBClient) GetPostTypeRedis(id uint64) (string, error) {
+	postType, err := db.redis.HGet(GetRedisPostKey(id), "type").Result()
+	if err == redis.Nil {
+		return "", ErrPostNotFound
+	}
+	return postType, err
+}
+
+func (db *DBClient) GetHeartCountRedis(id uint64) (uint32, error) {
+	return RedisParseUInt32(db.redis.HGet(GetRedisPostKey(id), "hearts").Result())
+}
+
+// Adds or removes a user's heart or flag on a post. The member set
+// of the post, the post's count, the user's own list and the counters
+// of both the user and the poster all change together, and only if
+// the user's membership actually changed. Counters of users that no
+// longer exist are left alone rather than recreated. The poster's
+// counter is only touched if the post still names ARGV[7] as its
+// poster. Returns -1 if the post does not exist, else the number of
+// memberships changed.
+const reactScript = `
+local post = KEYS[1]
+local members = KEYS[2]
+local userList = KEYS[3]
+local user = KEYS[4]
+local poster = KEYS[5]
+local userID = ARGV[1]
+local postID = ARGV[2]
+local delta = tonumber(ARGV[3])
+if redis.call("EXISTS", post) == 0 then
+	return -1
+end
+local changed
+if delta > 0 then
+	changed = redis.call("SADD", members, userID)
+else
+	changed = redis.call("SREM", members, userID)
+end
+if changed == 0 then
+	return 0
+end
+redis.call("HINCRBY", post, ARGV[4], delta)
+if delta > 0 then
+	redis.call("SADD", userList, postID)
+else
+	redis.call("SREM", userList, postID)
+end
+if redis.call("EXISTS", user) == 1 then
+	redis.call("HINCRBY", user, ARGV[5], delta)
+end
+if redis.call("HGET", post, "poster") == ARGV[7] and redis.call("EXISTS", poster) == 1 then
+	redis.call("HINCRBY", poster, ARGV[6], delta)
+end
+return changed
+`
+
+func (db *DBClient) ReactRedis(postID uint64, userID uint64, membersKey string, listKey string,
+	delta int64, field string, subField string, recField string) error {
+	if db.clustered() {
+		return db.reactClusterRedis(postID, userID, membersKey, listKey, delta, field, subField, recField)
+	}
+	postKey := GetRedisPostKey(postID)
+	posterStr, err := db.redis.HGet(postKey, "poster").Result()
+	if err == redis.Nil {
+		return ErrPostNotFound
 	}
-	_, err = db.redis.SAdd(poolKey, setMem).Result()
 	if err != nil {
 		return err
 	}
-	key := GetRedisPostKey(postID)
-	_, err = db.redis.HIncrBy(key, "hearts", 1).Result()
+	poster, err := RedisParseUInt64(posterStr, nil)
 	if err != nil {
 		return err
 	}
-	// db.redis.Expire(key, REDIS_EXPIRE)
+	keys := []string{postKey, membersKey, listKey, GetRedisUserKey(userID), GetRedisUserKey(poster)}
+	args := []string{strconv.FormatUint(userID, REDIS_INT_BASE),
+		strconv.FormatUint(postID, REDIS_INT_BASE),
+		strconv.FormatInt(delta, REDIS_INT_BASE),
+		field, subField, recField, posterStr}
+	res, err := db.redis.Eval(reactScript, keys, args).Result()
+	if err != nil {
+		return err
+	}
+	changed, _ := res.(int64)
+	if changed < 0 {
+		return ErrPostNotFound
+	}
+	if changed > 0 {
+		db.InvalidateThreadRedis(postID)
+	}
 	return nil
 }
 
-func (db *DBClient) UnheartPostRedis(postID uint64, userID uint64) error {
-	poolKey := GetRedisUserHeartedKey(postID)
-	setMem := fmt.Sprintf("%d", userID)
-	res, err := db.redis.SIsMember(poolKey, setMem).Result()
-	if !res || err != nil {
-		return errors.New("Post has not been hearted by user.")
-	}
-	_, err = db.redis.SRem(poolKey, setMem).Result()
+// Adds or removes ARGV[1] in the member set KEYS[2] of the post
+// KEYS[1] and, if that changed anything, adds ARGV[2] to the post's
+// count ARGV[3]. Returns -1 if the post does not exist, else the number
+// of memberships changed and the poster the post names.
+const reactPostScript = `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return -1
+end
+local changed
+if tonumber(ARGV[2]) > 0 then
+	changed = redis.call("SADD", KEYS[2], ARGV[1])
+else
+	changed = redis.call("SREM", KEYS[2], ARGV[1])
+end
+if changed == 1 then
+	redis.call("HINCRBY", KEYS[1], ARGV[3], ARGV[2])
+end
+return {changed, redis.call("HGET", KEYS[1], "poster") or ""}
+`
+
+// Adds or removes the post ARGV[1] in the list KEYS[2] of the user
+// KEYS[1] and adds ARGV[2] to the user's counter ARGV[3]. Counters of
+// users that no longer exist are left alone rather than recreated.
+const reactUserScript = `
+if tonumber(ARGV[2]) > 0 then
+	redis.call("SADD", KEYS[2], ARGV[1])
+else
+	redis.call("SREM", KEYS[2], ARGV[1])
+end
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	redis.call("HINCRBY", KEYS[1], ARGV[3], ARGV[2])
+end
+return 1
+`
+
+// Adds ARGV[2] to the counter ARGV[1] of the user KEYS[1], unless they
+// no longer exist.
+const incrUserScript = `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HINCRBY", KEYS[1], ARGV[1], ARGV[2])
+return 1
+`
+
+// Reacts to a post in a cluster, where reactScript would span hash
+// slots. The member set of the post and the post's count change
+// together, and only if the user's membership actually changed. The
+// user's own list and counter and then the poster's counter follow,
+// each in its own hash slot. The poster is the one the post named when
+// the membership changed.
+func (db *DBClient) reactClusterRedis(postID uint64, userID uint64, membersKey string, listKey string,
+	delta int64, field string, subField string, recField string) error {
+	userStr := strconv.FormatUint(userID, REDIS_INT_BASE)
+	postStr := strconv.FormatUint(postID, REDIS_INT_BASE)
+	deltaStr := strconv.FormatInt(delta, REDIS_INT_BASE)
+	res, err := db.redis.Eval(reactPostScript, []string{GetRedisPostKey(postID), membersKey},
+		[]string{userStr, deltaStr, field}).Result()
 	if err != nil {
 		return err
 	}
-	key := GetRedisPostKey(postID)
-	_, err = db.redis.HIncrBy(key, "hearts", -1).Result()
+	vals, ok := res.([]interface{})
+	if !ok {
+		return ErrPostNotFound
+	}
+	if len(vals) != 2 {
+		return errors.New("Unexpected response from react script.")
+	}
+	if changed, _ := vals[0].(int64); changed == 0 {
+		return nil
+	}
+	err = db.redis.Eval(reactUserScript, []string{GetRedisUserKey(userID), listKey},
+		[]string{postStr, deltaStr, subField}).Err()
 	if err != nil {
 		return err
 	}
-	// db.redis.Expire(key, REDIS_EXPIRE)
+	if posterStr, _ := vals[1].(string); posterStr != "" {
+		poster, err := RedisParseUInt64(posterStr, nil)
+		if err != nil {
+			return err
+		}
+		err = db.redis.Eval(incrUserScript, []string{GetRedisUserKey(poster)},
+			[]string{recField, deltaStr}).Err()
+		if err != nil {
+			return err
+		}
+	}
+	db.InvalidateThreadRedis(postID)
 	return nil
+}
+
+// Hearting a post the user has already hearted changes nothing.
+func (db *DBClient) HeartPostRedis(postID uint64, userID uint64) error {
+	return db.ReactRedis(postID, userID, GetRedisUserHeartedKey(postID), GetRedisUserHeartListKey(userID),
+		1, "hearts", "hearts-sub", "hearts-rec")
+}
 
+// Unhearting a post the user has not hearted changes nothing.
+func (db *DBClient) UnheartPostRedis(postID uint64, userID uint64) error {
+	return db.ReactRedis(postID, userID, GetRedisUserHeartedKey(postID), GetRedisUserHeartListKey(userID),
+		-1, "hearts", "hearts-sub", "hearts-rec")
 }
 
+// Flagging a post the user has already flagged changes nothing.
 func (db *DBClient) FlagPostRedis(postID uint64, userID uint64) error {
-	poolKey := GetRedisUserFlaggedKey(postID)
-	setMem := fmt.Sprintf("%d", userID)
-	res, err := db.redis.SIsMember(poolKey, setMem).Result()
-	if res || err != nil {
-		return errors.New("Post has already been flagged.")
-	}
-	_, err = db.redis.SAdd(poolKey, setMem).Result()
+	return db.ReactRedis(postID, userID, GetRedisUserFlaggedKey(postID), GetRedisUserFlagListKey(userID),
+		1, "flags", "flags-sub", "flags-rec")
+}
+
+// Creates the user hash KEYS[1] for user ARGV[1] and reserves their
+// username and email. Returns -1 if the username is taken and -2 if
+// the email is.
+const addUserScript = `
+if redis.call("SISMEMBER", KEYS[2], ARGV[2]) == 1 then
+	return -1
+end
+if redis.call("EXISTS", KEYS[3]) == 1 then
+	return -2
+end
+local id = ARGV[1]
+local fieldCount = tonumber(ARGV[3])
+redis.call("HMSET", KEYS[1], "id", id, unpack(ARGV, 4, 3 + 2 * fieldCount))
+redis.call("SADD", KEYS[2], ARGV[2])
+redis.call("SET", KEYS[3], id)
+return 1
+`
+
+// Files a new user in a cluster, where addUserScript would span hash
+// slots. Reserves their username and email, then writes their hash,
+// each in its own step. Returns ErrUsernameTaken or ErrEmailTaken,
+// releasing whatever was already reserved.
+func (db *DBClient) fileClusterUserRedis(id uint64, username string, email string, fields []string) error {
+	usernameKey := UsernameKey(username)
+	added, err := db.redis.SAdd(USERNAME_POOL_KEY, usernameKey).Result()
 	if err != nil {
 		return err
 	}
-	key := GetRedisPostKey(postID)
-	_, err = db.redis.HIncrBy(key, "flags", 1).Result()
+	if added == 0 {
+		return ErrUsernameTaken
+	}
+	idStr := strconv.FormatUint(id, REDIS_INT_BASE)
+	emailKey := GetRedisUserEmailKey(email)
+	reserved, err := db.redis.SetNX(emailKey, idStr, 0).Result()
+	if err == nil && !reserved {
+		err = ErrEmailTaken
+	}
+	if err == nil {
+		err = db.redis.HMSet(GetRedisUserKey(id), "id", idStr,
+			append([]string{"username", username}, fields...)...).Err()
+		if err != nil {
+			db.redis.Del(emailKey)
+		}
+	}
+	if err != nil {
+		db.redis.SRem(USERNAME_POOL_KEY, usernameKey)
+	}
+	return err
+}
+
+func (db *DBClient) fileUserRedis(id uint64, username string, email string, fields []string) error {
+	args := append([]string{strconv.FormatUint(id, REDIS_INT_BASE), UsernameKey(username),
+		strconv.Itoa(len(fields)/2 + 1), "username", username}, fields...)
+	keys := []string{GetRedisUserKey(id), USERNAME_POOL_KEY, GetRedisUserEmailKey(email)}
+	res, err := db.redis.Eval(addUserScript, keys, args).Result()
 	if err != nil {
 		return err
 	}
-	// db.redis.Expire(key, REDIS_EXPIRE)
+	switch status, _ := res.(int64); status {
+	case -1:
+		return ErrUsernameTaken
+	case -2:
+		return ErrEmailTaken
+	}
 	return nil
 }
 
 func (db *DBClient) CreateUserRedis(username string, authkey []byte, email string) (uint64, error) {
-	if res, err := db.redis.SIsMember(USERNAME_POOL_KEY, username).Result(); res || err != nil {
-		return 0, errors.New("Username already exists.")
-	}
 	return db.AddUserRedis(username, authkey, email)
 }
 
 func (db *DBClient) AddUserRedis(username string, authkey []byte, email string) (uint64, error) {
-	userIDSigned, err := db.redis.Incr(USER_COUNT_KEY).Result()
-	userID := uint64(userIDSigned)
+	now := RedisFormatTime(time.Now())
+	fields := []string{"created", now,
+		"flags-rec", "0",
+		"flags-sub", "0",
+		"hearts-rec", "0",
+		"hearts-sub", "0",
+		"auth", string(authkey),
+		"email", email}
+	userID, err := db.nextIDRedis(USER_COUNT_KEY)
 	if err != nil {
-		return 0, errors.New("Could not get number of users in db.")
+		return 0, fmt.Errorf("Could not get number of users in db. %w", err)
 	}
-	if db.SetUserRedis(userID, username, authkey, email) != nil {
-		return 0, errors.New("Could not add user to db.")
+	if db.clustered() {
+		err = db.fileClusterUserRedis(userID, username, email, fields)
+	} else {
+		err = db.fileUserRedis(userID, username, email, fields)
 	}
-	if db.redis.SAdd(USERNAME_POOL_KEY, username).Err() != nil {
-		return 0, errors.New("Could not reserve username.")
+	if err == ErrUsernameTaken || err == ErrEmailTaken {
+		return 0, err
 	}
-	if db.redis.Set(GetRedisUserEmailKey(email), userID, 0).Err() != nil {
-		return 0, errors.New("Could not add email to pool.")
+	if err != nil {
+		return 0, fmt.Errorf("Could not add user to db. %w", err)
 	}
 	return userID, nil
 }
@@ -381,7 +913,7 @@ func (db *DBClient) UserExistsRedis(userid uint64) (bool, error) {
 }
 
 func (db *DBClient) UsernameExistsRedis(username string) (bool, error) {
-	res, err := db.redis.SIsMember(USERNAME_POOL_KEY, username).Result()
+	res, err := db.redis.SIsMember(USERNAME_POOL_KEY, UsernameKey(username)).Result()
 	if err != nil {
 		return false, err
 	}
@@ -417,9 +949,40 @@ func (db *DBClient) UserAuthenticatedRedis(userid uint64, authkey []byte) (bool,
 }
 
 func (db *DBClient) GetUsernameRedis(userid uint64) (string, error) {
+	if userid == DeletedUserID {
+		return DeletedUsername, nil
+	}
 	return db.redis.HGet(GetRedisUserKey(userid), "username").Result()
 }
 
+// Looks up the usernames of many users in one round trip.
+func (db *DBClient) GetUsernamesRedis(userIDs []uint64) (map[uint64]string, error) {
+	usernames := map[uint64]string{}
+	pipe := db.redis.Pipeline()
+	defer pipe.Close()
+	cmds := map[uint64]*redis.StringCmd{}
+	for _, userID := range userIDs {
+		if userID == DeletedUserID {
+			usernames[userID] = DeletedUsername
+		} else if _, ok := cmds[userID]; !ok {
+			cmds[userID] = pipe.HGet(GetRedisUserKey(userID), "username")
+		}
+	}
+	if len(cmds) == 0 {
+		return usernames, nil
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return usernames, err
+	}
+	for userID, cmd := range cmds {
+		if cmd.Err() != nil {
+			return usernames, errors.New("User not found in db.")
+		}
+		usernames[userID] = cmd.Val()
+	}
+	return usernames, nil
+}
+
 func (db *DBClient) SetUserAuthKeyRedis(userid uint64, authkey []byte) error {
 	return db.redis.HSet(GetRedisUserKey(userid), "auth", string(authkey)).Err()
 }
@@ -430,12 +993,78 @@ func (db *DBClient) HasHeartedRedis(postid uint64, userid uint64) (bool, error)
 	return db.redis.SIsMember(postKey, userElem).Result()
 }
 
+// Checks which of many posts a user has hearted in one round trip.
+func (db *DBClient) HasHeartedPostsRedis(postIDs []uint64, userid uint64) (map[uint64]bool, error) {
+	hearted := map[uint64]bool{}
+	if len(postIDs) == 0 {
+		return hearted, nil
+	}
+	pipe := db.redis.Pipeline()
+	defer pipe.Close()
+	userElem := strconv.FormatUint(userid, REDIS_INT_BASE)
+	cmds := make([]*redis.BoolCmd, len(postIDs))
+	for i, postID := range postIDs {
+		cmds[i] = pipe.SIsMember(GetRedisUserHeartedKey(postID), userElem)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return hearted, err
+	}
+	for i, postID := range postIDs {
+		hearted[postID] = cmds[i].Val()
+	}
+	return hearted, nil
+}
+
 func (db *DBClient) FlushRedis() error {
-	return db.redis.FlushDb().Err()
+	return db.redis.forEachNode(func(node *redis.Client) error {
+		return node.FlushDb().Err()
+	})
+}
+
+// Users seen in each hour are kept in a HyperLogLog, so counting them
+// takes constant space at the cost of about 1% error.
+const ACTIVE_USERS_WINDOW = 24
+
+func GetRedisActiveUsersKey(hour int64) string {
+	// Tagged alike so that a count over several hours reads one slot.
+	return fmt.Sprintf("{active}:%d", hour)
+}
+
+func (db *DBClient) MarkActiveRedis(userID uint64, now time.Time) error {
+	key := GetRedisActiveUsersKey(now.Unix() / 3600)
+	pipe := db.redis.Pipeline()
+	defer pipe.Close()
+	pipe.PFAdd(key, strconv.FormatUint(userID, REDIS_INT_BASE))
+	pipe.Expire(key, (ACTIVE_USERS_WINDOW+1)*time.Hour)
+	_, err := pipe.Exec()
+	return err
+}
+
+// Counts the users marked active in the last ACTIVE_USERS_WINDOW
+// hours.
+func (db *DBClient) CountActiveUsersRedis(now time.Time) (uint64, error) {
+	hour := now.Unix() / 3600
+	keys := make([]string, ACTIVE_USERS_WINDOW)
+	for i := range keys {
+		keys[i] = GetRedisActiveUsersKey(hour - int64(i))
+	}
+	count, err := db.redis.PFCount(keys...).Result()
+	return uint64(count), err
 }
 
+// Reconnects to TESTING_REDIS_DB. A SELECT would only move whichever
+// pooled connection it happened to run on.
 func (db *DBClient) SelectTestingTableRedis() error {
-	return db.redis.Select(11).Err()
+	config := db.redisConfig
+	config.DB = TESTING_REDIS_DB
+	client, err := config.NewClient()
+	if err != nil {
+		return err
+	}
+	db.redis.Close()
+	db.redis = client
+	db.redisConfig = config
+	return nil
 }
 
 func (db *DBClient) GetLocalRedis(loc Geotag, radius float64) ([]Beacon, error) {
@@ -483,3 +1112,949 @@ func (db *DBClient) GetCommentCountRedis(postID uint64) (uint64, error) {
 	}
 	return uint64(count), nil
 }
+
+// Token bucket refill and take, done in one round trip so that
+// concurrent requests on several nodes can't overdraw a bucket.
+// Returns {allowed, milliseconds until the next token}.
+const takeTokenScript = `
+local capacity = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+local refill = math.floor((now - ts) / interval)
+if refill > 0 then
+	tokens = math.min(capacity, tokens + refill)
+	ts = ts + refill * interval
+end
+if tokens >= capacity then
+	ts = now
+end
+local allowed = 0
+local wait = 0
+if tokens > 0 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = interval - (now - ts)
+end
+redis.call("HMSET", KEYS[1], "tokens", tokens, "ts", ts)
+redis.call("PEXPIRE", KEYS[1], capacity * interval)
+return {allowed, wait}
+`
+
+func (db *DBClient) TakeTokenRedis(bucket string, capacity int, interval time.Duration) (bool, time.Duration, error) {
+	intervalMs := int64(interval / time.Millisecond)
+	if capacity <= 0 || intervalMs <= 0 {
+		return true, 0, nil
+	}
+	nowMs := time.Now().UnixNano() / int64(time.Millisecond)
+	res, err := db.redis.Eval(takeTokenScript, []string{GetRedisRateLimitKey(bucket)},
+		[]string{strconv.Itoa(capacity),
+			strconv.FormatInt(intervalMs, REDIS_INT_BASE),
+			strconv.FormatInt(nowMs, REDIS_INT_BASE)}).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) != 2 {
+		return false, 0, errors.New("Unexpected response from rate limit script.")
+	}
+	allowed, _ := vals[0].(int64)
+	waitMs, _ := vals[1].(int64)
+	return allowed == 1, time.Duration(waitMs) * time.Millisecond, nil
+}
+
+func (db *DBClient) IsAdminRedis(userID uint64) (bool, error) {
+	return db.redis.SIsMember(ADMIN_POOL_KEY, strconv.FormatUint(userID, REDIS_INT_BASE)).Result()
+}
+
+func (db *DBClient) SetAdminRedis(userID uint64, admin bool) error {
+	member := strconv.FormatUint(userID, REDIS_INT_BASE)
+	if admin {
+		return db.redis.SAdd(ADMIN_POOL_KEY, member).Err()
+	}
+	return db.redis.SRem(ADMIN_POOL_KEY, member).Err()
+}
+
+func (db *DBClient) GetPendingRedis() ([]uint64, error) {
+	members, err := db.redis.SMembers(PENDING_POOL_KEY).Result()
+	if err != nil {
+		return []uint64{}, err
+	}
+	ids := []uint64{}
+	for _, member := range members {
+		id, err := RedisParseUInt64(member, nil)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (db *DBClient) ApproveBeaconRedis(id uint64) error {
+	key := GetRedisPostKey(id)
+	res, err := db.redis.HMGet(key, "type", "pending", "parent").Result()
+	if err != nil {
+		return err
+	}
+	postType, _ := res[0].(string)
+	if postType == "" {
+		return ErrPostNotFound
+	}
+	if res[1] == nil {
+		return errors.New("Post is not awaiting review.")
+	}
+	if postType == "beacon" {
+		post, err := db.GetBeaconRedis(id)
+		if err != nil {
+			return err
+		}
+		err = db.IndexBeaconRedis(id, post.Location)
+		if err != nil {
+			return err
+		}
+	} else {
+		parentStr, _ := res[2].(string)
+		parent, err := RedisParseUInt64(parentStr, nil)
+		if err != nil {
+			return err
+		}
+		err = db.redis.RPush(GetRedisCommentListKey(parent), strconv.FormatUint(id, REDIS_INT_BASE)).Err()
+		if err != nil {
+			return err
+		}
+	}
+	err = db.redis.HDel(key, "pending").Err()
+	if err != nil {
+		return err
+	}
+	db.InvalidateThreadRedis(id)
+	return db.redis.SRem(PENDING_POOL_KEY, strconv.FormatUint(id, REDIS_INT_BASE)).Err()
+}
+
+func (db *DBClient) RejectBeaconRedis(id uint64) error {
+	key := GetRedisPostKey(id)
+	res, err := db.redis.HMGet(key, "type", "pending", "poster").Result()
+	if err != nil {
+		return err
+	}
+	if res[1] == nil {
+		return errors.New("Post is not awaiting review.")
+	}
+	posterStr, _ := res[2].(string)
+	poster, err := RedisParseUInt64(posterStr, nil)
+	if err != nil {
+		return err
+	}
+	indexKey := GetRedisUserCommentsKey(poster)
+	if postType, _ := res[0].(string); postType == "beacon" {
+		indexKey = GetRedisUserPostsKey(poster)
+	}
+	err = db.redis.LRem(indexKey, 0, strconv.FormatUint(id, REDIS_INT_BASE)).Err()
+	if err != nil {
+		return err
+	}
+	err = db.redis.Del(key, GetRedisCommentListKey(id)).Err()
+	if err != nil {
+		return err
+	}
+	db.InvalidateThreadRedis(id)
+	return db.redis.SRem(PENDING_POOL_KEY, strconv.FormatUint(id, REDIS_INT_BASE)).Err()
+}
+
+func RedisFormatPolygon(poly []Geotag) string {
+	buf := []byte{}
+	for _, vertex := range poly {
+		vertexBytes, _ := vertex.MarshalBinary()
+		buf = append(buf, vertexBytes...)
+	}
+	return string(buf)
+}
+
+func RedisParsePolygon(res string, err error) ([]Geotag, error) {
+	if err != nil {
+		return []Geotag{}, err
+	}
+	const vertexSize = 16
+	if len(res)%vertexSize != 0 {
+		return []Geotag{}, errors.New("Stored polygon was malformed.")
+	}
+	poly := []Geotag{}
+	for i := 0; i < len(res); i += vertexSize {
+		var vertex Geotag
+		err = vertex.UnmarshalBinary([]byte(res[i : i+vertexSize]))
+		if err != nil {
+			return []Geotag{}, err
+		}
+		poly = append(poly, vertex)
+	}
+	return poly, nil
+}
+
+func (db *DBClient) AddZoneRedis(zone *Zone) (uint64, error) {
+	zoneID, err := db.redis.Incr(ZONE_COUNT_KEY).Result()
+	if err != nil {
+		return 0, err
+	}
+	zone.ID = uint64(zoneID)
+	err = db.SetZoneRedis(zone)
+	if err != nil {
+		return 0, err
+	}
+	return zone.ID, nil
+}
+
+func (db *DBClient) SetZoneRedis(zone *Zone) error {
+	key := GetRedisZoneKey(zone.ID)
+	centerBytes, _ := zone.Center.MarshalBinary()
+	err := db.redis.HMSet(key, "name", zone.Name,
+		"rule", zone.Rule.String(),
+		"center", string(centerBytes[:]),
+		"radius", strconv.FormatFloat(zone.Radius, 'f', -1, 64),
+		"poly", RedisFormatPolygon(zone.Polygon)).Err()
+	if err != nil {
+		return err
+	}
+	return db.redis.SAdd(ZONE_POOL_KEY, strconv.FormatUint(zone.ID, REDIS_INT_BASE)).Err()
+}
+
+func (db *DBClient) ZoneExistsRedis(id uint64) (bool, error) {
+	return db.redis.Exists(GetRedisZoneKey(id)).Result()
+}
+
+func (db *DBClient) GetZoneRedis(id uint64) (Zone, error) {
+	res, err := db.redis.HGetAllMap(GetRedisZoneKey(id)).Result()
+	if err != nil {
+		return Zone{}, err
+	}
+	if len(res) == 0 {
+		return Zone{}, errors.New("Zone not found in db.")
+	}
+	var center Geotag
+	err = RedisParseBinary(res["center"], &center, err)
+	radius, err := RedisParseFloat64(res["radius"], err)
+	poly, err := RedisParsePolygon(res["poly"], err)
+	if err != nil {
+		return Zone{}, err
+	}
+	rule, err := ParseZoneRule(res["rule"])
+	if err != nil {
+		return Zone{}, err
+	}
+	zone := Zone{
+		ID:      id,
+		Name:    res["name"],
+		Rule:    rule,
+		Center:  center,
+		Radius:  radius,
+		Polygon: poly,
+	}
+	return zone, nil
+}
+
+func (db *DBClient) GetZonesRedis() ([]Zone, error) {
+	members, err := db.redis.SMembers(ZONE_POOL_KEY).Result()
+	if err != nil {
+		return []Zone{}, err
+	}
+	zones := []Zone{}
+	for _, member := range members {
+		id, err := RedisParseUInt64(member, nil)
+		if err != nil {
+			return zones, err
+		}
+		zone, err := db.GetZoneRedis(id)
+		if err != nil {
+			return zones, err
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+func (db *DBClient) DeleteZoneRedis(id uint64) error {
+	err := db.redis.SRem(ZONE_POOL_KEY, strconv.FormatUint(id, REDIS_INT_BASE)).Err()
+	if err != nil {
+		return err
+	}
+	return db.redis.Del(GetRedisZoneKey(id)).Err()
+}
+
+// The last device fix is only kept long enough to judge how fast a
+// user could have travelled between posts.
+func (db *DBClient) SetLastFixRedis(userID uint64, fix Geotag, t time.Time) error {
+	key := GetRedisUserFixKey(userID)
+	fixBytes, _ := fix.MarshalBinary()
+	err := db.redis.HMSet(key, "loc", string(fixBytes[:]),
+		"time", RedisFormatTime(t)).Err()
+	if err != nil {
+		return err
+	}
+	return db.redis.Expire(key, db.redisConfig.LastFixExpiry).Err()
+}
+
+func (db *DBClient) GetLastFixRedis(userID uint64) (Geotag, time.Time, bool, error) {
+	res, err := db.redis.HGetAllMap(GetRedisUserFixKey(userID)).Result()
+	if err != nil {
+		return Geotag{}, time.Time{}, false, err
+	}
+	if len(res) == 0 {
+		return Geotag{}, time.Time{}, false, nil
+	}
+	var fix Geotag
+	err = RedisParseBinary(res["loc"], &fix, err)
+	fixTime, err := RedisParseTime(res["time"], err)
+	if err != nil {
+		return Geotag{}, time.Time{}, false, err
+	}
+	return fix, fixTime, true, nil
+}
+
+func (db *DBClient) GetUserRedis(userID uint64) (User, error) {
+	res, err := db.redis.HGetAllMap(GetRedisUserKey(userID)).Result()
+	if err != nil {
+		return User{}, err
+	}
+	if len(res) == 0 {
+		return User{}, errors.New("User not found in db.")
+	}
+	created, err := RedisParseTime(res["created"], err)
+	flagsRec, err := RedisParseUInt32(res["flags-rec"], err)
+	heartsRec, err := RedisParseUInt32(res["hearts-rec"], err)
+	flagsSub, err := RedisParseUInt32(res["flags-sub"], err)
+	heartsSub, err := RedisParseUInt32(res["hearts-sub"], err)
+	if err != nil {
+		return User{}, err
+	}
+	user := User{
+		ID:              userID,
+		Username:        res["username"],
+		AccountCreated:  created,
+		FlagsReceived:   flagsRec,
+		HeartsReceived:  heartsRec,
+		FlagsSubmitted:  flagsSub,
+		HeartsSubmitted: heartsSub,
+		AuthKey:         []byte(res["auth"]),
+		Email:           res["email"],
+	}
+	return user, nil
+}
+
+func (db *DBClient) GetUserPostCountRedis(userID uint64) (uint64, error) {
+	count, err := db.redis.LLen(GetRedisUserPostsKey(userID)).Result()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(count), nil
+}
+
+// Returns the user along with up to count of their beacons, newest
+// first, skipping the first offset, and how many there are. Beacons
+// held for review are left out unless withPending is set, and so are
+// posts the index names that no longer exist. Telling which those are
+// reads every post in the index, in one round trip.
+func (db *DBClient) GetUserProfileRedis(userID uint64, offset uint64, count uint64, withPending bool) (UserProfile, error) {
+	user, err := db.GetUserRedis(userID)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	profile := UserProfile{User: user, Beacons: []Beacon{}}
+	ids, err := db.GetUserPostIDsRedis(GetRedisUserPostsKey(userID))
+	if err != nil || len(ids) == 0 {
+		return profile, err
+	}
+	pipe := db.redis.Pipeline()
+	defer pipe.Close()
+	cmds := make([]*redis.SliceCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HMGet(GetRedisPostKey(id), "type", "pending")
+	}
+	if _, err = pipe.Exec(); err != nil {
+		return UserProfile{}, err
+	}
+	shown := []uint64{}
+	for i, id := range ids {
+		fields := cmds[i].Val()
+		if len(fields) != 2 || fields[0] == nil || (fields[1] != nil && !withPending) {
+			continue
+		}
+		shown = append(shown, id)
+	}
+	profile.BeaconCount = uint64(len(shown))
+	for i := offset; i < uint64(len(shown)) && i < offset+count; i++ {
+		post, err := db.GetBeaconRedis(shown[i])
+		if err == ErrPostNotFound {
+			continue
+		}
+		if err != nil {
+			return UserProfile{}, err
+		}
+		profile.Beacons = append(profile.Beacons, post)
+	}
+	return profile, nil
+}
+
+// Swaps a user's reserved username for a new one. Returns 0 on
+// success, -1 if the user is gone, -2 if their username changed since
+// it was read, -3 if the new name is taken or else the number of
+// seconds left before the user may change their name again.
+const renameScript = `
+local user = KEYS[1]
+local pool = KEYS[2]
+local oldName = ARGV[1]
+local oldKey = ARGV[2]
+local newName = ARGV[3]
+local newKey = ARGV[4]
+local now = tonumber(ARGV[5])
+local cooldown = tonumber(ARGV[6])
+local current = redis.call("HGET", user, "username")
+if not current then
+	return -1
+end
+if current ~= oldName then
+	return -2
+end
+local renamed = tonumber(redis.call("HGET", user, "renamed"))
+if renamed and renamed + cooldown > now then
+	return renamed + cooldown - now
+end
+if newKey ~= oldKey then
+	if redis.call("SISMEMBER", pool, newKey) == 1 then
+		return -3
+	end
+	redis.call("SREM", pool, oldKey, oldName)
+	redis.call("SADD", pool, newKey)
+end
+redis.call("HMSET", user, "username", newName, "renamed", now)
+return 0
+`
+
+// Changes a user's username, releasing the old one. If the user
+// renamed themselves less than cooldown ago, returns
+// ErrUsernameCooldown along with how long they still have to wait.
+func (db *DBClient) ChangeUsernameRedis(userID uint64, username string, cooldown time.Duration) (time.Duration, error) {
+	userKey := GetRedisUserKey(userID)
+	oldName, err := db.redis.HGet(userKey, "username").Result()
+	if err == redis.Nil {
+		return 0, errors.New("User not found in db.")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if db.clustered() {
+		return db.changeClusterUsernameRedis(userKey, oldName, username, cooldown)
+	}
+	res, err := db.redis.Eval(renameScript, []string{userKey, USERNAME_POOL_KEY},
+		[]string{oldName, UsernameKey(oldName), username, UsernameKey(username),
+			RedisFormatTime(time.Now()),
+			strconv.FormatInt(int64(cooldown/time.Second), REDIS_INT_BASE)}).Result()
+	if err != nil {
+		return 0, err
+	}
+	status, _ := res.(int64)
+	switch {
+	case status == 0:
+		return 0, nil
+	case status == -1:
+		return 0, errors.New("User not found in db.")
+	case status == -2:
+		return 0, errors.New("Username was changed by another request.")
+	case status == -3:
+		return 0, ErrUsernameTaken
+	}
+	return time.Duration(status) * time.Second, ErrUsernameCooldown
+}
+
+// Renames the user KEYS[1] from ARGV[1] to ARGV[2], leaving the
+// username pool to the caller. Returns 0 on success, -1 if the user is gone, -2 if their username changed since
+// it was read or else the number of seconds left before the user may
+// change their name again.
+const renameUserScript = `
+local oldName = ARGV[1]
+local newName = ARGV[2]
+local now = tonumber(ARGV[3])
+local cooldown = tonumber(ARGV[4])
+local current = redis.call("HGET", KEYS[1], "username")
+if not current then
+	return -1
+end
+if current ~= oldName then
+	return -2
+end
+local renamed = tonumber(redis.call("HGET", KEYS[1], "renamed"))
+if renamed and renamed + cooldown > now then
+	return renamed + cooldown - now
+end
+redis.call("HMSET", KEYS[1], "username", newName, "renamed", now)
+return 0
+`
+
+// Renames a user in a cluster, where renameScript would span hash
+// slots. The new name is reserved before the user is renamed and the
+// old one released after, each in its own step.
+func (db *DBClient) changeClusterUsernameRedis(userKey string, oldName string, username string,
+	cooldown time.Duration) (time.Duration, error) {
+	oldKey, newKey := UsernameKey(oldName), UsernameKey(username)
+	if newKey != oldKey {
+		added, err := db.redis.SAdd(USERNAME_POOL_KEY, newKey).Result()
+		if err != nil {
+			return 0, err
+		}
+		if added == 0 {
+			return 0, ErrUsernameTaken
+		}
+	}
+	res, err := db.redis.Eval(renameUserScript, []string{userKey},
+		[]string{oldName, username, RedisFormatTime(time.Now()),
+			strconv.FormatInt(int64(cooldown/time.Second), REDIS_INT_BASE)}).Result()
+	status, _ := res.(int64)
+	if err != nil || status != 0 {
+		if newKey != oldKey {
+			db.redis.SRem(USERNAME_POOL_KEY, newKey)
+		}
+	}
+	switch {
+	case err != nil:
+		return 0, err
+	case status == -1:
+		return 0, errors.New("User not found in db.")
+	case status == -2:
+		return 0, errors.New("Username was changed by another request.")
+	case status > 0:
+		return time.Duration(status) * time.Second, ErrUsernameCooldown
+	}
+	if newKey != oldKey {
+		return 0, db.redis.SRem(USERNAME_POOL_KEY, oldKey, oldName).Err()
+	}
+	return 0, nil
+}
+
+func (db *DBClient) GetUserPostIDsRedis(key string) ([]uint64, error) {
+	strList, err := db.redis.LRange(key, 0, -1).Result()
+	if err != nil {
+		return []uint64{}, err
+	}
+	ids := []uint64{}
+	for _, str := range strList {
+		id, err := RedisParseUInt64(str, nil)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Removes a comment from its thread and from its poster's index.
+func (db *DBClient) DeleteCommentRedis(id uint64) error {
+	key := GetRedisPostKey(id)
+	res, err := db.redis.HMGet(key, "poster", "parent").Result()
+	if err != nil {
+		return err
+	}
+	idStr := strconv.FormatUint(id, REDIS_INT_BASE)
+	thread := id
+	if posterStr, ok := res[0].(string); ok {
+		poster, err := RedisParseUInt64(posterStr, nil)
+		if err != nil {
+			return err
+		}
+		err = db.redis.LRem(GetRedisUserCommentsKey(poster), 0, idStr).Err()
+		if err != nil {
+			return err
+		}
+	}
+	if parentStr, ok := res[1].(string); ok {
+		parent, err := RedisParseUInt64(parentStr, nil)
+		if err != nil {
+			return err
+		}
+		err = db.redis.LRem(GetRedisCommentListKey(parent), 0, idStr).Err()
+		if err != nil {
+			return err
+		}
+		thread = parent
+	}
+	err = db.redis.SRem(PENDING_POOL_KEY, idStr).Err()
+	if err != nil {
+		return err
+	}
+	err = db.redis.Del(key, GetRedisUserHeartedKey(id), GetRedisUserFlaggedKey(id)).Err()
+	if err != nil {
+		return err
+	}
+	db.InvalidateThreadRedis(thread)
+	return nil
+}
+
+// Removes a beacon along with every comment on it.
+func (db *DBClient) DeleteBeaconRedis(id uint64) error {
+	comments, err := db.GetCommentListRedis(id)
+	if err != nil {
+		return err
+	}
+	for _, commentID := range comments {
+		if err = db.DeleteCommentRedis(commentID); err != nil {
+			return err
+		}
+	}
+	key := GetRedisPostKey(id)
+	idStr := strconv.FormatUint(id, REDIS_INT_BASE)
+	posterStr, err := db.redis.HGet(key, "poster").Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if err == nil {
+		poster, err := RedisParseUInt64(posterStr, nil)
+		if err != nil {
+			return err
+		}
+		err = db.redis.LRem(GetRedisUserPostsKey(poster), 0, idStr).Err()
+		if err != nil {
+			return err
+		}
+	}
+	err = db.redis.ZRem(GEOTAG_KEY, idStr).Err()
+	if err != nil {
+		return err
+	}
+	err = db.redis.SRem(PENDING_POOL_KEY, idStr).Err()
+	if err != nil {
+		return err
+	}
+	err = db.redis.Del(key, GetRedisCommentListKey(id),
+		GetRedisUserHeartedKey(id), GetRedisUserFlaggedKey(id)).Err()
+	if err != nil {
+		return err
+	}
+	db.InvalidateThreadRedis(id)
+	return nil
+}
+
+// Detaches a post from its poster. Anything that could identify them,
+// such as an exact location, goes with it.
+func (db *DBClient) AnonymizePostRedis(id uint64) error {
+	key := GetRedisPostKey(id)
+	exists, err := db.redis.Exists(key).Result()
+	if err != nil || !exists {
+		return err
+	}
+	err = db.redis.HSet(key, "poster", strconv.FormatUint(DeletedUserID, REDIS_INT_BASE)).Err()
+	if err != nil {
+		return err
+	}
+	err = db.redis.HDel(key, "exact-loc").Err()
+	if err != nil {
+		return err
+	}
+	db.InvalidateThreadRedis(id)
+	return nil
+}
+
+// Takes back the reactions in a user's list at listKey, so that the
+// posts and their posters stop counting them. Each is taken back on its
+// own, and posts already gone are only dropped from the list. Returns
+// how many were left on failure.
+func (db *DBClient) takeBackReactionsRedis(userID uint64, listKey string, membersKey func(uint64) string,
+	field string, subField string, recField string) (int, error) {
+	ids, err := db.GetUserPostSetRedis(listKey)
+	if err != nil {
+		return 0, err
+	}
+	for i, id := range ids {
+		err = db.ReactRedis(id, userID, membersKey(id), listKey, -1, field, subField, recField)
+		if err == ErrPostNotFound {
+			err = db.redis.SRem(listKey, strconv.FormatUint(id, REDIS_INT_BASE)).Err()
+		}
+		if err != nil {
+			return len(ids) - i, err
+		}
+	}
+	return 0, nil
+}
+
+// Removes a user's account, releasing their username and email, and
+// anonymizes or deletes their posts according to policy. Their hearts
+// and flags are taken back first.
+//
+// The steps are not one transaction, but the user is removed last and
+// each step can be repeated, so a delete that fails part way reports
+// what was left and finishes when called again.
+func (db *DBClient) DeleteUserRedis(userID uint64, policy DeletePolicy) error {
+	user, err := db.GetUserRedis(userID)
+	if err != nil {
+		return err
+	}
+	postsKey := GetRedisUserPostsKey(userID)
+	commentsKey := GetRedisUserCommentsKey(userID)
+	beacons, err := db.GetUserPostIDsRedis(postsKey)
+	if err != nil {
+		return err
+	}
+	comments, err := db.GetUserPostIDsRedis(commentsKey)
+	if err != nil {
+		return err
+	}
+	left := func(what string, n int, err error) error {
+		return fmt.Errorf("Deleting user %d stopped with %d %s left; deleting them again finishes it. %w",
+			userID, n, what, err)
+	}
+	n, err := db.takeBackReactionsRedis(userID, GetRedisUserHeartListKey(userID), GetRedisUserHeartedKey,
+		"hearts", "hearts-sub", "hearts-rec")
+	if err != nil {
+		return left("hearts", n, err)
+	}
+	n, err = db.takeBackReactionsRedis(userID, GetRedisUserFlagListKey(userID), GetRedisUserFlaggedKey,
+		"flags", "flags-sub", "flags-rec")
+	if err != nil {
+		return left("flags", n, err)
+	}
+	for i, id := range beacons {
+		if policy == DeletePosts {
+			err = db.DeleteBeaconRedis(id)
+		} else {
+			err = db.AnonymizePostRedis(id)
+		}
+		if err != nil {
+			return left("beacons and their comments", len(beacons)-i, err)
+		}
+	}
+	for i, id := range comments {
+		if policy == DeletePosts {
+			err = db.DeleteCommentRedis(id)
+		} else {
+			err = db.AnonymizePostRedis(id)
+		}
+		if err != nil {
+			return left("comments", len(comments)-i, err)
+		}
+	}
+	userIDStr := strconv.FormatUint(userID, REDIS_INT_BASE)
+	err = db.redis.SRem(USERNAME_POOL_KEY, UsernameKey(user.Username), user.Username).Err()
+	if err == nil {
+		err = db.redis.SRem(ADMIN_POOL_KEY, userIDStr).Err()
+	}
+	if err == nil {
+		err = db.redis.Del(GetRedisUserEmailKey(user.Email)).Err()
+	}
+	if err == nil {
+		err = db.redis.Del(GetRedisUserKey(userID), postsKey, commentsKey,
+			GetRedisUserHeartListKey(userID), GetRedisUserFlagListKey(userID),
+			GetRedisUserFixKey(userID)).Err()
+	}
+	if err != nil {
+		return left("account records", 1, err)
+	}
+	return nil
+}
+
+// Returns every field stored for a user except their auth key.
+func (db *DBClient) GetUserRecordRedis(userID uint64) (map[string]string, error) {
+	res, err := db.redis.HGetAllMap(GetRedisUserKey(userID)).Result()
+	if err != nil {
+		return map[string]string{}, err
+	}
+	if len(res) == 0 {
+		return map[string]string{}, errors.New("User not found in db.")
+	}
+	delete(res, "auth")
+	return res, nil
+}
+
+func (db *DBClient) GetUserPostSetRedis(key string) ([]uint64, error) {
+	members, err := db.redis.SMembers(key).Result()
+	if err != nil {
+		return []uint64{}, err
+	}
+	ids := []uint64{}
+	for _, member := range members {
+		id, err := RedisParseUInt64(member, nil)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	sort.Sort(uint64Slice(ids))
+	return ids, nil
+}
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Looks up a comment by its ID alone, reading the beacon it belongs
+// to from the comment itself.
+func (db *DBClient) GetCommentByIDRedis(id uint64) (Comment, error) {
+	parent, err := RedisParseUInt64(db.redis.HGet(GetRedisPostKey(id), "parent").Result())
+	if err == redis.Nil {
+		return Comment{}, errors.New("Comment not found in db.")
+	}
+	if err != nil {
+		return Comment{}, err
+	}
+	return db.GetCommentRedis(id, parent)
+}
+
+func (db *DBClient) AddExportRedis(token string, userID uint64) error {
+	key := GetRedisExportKey(token)
+	err := db.redis.HMSet(key, "user", strconv.FormatUint(userID, REDIS_INT_BASE),
+		"status", ExportPending.String()).Err()
+	if err != nil {
+		return err
+	}
+	return db.redis.Expire(key, db.redisConfig.ExportExpiry).Err()
+}
+
+// Stores a finished archive. An export that has already expired is
+// not brought back.
+func (db *DBClient) FinishExportRedis(token string, status ExportStatus, data []byte) error {
+	key := GetRedisExportKey(token)
+	exists, err := db.redis.Exists(key).Result()
+	if err != nil || !exists {
+		return err
+	}
+	return db.redis.HMSet(key, "status", status.String(), "data", string(data)).Err()
+}
+
+// Hands out a finished archive of the user ARGV[1] and deletes it, so
+// that it can only be downloaded once. Exports of other users are
+// treated as missing.
+const takeExportScript = `
+local res = redis.call("HMGET", KEYS[1], "status", "data", "user")
+if not res[1] or res[3] ~= ARGV[1] then
+	return {}
+end
+if res[1] == "ready" then
+	redis.call("DEL", KEYS[1])
+end
+return res
+`
+
+// Returns the status of an export and, once ready, its archive. The
+// found result is false if the token is unknown, has expired or
+// belongs to another user than userID.
+func (db *DBClient) TakeExportRedis(token string, userID uint64) (ExportStatus, []byte, bool, error) {
+	res, err := db.redis.Eval(takeExportScript, []string{GetRedisExportKey(token)},
+		[]string{strconv.FormatUint(userID, REDIS_INT_BASE)}).Result()
+	if err != nil {
+		return ExportFailed, []byte{}, false, err
+	}
+	vals, _ := res.([]interface{})
+	if len(vals) == 0 {
+		return ExportFailed, []byte{}, false, nil
+	}
+	statusStr, _ := vals[0].(string)
+	status, err := ParseExportStatus(statusStr)
+	if err != nil {
+		return ExportFailed, []byte{}, false, err
+	}
+	data, _ := vals[1].(string)
+	return status, []byte(data), true, nil
+}
+
+// Replaces a beacon hash and its comment list in one step.
+const storeThreadScript = `
+local fieldCount = tonumber(ARGV[1])
+redis.call("DEL", KEYS[1], KEYS[2])
+redis.call("HMSET", KEYS[1], unpack(ARGV, 2, 1 + 2 * fieldCount))
+if #ARGV > 1 + 2 * fieldCount then
+	redis.call("RPUSH", KEYS[2], unpack(ARGV, 2 + 2 * fieldCount))
+end
+return 0
+`
+
+// Stores a whole thread under the IDs it already has, so that
+// GetThreadRedis returns it as given. Comments dropped from the thread
+// since it was last stored are removed.
+func (db *DBClient) StoreThreadRedis(post Beacon) error {
+	listKey := GetRedisCommentListKey(post.ID)
+	oldList, err := db.redis.LRange(listKey, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	kept := map[string]bool{}
+	commentIDs := []string{}
+	for i := range post.Comments {
+		comment := &post.Comments[i]
+		fields := commentFieldsRedis(comment, comment.Time)
+		err = db.redis.HMSet(GetRedisPostKey(comment.ID), fields[0], fields[1], fields[2:]...).Err()
+		if err != nil {
+			return err
+		}
+		idStr := strconv.FormatUint(comment.ID, REDIS_INT_BASE)
+		kept[idStr] = true
+		commentIDs = append(commentIDs, idStr)
+	}
+	fields := beaconFieldsRedis(&post, post.Time)
+	if post.Pending {
+		fields = append(fields, "pending", "1")
+	}
+	args := append([]string{strconv.Itoa(len(fields) / 2)}, fields...)
+	err = db.redis.Eval(storeThreadScript, []string{GetRedisPostKey(post.ID), listKey},
+		append(args, commentIDs...)).Err()
+	if err != nil {
+		return err
+	}
+	pipe := db.redis.Pipeline()
+	defer pipe.Close()
+	for _, idStr := range oldList {
+		if kept[idStr] {
+			continue
+		}
+		id, err := RedisParseUInt64(idStr, nil)
+		if err != nil {
+			return err
+		}
+		pipe.Del(GetRedisPostKey(id))
+	}
+	_, err = pipe.Exec()
+	return err
+}
+
+// Removes a stored thread: the beacon, its comment list and the
+// comments on it.
+func (db *DBClient) EvictThreadRedis(id uint64) error {
+	listKey := GetRedisCommentListKey(id)
+	list, err := db.redis.LRange(listKey, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	pipe := db.redis.Pipeline()
+	defer pipe.Close()
+	pipe.Del(GetRedisPostKey(id), listKey)
+	for _, idStr := range list {
+		commentID, err := RedisParseUInt64(idStr, nil)
+		if err != nil {
+			return err
+		}
+		pipe.Del(GetRedisPostKey(commentID))
+	}
+	_, err = pipe.Exec()
+	return err
+}
+
+// Stores a whole user hash under the ID the user already has.
+func (db *DBClient) StoreUserRedis(user User) error {
+	return db.redis.HMSet(GetRedisUserKey(user.ID), "id", strconv.FormatUint(user.ID, REDIS_INT_BASE),
+		"username", user.Username,
+		"created", RedisFormatTime(user.AccountCreated),
+		"flags-rec", strconv.FormatUint(uint64(user.FlagsReceived), REDIS_INT_BASE),
+		"flags-sub", strconv.FormatUint(uint64(user.FlagsSubmitted), REDIS_INT_BASE),
+		"hearts-rec", strconv.FormatUint(uint64(user.HeartsReceived), REDIS_INT_BASE),
+		"hearts-sub", strconv.FormatUint(uint64(user.HeartsSubmitted), REDIS_INT_BASE),
+		"auth", string(user.AuthKey),
+		"email", user.Email).Err()
+}
+
+func (db *DBClient) EvictUserRedis(userID uint64) error {
+	return db.redis.Del(GetRedisUserKey(userID)).Err()
+}
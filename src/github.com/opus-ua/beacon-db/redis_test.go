@@ -1,30 +1,114 @@
 package beacondb
 
 import (
+	"bytes"
 	"fmt"
 	. "github.com/opus-ua/beacon-post"
 	"gopkg.in/redis.v3"
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var db *DBClient
-var client *redis.Client = nil
+var client RedisClient = nil
+
+// Shares the database of db but takes the paths a cluster would.
+var clusterDB *DBClient
+
+// Returns the cluster hash slot of a key: the CRC16 of its hash tag,
+// or of the whole key if it has none, modulo 16384.
+func hashSlot(key string) uint16 {
+	if start := strings.Index(key, "{"); start >= 0 {
+		if end := strings.Index(key[start+1:], "}"); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	crc := uint16(0)
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc % 16384
+}
+
+func checkSlots(op string, keys ...string) {
+	for _, key := range keys {
+		if hashSlot(key) != hashSlot(keys[0]) {
+			panic(fmt.Sprintf("%s spans hash slots: %v", op, keys))
+		}
+	}
+}
+
+// Scripts that only run outside a cluster, and so may span hash slots.
+var unclusteredScripts = map[string]bool{
+	addBeaconScript:  true,
+	addCommentScript: true,
+	reactScript:      true,
+	addUserScript:    true,
+	renameScript:     true,
+}
+
+// Panics on any script or multi-key command a cluster would refuse
+// for spanning hash slots, so that every test also checks the keys
+// each write touches. A cluster client also panics on scripts that
+// only run outside a cluster.
+type slotCheckClient struct {
+	RedisClient
+	cluster bool
+}
+
+func (c slotCheckClient) Eval(script string, keys []string, args []string) *redis.Cmd {
+	if !unclusteredScripts[script] {
+		checkSlots("EVAL", keys...)
+	} else if c.cluster {
+		panic(fmt.Sprintf("EVAL of a script spanning hash slots in a cluster: %v", keys))
+	}
+	return c.RedisClient.Eval(script, keys, args)
+}
+
+func (c slotCheckClient) Del(keys ...string) *redis.IntCmd {
+	checkSlots("DEL", keys...)
+	return c.RedisClient.Del(keys...)
+}
+
+func (c slotCheckClient) PFCount(keys ...string) *redis.IntCmd {
+	checkSlots("PFCOUNT", keys...)
+	return c.RedisClient.PFCount(keys...)
+}
 
 func TestMain(m *testing.M) {
-	client = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-	})
-	if err := client.Select(11).Err(); err != nil {
+	// Every pooled connection has to use the unused database, so it is
+	// chosen here rather than with SELECT.
+	config := DefaultRedisConfig
+	config.DB = TESTING_REDIS_DB
+	var err error
+	if client, err = config.NewClient(); err == nil {
+		err = client.Ping().Err()
+	}
+	if err != nil {
 		fmt.Printf("Could not select unused database.\n")
 		os.Exit(1)
 	}
 	db = &DBClient{
-		redis: client,
+		redis:       slotCheckClient{RedisClient: client},
+		redisConfig: config,
+	}
+	clusterConfig := config
+	clusterConfig.ClusterAddrs = []string{config.Addr}
+	clusterDB = &DBClient{
+		redis:       slotCheckClient{RedisClient: client, cluster: true},
+		redisConfig: clusterConfig,
 	}
 	client.FlushDb()
 	res := m.Run()
@@ -57,12 +141,102 @@ var p Beacon = Beacon{
 	Flags:       1,
 }
 
+func TestRedisConfig(t *testing.T) {
+	invalid := map[string]func(config *RedisConfig){
+		"cluster with db": func(config *RedisConfig) {
+			config.ClusterAddrs, config.DB = []string{"localhost:7000"}, 2
+		},
+		"cluster with TLS": func(config *RedisConfig) {
+			config.ClusterAddrs, config.TLS = []string{"localhost:7000"}, true
+		},
+		"cluster and sentinels": func(config *RedisConfig) {
+			config.ClusterAddrs, config.SentinelAddrs = []string{"localhost:7000"}, []string{"localhost:26379"}
+		},
+		"sentinel no master": func(config *RedisConfig) { config.SentinelAddrs = []string{"localhost:26379"} },
+		"no address":         func(config *RedisConfig) { config.Addr = "" },
+		"missing CA":         func(config *RedisConfig) { config.TLS, config.TLSCAFile = true, "/nonexistent/ca.pem" },
+		"short expiry":       func(config *RedisConfig) { config.ThreadCacheTTL = time.Millisecond },
+	}
+	for name, change := range invalid {
+		config := DefaultRedisConfig
+		change(&config)
+		if _, err := config.NewClient(); err == nil {
+			t.Fatalf("Config '%s' was accepted.", name)
+		}
+	}
+	testDB, err := NewDB(DefaultRedisConfig, false, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = testDB.SelectTestingTable(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer testDB.redis.Close()
+	key := "config-test"
+	if err = testDB.redis.Set(key, "1", 0).Err(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	RedisExpect(client.Get(key), "1", t)
+	client.Del(key)
+	cluster := DefaultRedisConfig
+	cluster.ClusterAddrs = []string{DefaultRedisConfig.Addr}
+	if _, err = NewDB(cluster, false, true); err == nil {
+		t.Fatalf("Tests were allowed to run against a cluster.")
+	}
+}
+
+func TestHashSlots(t *testing.T) {
+	if slot := hashSlot("123456789"); slot != 0x31C3 {
+		t.Fatalf("Hash slot of '123456789' was %d, not %d.", slot, 0x31C3)
+	}
+	keys := [][]string{
+		{GetRedisPostKey(12), GetRedisCommentListKey(12), GetRedisThreadCacheKey(12),
+			GetRedisUserHeartedKey(12), GetRedisUserFlaggedKey(12)},
+		{GetRedisUserKey(3), GetRedisUserFixKey(3), GetRedisUserPostsKey(3), GetRedisUserCommentsKey(3),
+			GetRedisUserHeartListKey(3), GetRedisUserFlagListKey(3)},
+		{GetRedisActiveUsersKey(1), GetRedisActiveUsersKey(2)},
+	}
+	for _, group := range keys {
+		for _, key := range group {
+			if hashSlot(key) != hashSlot(group[0]) {
+				t.Fatalf("'%s' and '%s' are in different hash slots.", key, group[0])
+			}
+		}
+	}
+}
+
+// The test server may answer CLUSTER SLOTS even though it is not part
+// of a cluster, in which case it stands in for a one node cluster.
+func TestRedisCluster(t *testing.T) {
+	config := DefaultRedisConfig
+	config.ClusterAddrs = []string{DefaultRedisConfig.Addr}
+	cluster, err := config.NewClient()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer cluster.Close()
+	if err = client.(singleClient).ClusterInfo().Err(); err != nil {
+		t.Skipf("Redis at %s is not a cluster. %s", DefaultRedisConfig.Addr, err.Error())
+	}
+	if err = cluster.Ping().Err(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	nodes := 0
+	err = cluster.forEachNode(func(node *redis.Client) error {
+		nodes++
+		return node.Ping().Err()
+	})
+	if err != nil || nodes == 0 {
+		t.Fatalf("Could not reach the cluster's masters: %d reached. %v", nodes, err)
+	}
+}
+
 func TestAddBeacon(t *testing.T) {
 	_, err := db.AddBeacon(&p, 1)
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
-	key := fmt.Sprintf("p:%d", p.ID)
+	key := fmt.Sprintf("{p:%d}", p.ID)
 	RedisExpect(client.HGet(key, "img"), "abcde", t)
 	RedisExpect(client.HGet(key, "loc"), "\x00\x00\x00\x00\x00\x80F@\x00\x00\x00\x00\x00\x80F@", t)
 	RedisExpect(client.HGet(key, "poster"), "54321", t)
@@ -92,7 +266,7 @@ var commentB Comment = Comment{
 func TestAddComment(t *testing.T) {
 	db.AddComment(&commentA, 2)
 	db.AddComment(&commentB, 3)
-	commentListKey := "p:1:c"
+	commentListKey := "{p:1}:c"
 	res, err := client.LRange(commentListKey, 0, -1).Result()
 	if err != nil {
 		t.Fatalf(err.Error())
@@ -101,7 +275,7 @@ func TestAddComment(t *testing.T) {
 		fmt.Printf("Expected: ['2', '3']\nRetrieved: %v", res)
 		t.Fatalf("Comment list was not correct.")
 	}
-	key := fmt.Sprintf("p:%d", commentA.ID)
+	key := fmt.Sprintf("{p:%d}", commentA.ID)
 	RedisExpect(client.HGet(key, "poster"), "54321", t)
 	RedisExpect(client.HGet(key, "parent"), "1", t)
 	RedisExpect(client.HGet(key, "text"), "For real. This is stuff.", t)
@@ -109,7 +283,7 @@ func TestAddComment(t *testing.T) {
 	RedisExpect(client.HGet(key, "flags"), "0", t)
 	RedisExpect(client.HGet(key, "type"), "comment", t)
 	RedisNotNil(client.HGet(key, "time"), t)
-	key = fmt.Sprintf("p:%d", commentB.ID)
+	key = fmt.Sprintf("{p:%d}", commentB.ID)
 	RedisExpect(client.HGet(key, "poster"), "626", t)
 	RedisExpect(client.HGet(key, "parent"), "1", t)
 	RedisExpect(client.HGet(key, "text"), "Reed sucks.", t)
@@ -119,6 +293,45 @@ func TestAddComment(t *testing.T) {
 	RedisNotNil(client.HGet(key, "time"), t)
 }
 
+func TestClusterComment(t *testing.T) {
+	post := Beacon{
+		Image:     []byte("abcde"),
+		Thumbnail: []byte("abcde"),
+		Location:  Geotag{Latitude: 45.0, Longitude: 45.0},
+		PosterID:  626,
+	}
+	postID, err := clusterDB.AddBeacon(&post, 626)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	shown := Comment{PosterID: 626, BeaconID: postID, Text: "Shown."}
+	held := Comment{PosterID: 626, BeaconID: postID, Text: "Held.", Pending: true}
+	if err = clusterDB.AddCommentRedis(&shown, 626); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = clusterDB.AddCommentRedis(&held, 626); err != nil {
+		t.Fatalf(err.Error())
+	}
+	ids, err := clusterDB.GetCommentListRedis(postID)
+	if err != nil || !reflect.DeepEqual(ids, []uint64{shown.ID}) {
+		t.Fatalf("Comment list was %v, not [%d].", ids, shown.ID)
+	}
+	if pending, _ := client.SIsMember(PENDING_POOL_KEY, strconv.FormatUint(held.ID, 10)).Result(); !pending {
+		t.Fatalf("Held comment was not held for review.")
+	}
+	if err = clusterDB.FlagPostRedis(shown.ID, 1); err != nil {
+		t.Fatalf(err.Error())
+	}
+	RedisExpect(client.HGet(GetRedisPostKey(shown.ID), "flags"), "1", t)
+	if err = clusterDB.ApproveBeaconRedis(held.ID); err != nil {
+		t.Fatalf(err.Error())
+	}
+	ids, err = clusterDB.GetCommentListRedis(postID)
+	if err != nil || !reflect.DeepEqual(ids, []uint64{shown.ID, held.ID}) {
+		t.Fatalf("Approved comment was not filed in its thread.")
+	}
+}
+
 func TestGetBeacon(t *testing.T) {
 	post, err := db.GetThreadRedis(1)
 	if err != nil {
@@ -143,6 +356,16 @@ func TestHeartPost(t *testing.T) {
 		t.Fatalf(err.Error())
 	}
 	RedisExpect(client.HGet(key, "hearts"), "6", t)
+	if err = db.HeartPostRedis(1, 1); err != nil {
+		t.Fatalf(err.Error())
+	}
+	RedisExpect(client.HGet(key, "hearts"), "6", t)
+	if err = db.HeartPostRedis(9999, 1); err != ErrPostNotFound {
+		t.Fatalf("Hearting a missing post did not fail.")
+	}
+	if exists, _ := client.Exists(GetRedisPostKey(9999)).Result(); exists {
+		t.Fatalf("Hearting a missing post created it.")
+	}
 }
 
 func TestFlagPost(t *testing.T) {
@@ -159,7 +382,7 @@ func TestSetUser(t *testing.T) {
 	if _, err := db.CreateUserRedis("test-user", []byte(""), "anonymous@gmail.com"); err != nil {
 		t.Fatalf(err.Error())
 	}
-	key := "u:1"
+	key := "{u:1}"
 	RedisExpect(client.HGet(key, "username"), "test-user", t)
 	RedisExpect(client.HGet(key, "flags-rec"), "0", t)
 	RedisExpect(client.HGet(key, "flags-sub"), "0", t)
@@ -174,6 +397,788 @@ func TestSetUser(t *testing.T) {
 	}
 }
 
+func TestAddFuzzedBeacon(t *testing.T) {
+	exact := Geotag{Latitude: 33.2191, Longitude: -87.5441}
+	fuzzed := Beacon{
+		Image:       []byte("abcde"),
+		Thumbnail:   []byte("abcde"),
+		Location:    exact,
+		Precision:   Precision1km,
+		PosterID:    54321,
+		Description: "Somewhere around here.",
+	}
+	id, err := db.AddBeacon(&fuzzed, 1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	post, err := db.GetBeaconRedis(id)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if post.Location == exact {
+		t.Fatalf("Stored location was not fuzzed.")
+	}
+	nearby := Geotag{Latitude: 33.2192, Longitude: -87.5442}
+	if post.Location != nearby.Fuzz(Precision1km) {
+		t.Fatalf("Fuzzing was not deterministic.")
+	}
+	if post.ExactLocation != nil {
+		t.Fatalf("Exact location was kept without permission.")
+	}
+	if post.Precision != Precision1km {
+		t.Fatalf("Precision was '%s', not '1km'.", post.Precision)
+	}
+	kept := fuzzed
+	kept.Location = exact
+	kept.ExactLocation = &exact
+	id, err = db.AddBeacon(&kept, 1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	post, err = db.GetBeaconRedis(id)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if post.ExactLocation == nil || *post.ExactLocation != exact {
+		t.Fatalf("Exact location was not kept.")
+	}
+}
+
+func TestTakeToken(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		allowed, _, err := db.TakeTokenRedis("test", 2, time.Hour)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !allowed {
+			t.Fatalf("Token %d was refused from a full bucket.", i)
+		}
+	}
+	allowed, wait, err := db.TakeTokenRedis("test", 2, time.Hour)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if allowed {
+		t.Fatalf("Token was taken from an empty bucket.")
+	}
+	if wait <= 0 || wait > time.Hour {
+		t.Fatalf("Wait time was %s.", wait)
+	}
+}
+
+func TestZones(t *testing.T) {
+	circle := Zone{
+		Name:   "School",
+		Rule:   ZoneDenyPost,
+		Center: Geotag{Latitude: 10.0, Longitude: 10.0},
+		Radius: 0.5,
+	}
+	square := Zone{
+		Name: "Campus",
+		Rule: ZoneRequireReview,
+		Polygon: []Geotag{
+			Geotag{Latitude: 20.0, Longitude: 20.0},
+			Geotag{Latitude: 20.0, Longitude: 20.1},
+			Geotag{Latitude: 20.1, Longitude: 20.1},
+			Geotag{Latitude: 20.1, Longitude: 20.0},
+		},
+	}
+	if _, err := db.AddZoneRedis(&circle); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := db.AddZoneRedis(&square); err != nil {
+		t.Fatalf(err.Error())
+	}
+	zones, err := db.GetZonesRedis()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(zones) != 2 {
+		t.Fatalf("Retrieved %d zones, not 2.", len(zones))
+	}
+	stored, err := db.GetZoneRedis(square.ID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !reflect.DeepEqual(stored, square) {
+		t.Fatalf("Retrieved zone not same as stored zone.")
+	}
+	if allowed, _ := CheckZones(zones, Geotag{Latitude: 10.001, Longitude: 10.001}); allowed {
+		t.Fatalf("Posting was allowed inside a deny zone.")
+	}
+	if allowed, review := CheckZones(zones, Geotag{Latitude: 20.05, Longitude: 20.05}); !allowed || !review {
+		t.Fatalf("Posting inside a review zone was not held for review.")
+	}
+	if allowed, review := CheckZones(zones, Geotag{Latitude: 30.0, Longitude: 30.0}); !allowed || review {
+		t.Fatalf("Posting outside all zones was restricted.")
+	}
+	hidden := Zone{
+		Name:   "Shelter",
+		Rule:   ZoneHideLocal,
+		Center: Geotag{Latitude: 40.0, Longitude: 40.0},
+		Radius: 0.5,
+	}
+	exact := Geotag{Latitude: 40.001, Longitude: 40.001}
+	fuzzed := Beacon{Location: Geotag{Latitude: 40.01, Longitude: 40.01}, ExactLocation: &exact}
+	if !HiddenByZones([]Zone{hidden}, fuzzed) {
+		t.Fatalf("Post inside a hidden zone escaped it through its coarsened location.")
+	}
+	fuzzed.ExactLocation = nil
+	if HiddenByZones([]Zone{hidden}, fuzzed) {
+		t.Fatalf("Post outside a hidden zone was hidden.")
+	}
+	if err = db.DeleteZoneRedis(circle.ID); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = db.DeleteZoneRedis(square.ID); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+func TestApproveBeacon(t *testing.T) {
+	held := Beacon{
+		Image:       []byte("abcde"),
+		Thumbnail:   []byte("abcde"),
+		Location:    Geotag{Latitude: 20.05, Longitude: 20.05},
+		PosterID:    54321,
+		Description: "Hold me.",
+		Pending:     true,
+	}
+	id, err := db.AddBeacon(&held, 1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	local, err := db.GetLocalRedis(held.Location, 1.0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(local) != 0 {
+		t.Fatalf("Held beacon was visible in local search.")
+	}
+	if err = db.ApproveBeaconRedis(id); err != nil {
+		t.Fatalf(err.Error())
+	}
+	local, err = db.GetLocalRedis(held.Location, 1.0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(local) != 1 || local[0].Pending {
+		t.Fatalf("Approved beacon was not visible in local search.")
+	}
+	pending, err := db.GetPendingRedis()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(pending) != 0 {
+		t.Fatalf("Approved beacon was still pending.")
+	}
+}
+
+func TestThreadCache(t *testing.T) {
+	posterID, err := db.CreateUserRedis("Cacher", []byte(""), "cacher@gmail.com")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	post := Beacon{
+		Image:     []byte("cached image"),
+		Thumbnail: []byte("cached thumb"),
+		Location:  Geotag{Latitude: 10.0, Longitude: 10.0},
+		PosterID:  posterID,
+	}
+	beaconID, err := db.AddBeaconRedis(&post, posterID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	comment := Comment{PosterID: DeletedUserID, BeaconID: beaconID, Text: "cached"}
+	if err = db.AddCommentRedis(&comment, posterID); err != nil {
+		t.Fatalf(err.Error())
+	}
+	uncached, err := db.GetThread(beaconID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	cacheKey := GetRedisThreadCacheKey(beaconID)
+	if exists, _ := client.Exists(cacheKey).Result(); !exists {
+		t.Fatalf("Thread was not cached.")
+	}
+	cached, err := db.GetThread(beaconID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !reflect.DeepEqual(cached, uncached) {
+		t.Fatalf("Cached thread differs: %+v != %+v", cached, uncached)
+	}
+	_, staleRev, err := db.getThreadRedis(beaconID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = db.HeartPostRedis(comment.ID, posterID); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if exists, _ := client.Exists(cacheKey).Result(); exists {
+		t.Fatalf("Hearting a comment did not invalidate its thread.")
+	}
+	client.Eval(fillThreadScript, []string{GetRedisPostKey(beaconID), cacheKey},
+		[]string{staleRev, "{}", "60"})
+	if exists, _ := client.Exists(cacheKey).Result(); exists {
+		t.Fatalf("Thread read before a heart was cached after it.")
+	}
+	thread, err := db.GetThread(beaconID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if thread.Comments[0].Hearts != 1 {
+		t.Fatalf("Thread has stale heart count %d.", thread.Comments[0].Hearts)
+	}
+	usernames, err := db.GetUsernames([]uint64{posterID, DeletedUserID, posterID})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(usernames) != 2 || usernames[posterID] != "Cacher" || usernames[DeletedUserID] != DeletedUsername {
+		t.Fatalf("Got usernames %v.", usernames)
+	}
+	if _, err = db.GetUsernames([]uint64{posterID, 99999}); err == nil {
+		t.Fatalf("Username of a missing user was found.")
+	}
+	hearted, err := db.HasHeartedPosts([]uint64{beaconID, comment.ID}, posterID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if hearted[beaconID] || !hearted[comment.ID] {
+		t.Fatalf("Got hearts %v.", hearted)
+	}
+	if err = db.DeleteBeaconRedis(beaconID); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = db.GetThread(beaconID); err == nil {
+		t.Fatalf("Deleted thread was still cached.")
+	}
+	db.DeleteUserRedis(posterID, DeletePosts)
+}
+
+func TestUserProfile(t *testing.T) {
+	posterID, err := db.CreateUserRedis("profile-user", []byte(""), "profile@gmail.com")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	post := Beacon{
+		Image:       []byte("abcde"),
+		Thumbnail:   []byte("abcde"),
+		Location:    Geotag{Latitude: 45.0, Longitude: 45.0},
+		PosterID:    posterID,
+		Description: "Look at my profile.",
+	}
+	postID, err := db.AddBeacon(&post, posterID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = db.HeartPostRedis(postID, 1); err != nil {
+		t.Fatalf(err.Error())
+	}
+	RedisExpect(client.HGet("{u:1}", "hearts-sub"), "1", t)
+	RedisExpect(client.HGet(GetRedisUserKey(posterID), "hearts-rec"), "1", t)
+	held := post
+	held.Pending = true
+	heldID, err := db.AddBeacon(&held, posterID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// An index entry left behind by a post that is gone.
+	client.LPush(GetRedisUserPostsKey(posterID), "99999")
+	profile, err := db.GetUserProfileRedis(posterID, 0, 10, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if profile.Username != "profile-user" || profile.HeartsReceived != 1 {
+		t.Fatalf("Retrieved profile was not correct.")
+	}
+	if len(profile.Beacons) != 1 || profile.Beacons[0].ID != postID || profile.BeaconCount != 1 {
+		t.Fatalf("Profile did not list and count only the user's shown beacon.")
+	}
+	profile, err = db.GetUserProfileRedis(posterID, 1, 10, true)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(profile.Beacons) != 1 || profile.Beacons[0].ID != postID || profile.BeaconCount != 2 {
+		t.Fatalf("Profile with pending beacons did not page over both of them.")
+	}
+	client.LRem(GetRedisUserPostsKey(posterID), 0, "99999")
+	db.DeleteBeaconRedis(heldID)
+	if err = db.UnheartPostRedis(postID, 1); err != nil {
+		t.Fatalf(err.Error())
+	}
+	RedisExpect(client.HGet(GetRedisUserKey(posterID), "hearts-rec"), "0", t)
+}
+
+func TestChangeUsername(t *testing.T) {
+	for prefix, db := range map[string]*DBClient{"": db, "Cluster-": clusterDB} {
+		userID, err := db.CreateUserRedis(prefix+"Renamer", []byte(""), prefix+"renamer@gmail.com")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if _, err = db.CreateUserRedis(prefix+"renamer", []byte(""), prefix+"renamer2@gmail.com"); err != ErrUsernameTaken {
+			t.Fatalf("Username was not unique regardless of case.")
+		}
+		if _, err = db.CreateUserRedis(prefix+"Other", []byte(""), prefix+"renamer@gmail.com"); err != ErrEmailTaken {
+			t.Fatalf("Email was registered twice.")
+		}
+		if exists, _ := db.UsernameExistsRedis(prefix + "Other"); exists {
+			t.Fatalf("Username of a refused user was kept.")
+		}
+		if _, err = db.ChangeUsernameRedis(userID, prefix+"Renamed", time.Hour); err != nil {
+			t.Fatalf(err.Error())
+		}
+		RedisExpect(client.HGet(GetRedisUserKey(userID), "username"), prefix+"Renamed", t)
+		if exists, _ := db.UsernameExistsRedis(prefix + "renamer"); exists {
+			t.Fatalf("Old username was not released.")
+		}
+		wait, err := db.ChangeUsernameRedis(userID, prefix+"Renamed Again", time.Hour)
+		if err != ErrUsernameCooldown || wait <= 0 {
+			t.Fatalf("Username was changed during cooldown.")
+		}
+		if exists, _ := db.UsernameExistsRedis(prefix + "Renamed Again"); exists {
+			t.Fatalf("Username refused during cooldown was kept.")
+		}
+		if _, err = db.ChangeUsernameRedis(userID, "Profile-User", 0); err != ErrUsernameTaken {
+			t.Fatalf("Username was changed to a taken name.")
+		}
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	// The deleted users heart and flag a beacon of someone else.
+	posterID, err := db.CreateUserRedis("hearted", []byte(""), "hearted@gmail.com")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	hearted := Beacon{
+		Image:       []byte("abcde"),
+		Thumbnail:   []byte("abcde"),
+		Location:    Geotag{Latitude: 45.0, Longitude: 45.0},
+		PosterID:    posterID,
+		Description: "Still here.",
+	}
+	heartedID, err := db.AddBeacon(&hearted, posterID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, policy := range []DeletePolicy{AnonymizePosts, DeletePosts} {
+		email := fmt.Sprintf("%s@gmail.com", policy.String())
+		userID, err := db.CreateUserRedis(policy.String(), []byte(""), email)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		post := Beacon{
+			Image:       []byte("abcde"),
+			Thumbnail:   []byte("abcde"),
+			Location:    Geotag{Latitude: 45.0, Longitude: 45.0},
+			PosterID:    userID,
+			Description: "Soon to be gone.",
+		}
+		postID, err := db.AddBeacon(&post, userID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		comment := Comment{BeaconID: postID, PosterID: 1, Text: "Bye."}
+		if err = db.AddCommentRedis(&comment, 1); err != nil {
+			t.Fatalf(err.Error())
+		}
+		before, err := db.GetThreadRedis(heartedID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		poster, err := db.GetUserRedis(posterID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err = db.HeartPostRedis(heartedID, userID); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err = db.FlagPostRedis(heartedID, userID); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err = db.DeleteUserRedis(userID, policy); err != nil {
+			t.Fatalf(err.Error())
+		}
+		after, err := db.GetThreadRedis(heartedID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if after.Hearts != before.Hearts || after.Flags != before.Flags {
+			t.Fatalf("Hearts and flags of deleted user were still counted.")
+		}
+		userIDStr := strconv.FormatUint(userID, REDIS_INT_BASE)
+		if hearted, _ := client.SIsMember(GetRedisUserHeartedKey(heartedID), userIDStr).Result(); hearted {
+			t.Fatalf("Deleted user was left among the hearts of a post.")
+		}
+		if flagged, _ := client.SIsMember(GetRedisUserFlaggedKey(heartedID), userIDStr).Result(); flagged {
+			t.Fatalf("Deleted user was left among the flags of a post.")
+		}
+		if posterAfter, _ := db.GetUserRedis(posterID); posterAfter.HeartsReceived != poster.HeartsReceived ||
+			posterAfter.FlagsReceived != poster.FlagsReceived {
+			t.Fatalf("Poster still counted the hearts and flags of a deleted user.")
+		}
+		if exists, _ := db.EmailExistsRedis(email); exists {
+			t.Fatalf("Email of deleted user was kept.")
+		}
+		if exists, _ := db.UsernameExistsRedis(policy.String()); exists {
+			t.Fatalf("Username of deleted user was kept.")
+		}
+		thread, err := db.GetThreadRedis(postID)
+		if policy == DeletePosts {
+			if err == nil {
+				t.Fatalf("Beacon of deleted user was kept.")
+			}
+			comments, _ := db.GetUserPostIDsRedis(GetRedisUserCommentsKey(1))
+			for _, id := range comments {
+				if id == comment.ID {
+					t.Fatalf("Deleted comment was left in its poster's index.")
+				}
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if thread.PosterID != DeletedUserID || len(thread.Comments) != 1 {
+			t.Fatalf("Beacon of deleted user was not anonymized.")
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	if err := db.HeartPostRedis(1, 2); err != nil {
+		t.Fatalf(err.Error())
+	}
+	hearted, err := db.GetUserHearted(2)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !reflect.DeepEqual(hearted, []uint64{1}) {
+		t.Fatalf("Hearted post was not listed for its user.")
+	}
+	if err = db.AddExportRedis("token", 2); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if status, _, found, _ := db.TakeExportRedis("token", 2); !found || status != ExportPending {
+		t.Fatalf("New export was not pending.")
+	}
+	if err = db.FinishExportRedis("token", ExportReady, []byte("zip")); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, _, found, _ := db.TakeExportRedis("token", 3); found {
+		t.Fatalf("Export was handed to another user.")
+	}
+	status, data, found, err := db.TakeExportRedis("token", 2)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !found || status != ExportReady || string(data) != "zip" {
+		t.Fatalf("Finished export was not returned.")
+	}
+	if _, _, found, _ = db.TakeExportRedis("token", 2); found {
+		t.Fatalf("Export could be downloaded twice.")
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	const workers = 20
+	for prefix, db := range map[string]*DBClient{"": db, "cluster-": clusterDB} {
+		posterID, err := db.CreateUserRedis(prefix+"stressed", []byte(""), prefix+"stressed@gmail.com")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		post := Beacon{
+			Image:       []byte("abcde"),
+			Thumbnail:   []byte("abcde"),
+			Location:    Geotag{Latitude: 45.0, Longitude: 45.0},
+			PosterID:    posterID,
+			Description: "Heart me.",
+		}
+		postID, err := db.AddBeacon(&post, posterID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		var wg sync.WaitGroup
+		errs := make(chan error, workers*10)
+		created := make(chan uint64, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				userID := uint64(i%5 + 1)
+				for j := 0; j < 10; j++ {
+					var err error
+					if (i+j)%3 == 0 {
+						err = db.UnheartPostRedis(postID, userID)
+					} else {
+						err = db.HeartPostRedis(postID, userID)
+					}
+					if err != nil {
+						errs <- err
+					}
+				}
+				copy := post
+				if _, err := db.AddBeaconRedis(&copy, posterID); err != nil {
+					errs <- err
+				}
+				if id, err := db.CreateUserRedis(prefix+"racer", []byte(""), fmt.Sprintf("%sracer%d@gmail.com", prefix, i)); err == nil {
+					created <- id
+				} else if err != ErrUsernameTaken {
+					errs <- err
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		close(created)
+		for err := range errs {
+			t.Fatalf(err.Error())
+		}
+		if len(created) != 1 {
+			t.Fatalf("%d users were created with the same username.", len(created))
+		}
+		members, err := client.SCard(GetRedisUserHeartedKey(postID)).Result()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		RedisExpect(client.HGet(GetRedisPostKey(postID), "hearts"), strconv.FormatInt(members, 10), t)
+		RedisExpect(client.HGet(GetRedisUserKey(posterID), "hearts-rec"), strconv.FormatInt(members, 10), t)
+		count, err := db.GetUserPostCountRedis(posterID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if count != workers+1 {
+			t.Fatalf("Poster index held %d beacons, not %d.", count, workers+1)
+		}
+	}
+}
+
+func TestFsck(t *testing.T) {
+	client.HIncrBy(GetRedisPostKey(9998), "hearts", 1)
+	client.HSet(GetRedisPostKey(1), "hearts", "100")
+	client.GeoAdd(GEOTAG_KEY, &redis.GeoLocation{Name: "9997", Latitude: 1.0, Longitude: 1.0})
+	client.Set(GetRedisUserEmailKey("ghost@gmail.com"), "9999", 0)
+	// Writes cut short between hash slots.
+	unindexed := p
+	unindexed.PosterID = 1
+	unindexedID, _ := db.AddBeaconRedis(&unindexed, 1)
+	client.LRem(GetRedisUserPostsKey(1), 0, strconv.FormatUint(unindexedID, 10))
+	unqueued := p
+	unqueued.PosterID = 1
+	unqueued.Pending = true
+	unqueuedID, _ := db.AddBeaconRedis(&unqueued, 1)
+	client.SRem(PENDING_POOL_KEY, strconv.FormatUint(unqueuedID, 10))
+	unthreaded := Comment{BeaconID: 1, PosterID: 1, Text: "Lost"}
+	db.AddCommentRedis(&unthreaded, 1)
+	client.LRem(GetRedisCommentListKey(1), 0, strconv.FormatUint(unthreaded.ID, 10))
+	client.HSet(GetRedisUserKey(1), "hearts-sub", "100")
+	res, err := db.FsckRedis(false, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, kind := range []string{FsckStrayPost, FsckHeartCount, FsckGeoOrphan, FsckEmailOrphan,
+		FsckUnindexedPost, FsckUnqueuedPost, FsckUnthreaded, FsckUserCount} {
+		if res.Found[kind] == 0 {
+			t.Fatalf("Fsck did not find %s.", kind)
+		}
+		if res.Repaired[kind] != 0 {
+			t.Fatalf("Fsck repaired %s without --repair.", kind)
+		}
+	}
+	if res, err = db.FsckRedis(true, nil); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if res, err = db.FsckRedis(false, nil); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if res.Total() != 0 {
+		t.Fatalf("Fsck left %d inconsistencies after repairing: %v", res.Total(), res.Found)
+	}
+	hearts, _ := client.SCard(GetRedisUserHeartedKey(1)).Result()
+	RedisExpect(client.HGet(GetRedisPostKey(1), "hearts"), strconv.FormatInt(hearts, 10), t)
+	comments, _ := db.GetCommentListRedis(1)
+	if len(comments) == 0 || comments[len(comments)-1] != unthreaded.ID {
+		t.Fatalf("Comment %d was not put back at the end of its thread: %v", unthreaded.ID, comments)
+	}
+	// A post whose ID was taken after the scan started, and which is
+	// yet to be filed, is not damage.
+	late := p
+	late.PosterID = 1
+	lateID, _ := db.AddBeaconRedis(&late, 1)
+	client.LRem(GetRedisUserPostsKey(1), 0, strconv.FormatUint(lateID, 10))
+	client.Set(POST_COUNT_KEY, strconv.FormatUint(lateID-1, 10), 0)
+	if res, err = db.FsckRedis(true, nil); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if res.Found[FsckUnindexedPost] != 0 {
+		t.Fatalf("Fsck took a post created during the scan for an unindexed one.")
+	}
+	client.Set(POST_COUNT_KEY, strconv.FormatUint(lateID, 10), 0)
+	db.DeleteCommentRedis(unthreaded.ID)
+	db.DeleteBeaconRedis(unindexedID)
+	db.DeleteBeaconRedis(unqueuedID)
+	db.DeleteBeaconRedis(lateID)
+}
+
+func TestNewSchema(t *testing.T) {
+	emptyClient := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+		DB:   12,
+	})
+	defer emptyClient.Close()
+	emptyClient.FlushDb()
+	defer emptyClient.FlushDb()
+	emptyDB := &DBClient{
+		redis:       singleClient{Client: emptyClient},
+		redisConfig: DefaultRedisConfig,
+	}
+	if err := emptyDB.markNewSchemaRedis(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := emptyDB.CheckSchemaRedis(); err != nil {
+		t.Fatalf("New database was not marked up to date. %s", err.Error())
+	}
+	emptyClient.FlushDb()
+	emptyClient.Set(USER_COUNT_KEY, "3", 0)
+	emptyDB.markNewSchemaRedis()
+	if err := emptyDB.CheckSchemaRedis(); err == nil {
+		t.Fatalf("Database with users but no schema version passed the check.")
+	}
+}
+
+// Writes a user, a comment and its hearts the way versions before the
+// schema was versioned did, under keys without hash tags.
+func TestMigrate(t *testing.T) {
+	client.HMSet("u:9001", "id", "9001", "username", "MixedCase", "created", "0",
+		"hearts-rec", "0", "hearts-sub", "1", "flags-rec", "0", "flags-sub", "0",
+		"auth", "", "email", "mixed@gmail.com")
+	client.SAdd(USERNAME_POOL_KEY, "MixedCase")
+	client.HMSet("p:9000", "type", "comment", "poster", "9001",
+		"parent", "1", "time", "2016-03-01 12:00:00 +0000 UTC", "hearts", "1", "flags", "0")
+	client.SAdd("h:9000", "9001")
+	client.Set("t:9000", "{}", 0)
+	client.Set("active:9000", "1", time.Hour)
+	version, err := db.MigrateRedis(true, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if stored, _ := db.GetSchemaVersionRedis(); stored != 0 || version != LatestSchemaVersion() {
+		t.Fatalf("Dry run recorded schema version %d.", stored)
+	}
+	RedisExpect(client.HGet("p:9000", "time"), "2016-03-01 12:00:00 +0000 UTC", t)
+	if err = db.CheckSchemaRedis(); err == nil {
+		t.Fatalf("Schema check passed before migrating.")
+	}
+	if _, err = db.MigrateRedis(false, nil); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if stored, _ := db.GetSchemaVersionRedis(); stored != LatestSchemaVersion() {
+		t.Fatalf("Schema version %d was recorded, not %d.", stored, LatestSchemaVersion())
+	}
+	if err = db.CheckSchemaRedis(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, key := range []string{"u:9001", "p:9000", "h:9000", "t:9000", "active:9000"} {
+		if exists, _ := client.Exists(key).Result(); exists {
+			t.Fatalf("Legacy key '%s' was left behind.", key)
+		}
+	}
+	RedisExpect(client.HGet(GetRedisPostKey(9000), "time"), "1456833600", t)
+	RedisExpect(client.HGet(GetRedisUserKey(9001), "username"), "MixedCase", t)
+	if exists, _ := db.UsernameExistsRedis("MIXEDCASE"); !exists {
+		t.Fatalf("Username was not reserved in lowercase.")
+	}
+	if ids, _ := db.GetUserPostIDsRedis(GetRedisUserCommentsKey(9001)); len(ids) != 1 || ids[0] != 9000 {
+		t.Fatalf("Comment of user 9001 was not indexed.")
+	}
+	if hearted, _ := db.HasHeartedRedis(9000, 9001); !hearted {
+		t.Fatalf("Heart of user 9001 was not moved.")
+	}
+	if ids, _ := db.GetUserPostSetRedis(GetRedisUserHeartListKey(9001)); len(ids) != 1 || ids[0] != 9000 {
+		t.Fatalf("Heart of user 9001 was not indexed.")
+	}
+	if ttl, _ := client.PTTL(GetRedisActiveUsersKey(9000)).Result(); ttl <= 0 {
+		t.Fatalf("Expiry of a moved key was dropped.")
+	}
+	client.Set(SCHEMA_VERSION_KEY, "0", 0)
+	changed := 0
+	_, err = db.MigrateRedis(false, func(progress MigrateProgress) {
+		changed += progress.Changed
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if changed != 0 {
+		t.Fatalf("Migrating again changed %d keys.", changed)
+	}
+	db.DeleteCommentRedis(9000)
+	db.DeleteUserRedis(9001, AnonymizePosts)
+	client.Del(GetRedisActiveUsersKey(9000))
+}
+
+func TestBackupRestore(t *testing.T) {
+	buf := &bytes.Buffer{}
+	backedUp, err := db.BackupRedis(buf, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if backedUp.Users == 0 || backedUp.Posts == 0 || backedUp.Images == 0 || backedUp.Geo == 0 {
+		t.Fatalf("Backup left out records: %+v", backedUp)
+	}
+	restoreClient := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+		DB:   12,
+	})
+	defer restoreClient.Close()
+	restoreClient.FlushDb()
+	defer restoreClient.FlushDb()
+	restoreDB := &DBClient{
+		redis:       slotCheckClient{RedisClient: singleClient{Client: restoreClient}},
+		redisConfig: DefaultRedisConfig,
+	}
+	restored, err := restoreDB.RestoreRedis(bytes.NewReader(buf.Bytes()), false, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if restored != backedUp {
+		t.Fatalf("Restored %+v but backed up %+v.", restored, backedUp)
+	}
+	original, err := db.GetThreadRedis(1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	copied, err := restoreDB.GetThreadRedis(1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !reflect.DeepEqual(original, copied) {
+		t.Fatalf("Restored beacon differs from the original.")
+	}
+	originalUser, _ := db.GetUserRedis(1)
+	copiedUser, err := restoreDB.GetUserRedis(1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !reflect.DeepEqual(originalUser, copiedUser) {
+		t.Fatalf("Restored user differs from the original.")
+	}
+	if _, err = restoreDB.RestoreRedis(bytes.NewReader(buf.Bytes()), false, nil); err == nil {
+		t.Fatalf("Restored over a db that was not empty.")
+	}
+	postCount, _ := restoreDB.getCountRedis(POST_COUNT_KEY)
+	merged, err := restoreDB.RestoreRedis(bytes.NewReader(buf.Bytes()), true, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if merged.Merged != backedUp.Users || merged.Posts != backedUp.Posts {
+		t.Fatalf("Merge should have merged every user and copied every post: %+v", merged)
+	}
+	if count, _ := restoreDB.getCountRedis(POST_COUNT_KEY); count != postCount+uint64(merged.Posts) {
+		t.Fatalf("Merged posts were not given new IDs.")
+	}
+}
+
 func BenchmarkAddBeaconRedis(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		p.Description = strconv.Itoa(i)
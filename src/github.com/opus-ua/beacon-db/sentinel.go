@@ -0,0 +1,176 @@
+package beacondb
+
+import (
+	"crypto/tls"
+	"errors"
+	"gopkg.in/redis.v3"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long to wait before asking the sentinels again after losing
+// touch with all of them.
+const SENTINEL_RETRY_INTERVAL = time.Second
+
+// Dials whichever server the sentinels name as master, over TLS. The
+// failover client of redis.v3 only dials plain TCP, so with TLS a
+// plain client is given this as its dialer. Sentinels are reached over
+// TLS too. When the sentinels announce a new master, connections to
+// the old one are closed so the pool replaces them.
+type sentinelDialer struct {
+	config    RedisConfig
+	tlsConfig *tls.Config
+
+	mu     sync.Mutex
+	conns  map[*sentinelConn]bool
+	closed chan struct{}
+}
+
+// A connection to the master at addr, forgotten once closed.
+type sentinelConn struct {
+	net.Conn
+	addr   string
+	dialer *sentinelDialer
+}
+
+func (conn *sentinelConn) Close() error {
+	conn.dialer.mu.Lock()
+	delete(conn.dialer.conns, conn)
+	conn.dialer.mu.Unlock()
+	return conn.Conn.Close()
+}
+
+func newSentinelDialer(config RedisConfig, tlsConfig *tls.Config) *sentinelDialer {
+	d := &sentinelDialer{
+		config:    config,
+		tlsConfig: tlsConfig,
+		conns:     map[*sentinelConn]bool{},
+		closed:    make(chan struct{}),
+	}
+	go d.watch()
+	return d
+}
+
+func (d *sentinelDialer) Close() {
+	close(d.closed)
+}
+
+func (d *sentinelDialer) dialTLS(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: d.config.DialTimeout}
+	return tls.DialWithDialer(dialer, "tcp", addr, d.tlsConfig)
+}
+
+func (d *sentinelDialer) sentinel(addr string) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:         addr,
+		DialTimeout:  d.config.DialTimeout,
+		ReadTimeout:  d.config.ReadTimeout,
+		WriteTimeout: d.config.WriteTimeout,
+		PoolSize:     1,
+		Dialer: func() (net.Conn, error) {
+			return d.dialTLS(addr)
+		},
+	})
+}
+
+// Asks each sentinel in turn for the address of the master.
+func (d *sentinelDialer) masterAddr() (string, error) {
+	for _, addr := range d.config.SentinelAddrs {
+		sentinel := d.sentinel(addr)
+		cmd := redis.NewStringSliceCmd("SENTINEL", "get-master-addr-by-name", d.config.SentinelMaster)
+		sentinel.Process(cmd)
+		sentinel.Close()
+		if master, err := cmd.Result(); err == nil && len(master) == 2 {
+			return net.JoinHostPort(master[0], master[1]), nil
+		}
+	}
+	return "", errors.New("No sentinel named the master.")
+}
+
+func (d *sentinelDialer) Dial() (net.Conn, error) {
+	addr, err := d.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.dialTLS(addr)
+	if err != nil {
+		return nil, err
+	}
+	tracked := &sentinelConn{Conn: conn, addr: addr, dialer: d}
+	d.mu.Lock()
+	d.conns[tracked] = true
+	d.mu.Unlock()
+	return tracked, nil
+}
+
+// Closes every connection to a server other than the new master.
+func (d *sentinelDialer) switchMaster(addr string) {
+	d.mu.Lock()
+	stale := []*sentinelConn{}
+	for conn := range d.conns {
+		if conn.addr != addr {
+			stale = append(stale, conn)
+		}
+	}
+	d.mu.Unlock()
+	for _, conn := range stale {
+		conn.Close()
+	}
+}
+
+// Listens for failovers on one sentinel at a time until closed.
+func (d *sentinelDialer) watch() {
+	for i := 0; ; i++ {
+		select {
+		case <-d.closed:
+			return
+		default:
+		}
+		addr := d.config.SentinelAddrs[i%len(d.config.SentinelAddrs)]
+		sentinel := d.sentinel(addr)
+		err := d.listen(sentinel)
+		sentinel.Close()
+		if err != nil {
+			log.Printf("Lost sentinel %s. %s", addr, err.Error())
+		}
+		select {
+		case <-d.closed:
+			return
+		case <-time.After(SENTINEL_RETRY_INTERVAL):
+		}
+	}
+}
+
+func (d *sentinelDialer) listen(sentinel *redis.Client) error {
+	pubsub, err := sentinel.Subscribe("+switch-master")
+	if err != nil {
+		return err
+	}
+	defer pubsub.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-d.closed:
+			pubsub.Close()
+		case <-done:
+		}
+	}()
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			return err
+		}
+		// <master name> <old ip> <old port> <new ip> <new port>
+		parts := strings.Split(msg.Payload, " ")
+		if len(parts) != 5 || parts[0] != d.config.SentinelMaster {
+			continue
+		}
+		addr := net.JoinHostPort(parts[3], parts[4])
+		log.Printf("Sentinels moved master %s to %s.", parts[0], addr)
+		d.switchMaster(addr)
+	}
+}
@@ -5,16 +5,19 @@ import (
 )
 
 type Beacon struct {
-	ID          uint64
-	Image       []byte
-	Thumbnail   []byte
-	Location    Geotag
-	PosterID    uint64
-	Description string
-	Hearts      uint32
-	Flags       uint32
-	Time        time.Time
-	Comments    []Comment
+	ID            uint64
+	Image         []byte
+	Thumbnail     []byte
+	Location      Geotag
+	ExactLocation *Geotag
+	Precision     Precision
+	PosterID      uint64
+	Description   string
+	Hearts        uint32
+	Flags         uint32
+	Time          time.Time
+	Pending       bool
+	Comments      []Comment
 }
 
 type Comment struct {
@@ -25,4 +28,5 @@ type Comment struct {
 	Hearts   uint32
 	Flags    uint32
 	Time     time.Time
+	Pending  bool
 }
@@ -3,6 +3,7 @@ package beaconpost
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"math"
 )
 
@@ -49,9 +50,9 @@ func Distance(p1 Geotag, p2 Geotag) float64 {
 		Longitude: ToRadians(p2.Longitude - p1.Longitude),
 	}
 	a := math.Pow(math.Sin(delta.Latitude/2.0), 2) +
-		math.Cos(ToRadians(p1.Latitude)) +
-		math.Cos(ToRadians(p2.Latitude)) +
-		math.Pow(math.Sin(delta.Longitude/2.0), 2)
+		math.Cos(ToRadians(p1.Latitude))*
+			math.Cos(ToRadians(p2.Latitude))*
+			math.Pow(math.Sin(delta.Longitude/2.0), 2)
 	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1.0-a))
 	return c * 6371.0
 }
@@ -59,3 +60,76 @@ func Distance(p1 Geotag, p2 Geotag) float64 {
 func KilometersToMiles(km float64) float64 {
 	return 0.621371 * km
 }
+
+// Precision controls how much of a beacon's location is revealed to
+// other users. Anything coarser than PrecisionExact is snapped to the
+// center of a grid cell of roughly the given size.
+type Precision uint8
+
+const (
+	PrecisionExact Precision = iota
+	Precision100m
+	Precision1km
+	PrecisionNeighborhood
+)
+
+const metersPerDegreeLatitude = 111320.0
+
+var precisionNames = map[Precision]string{
+	PrecisionExact:        "exact",
+	Precision100m:         "100m",
+	Precision1km:          "1km",
+	PrecisionNeighborhood: "neighborhood",
+}
+
+var precisionCellMeters = map[Precision]float64{
+	PrecisionExact:        0.0,
+	Precision100m:         100.0,
+	Precision1km:          1000.0,
+	PrecisionNeighborhood: 3000.0,
+}
+
+func (p Precision) String() string {
+	if name, ok := precisionNames[p]; ok {
+		return name
+	}
+	return precisionNames[PrecisionExact]
+}
+
+func ParsePrecision(name string) (Precision, error) {
+	if name == "" {
+		return PrecisionExact, nil
+	}
+	for p, pName := range precisionNames {
+		if pName == name {
+			return p, nil
+		}
+	}
+	return PrecisionExact, errors.New("Unknown location precision.")
+}
+
+// Snaps the geotag to the center of the grid cell containing it.
+// Cells are square in meters, so longitude steps widen toward the
+// poles. The result depends only on the input, so repeated posts
+// from the same spot always land on the same point.
+func (tag Geotag) Fuzz(p Precision) Geotag {
+	cell, ok := precisionCellMeters[p]
+	if !ok || cell == 0.0 {
+		return tag
+	}
+	latStep := cell / metersPerDegreeLatitude
+	lat := snapToCell(tag.Latitude, latStep)
+	lat = math.Max(-90.0, math.Min(90.0, lat))
+	cosLat := math.Cos(ToRadians(lat))
+	if cosLat < 0.01 {
+		cosLat = 0.01
+	}
+	lonStep := latStep / cosLat
+	lon := snapToCell(tag.Longitude+180.0, lonStep) - 180.0
+	lon = math.Max(-180.0, math.Min(180.0, lon))
+	return Geotag{Latitude: lat, Longitude: lon}
+}
+
+func snapToCell(val float64, step float64) float64 {
+	return (math.Floor(val/step) + 0.5) * step
+}
@@ -1,9 +1,17 @@
 package beaconpost
 
 import (
+	"errors"
+	"strings"
 	"time"
 )
 
+// Posts by deleted accounts are shown under this ID and username.
+const (
+	DeletedUserID   = 0
+	DeletedUsername = "[deleted]"
+)
+
 type User struct {
 	ID              uint64
 	Username        string
@@ -16,7 +24,72 @@ type User struct {
 	Email           string
 }
 
+// Beacons is one page of the beacons BeaconCount counts.
 type UserProfile struct {
 	User
-	Beacons []Beacon
+	Beacons     []Beacon
+	BeaconCount uint64
+}
+
+// DeletePolicy says what happens to a user's posts when they delete
+// their account.
+type DeletePolicy uint8
+
+const (
+	// Posts stay up but are no longer tied to the account.
+	AnonymizePosts DeletePolicy = iota
+	// Posts are removed, along with every comment on removed beacons.
+	DeletePosts
+)
+
+var deletePolicyNames = map[DeletePolicy]string{
+	AnonymizePosts: "anonymize",
+	DeletePosts:    "delete",
+}
+
+func (p DeletePolicy) String() string {
+	return deletePolicyNames[p]
+}
+
+func ParseDeletePolicy(name string) (DeletePolicy, error) {
+	for policy, policyName := range deletePolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return AnonymizePosts, errors.New("Unknown delete policy.")
+}
+
+// Usernames are unique regardless of case, so they are reserved
+// under this form.
+func UsernameKey(username string) string {
+	return strings.ToLower(username)
+}
+
+// ExportStatus tracks an archive of a user's data while it is built.
+type ExportStatus uint8
+
+const (
+	ExportPending ExportStatus = iota
+	ExportReady
+	ExportFailed
+)
+
+var exportStatusNames = map[ExportStatus]string{
+	ExportPending: "pending",
+	ExportReady:   "ready",
+	ExportFailed:  "failed",
+}
+
+func (s ExportStatus) String() string {
+	return exportStatusNames[s]
+}
+
+func ParseExportStatus(name string) (ExportStatus, error) {
+	for status, statusName := range exportStatusNames {
+		if statusName == name {
+			return status, nil
+		}
+	}
+	return ExportFailed, errors.New("Unknown export status.")
 }
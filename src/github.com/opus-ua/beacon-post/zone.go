@@ -0,0 +1,140 @@
+package beaconpost
+
+import (
+	"errors"
+)
+
+// ZoneRule says what happens to posts made inside a zone.
+type ZoneRule uint8
+
+const (
+	// Posting inside the zone is refused.
+	ZoneDenyPost ZoneRule = iota
+	// Posts inside the zone are accepted but left out of local searches.
+	ZoneHideLocal
+	// Posts inside the zone are held until a moderator approves them.
+	ZoneRequireReview
+	// Posting is only allowed inside launch regions, if any exist.
+	ZoneLaunchRegion
+)
+
+var zoneRuleNames = map[ZoneRule]string{
+	ZoneDenyPost:      "deny",
+	ZoneHideLocal:     "hide",
+	ZoneRequireReview: "review",
+	ZoneLaunchRegion:  "region",
+}
+
+func (rule ZoneRule) String() string {
+	return zoneRuleNames[rule]
+}
+
+func ParseZoneRule(name string) (ZoneRule, error) {
+	for rule, ruleName := range zoneRuleNames {
+		if ruleName == name {
+			return rule, nil
+		}
+	}
+	return ZoneDenyPost, errors.New("Unknown zone rule.")
+}
+
+// A zone is either a circle, given by Center and Radius in
+// kilometers, or a polygon given by its vertices in order.
+type Zone struct {
+	ID      uint64
+	Name    string
+	Rule    ZoneRule
+	Center  Geotag
+	Radius  float64
+	Polygon []Geotag
+}
+
+func (z *Zone) IsCircle() bool {
+	return len(z.Polygon) == 0
+}
+
+func (z *Zone) Validate() error {
+	if _, ok := zoneRuleNames[z.Rule]; !ok {
+		return errors.New("Unknown zone rule.")
+	}
+	if z.IsCircle() {
+		if z.Radius <= 0.0 {
+			return errors.New("Circular zone must have a positive radius.")
+		}
+		return nil
+	}
+	if len(z.Polygon) < 3 {
+		return errors.New("Polygonal zone must have at least three vertices.")
+	}
+	return nil
+}
+
+func (z *Zone) Contains(tag Geotag) bool {
+	if z.IsCircle() {
+		return Distance(z.Center, tag) <= z.Radius
+	}
+	return polygonContains(z.Polygon, tag)
+}
+
+// Ray casting in the plane of latitude and longitude. Good enough
+// for zones that are small and don't cross the antimeridian.
+func polygonContains(poly []Geotag, tag Geotag) bool {
+	inside := false
+	j := len(poly) - 1
+	for i := 0; i < len(poly); i++ {
+		a, b := poly[i], poly[j]
+		if (a.Latitude > tag.Latitude) != (b.Latitude > tag.Latitude) {
+			crossing := (b.Longitude-a.Longitude)*(tag.Latitude-a.Latitude)/
+				(b.Latitude-a.Latitude) + a.Longitude
+			if tag.Longitude < crossing {
+				inside = !inside
+			}
+		}
+		j = i
+	}
+	return inside
+}
+
+// Decides whether a post at tag may be made, and if so, whether it
+// must be reviewed first. Once any launch region exists, posts made
+// outside all of them are refused.
+func CheckZones(zones []Zone, tag Geotag) (allowed bool, review bool) {
+	hasRegions := false
+	inRegion := false
+	for _, zone := range zones {
+		if zone.Rule == ZoneLaunchRegion {
+			hasRegions = true
+		}
+		if !zone.Contains(tag) {
+			continue
+		}
+		switch zone.Rule {
+		case ZoneDenyPost:
+			return false, false
+		case ZoneRequireReview:
+			review = true
+		case ZoneLaunchRegion:
+			inRegion = true
+		}
+	}
+	if hasRegions && !inRegion {
+		return false, false
+	}
+	return true, review
+}
+
+// Whether post should be left out of local searches. A post whose
+// published location was coarsened is judged by where it really is,
+// so it can't escape a zone near the edge.
+func HiddenByZones(zones []Zone, post Beacon) bool {
+	tag := post.Location
+	if post.ExactLocation != nil {
+		tag = *post.ExactLocation
+	}
+	for _, zone := range zones {
+		if zone.Rule == ZoneHideLocal && zone.Contains(tag) {
+			return true
+		}
+	}
+	return false
+}
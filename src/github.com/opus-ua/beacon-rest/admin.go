@@ -0,0 +1,195 @@
+package beaconrest
+
+import (
+    "encoding/json"
+    "net/http"
+    "io"
+    "io/ioutil"
+    . "github.com/opus-ua/beacon-post"
+    . "github.com/opus-ua/beacon-db"
+)
+
+func ToZoneMsg(zone Zone) ZoneMsg {
+    msg := ZoneMsg{
+        ID:     zone.ID,
+        Name:   zone.Name,
+        Rule:   zone.Rule.String(),
+    }
+    if zone.IsCircle() {
+        msg.Center = &LocationMsg{
+            Latitude:  zone.Center.Latitude,
+            Longitude: zone.Center.Longitude,
+        }
+        msg.Radius = zone.Radius
+    } else {
+        for _, vertex := range zone.Polygon {
+            msg.Polygon = append(msg.Polygon, LocationMsg{
+                Latitude:  vertex.Latitude,
+                Longitude: vertex.Longitude,
+            })
+        }
+    }
+    return msg
+}
+
+func ParseZoneJson(w http.ResponseWriter, r *http.Request) (Zone, error) {
+    body, err := ioutil.ReadAll(r.Body)
+    if err != nil {
+        return Zone{}, WriteErrorResp(w, err.Error(), ServerError)
+    }
+    var zoneMsg ZoneMsg
+    err = json.Unmarshal(body, &zoneMsg)
+    if err != nil {
+        return Zone{}, WriteErrorResp(w, err.Error(), JsonError)
+    }
+    rule, err := ParseZoneRule(zoneMsg.Rule)
+    if err != nil {
+        return Zone{}, WriteErrorResp(w, err.Error(), JsonError)
+    }
+    zone := Zone{
+        Name:   zoneMsg.Name,
+        Rule:   rule,
+        Radius: zoneMsg.Radius,
+    }
+    if zoneMsg.Center != nil {
+        zone.Center = Geotag{
+            Latitude:  zoneMsg.Center.Latitude,
+            Longitude: zoneMsg.Center.Longitude,
+        }
+    }
+    for _, vertex := range zoneMsg.Polygon {
+        zone.Polygon = append(zone.Polygon, Geotag{
+            Latitude:  vertex.Latitude,
+            Longitude: vertex.Longitude,
+        })
+    }
+    if err = zone.Validate(); err != nil {
+        return Zone{}, WriteErrorResp(w, err.Error(), JsonError)
+    }
+    return zone, nil
+}
+
+func HandleGetZones(w http.ResponseWriter, r *http.Request, db *DBClient) {
+    zones, err := db.GetZones()
+    if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    respMsg := ZoneListMsg{Zones: []ZoneMsg{}}
+    for _, zone := range zones {
+        respMsg.Zones = append(respMsg.Zones, ToZoneMsg(zone))
+    }
+    respJson, err := json.Marshal(respMsg)
+    if err != nil {
+        WriteErrorResp(w, err.Error(), ServerError)
+        return
+    }
+    io.WriteString(w, string(respJson))
+}
+
+func HandleCreateZone(w http.ResponseWriter, r *http.Request, db *DBClient) {
+    zone, err := ParseZoneJson(w, r)
+    if err != nil {
+        return
+    }
+    id, err := db.AddZone(&zone)
+    if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    respJson, err := json.Marshal(PostID{ID: id})
+    if err != nil {
+        WriteErrorResp(w, err.Error(), ServerError)
+        return
+    }
+    io.WriteString(w, string(respJson))
+}
+
+func HandleUpdateZone(w http.ResponseWriter, r *http.Request, id uint64, db *DBClient) {
+    zone, err := ParseZoneJson(w, r)
+    if err != nil {
+        return
+    }
+    exists, err := db.ZoneExists(id)
+    if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    if !exists {
+        WriteErrorResp(w, "Zone not found in db.", ZoneNotFound)
+        return
+    }
+    zone.ID = id
+    err = db.SetZone(&zone)
+    if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    w.WriteHeader(200)
+}
+
+func HandleDeleteZone(w http.ResponseWriter, r *http.Request, id uint64, db *DBClient) {
+    exists, err := db.ZoneExists(id)
+    if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    if !exists {
+        WriteErrorResp(w, "Zone not found in db.", ZoneNotFound)
+        return
+    }
+    err = db.DeleteZone(id)
+    if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    w.WriteHeader(200)
+}
+
+func HandleGetPending(w http.ResponseWriter, r *http.Request, db *DBClient) {
+    pending, err := db.GetPending()
+    if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    msg := PendingListMsg{Beacons: []uint64{}, Comments: []uint64{}}
+    for _, id := range pending {
+        postType, err := db.GetPostType(id)
+        if err == ErrPostNotFound {
+            continue
+        }
+        if err != nil {
+            WriteErrorResp(w, err.Error(), DatabaseError)
+            return
+        }
+        if postType == "comment" {
+            msg.Comments = append(msg.Comments, id)
+        } else {
+            msg.Beacons = append(msg.Beacons, id)
+        }
+    }
+    respJson, err := json.Marshal(msg)
+    if err != nil {
+        WriteErrorResp(w, err.Error(), ServerError)
+        return
+    }
+    io.WriteString(w, string(respJson))
+}
+
+func HandleApproveBeacon(w http.ResponseWriter, r *http.Request, id uint64, db *DBClient) {
+    err := db.ApproveBeacon(id)
+    if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    w.WriteHeader(200)
+}
+
+func HandleRejectBeacon(w http.ResponseWriter, r *http.Request, id uint64, db *DBClient) {
+    err := db.RejectBeacon(id)
+    if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    w.WriteHeader(200)
+}
@@ -0,0 +1,149 @@
+package beaconrest
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    . "github.com/opus-ua/beacon-db"
+)
+
+// The user a request was made by, as resolved from its BasicAuth.
+type Principal struct {
+    UserID uint64
+    // Only set on routes behind RequireAdmin.
+    Admin bool
+}
+
+type principalKey struct{}
+
+// The outcome of checking the credentials of a request, kept so every
+// middleware of a route shares one lookup.
+type authResult struct {
+    principal Principal
+    // Whether the request carried BasicAuth at all.
+    given bool
+    // Nil if the credentials were accepted.
+    err error
+    errCode int
+}
+
+// Checks the BasicAuth of r, if any, and returns r with the outcome in
+// its context. Never writes a response: whether a failure matters is
+// up to the middleware of the route. Only the auth middleware calls
+// this, so public routes never look up credentials.
+func resolveAuth(w http.ResponseWriter, r *http.Request, db *DBClient) *http.Request {
+    if _, ok := r.Context().Value(principalKey{}).(authResult); ok {
+        return r
+    }
+    result := authResult{}
+    if _, _, ok := r.BasicAuth(); ok {
+        result.given = true
+        result.principal, result.err, result.errCode = checkCredentials(w, r, db)
+    }
+    return r.WithContext(context.WithValue(r.Context(), principalKey{}, result))
+}
+
+func checkCredentials(w http.ResponseWriter, r *http.Request, db *DBClient) (Principal, error, int) {
+    userIDSigned, authKey, err := GetAuthenticationInfo(w, r)
+    if err != nil {
+        return Principal{}, err, AuthenticationError
+    }
+    if userIDSigned < 0 {
+        return Principal{}, errors.New("Unable to read user ID."), AuthenticationError
+    }
+    userID := uint64(userIDSigned)
+    authed, err := db.UserAuthenticated(userID, authKey)
+    if err != nil {
+        return Principal{}, err, DatabaseError
+    }
+    if !authed {
+        return Principal{}, errors.New("Could not authenticate."), AuthenticationError
+    }
+    authenticated(w, userID, db)
+    return Principal{UserID: userID}, nil, 0
+}
+
+func authFromContext(ctx context.Context) authResult {
+    result, _ := ctx.Value(principalKey{}).(authResult)
+    return result
+}
+
+// The user who made the request ctx belongs to, if the request carried
+// valid credentials.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+    result := authFromContext(ctx)
+    if !result.given || result.err != nil {
+        return Principal{}, false
+    }
+    return result.principal, true
+}
+
+// The id of the user who made r. Only meaningful on routes behind
+// RequireUser or RequireAdmin.
+func AuthenticatedUser(r *http.Request) uint64 {
+    principal, _ := PrincipalFromContext(r.Context())
+    return principal.UserID
+}
+
+// The id of the user who made r, or -1 for anonymous requests.
+func viewerOf(r *http.Request) int64 {
+    if principal, ok := PrincipalFromContext(r.Context()); ok {
+        return int64(principal.UserID)
+    }
+    return -1
+}
+
+// Rejects requests without valid credentials.
+func RequireUser(next BeaconHandler) BeaconHandler {
+    return func(w http.ResponseWriter, r *http.Request, db *DBClient) {
+        r = resolveAuth(w, r, db)
+        result := authFromContext(r.Context())
+        if !result.given {
+            WriteErrorResp(w, "Unable to parse BasicAuth.", AuthenticationError)
+            return
+        }
+        if result.err != nil {
+            WriteErrorResp(w, result.err.Error(), result.errCode)
+            return
+        }
+        if !AllowUser(w, r, result.principal.UserID) {
+            return
+        }
+        next(w, r, db)
+    }
+}
+
+// Lets anonymous requests through but rejects those with credentials
+// that don't check out, rather than quietly serving them as anonymous.
+func OptionalUser(next BeaconHandler) BeaconHandler {
+    return func(w http.ResponseWriter, r *http.Request, db *DBClient) {
+        r = resolveAuth(w, r, db)
+        result := authFromContext(r.Context())
+        if result.given && result.err != nil {
+            WriteErrorResp(w, result.err.Error(), result.errCode)
+            return
+        }
+        if result.given && !AllowUser(w, r, result.principal.UserID) {
+            return
+        }
+        next(w, r, db)
+    }
+}
+
+// Rejects requests not made by an administrator.
+func RequireAdmin(next BeaconHandler) BeaconHandler {
+    return RequireUser(func(w http.ResponseWriter, r *http.Request, db *DBClient) {
+        result := authFromContext(r.Context())
+        admin, err := db.IsAdmin(result.principal.UserID)
+        if err != nil {
+            WriteErrorResp(w, err.Error(), DatabaseError)
+            return
+        }
+        if !admin {
+            WriteErrorResp(w, "User is not an administrator.", PermissionDenied)
+            return
+        }
+        result.principal.Admin = true
+        next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, result)), db)
+    })
+}
@@ -1,98 +1,340 @@
 package beaconrest
 
 import (
+    "context"
+    "crypto/tls"
 	"encoding/json"
+    "errors"
+    "log"
+    "net"
     "net/http"
     "fmt"
-    "strings"
-    "strconv"
 	"io"
+    "sync"
+    "time"
 	. "github.com/opus-ua/beacon-db"
 )
 
 type BeaconServer struct {
+    // The root of the server's routes. Its methods register them.
+    *RouteGroup
     db *DBClient
-    mux *http.ServeMux
+    router router
     authCodes []string
     version VersionInfo
+    limiter *RateLimiter
+    policy PostPolicy
+    accounts AccountPolicy
+    exporter *Exporter
+    limits ServerLimits
+    // Set by SetTLS.
+    tls TLSConfig
+    certs *CertReloader
+    // Set by SetMetricsAddr.
+    metricsAddr string
+    // Set by Start.
+    server *http.Server
+    redirect *http.Server
+    metrics *http.Server
+    serverMutex sync.Mutex
 }
 
-func NewBeaconServer(dev bool, testing bool, version VersionInfo, auth []string) *BeaconServer {
+// Limits on connections and requests. Zero disables a limit.
+type ServerLimits struct {
+    ReadTimeout time.Duration `toml:"read_timeout"`
+    WriteTimeout time.Duration `toml:"write_timeout"`
+    IdleTimeout time.Duration `toml:"idle_timeout"`
+    MaxHeaderBytes int `toml:"max_header_bytes"`
+    // Larger bodies are answered with a 413.
+    MaxBodyBytes int64 `toml:"max_body_bytes"`
+    // How long Shutdown waits for requests in flight and queued
+    // exports before giving up on them.
+    ShutdownTimeout time.Duration `toml:"shutdown_timeout"`
+}
+
+// The body limit leaves room for a full size image and its json.
+var DefaultServerLimits = ServerLimits{
+    ReadTimeout: time.Minute,
+    WriteTimeout: time.Minute,
+    IdleTimeout: 2 * time.Minute,
+    MaxHeaderBytes: 1 << 20,
+    MaxBodyBytes: 2 * MAX_IMG_BYTES,
+    ShutdownTimeout: 30 * time.Second,
+}
+
+// Policies applied to new posts.
+type PostPolicy struct {
+    Proximity ProximityPolicy
+    Filter    *ContentFilter
+}
+
+func NewBeaconServer(dev bool, testing bool, redisConfig RedisConfig, version VersionInfo, auth []string) (*BeaconServer, error) {
+    db, err := NewDB(redisConfig, dev, testing)
+    if err != nil {
+        return nil, err
+    }
     bs := &BeaconServer{
-        db: NewDB(dev, testing),
-        mux: http.DefaultServeMux,
+        db: db,
         authCodes: auth,
         version: version,
+        policy: PostPolicy{
+            Proximity: DefaultProximityPolicy,
+        },
+        accounts: DefaultAccountPolicy,
+        limits: DefaultServerLimits,
     }
+    bs.RouteGroup = &RouteGroup{server: bs}
+    bs.policy.Filter, _ = NewContentFilter(DefaultFilterConfig)
+    bs.exporter = NewExporter(bs.db, EXPORT_WORKERS)
+    if !testing {
+        bs.limiter = NewRateLimiter(NewRedisRateLimitStore(bs.db), DefaultRateLimits)
+    }
+    registerActiveUsers(bs.db)
     bs.HandleVersion("/version")
+    bs.HandleHealth("/healthz")
+    bs.HandleReady("/readyz")
     bs.HandleAuth("/createaccount", "POST", HandleCreateAccount)
-    bs.HandlePost("/beacon", HandlePostBeacon)
-    bs.HandlePost("/local", HandleGetLocal)
-    bs.HandlePost("/comment", HandlePostComment)
-    bs.HandleIntParam("/beacon/", "GET", HandleGetBeacon)
-    bs.HandleIntParam("/heart/", "POST", HandleHeartPost)
-    bs.HandleIntParam("/unheart/", "POST", HandleUnheartPost)
-    bs.HandleIntParam("/flag/", "POST", HandleFlagPost)
-    return bs
+
+    viewers := bs.Group("", OptionalUser)
+    viewers.HandlePost("/local", HandleGetLocal)
+    viewers.HandleIntParam("/beacon/{id}", "GET", HandleGetBeacon)
+    viewers.HandleIntParam("/user/{id}", "GET", HandleGetUser)
+
+    users := bs.Group("", RequireUser)
+    users.HandlePolicy("/beacon", "POST", HandlePostBeacon)
+    users.HandlePolicy("/comment", "POST", HandlePostComment)
+    users.HandleIntParam("/heart/{id}", "POST", HeartHandler("", true))
+    users.HandleIntParam("/unheart/{id}", "POST", HeartHandler("", false))
+    users.HandleIntParam("/flag/{id}", "POST", FlagHandler(""))
+    users.HandleIntParam("/beacon/{id}/heart", "POST", HeartHandler("beacon", true))
+    users.HandleIntParam("/beacon/{id}/unheart", "POST", HeartHandler("beacon", false))
+    users.HandleIntParam("/beacon/{id}/flag", "POST", FlagHandler("beacon"))
+    users.HandleIntParam("/comment/{id}/heart", "POST", HeartHandler("comment", true))
+    users.HandleIntParam("/comment/{id}/unheart", "POST", HeartHandler("comment", false))
+    users.HandleIntParam("/comment/{id}/flag", "POST", FlagHandler("comment"))
+    users.HandleGet("/me", HandleGetMe)
+    users.HandleAccount("/me", "DELETE", HandleDeleteMe)
+    users.HandleAccount("/me/username", "PUT", HandleChangeUsername)
+    users.HandlePost("/me/export", bs.exporter.HandleRequestExport)
+    users.HandleGet("/export/{token}", HandleDownloadExport)
+
+    admins := bs.Group("", RequireAdmin)
+    admins.HandleGet("/zones", HandleGetZones)
+    admins.HandlePost("/zone", HandleCreateZone)
+    admins.HandleIntParam("/zone/{id}", "POST", HandleUpdateZone)
+    admins.HandleIntParam("/deletezone/{id}", "POST", HandleDeleteZone)
+    admins.HandleGet("/pending", HandleGetPending)
+    admins.HandleIntParam("/approve/{id}", "POST", HandleApproveBeacon)
+    admins.HandleIntParam("/reject/{id}", "POST", HandleRejectBeacon)
+    return bs, nil
 }
 
+// The default of how often filter rules are checked for changes.
+const FILTER_RELOAD_INTERVAL = 10 * time.Second
+
 type BeaconHandler func(http.ResponseWriter, *http.Request, *DBClient)
 type IntParamBeaconHandler func(http.ResponseWriter, *http.Request, uint64, *DBClient)
 type AuthBeaconHandler func(http.ResponseWriter, *http.Request, []string, *DBClient)
+type PolicyBeaconHandler func(http.ResponseWriter, *http.Request, *PostPolicy, *DBClient)
+type AccountBeaconHandler func(http.ResponseWriter, *http.Request, *AccountPolicy, *DBClient)
 
-func (bm *BeaconServer) Start(port uint) error {
-    loggingHandler := NewApacheLoggingHandler(bm.mux)
+// Listens on addr, a host:port where an empty host means every
+// interface. Serves HTTPS if SetTLS was called. Returns nil once
+// Shutdown is called.
+func (bm *BeaconServer) Start(addr string) error {
+    handler := bm.limitBody(http.HandlerFunc(bm.dispatch))
+    if bm.certs != nil && bm.tls.HSTSMaxAge > 0 {
+        handler = hstsHandler(bm.tls.hstsHeader(), handler)
+    }
     server := &http.Server{
-        Addr: fmt.Sprintf(":%d", port),
-        Handler: loggingHandler,
+        Addr: addr,
+        Handler: NewRequestLoggingHandler(handler),
+        ReadTimeout: bm.limits.ReadTimeout,
+        WriteTimeout: bm.limits.WriteTimeout,
+        IdleTimeout: bm.limits.IdleTimeout,
+        MaxHeaderBytes: bm.limits.MaxHeaderBytes,
+    }
+    var redirect *http.Server
+    if bm.certs != nil && bm.tls.RedirectAddr != "" {
+        listener, err := net.Listen("tcp", bm.tls.RedirectAddr)
+        if err != nil {
+            return err
+        }
+        redirect = &http.Server{
+            Handler: NewRequestLoggingHandler(redirectHandler(addr)),
+            ReadTimeout: bm.limits.ReadTimeout,
+            WriteTimeout: bm.limits.WriteTimeout,
+            IdleTimeout: bm.limits.IdleTimeout,
+            MaxHeaderBytes: bm.limits.MaxHeaderBytes,
+        }
+        go func() {
+            if err := redirect.Serve(listener); err != http.ErrServerClosed {
+                log.Printf("HTTPS redirect stopped. %s", err.Error())
+            }
+        }()
     }
-    return server.ListenAndServe()
+    var metrics *http.Server
+    if bm.metricsAddr != "" {
+        var err error
+        if metrics, err = bm.startMetrics(); err != nil {
+            if redirect != nil {
+                redirect.Close()
+            }
+            return err
+        }
+    }
+    bm.serverMutex.Lock()
+    bm.server = server
+    bm.redirect = redirect
+    bm.metrics = metrics
+    bm.serverMutex.Unlock()
+    var err error
+    if bm.certs != nil {
+        server.TLSConfig = &tls.Config{
+            MinVersion: tls.VersionTLS12,
+            GetCertificate: bm.certs.GetCertificate,
+        }
+        err = server.ListenAndServeTLS("", "")
+    } else {
+        err = server.ListenAndServe()
+    }
+    if err == http.ErrServerClosed {
+        return nil
+    }
+    return err
 }
 
-func (bm *BeaconServer) TestingMode() error {
-    return bm.db.SelectTestingTable()
+func (bm *BeaconServer) limitBody(handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        max := bm.limits.MaxBodyBytes
+        if max > 0 {
+            if r.ContentLength > max {
+                msg := fmt.Sprintf("Body of %d bytes is over the limit of %d.", r.ContentLength, max)
+                WriteErrorResp(w, msg, RequestTooLarge)
+                return
+            }
+            r.Body = http.MaxBytesReader(w, r.Body, max)
+        }
+        handler.ServeHTTP(w, r)
+    })
 }
 
-func (bm *BeaconServer) HandleMethod(uri string, method string, handler BeaconHandler) {
-    bm.mux.HandleFunc(uri, func(w http.ResponseWriter, r *http.Request) {
-        if r.Method != method {
-            msg := fmt.Sprintf("Only method %s supported.", method)
-            WriteErrorResp(w, msg, ProtocolError)
-            return
+// Stops accepting connections, waits for requests in flight and
+// queued exports to finish, then closes the database. Requests still
+// running when ctx is done are abandoned, and exports are cancelled
+// and marked as failed.
+func (bm *BeaconServer) Shutdown(ctx context.Context) error {
+    bm.serverMutex.Lock()
+    server, redirect, metrics := bm.server, bm.redirect, bm.metrics
+    bm.serverMutex.Unlock()
+    var err error
+    if redirect != nil {
+        redirect.Close()
+    }
+    if metrics != nil {
+        metrics.Close()
+    }
+    if server != nil {
+        if err = server.Shutdown(ctx); err != nil {
+            server.Close()
         }
-        handler(w, r, bm.db)
-    })
+    }
+    if bm.exporter.Close(ctx) != nil {
+        log.Printf("Cancelled exports still in progress and marked them as failed.")
+    }
+    bm.policy.Filter.Close()
+    if bm.certs != nil {
+        bm.certs.Close()
+    }
+    if dbErr := bm.db.Close(); err == nil {
+        err = dbErr
+    }
+    return err
 }
 
-func (bm *BeaconServer) HandleGet(uri string, handler BeaconHandler) {
-    bm.HandleMethod(uri, "GET", handler)
+// Replaces the rate limiter. A nil limiter disables rate limiting.
+func (bm *BeaconServer) SetRateLimiter(limiter *RateLimiter) {
+    bm.limiter = limiter
 }
 
-func (bm *BeaconServer) HandlePost(uri string, handler BeaconHandler) {
-    bm.HandleMethod(uri, "POST", handler)
+func (bm *BeaconServer) SetPostPolicy(policy PostPolicy) {
+    bm.policy = policy
 }
 
-func (bm *BeaconServer) HandleIntParam(uri string, method string, handler IntParamBeaconHandler) {
-    bm.HandleMethod(uri, method, func(w http.ResponseWriter, r *http.Request, db *DBClient) {
-        splitURI := strings.Split(r.RequestURI, "/")
-        if len(splitURI) < 3 {
-            WriteErrorResp(w, "Could not parse uri parameter.", ProtocolError)
-            return
-        }
-        intStr := splitURI[2]
-        intSigned, err := strconv.ParseInt(intStr, 10, 64)
-        if err != nil {
-            WriteErrorResp(w, "Could not parse uri parameter.", ProtocolError)
-            return
-        }
-        handler(w, r, uint64(intSigned), db)
-    })
+func (bm *BeaconServer) SetProximityPolicy(policy ProximityPolicy) {
+    bm.policy.Proximity = policy
 }
 
-func (bm *BeaconServer) HandleAuth(uri string, method string, handler AuthBeaconHandler) {
-    bm.HandleMethod(uri, method, func(w http.ResponseWriter, r *http.Request, db *DBClient) {
-        handler(w, r, bm.authCodes, db)
-    })
+func (bm *BeaconServer) SetAccountPolicy(policy AccountPolicy) {
+    bm.accounts = policy
+}
+
+// Takes effect on the next call to Start.
+func (bm *BeaconServer) SetServerLimits(limits ServerLimits) {
+    bm.limits = limits
+}
+
+// Loads the certificate to serve HTTPS with from the next call to
+// Start, and reloads it whenever its files change.
+func (bm *BeaconServer) SetTLS(config TLSConfig) error {
+    if err := config.Validate(); err != nil {
+        return err
+    }
+    if !config.Enabled() {
+        return nil
+    }
+    certs, err := NewCertReloader(config.CertFile, config.KeyFile)
+    if err != nil {
+        return err
+    }
+    certs.Watch(config.ReloadInterval)
+    bm.tls = config
+    bm.certs = certs
+    return nil
+}
+
+// Reloads the certificate set by SetTLS at once. Does nothing if the
+// server does not use TLS.
+func (bm *BeaconServer) ReloadCertificate() error {
+    if bm.certs == nil {
+        return nil
+    }
+    return bm.certs.Reload()
+}
+
+// Replaces the limits of the rate limiter, keeping its buckets. Does
+// nothing if rate limiting is disabled.
+func (bm *BeaconServer) SetRateLimits(limits map[string]EndpointLimits) {
+    if bm.limiter != nil {
+        bm.limiter = NewRateLimiter(bm.limiter.Store(), limits)
+    }
+}
+
+// Loads content filter rules from a JSON file and reloads them
+// whenever the file changes, checking every interval.
+func (bm *BeaconServer) LoadFilterRules(path string, interval time.Duration) error {
+    if interval <= 0 {
+        return errors.New("Filter reload interval must be positive.")
+    }
+    if err := bm.policy.Filter.LoadFile(path); err != nil {
+        return err
+    }
+    bm.policy.Filter.Watch(interval)
+    return nil
+}
+
+// Moves durable storage to Postgres. See DBClient.UsePostgres.
+func (bm *BeaconServer) UsePostgres(dsn string, redisCache bool) error {
+    return bm.db.UsePostgres(dsn, redisCache)
+}
+
+// Returns an error if the database must be migrated before serving.
+func (bm *BeaconServer) CheckSchema() error {
+    return bm.db.CheckSchema()
+}
+
+func (bm *BeaconServer) TestingMode() error {
+    return bm.db.SelectTestingTable()
 }
 
 type VersionInfo struct {
@@ -1,17 +1,20 @@
 package beaconrest
 
 import (
+    "context"
     "encoding/json"
     "net/http"
     "fmt"
-    "log"
+    "log/slog"
     "runtime"
     "path"
+    "strconv"
 )
 
 type JSONError struct {
     Code int `json:"code"`
 	Msg string `json:"error"`
+    RequestID string `json:"request_id,omitempty"`
 }
 
 func (e JSONError) Error() string {
@@ -27,11 +30,23 @@ const (
     ProtocolError = 31
     JsonError = 32
     AuthenticationError = 33
+    RateLimited = 34
+    PermissionDenied = 35
+    LocationDenied = 36
+    LocationImplausible = 37
+    ContentRejected = 38
+    PostNotFound = 39
     DatabaseError = 40
     ServerError = 41
     ExternalServiceError = 42
+    RequestTooLarge = 43
+    EndpointNotFound = 44
+    MethodNotAllowed = 45
     NoAccountFound = 50
     UsernameExists = 51
+    UsernameCooldown = 52
+    ExportNotFound = 53
+    ZoneNotFound = 54
     UnspecifiedError = 99
 )
 
@@ -42,11 +57,23 @@ func init() {
         31: ErrResp{HttpCode: 400, HttpMsg: "Protocol error."},
         32: ErrResp{HttpCode: 400, HttpMsg: "Json error."},
         33: ErrResp{HttpCode: 400, HttpMsg: "Authentication error."},
+        34: ErrResp{HttpCode: 429, HttpMsg: "Too many requests."},
+        35: ErrResp{HttpCode: 403, HttpMsg: "Permission denied."},
+        36: ErrResp{HttpCode: 403, HttpMsg: "Posting is not allowed here."},
+        37: ErrResp{HttpCode: 403, HttpMsg: "Beacon location could not be verified."},
+        38: ErrResp{HttpCode: 400, HttpMsg: "Content is not allowed."},
+        39: ErrResp{HttpCode: 404, HttpMsg: "Post not found."},
         40: ErrResp{HttpCode: 500, HttpMsg: "Database error."},
         41: ErrResp{HttpCode: 500, HttpMsg: "Server error."},
         42: ErrResp{HttpCode: 400, HttpMsg: "External service error."},
+        43: ErrResp{HttpCode: 413, HttpMsg: "Request too large."},
+        44: ErrResp{HttpCode: 404, HttpMsg: "Endpoint not found."},
+        45: ErrResp{HttpCode: 405, HttpMsg: "Method not allowed."},
         50: ErrResp{HttpCode: 400, HttpMsg: "No account found."},
         51: ErrResp{HttpCode: 400, HttpMsg: "Username already exists."},
+        52: ErrResp{HttpCode: 429, HttpMsg: "Username was changed too recently."},
+        53: ErrResp{HttpCode: 404, HttpMsg: "Export not found."},
+        54: ErrResp{HttpCode: 404, HttpMsg: "Zone not found."},
         99: ErrResp{HttpCode: 500, HttpMsg: "Unspecified error."},
     }
 }
@@ -57,10 +84,20 @@ func WriteErrorResp(w http.ResponseWriter, debugMsg string, errCode int) error {
         err = errorCodes[99]
     }
     _, file, line, _ := runtime.Caller(1)
-    errMsg := fmt.Sprintf("%s:%d: %s", path.Base(file), line, debugMsg)
-    jsonObj := JSONError{Code: errCode, Msg: errMsg}
-    log.Printf(jsonObj.Error())
-    jsonErr, _ := json.Marshal(JSONError{Code: errCode, Msg: err.HttpMsg})
+    source := fmt.Sprintf("%s:%d", path.Base(file), line)
+    jsonObj := JSONError{Code: errCode, Msg: fmt.Sprintf("%s: %s", source, debugMsg)}
+    level := slog.LevelWarn
+    if err.HttpCode >= 500 {
+        level = slog.LevelError
+    }
+    errorResponses.WithLabelValues(strconv.Itoa(errCode)).Inc()
+    RequestLog(w).Log(context.Background(), level, err.HttpMsg,
+        "code", errCode, "error", debugMsg, "source", source)
+    jsonErr, _ := json.Marshal(JSONError{
+        Code: errCode,
+        Msg: err.HttpMsg,
+        RequestID: ResponseRequestID(w),
+    })
     http.Error(w, string(jsonErr), err.HttpCode)
     return jsonObj
 }
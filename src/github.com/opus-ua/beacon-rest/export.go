@@ -0,0 +1,299 @@
+package beaconrest
+
+import (
+    "archive/zip"
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "sync"
+    . "github.com/opus-ua/beacon-post"
+    . "github.com/opus-ua/beacon-db"
+)
+
+const (
+    EXPORT_WORKERS = 2
+    EXPORT_QUEUE_SIZE = 16
+    EXPORT_TOKEN_BYTES = 32
+)
+
+var ErrExportQueueFull = errors.New("Too many exports are in progress.")
+
+type exportJob struct {
+    token  string
+    userID uint64
+}
+
+// Builds archives of users' data in the background. Finished
+// archives are kept in the db until downloaded or expired.
+type Exporter struct {
+    db     *DBClient
+    jobs   chan exportJob
+    mutex  sync.Mutex
+    closed bool
+    wg     sync.WaitGroup
+    // Cancelled when Close gives up on the exports left.
+    ctx    context.Context
+    cancel context.CancelFunc
+}
+
+func NewExporter(db *DBClient, workers int) *Exporter {
+    e := &Exporter{
+        db:   db,
+        jobs: make(chan exportJob, EXPORT_QUEUE_SIZE),
+    }
+    e.ctx, e.cancel = context.WithCancel(context.Background())
+    for i := 0; i < workers; i++ {
+        e.wg.Add(1)
+        go e.work()
+    }
+    return e
+}
+
+func (e *Exporter) work() {
+    defer e.wg.Done()
+    for job := range e.jobs {
+        status := ExportReady
+        data, err := BuildExport(e.ctx, job.userID, e.db)
+        if err == context.Canceled {
+            log.Printf("Cancelled export of user %d.", job.userID)
+        } else if err != nil {
+            log.Printf("Could not export data of user %d. %s", job.userID, err.Error())
+        }
+        if err != nil {
+            status = ExportFailed
+            data = []byte{}
+        }
+        if err = e.db.FinishExport(job.token, status, data); err != nil {
+            log.Printf("Could not store export of user %d. %s", job.userID, err.Error())
+        }
+    }
+}
+
+// Queues an export of the user's data and returns the token it can
+// be downloaded with.
+func (e *Exporter) Export(userID uint64) (string, error) {
+    tokenBytes := make([]byte, EXPORT_TOKEN_BYTES)
+    if _, err := rand.Read(tokenBytes); err != nil {
+        return "", err
+    }
+    token := hex.EncodeToString(tokenBytes)
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    if e.closed || len(e.jobs) == cap(e.jobs) {
+        return "", ErrExportQueueFull
+    }
+    if err := e.db.AddExport(token, userID); err != nil {
+        return "", err
+    }
+    e.jobs <- exportJob{token: token, userID: userID}
+    return token, nil
+}
+
+// Stops taking exports and waits for queued ones to finish. If ctx is
+// done first, the exports left are cancelled and marked as failed
+// before ctx's error is returned, so that none is left pending.
+func (e *Exporter) Close(ctx context.Context) error {
+    e.mutex.Lock()
+    if !e.closed {
+        e.closed = true
+        close(e.jobs)
+    }
+    e.mutex.Unlock()
+    done := make(chan struct{})
+    go func() {
+        e.wg.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+        return nil
+    case <-ctx.Done():
+    }
+    e.cancel()
+    <-done
+    return ctx.Err()
+}
+
+func writeZipJson(archive *zip.Writer, name string, obj interface{}) error {
+    data, err := json.MarshalIndent(obj, "", "    ")
+    if err != nil {
+        return err
+    }
+    f, err := archive.Create(name)
+    if err != nil {
+        return err
+    }
+    _, err = f.Write(data)
+    return err
+}
+
+func ToExportBeaconMsg(post Beacon) ExportBeaconMsg {
+    msg := ExportBeaconMsg{
+        ID:        post.ID,
+        Text:      post.Description,
+        Location:  LocationMsg{
+            Latitude:  post.Location.Latitude,
+            Longitude: post.Location.Longitude,
+        },
+        Precision: post.Precision.String(),
+        Hearts:    post.Hearts,
+        Flags:     post.Flags,
+        Time:      FormatTime(post.Time),
+        Pending:   post.Pending,
+        Image:     fmt.Sprintf("images/%d.jpg", post.ID),
+    }
+    if post.ExactLocation != nil {
+        msg.ExactLocation = &LocationMsg{
+            Latitude:  post.ExactLocation.Latitude,
+            Longitude: post.ExactLocation.Longitude,
+        }
+    }
+    return msg
+}
+
+// Writes everything stored about a user into a ZIP archive: their
+// account, their beacons with full images, their comments and the
+// posts they hearted and flagged. Gives up between posts once ctx is
+// done.
+func BuildExport(ctx context.Context, userID uint64, db *DBClient) ([]byte, error) {
+    if err := ctx.Err(); err != nil {
+        return []byte{}, err
+    }
+    record, err := db.GetUserRecord(userID)
+    if err != nil {
+        return []byte{}, err
+    }
+    beaconIDs, err := db.GetUserBeaconIDs(userID)
+    if err != nil {
+        return []byte{}, err
+    }
+    commentIDs, err := db.GetUserCommentIDs(userID)
+    if err != nil {
+        return []byte{}, err
+    }
+    hearted, err := db.GetUserHearted(userID)
+    if err != nil {
+        return []byte{}, err
+    }
+    flagged, err := db.GetUserFlagged(userID)
+    if err != nil {
+        return []byte{}, err
+    }
+    buf := &bytes.Buffer{}
+    archive := zip.NewWriter(buf)
+    if err = writeZipJson(archive, "user.json", record); err != nil {
+        return []byte{}, err
+    }
+    beacons := []ExportBeaconMsg{}
+    for _, id := range beaconIDs {
+        if err = ctx.Err(); err != nil {
+            return []byte{}, err
+        }
+        post, err := db.GetBeacon(id)
+        if err != nil {
+            return []byte{}, err
+        }
+        msg := ToExportBeaconMsg(post)
+        beacons = append(beacons, msg)
+        img, err := archive.Create(msg.Image)
+        if err != nil {
+            return []byte{}, err
+        }
+        if _, err = img.Write(post.Image); err != nil {
+            return []byte{}, err
+        }
+    }
+    if err = writeZipJson(archive, "beacons.json", beacons); err != nil {
+        return []byte{}, err
+    }
+    comments := []ExportCommentMsg{}
+    for _, id := range commentIDs {
+        if err = ctx.Err(); err != nil {
+            return []byte{}, err
+        }
+        comment, err := db.GetCommentByID(id)
+        if err != nil {
+            return []byte{}, err
+        }
+        comments = append(comments, ExportCommentMsg{
+            ID:       comment.ID,
+            BeaconID: comment.BeaconID,
+            Text:     comment.Text,
+            Hearts:   comment.Hearts,
+            Flags:    comment.Flags,
+            Time:     FormatTime(comment.Time),
+            Pending:  comment.Pending,
+        })
+    }
+    if err = writeZipJson(archive, "comments.json", comments); err != nil {
+        return []byte{}, err
+    }
+    if err = writeZipJson(archive, "hearted.json", PostListMsg{Posts: hearted}); err != nil {
+        return []byte{}, err
+    }
+    if err = writeZipJson(archive, "flagged.json", PostListMsg{Posts: flagged}); err != nil {
+        return []byte{}, err
+    }
+    if err = archive.Close(); err != nil {
+        return []byte{}, err
+    }
+    return buf.Bytes(), nil
+}
+
+func (e *Exporter) HandleRequestExport(w http.ResponseWriter, r *http.Request, db *DBClient) {
+    token, err := e.Export(AuthenticatedUser(r))
+    if err == ErrExportQueueFull {
+        WriteErrorResp(w, err.Error(), RateLimited)
+        return
+    }
+    if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    respJson, err := json.Marshal(ExportMsg{Token: token, Status: ExportPending.String()})
+    if err != nil {
+        WriteErrorResp(w, err.Error(), ServerError)
+        return
+    }
+    w.WriteHeader(http.StatusAccepted)
+    io.WriteString(w, string(respJson))
+}
+
+// Serves a finished archive once, and only to the user who asked for
+// it, so that a token leaked through a log is of no use on its own.
+// Until the archive is ready, answers with 202 and its status.
+func HandleDownloadExport(w http.ResponseWriter, r *http.Request, db *DBClient) {
+    token := URIParam(r, "token")
+    status, data, found, err := db.TakeExport(token, AuthenticatedUser(r))
+    if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    if !found {
+        WriteErrorResp(w, "Export has expired or was already downloaded.", ExportNotFound)
+        return
+    }
+    switch status {
+    case ExportPending:
+        respJson, err := json.Marshal(ExportMsg{Token: token, Status: status.String()})
+        if err != nil {
+            WriteErrorResp(w, err.Error(), ServerError)
+            return
+        }
+        w.WriteHeader(http.StatusAccepted)
+        io.WriteString(w, string(respJson))
+    case ExportFailed:
+        WriteErrorResp(w, "Export could not be built.", ServerError)
+    default:
+        w.Header().Set("Content-Type", "application/zip")
+        w.Header().Set("Content-Disposition", `attachment; filename="beacon-export.zip"`)
+        w.Write(data)
+    }
+}
@@ -0,0 +1,55 @@
+package beaconrest
+
+import (
+    "context"
+    "testing"
+    . "github.com/opus-ua/beacon-post"
+    . "github.com/opus-ua/beacon-db"
+)
+
+func TestExportsFailedOnClose(t *testing.T) {
+    config := DefaultRedisConfig
+    config.DB = REST_TEST_REDIS_DB
+    db, err := NewDB(config, false, false)
+    if err != nil {
+        t.Fatalf(err.Error())
+    }
+    db.Flush()
+    defer db.Close()
+    defer db.Flush()
+    userID, err := db.CreateUser("exporter", []byte("secret"), "exporter@gmail.com")
+    if err != nil {
+        t.Fatalf(err.Error())
+    }
+    // Without workers the exports stay queued until one is started
+    // after they have been cancelled.
+    e := NewExporter(db, 0)
+    tokens := []string{}
+    for i := 0; i < 3; i++ {
+        token, err := e.Export(userID)
+        if err != nil {
+            t.Fatalf(err.Error())
+        }
+        tokens = append(tokens, token)
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    e.cancel()
+    e.wg.Add(1)
+    go e.work()
+    if err = e.Close(ctx); err != nil && err != context.Canceled {
+        t.Fatalf(err.Error())
+    }
+    if _, err = e.Export(userID); err != ErrExportQueueFull {
+        t.Fatalf("Export was queued after the exporter was closed.")
+    }
+    for _, token := range tokens {
+        status, _, found, err := db.TakeExport(token, userID)
+        if err != nil || !found {
+            t.Fatalf("Cancelled export was lost.")
+        }
+        if status != ExportFailed {
+            t.Fatalf("Cancelled export is %s, not failed.", status.String())
+        }
+    }
+}
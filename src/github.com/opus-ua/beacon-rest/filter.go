@@ -0,0 +1,517 @@
+package beaconrest
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "regexp"
+    "strings"
+    "sync"
+    "time"
+    "unicode"
+    "unicode/utf8"
+)
+
+// What a filter rule does with text it matches. Actions are ordered
+// by severity, so the outcome of several rules is the largest one.
+type FilterAction uint8
+
+const (
+    FilterAllow FilterAction = iota
+    FilterMask
+    FilterReview
+    FilterReject
+)
+
+var filterActionNames = map[FilterAction]string{
+    FilterAllow:  "allow",
+    FilterMask:   "mask",
+    FilterReview: "review",
+    FilterReject: "reject",
+}
+
+func (a FilterAction) String() string {
+    return filterActionNames[a]
+}
+
+func ParseFilterAction(name string) (FilterAction, error) {
+    for action, actionName := range filterActionNames {
+        if actionName == name {
+            return action, nil
+        }
+    }
+    return FilterAllow, fmt.Errorf("Unknown filter action '%s'.", name)
+}
+
+func (a *FilterAction) UnmarshalJSON(data []byte) error {
+    var name string
+    if err := json.Unmarshal(data, &name); err != nil {
+        return err
+    }
+    action, err := ParseFilterAction(name)
+    if err != nil {
+        return err
+    }
+    *a = action
+    return nil
+}
+
+func (a FilterAction) MarshalJSON() ([]byte, error) {
+    return json.Marshal(a.String())
+}
+
+type FilterRule interface {
+    // Checks text against the rule. Returns the text, masked if the
+    // rule's action is FilterMask, and the action the text calls for.
+    Apply(text string) (string, FilterAction)
+    Name() string
+}
+
+type FilterResult struct {
+    Text    string
+    Action  FilterAction
+    Reasons []string
+}
+
+// Symbols that stand in for letters. These are only folded on a
+// second pass, since they are just as often plain punctuation.
+var leetSymbols = map[rune]rune{
+    '@': 'a', '$': 's', '!': 'i', '|': 'l', '+': 't',
+}
+
+// Lookalikes folded away before blocklist matching. Digits standing
+// in for letters, and Cyrillic, Greek and accented letters that look
+// like plain Latin ones.
+var confusables = map[rune]rune{
+    '0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't',
+    '8': 'b', '9': 'g',
+    'а': 'a', 'в': 'b', 'е': 'e', 'к': 'k', 'м': 'm', 'н': 'h',
+    'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x',
+    'і': 'i', 'ј': 'j', 'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w',
+    'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k',
+    'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+    'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a',
+    'è': 'e', 'é': 'e', 'ê': 'e', 'ë': 'e', 'ì': 'i', 'í': 'i',
+    'î': 'i', 'ï': 'i', 'ò': 'o', 'ó': 'o', 'ô': 'o', 'õ': 'o',
+    'ö': 'o', 'ù': 'u', 'ú': 'u', 'û': 'u', 'ü': 'u', 'ý': 'y',
+    'ÿ': 'y', 'ñ': 'n', 'ç': 'c',
+}
+
+// Folds text for blocklist matching. Returns the folded text and,
+// for each rune in it, the index of the rune in text it came from.
+// Invisible format characters are dropped.
+func NormalizeText(text string, symbols bool) (string, []int) {
+    original := []rune(text)
+    folded := make([]rune, 0, len(original))
+    origins := make([]int, 0, len(original))
+    for i, r := range original {
+        if unicode.Is(unicode.Cf, r) {
+            continue
+        }
+        if r >= 0xFF01 && r <= 0xFF5E {
+            r -= 0xFEE0
+        }
+        r = unicode.ToLower(r)
+        if c, ok := confusables[r]; ok {
+            r = c
+        } else if c, ok := leetSymbols[r]; ok && symbols {
+            r = c
+        }
+        folded = append(folded, r)
+        origins = append(origins, i)
+    }
+    return string(folded), origins
+}
+
+func maskRunes(runes []rune, start int, end int) {
+    for i := start; i < end && i < len(runes); i++ {
+        if !unicode.IsSpace(runes[i]) {
+            runes[i] = '*'
+        }
+    }
+}
+
+func maskMatches(text string, re *regexp.Regexp) string {
+    return re.ReplaceAllStringFunc(text, func(match string) string {
+        return strings.Repeat("*", utf8.RuneCountInString(match))
+    })
+}
+
+// Matches a regular expression against normalized text, so that it
+// also catches leetspeak and lookalike spellings.
+type BlocklistRule struct {
+    pattern *regexp.Regexp
+    action  FilterAction
+    name    string
+}
+
+func NewWordRule(word string, action FilterAction) (*BlocklistRule, error) {
+    folded, _ := NormalizeText(word, true)
+    pattern := `\b` + regexp.QuoteMeta(folded) + `\b`
+    return newBlocklistRule(pattern, action, fmt.Sprintf("word '%s'", word))
+}
+
+func NewRegexRule(pattern string, action FilterAction) (*BlocklistRule, error) {
+    return newBlocklistRule(pattern, action, fmt.Sprintf("pattern '%s'", pattern))
+}
+
+func newBlocklistRule(pattern string, action FilterAction, name string) (*BlocklistRule, error) {
+    re, err := regexp.Compile("(?i)" + pattern)
+    if err != nil {
+        return nil, err
+    }
+    return &BlocklistRule{pattern: re, action: action, name: name}, nil
+}
+
+func (rule *BlocklistRule) Name() string {
+    return rule.name
+}
+
+func (rule *BlocklistRule) Apply(text string) (string, FilterAction) {
+    runes := []rune(text)
+    matched := false
+    for _, symbols := range []bool{false, true} {
+        folded, origins := NormalizeText(text, symbols)
+        matches := rule.pattern.FindAllStringIndex(folded, -1)
+        if len(matches) == 0 {
+            continue
+        }
+        matched = true
+        if rule.action != FilterMask {
+            break
+        }
+        byteToRune := make([]int, len(folded)+1)
+        runeIndex := 0
+        for i := range folded {
+            byteToRune[i] = runeIndex
+            runeIndex++
+        }
+        byteToRune[len(folded)] = runeIndex
+        for _, match := range matches {
+            start, end := byteToRune[match[0]], byteToRune[match[1]]
+            if start == end {
+                continue
+            }
+            maskRunes(runes, origins[start], origins[end-1]+1)
+        }
+    }
+    if !matched {
+        return text, FilterAllow
+    }
+    if rule.action != FilterMask {
+        return text, rule.action
+    }
+    return string(runes), FilterMask
+}
+
+// Matches a regular expression against the text as written.
+type PatternRule struct {
+    pattern *regexp.Regexp
+    action  FilterAction
+    name    string
+}
+
+var (
+    linkPattern    = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+|\b[a-z0-9\-]+(?:\.[a-z0-9\-]+)*\.(?:com|net|org|io|co|info|biz|ly|me|app|xyz|gg)\b(?:/\S*)?`)
+    emailPattern   = regexp.MustCompile(`(?i)[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,}`)
+    phonePattern   = regexp.MustCompile(`(?:\+\d{1,3}[\s.\-]?)?(?:\(\d{1,4}\)[\s.\-]?)?\d{1,4}(?:[\s.\-]\d{2,4}){1,4}|\+?\d{7,15}`)
+    // Digit runs that look like phone numbers but aren't: dates,
+    // ranges of years and amounts grouped in thousands.
+    datePattern    = regexp.MustCompile(`^(?:\d{4}[\-.]\d{1,2}[\-.]\d{1,2}|\d{1,2}[\-.]\d{1,2}[\-.]\d{4}|(?:19|20)\d\d\s?-\s?(?:19|20)\d\d)(?:\D|$)`)
+    groupedPattern = regexp.MustCompile(`^\d{1,3}(?:[\s.]\d{3})+$`)
+)
+
+func NewLinkRule(action FilterAction) *PatternRule {
+    return &PatternRule{pattern: linkPattern, action: action, name: "link"}
+}
+
+func NewEmailRule(action FilterAction) *PatternRule {
+    return &PatternRule{pattern: emailPattern, action: action, name: "email address"}
+}
+
+func (rule *PatternRule) Name() string {
+    return rule.name
+}
+
+func (rule *PatternRule) Apply(text string) (string, FilterAction) {
+    if !rule.pattern.MatchString(text) {
+        return text, FilterAllow
+    }
+    if rule.action == FilterMask {
+        return maskMatches(text, rule.pattern), FilterMask
+    }
+    return text, rule.action
+}
+
+// Matches phone numbers of 7 to 15 digits, leaving alone dates,
+// prices and other numbers that phonePattern alone would catch.
+type PhoneRule struct {
+    action FilterAction
+}
+
+func NewPhoneRule(action FilterAction) *PhoneRule {
+    return &PhoneRule{action: action}
+}
+
+func (rule *PhoneRule) Name() string {
+    return "phone number"
+}
+
+func isDigit(b byte) bool {
+    return b >= '0' && b <= '9'
+}
+
+// Returns the byte ranges of the phone numbers in text.
+func findPhoneNumbers(text string) [][]int {
+    found := [][]int{}
+    for _, match := range phonePattern.FindAllStringIndex(text, -1) {
+        start, end := match[0], match[1]
+        // Part of a longer number, such as a decimal or an id.
+        if (start > 0 && isDigit(text[start-1])) || (end < len(text) && isDigit(text[end])) {
+            continue
+        }
+        number := text[start:end]
+        digits := 0
+        for i := 0; i < len(number); i++ {
+            if isDigit(number[i]) {
+                digits++
+            }
+        }
+        if digits < 7 || digits > 15 || datePattern.MatchString(number) || groupedPattern.MatchString(number) {
+            continue
+        }
+        found = append(found, match)
+    }
+    return found
+}
+
+func (rule *PhoneRule) Apply(text string) (string, FilterAction) {
+    matches := findPhoneNumbers(text)
+    if len(matches) == 0 {
+        return text, FilterAllow
+    }
+    if rule.action != FilterMask {
+        return text, rule.action
+    }
+    masked := ""
+    last := 0
+    for _, match := range matches {
+        masked += text[last:match[0]] + strings.Repeat("*", utf8.RuneCountInString(text[match[0]:match[1]]))
+        last = match[1]
+    }
+    return masked + text[last:], FilterMask
+}
+
+type FilterRuleConfig struct {
+    Pattern string       `json:"pattern"`
+    Action  FilterAction `json:"action"`
+}
+
+// The rules file format. Emails are matched before phone numbers
+// and links so that their digits and domains aren't masked twice.
+type FilterConfig struct {
+    Words   []FilterRuleConfig `json:"words"`
+    Regexes []FilterRuleConfig `json:"regexes"`
+    Emails  FilterAction       `json:"emails"`
+    Phones  FilterAction       `json:"phones"`
+    Links   FilterAction       `json:"links"`
+}
+
+var DefaultFilterConfig = FilterConfig{
+    Emails: FilterMask,
+    Phones: FilterMask,
+    Links:  FilterReview,
+}
+
+func LoadFilterConfig(path string) (FilterConfig, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return FilterConfig{}, err
+    }
+    config := DefaultFilterConfig
+    err = json.Unmarshal(data, &config)
+    if err != nil {
+        return FilterConfig{}, err
+    }
+    return config, nil
+}
+
+func (config FilterConfig) Rules() ([]FilterRule, error) {
+    rules := []FilterRule{}
+    for _, word := range config.Words {
+        rule, err := NewWordRule(word.Pattern, word.Action)
+        if err != nil {
+            return []FilterRule{}, err
+        }
+        rules = append(rules, rule)
+    }
+    for _, regex := range config.Regexes {
+        rule, err := NewRegexRule(regex.Pattern, regex.Action)
+        if err != nil {
+            return []FilterRule{}, err
+        }
+        rules = append(rules, rule)
+    }
+    if config.Emails != FilterAllow {
+        rules = append(rules, NewEmailRule(config.Emails))
+    }
+    if config.Phones != FilterAllow {
+        rules = append(rules, NewPhoneRule(config.Phones))
+    }
+    if config.Links != FilterAllow {
+        rules = append(rules, NewLinkRule(config.Links))
+    }
+    return rules, nil
+}
+
+// Runs text through an ordered list of rules. The configured rules
+// can be swapped at any time, either directly or by watching a rules
+// file. Rules added with Use are kept across reloads.
+type ContentFilter struct {
+    mutex   sync.RWMutex
+    rules   []FilterRule
+    plugins []FilterRule
+    path    string
+    modTime time.Time
+    stop    chan struct{}
+}
+
+func NewContentFilter(config FilterConfig) (*ContentFilter, error) {
+    filter := &ContentFilter{}
+    if err := filter.SetConfig(config); err != nil {
+        return nil, err
+    }
+    return filter, nil
+}
+
+func (f *ContentFilter) SetConfig(config FilterConfig) error {
+    rules, err := config.Rules()
+    if err != nil {
+        return err
+    }
+    f.mutex.Lock()
+    f.rules = rules
+    f.mutex.Unlock()
+    return nil
+}
+
+func (f *ContentFilter) Use(rule FilterRule) {
+    f.mutex.Lock()
+    f.plugins = append(f.plugins, rule)
+    f.mutex.Unlock()
+}
+
+func (f *ContentFilter) Filter(text string) FilterResult {
+    result := FilterResult{Text: text, Action: FilterAllow}
+    if f == nil {
+        return result
+    }
+    f.mutex.RLock()
+    rules := append(append([]FilterRule{}, f.rules...), f.plugins...)
+    f.mutex.RUnlock()
+    for _, rule := range rules {
+        text, action := rule.Apply(result.Text)
+        if action == FilterAllow {
+            continue
+        }
+        result.Text = text
+        result.Reasons = append(result.Reasons, fmt.Sprintf("%s (%s)", rule.Name(), action))
+        if action > result.Action {
+            result.Action = action
+        }
+        if action == FilterReject {
+            break
+        }
+    }
+    return result
+}
+
+// Loads rules from the file at path. The old rules stay in place if
+// the file can't be read or parsed.
+func (f *ContentFilter) LoadFile(path string) error {
+    info, err := os.Stat(path)
+    if err != nil {
+        return err
+    }
+    config, err := LoadFilterConfig(path)
+    if err != nil {
+        return err
+    }
+    if err = f.SetConfig(config); err != nil {
+        return err
+    }
+    f.mutex.Lock()
+    f.path = path
+    f.modTime = info.ModTime()
+    f.mutex.Unlock()
+    return nil
+}
+
+// Reloads the rules file last given to LoadFile.
+func (f *ContentFilter) Reload() error {
+    f.mutex.RLock()
+    path := f.path
+    f.mutex.RUnlock()
+    if path == "" {
+        return errors.New("No filter rules file has been loaded.")
+    }
+    return f.LoadFile(path)
+}
+
+// Polls the rules file last given to LoadFile and reloads it
+// whenever it changes, until Close is called.
+func (f *ContentFilter) Watch(interval time.Duration) {
+    f.mutex.Lock()
+    if f.stop != nil {
+        f.mutex.Unlock()
+        return
+    }
+    stop := make(chan struct{})
+    f.stop = stop
+    f.mutex.Unlock()
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-stop:
+                return
+            case <-ticker.C:
+                f.reloadIfChanged()
+            }
+        }
+    }()
+}
+
+func (f *ContentFilter) reloadIfChanged() {
+    f.mutex.RLock()
+    path, modTime := f.path, f.modTime
+    f.mutex.RUnlock()
+    if path == "" {
+        return
+    }
+    info, err := os.Stat(path)
+    if err != nil || info.ModTime().Equal(modTime) {
+        return
+    }
+    if err = f.LoadFile(path); err != nil {
+        log.Printf("Could not reload filter rules from '%s'. %s", path, err.Error())
+        f.mutex.Lock()
+        f.modTime = info.ModTime()
+        f.mutex.Unlock()
+        return
+    }
+    log.Printf("Reloaded filter rules from '%s'.", path)
+}
+
+func (f *ContentFilter) Close() {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    if f.stop != nil {
+        close(f.stop)
+        f.stop = nil
+    }
+}
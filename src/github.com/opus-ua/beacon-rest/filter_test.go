@@ -0,0 +1,189 @@
+package beaconrest
+
+import (
+    "io/ioutil"
+    "os"
+    "testing"
+    "time"
+)
+
+func TestNormalizeText(t *testing.T) {
+    for _, c := range []struct {
+        text    string
+        symbols bool
+        folded  string
+    }{
+        {"Hello", false, "hello"},
+        {"b4dw0rd", false, "badword"},
+        {"ｂａｄ", false, "bad"},
+        {"ваd", false, "bad"},
+        {"βαd", false, "bad"},
+        {"bád", false, "bad"},
+        {"b​ad", false, "bad"},
+        {"$@d", false, "$@d"},
+        {"$@d", true, "sad"},
+    } {
+        folded, origins := NormalizeText(c.text, c.symbols)
+        if folded != c.folded {
+            t.Fatalf("'%s' was folded to '%s', not '%s'.", c.text, folded, c.folded)
+        }
+        if len(origins) != len([]rune(folded)) {
+            t.Fatalf("'%s' gave %d origins for %d runes.", c.text, len(origins), len([]rune(folded)))
+        }
+    }
+    _, origins := NormalizeText("b​ad", false)
+    if origins[1] != 2 {
+        t.Fatalf("Rune after a dropped character came from %d, not 2.", origins[1])
+    }
+}
+
+func TestFilterMasks(t *testing.T) {
+    config := FilterConfig{
+        Words:   []FilterRuleConfig{{Pattern: "badword", Action: FilterMask}},
+        Regexes: []FilterRuleConfig{{Pattern: `buy\s+now`, Action: FilterMask}},
+        Emails:  FilterMask,
+        Phones:  FilterMask,
+        Links:   FilterMask,
+    }
+    filter, err := NewContentFilter(config)
+    if err != nil {
+        t.Fatalf("Could not build filter. %s", err.Error())
+    }
+    for _, c := range []struct {
+        text   string
+        masked string
+        action FilterAction
+    }{
+        {"a badword here", "a ******* here", FilterMask},
+        {"a B4DW0RD here", "a ******* here", FilterMask},
+        {"a b@dword here", "a ******* here", FilterMask},
+        {"badwords", "badwords", FilterAllow},
+        {"Buy  now!", "***  ***!", FilterMask},
+        {"mail a.b@example.com", "mail ***************", FilterMask},
+        {"call 555-1234", "call ********", FilterMask},
+        {"call (555) 123-4567", "call **************", FilterMask},
+        {"call +1 555 123 4567", "call ***************", FilterMask},
+        {"call +44 20 7946 0958", "call ****************", FilterMask},
+        {"call 5551234567", "call **********", FilterMask},
+        {"see example.com/page", "see ****************", FilterMask},
+        {"see https://x.org", "see *************", FilterMask},
+        {"nothing to see", "nothing to see", FilterAllow},
+    } {
+        result := filter.Filter(c.text)
+        if result.Text != c.masked || result.Action != c.action {
+            t.Fatalf("'%s' gave '%s' (%s), not '%s' (%s).", c.text, result.Text, result.Action, c.masked, c.action)
+        }
+    }
+}
+
+func TestPhoneRuleIgnoresOtherNumbers(t *testing.T) {
+    rule := NewPhoneRule(FilterMask)
+    for _, text := range []string{
+        "meet on 2024-05-01",
+        "meet on 2024-05-01 10:30",
+        "meet on 01.05.2024",
+        "open 2019-2024",
+        "sold for 1 800 000",
+        "sold for 1.800.000",
+        "pi is 3.14159265",
+        "order 1234567890123456789",
+        "room 12 34",
+        "at 10:30-11:45",
+    } {
+        masked, action := rule.Apply(text)
+        if action != FilterAllow || masked != text {
+            t.Fatalf("'%s' was taken for a phone number: '%s'.", text, masked)
+        }
+    }
+}
+
+func TestFilterActions(t *testing.T) {
+    filter, err := NewContentFilter(FilterConfig{
+        Words: []FilterRuleConfig{
+            {Pattern: "spam", Action: FilterReview},
+            {Pattern: "slur", Action: FilterReject},
+        },
+        Emails: FilterMask,
+    })
+    if err != nil {
+        t.Fatalf("Could not build filter. %s", err.Error())
+    }
+    for _, c := range []struct {
+        text    string
+        action  FilterAction
+        reasons int
+    }{
+        {"hello", FilterAllow, 0},
+        {"spam", FilterReview, 1},
+        {"spam a@b.com", FilterReview, 2},
+        {"spam slur a@b.com", FilterReject, 2},
+    } {
+        result := filter.Filter(c.text)
+        if result.Action != c.action || len(result.Reasons) != c.reasons {
+            t.Fatalf("'%s' gave %s with %d reasons, not %s with %d.", c.text, result.Action, len(result.Reasons), c.action, c.reasons)
+        }
+    }
+    var nilFilter *ContentFilter
+    if result := nilFilter.Filter("spam"); result.Action != FilterAllow || result.Text != "spam" {
+        t.Fatalf("A nil filter changed the text.")
+    }
+}
+
+func TestFilterReload(t *testing.T) {
+    file, err := ioutil.TempFile("", "filter")
+    if err != nil {
+        t.Fatalf("Could not create rules file.")
+    }
+    path := file.Name()
+    file.Close()
+    defer os.Remove(path)
+    writeRules := func(rules string, modTime time.Time) {
+        if err := ioutil.WriteFile(path, []byte(rules), 0600); err != nil {
+            t.Fatalf("Could not write rules file.")
+        }
+        os.Chtimes(path, modTime, modTime)
+    }
+    start := time.Now().Add(-time.Hour)
+    writeRules(`{"words": [{"pattern": "foo", "action": "reject"}]}`, start)
+    filter, err := NewContentFilter(DefaultFilterConfig)
+    if err != nil {
+        t.Fatalf("Could not build filter. %s", err.Error())
+    }
+    if err = filter.Reload(); err == nil {
+        t.Fatalf("Reloading before any file was loaded did not fail.")
+    }
+    if err = filter.LoadFile(path); err != nil {
+        t.Fatalf("Could not load rules file. %s", err.Error())
+    }
+    if filter.Filter("foo").Action != FilterReject {
+        t.Fatalf("Rule from the loaded file was not applied.")
+    }
+    if filter.Filter("a@b.com").Action != FilterMask {
+        t.Fatalf("Defaults were not kept for settings the file leaves out.")
+    }
+    plugin, _ := NewWordRule("qux", FilterReview)
+    filter.Use(plugin)
+
+    writeRules(`{"words": [{"pattern": "bar", "action": "reject"}]}`, start.Add(time.Minute))
+    filter.reloadIfChanged()
+    if filter.Filter("foo").Action != FilterAllow || filter.Filter("bar").Action != FilterReject {
+        t.Fatalf("Changed rules file was not reloaded.")
+    }
+    if filter.Filter("qux").Action != FilterReview {
+        t.Fatalf("Rule added with Use was dropped on reload.")
+    }
+
+    writeRules(`{"words": [`, start.Add(2*time.Minute))
+    filter.reloadIfChanged()
+    if filter.Filter("bar").Action != FilterReject {
+        t.Fatalf("Unparseable rules file replaced the old rules.")
+    }
+    if err = filter.Reload(); err == nil {
+        t.Fatalf("Reloading an unparseable rules file did not fail.")
+    }
+
+    writeRules(`{"words": [{"pattern": "baz", "action": "nonsense"}]}`, start.Add(3*time.Minute))
+    if err = filter.Reload(); err == nil {
+        t.Fatalf("Rules file with an unknown action was accepted.")
+    }
+}
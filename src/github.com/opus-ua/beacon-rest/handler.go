@@ -5,7 +5,6 @@ import (
     "net/textproto"
     "mime"
     "net/http"
-    "log"
     "encoding/json"
     "strings"
     "io/ioutil"
@@ -15,8 +14,11 @@ import (
     "strconv"
     "crypto/rand"
     "errors"
+    "fmt"
     . "github.com/opus-ua/beacon-post"
     . "github.com/opus-ua/beacon-db"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -27,24 +29,42 @@ func FormatTime(t time.Time) int64 {
     return t.Unix()
 }
 
-func ParsePostBeaconJson(w http.ResponseWriter, part *multipart.Part, ip string) (Beacon, error) {
+func ParsePostBeaconJson(w http.ResponseWriter, part *multipart.Part, ip string) (Beacon, *DeviceFix, error) {
     jsonBytes, err := ioutil.ReadAll(part)
     if err != nil {
-        return Beacon{}, WriteErrorResp(w, "Unable to read json body.", JsonError)
+        return Beacon{}, nil, WriteErrorResp(w, "Unable to read json body.", JsonError)
     }
     var beaconMsg SubmitBeaconMsg
     err = json.Unmarshal(jsonBytes, &beaconMsg)
     if err != nil {
-        return Beacon{}, WriteErrorResp(w, "Unable to parse json body.", JsonError)
+        return Beacon{}, nil, WriteErrorResp(w, "Unable to parse json body.", JsonError)
     }
+    precision, err := ParsePrecision(beaconMsg.Precision)
+    if err != nil {
+        return Beacon{}, nil, WriteErrorResp(w, err.Error(), JsonError)
+    }
+    loc := Geotag{Latitude: beaconMsg.Latitude, Longitude: beaconMsg.Longitude}
     post := Beacon{
-        PosterID: beaconMsg.Poster,
-        Location: Geotag{Latitude: beaconMsg.Latitude, Longitude: beaconMsg.Longitude},
+        Location: loc,
+        Precision: precision,
         Description: beaconMsg.Text,
         Hearts: 0,
         Flags: 0,
     }
-    return post, nil
+    if beaconMsg.KeepExact {
+        post.ExactLocation = &loc
+    }
+    var fix *DeviceFix
+    if beaconMsg.Fix != nil {
+        fix = &DeviceFix{
+            Location: Geotag{
+                Latitude: beaconMsg.Fix.Latitude,
+                Longitude: beaconMsg.Fix.Longitude,
+            },
+            Accuracy: beaconMsg.Fix.Accuracy,
+        }
+    }
+    return post, fix, nil
 }
 
 func GetPostBeaconImg(w http.ResponseWriter, part *multipart.Part, ip string) ([]byte, error) {
@@ -69,6 +89,10 @@ func ToRespCommentMsg(w http.ResponseWriter, comment Comment, viewerID int64, db
     } else {
         hearted = false
     }
+    return newRespCommentMsg(comment, username, hearted), nil
+}
+
+func newRespCommentMsg(comment Comment, username string, hearted bool) RespCommentMsg {
     return RespCommentMsg{
         SubmitCommentMsg: SubmitCommentMsg{
             Id:     comment.ID,
@@ -81,30 +105,32 @@ func ToRespCommentMsg(w http.ResponseWriter, comment Comment, viewerID int64, db
             Username: username,
             Hearted: hearted,
         },
-    }, nil
+    }
 }
 
+// Looks up every username and heart in the thread at once rather
+// than once per comment.
 func ToRespBeaconMsg(w http.ResponseWriter, beacon Beacon, viewerID int64, db *DBClient) (RespBeaconMsg, error) {
-    username, err := db.GetUsername(beacon.PosterID)
+    posterIDs := []uint64{beacon.PosterID}
+    postIDs := []uint64{beacon.ID}
+    for _, comment := range beacon.Comments {
+        posterIDs = append(posterIDs, comment.PosterID)
+        postIDs = append(postIDs, comment.ID)
+    }
+    usernames, err := db.GetUsernames(posterIDs)
     if err != nil {
         return RespBeaconMsg{}, WriteErrorResp(w, err.Error(), DatabaseError)
     }
-    var hearted bool
+    hearted := map[uint64]bool{}
     if viewerID >= 0 {
-        hearted, err = db.HasHearted(beacon.ID, uint64(viewerID))
+        hearted, err = db.HasHeartedPosts(postIDs, uint64(viewerID))
         if err != nil {
             return RespBeaconMsg{}, WriteErrorResp(w, err.Error(), DatabaseError)
         }
-    } else {
-        hearted = false
     }
     comments := []RespCommentMsg{}
     for _, comment := range beacon.Comments {
-        commentMsg, err := ToRespCommentMsg(w, comment, viewerID, db)
-        if err != nil {
-            return RespBeaconMsg{}, err
-        }
-        comments = append(comments, commentMsg)
+        comments = append(comments, newRespCommentMsg(comment, usernames[comment.PosterID], hearted[comment.ID]))
     }
     return RespBeaconMsg{
         SubmitBeaconMsg: SubmitBeaconMsg{
@@ -117,17 +143,59 @@ func ToRespBeaconMsg(w http.ResponseWriter, beacon Beacon, viewerID int64, db *D
                 Latitude:   beacon.Location.Latitude,
                 Longitude:  beacon.Location.Longitude,
             },
+            Precision:  beacon.Precision.String(),
         },
         RespPostMsg: RespPostMsg{
             Hearts:     beacon.Hearts,
             Time:       FormatTime(beacon.Time),
-            Username:   username,
-            Hearted:    hearted,
+            Username:   usernames[beacon.PosterID],
+            Hearted:    hearted[beacon.ID],
         },
         Comments:   comments,
     }, nil
 }
 
+func ToRespThumbnailMsg(w http.ResponseWriter, post Beacon, viewerID int64, db *DBClient) (RespThumbnailMsg, error) {
+    username, err := db.GetUsername(post.PosterID)
+    if err != nil {
+        return RespThumbnailMsg{}, WriteErrorResp(w, err.Error(), DatabaseError)
+    }
+    var hearted bool
+    if viewerID >= 0 {
+        hearted, err = db.HasHearted(post.ID, uint64(viewerID))
+        if err != nil {
+            return RespThumbnailMsg{}, WriteErrorResp(w, err.Error(), DatabaseError)
+        }
+    } else {
+        hearted = false
+    }
+    commentCount, err := db.GetCommentCount(post.ID)
+    if err != nil {
+        return RespThumbnailMsg{}, WriteErrorResp(w, err.Error(), DatabaseError)
+    }
+    return RespThumbnailMsg{
+        SubmitBeaconMsg: SubmitBeaconMsg{
+            SubmitPostMsg: SubmitPostMsg{
+                Id: post.ID,
+                Poster: post.PosterID,
+                Text: post.Description,
+            },
+            LocationMsg: LocationMsg{
+                Latitude: post.Location.Latitude,
+                Longitude: post.Location.Longitude,
+            },
+            Precision: post.Precision.String(),
+        },
+        RespPostMsg: RespPostMsg{
+            Hearts: post.Hearts,
+            Time: FormatTime(post.Time),
+            Username: username,
+            Hearted: hearted,
+        },
+        CommentCount: commentCount,
+    }, nil
+}
+
 func GetAuthenticationInfo(w http.ResponseWriter, r *http.Request) (int64, []byte, error) {
     userIDStr, authKeyStr, ok := r.BasicAuth()
     if !ok {
@@ -141,36 +209,9 @@ func GetAuthenticationInfo(w http.ResponseWriter, r *http.Request) (int64, []byt
     return userID, authKey, nil
 }
 
-func Authenticate(w http.ResponseWriter, r *http.Request, db *DBClient) (uint64, error) {
-    userIDSigned, authKey, err := GetAuthenticationInfo(w, r)
-    if err != nil {
-        return 0, WriteErrorResp(w, err.Error(), ProtocolError)
-    }
-    userID := uint64(userIDSigned)
-    if authed, err := db.UserAuthenticated(userID, authKey); !authed || err != nil {
-        return 0, WriteErrorResp(w, err.Error(), DatabaseError)
-    }
-    return userID, nil
-}
-
-func OptionalAuthenticate(w http.ResponseWriter, r *http.Request, db *DBClient) (int64, error) {
-    userID, authKey, err := GetAuthenticationInfo(w, r)
-    if err != nil {
-        return -1, nil
-    }
-    if authed, err := db.UserAuthenticated(uint64(userID), authKey); !authed || err != nil {
-        return 0, WriteErrorResp(w, err.Error(), DatabaseError)
-    }
-    return userID, nil
-}
-
-func HandlePostBeacon(w http.ResponseWriter, r *http.Request, db *DBClient) {
+func HandlePostBeacon(w http.ResponseWriter, r *http.Request, policy *PostPolicy, db *DBClient) {
     ip := r.RemoteAddr
-    userID, err := Authenticate(w, r, db)
-    if err != nil {
-        WriteErrorResp(w, "Could not authenticate.", AuthenticationError)
-        return
-    }
+    userID := AuthenticatedUser(r)
     mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
     if err != nil {
         WriteErrorResp(w, "Content-Type not found.", ProtocolError)
@@ -186,14 +227,48 @@ func HandlePostBeacon(w http.ResponseWriter, r *http.Request, db *DBClient) {
         WriteErrorResp(w, "Didn't receive enough message parts.", ProtocolError)
         return
     }
-    post, err := ParsePostBeaconJson(w, jsonPart, ip)
+    post, fix, err := ParsePostBeaconJson(w, jsonPart, ip)
+    if err != nil {
+        return
+    }
+    // Whatever userid the body names, the post is the poster's own.
+    post.PosterID = userID
+    zones, err := db.GetZones()
     if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    allowed, review := CheckZones(zones, post.Location)
+    if !allowed {
+        WriteErrorResp(w, "Beacon location is inside a blocked zone.", LocationDenied)
+        return
+    }
+    post.Pending = review
+    if !ApplyContentFilter(w, policy.Filter, &post.Description, &post.Pending) {
+        return
+    }
+    lastLoc, lastTime, hasLast, err := db.GetLastFix(userID)
+    if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
         return
     }
+    var lastFix *DeviceFix
+    if hasLast {
+        lastFix = &DeviceFix{Location: lastLoc}
+    }
+    now := time.Now()
+    violation := policy.Proximity.Violation(post.Location, fix, lastFix, lastTime, now)
+    if violation != "" {
+        if policy.Proximity.Action != ReviewViolations {
+            WriteErrorResp(w, violation, LocationImplausible)
+            return
+        }
+        RequestLog(w).Info("Holding beacon for review.", "violation", violation)
+        post.Pending = true
+    }
     imgPart, err := multiReader.NextPart()
     if err != nil {
-        log.Printf(err.Error())
-        WriteErrorResp(w, "No image found in message.", ProtocolError)
+        WriteErrorResp(w, "No image found in message. " + err.Error(), ProtocolError)
         return
     }
     img, err := GetPostBeaconImg(w, imgPart, ip)
@@ -201,7 +276,12 @@ func HandlePostBeacon(w http.ResponseWriter, r *http.Request, db *DBClient) {
         return
     }
     post.Image = img
+    thumbStart := time.Now()
+    _, thumbSpan := startSpan(r.Context(), "MakeThumbnail", trace.SpanKindInternal, attribute.Int("image.bytes", len(img)))
     post.Thumbnail, err = MakeThumbnail(img)
+    setSpanError(thumbSpan, err)
+    thumbSpan.End()
+    imageSeconds.Observe(time.Since(thumbStart).Seconds())
     if err != nil {
         WriteErrorResp(w, err.Error(), ServerError)
         return
@@ -211,7 +291,13 @@ func HandlePostBeacon(w http.ResponseWriter, r *http.Request, db *DBClient) {
         WriteErrorResp(w, err.Error(), DatabaseError)
         return
     }
-    respBeaconMsg := PostID{ID: id}
+    beaconsPosted.Inc()
+    if fix != nil {
+        if err = db.SetLastFix(userID, fix.Location, now); err != nil {
+            RequestLog(w).Warn("Could not store device fix.", "error", err.Error())
+        }
+    }
+    respBeaconMsg := PostID{ID: id, Pending: post.Pending}
     respJson, err := json.Marshal(respBeaconMsg)
     if err != nil {
         WriteErrorResp(w, err.Error(), JsonError)
@@ -220,14 +306,43 @@ func HandlePostBeacon(w http.ResponseWriter, r *http.Request, db *DBClient) {
     io.WriteString(w, string(respJson))
 }
 
+// Whether the viewer of a request may see a post held for review,
+// which only its poster and administrators may.
+func canSeePending(r *http.Request, posterID uint64, db *DBClient) (bool, error) {
+    viewerID := viewerOf(r)
+    if viewerID == int64(posterID) {
+        return true, nil
+    }
+    if viewerID < 0 {
+        return false, nil
+    }
+    return db.IsAdmin(uint64(viewerID))
+}
+
 func HandleGetBeacon(w http.ResponseWriter, r *http.Request, id uint64, db *DBClient) {
-    var viewerID int64
-    viewerID, err := OptionalAuthenticate(w, r, db)
+    viewerID := viewerOf(r)
     beacon, err := db.GetThread(id)
+    if err == ErrPostNotFound {
+        WriteErrorResp(w, "Beacon not found.", PostNotFound)
+        return
+    }
     if err != nil {
         WriteErrorResp(w, err.Error(), DatabaseError)
         return
     }
+    if beacon.Pending {
+        visible, err := canSeePending(r, beacon.PosterID, db)
+        if err != nil {
+            WriteErrorResp(w, err.Error(), DatabaseError)
+            return
+        }
+        if !visible {
+            // Looks the same as a missing beacon so held posts aren't
+            // revealed.
+            WriteErrorResp(w, "Beacon not found.", PostNotFound)
+            return
+        }
+    }
     respBeaconMsg, err := ToRespBeaconMsg(w, beacon, viewerID, db)
     if err != nil {
         return
@@ -256,46 +371,81 @@ func HandleGetBeacon(w http.ResponseWriter, r *http.Request, id uint64, db *DBCl
     w.Write(respBody.Bytes())
 }
 
-func HandleHeartPost(w http.ResponseWriter, r *http.Request, id uint64, db *DBClient) {
-    userID, err := Authenticate(w, r, db)
-    if err != nil {
-        WriteErrorResp(w, err.Error(), AuthenticationError)
-        return
+// Checks that a post exists and, unless postType is empty, that it is
+// of that type.
+func ValidatePostTarget(w http.ResponseWriter, id uint64, postType string, db *DBClient) error {
+    actualType, err := db.GetPostType(id)
+    if err == ErrPostNotFound || (err == nil && postType != "" && actualType != postType) {
+        return WriteErrorResp(w, fmt.Sprintf("No %s with ID %d.", postTypeName(postType), id), PostNotFound)
     }
-    err = db.HeartPost(id, userID)
     if err != nil {
-        WriteErrorResp(w, err.Error(), DatabaseError)
-        return
+        return WriteErrorResp(w, err.Error(), DatabaseError)
     }
-    w.WriteHeader(200)
+    return nil
 }
 
-func HandleUnheartPost(w http.ResponseWriter, r *http.Request, id uint64, db *DBClient) {
-    userID, err := Authenticate(w, r, db)
-    if err != nil {
-        WriteErrorResp(w, err.Error(), AuthenticationError)
-        return
+func postTypeName(postType string) string {
+    if postType == "" {
+        return "post"
     }
-    err = db.UnheartPost(id, userID)
-    if err != nil {
-        WriteErrorResp(w, err.Error(), DatabaseError)
-        return
-    }
-    w.WriteHeader(200)
+    return postType
 }
 
-func HandleFlagPost(w http.ResponseWriter, r *http.Request, id uint64, db *DBClient) {
-    userID, err := Authenticate(w, r, db)
-    if err != nil {
-        WriteErrorResp(w, err.Error(), AuthenticationError)
-        return
+// Returns a handler that hearts or unhearts posts of the given type,
+// or of any type if postType is empty. Hearting a post twice is not an
+// error; the response always holds the resulting state.
+func HeartHandler(postType string, heart bool) IntParamBeaconHandler {
+    return func(w http.ResponseWriter, r *http.Request, id uint64, db *DBClient) {
+        userID := AuthenticatedUser(r)
+        if ValidatePostTarget(w, id, postType, db) != nil {
+            return
+        }
+        var err error
+        action := "heart"
+        if heart {
+            err = db.HeartPost(id, userID)
+        } else {
+            action = "unheart"
+            err = db.UnheartPost(id, userID)
+        }
+        if err != nil {
+            WriteErrorResp(w, err.Error(), DatabaseError)
+            return
+        }
+        heartActions.WithLabelValues(action).Inc()
+        hearts, err := db.GetHeartCount(id)
+        if err != nil {
+            WriteErrorResp(w, err.Error(), DatabaseError)
+            return
+        }
+        respJson, err := json.Marshal(HeartStateMsg{ID: id, Hearts: hearts, Hearted: heart})
+        if err != nil {
+            WriteErrorResp(w, err.Error(), ServerError)
+            return
+        }
+        io.WriteString(w, string(respJson))
     }
-    err = db.FlagPost(id, userID)
-    if err != nil {
-        WriteErrorResp(w, err.Error(), DatabaseError)
-        return;
+}
+
+// Returns a handler that flags posts of the given type, or of any
+// type if postType is empty.
+func FlagHandler(postType string) IntParamBeaconHandler {
+    return func(w http.ResponseWriter, r *http.Request, id uint64, db *DBClient) {
+        userID := AuthenticatedUser(r)
+        if ValidatePostTarget(w, id, postType, db) != nil {
+            return
+        }
+        if err := db.FlagPost(id, userID); err != nil {
+            WriteErrorResp(w, err.Error(), DatabaseError)
+            return
+        }
+        respJson, err := json.Marshal(FlagStateMsg{ID: id, Flagged: true})
+        if err != nil {
+            WriteErrorResp(w, err.Error(), ServerError)
+            return
+        }
+        io.WriteString(w, string(respJson))
     }
-    w.WriteHeader(200)
 }
 
 func GenerateSecret(w http.ResponseWriter) (string, error) {
@@ -316,8 +466,22 @@ func HandleCreateAccount(w http.ResponseWriter, r *http.Request, googleID []stri
     decoder := json.NewDecoder(r.Body)
     var accountReq CreateAccountReqMsg
     decoder.Decode(&accountReq)
-    url := "https://www.googleapis.com/oauth2/v3/tokeninfo?id_token=" + accountReq.Token
-    res, err := http.Get(url)
+    url := TOKENINFO_URL + "?id_token=" + accountReq.Token
+    // The trace context is not passed on to Google.
+    ctx, span := startSpan(r.Context(), "GET tokeninfo", trace.SpanKindClient,
+        attribute.String("http.request.method", "GET"), attribute.String("server.address", "www.googleapis.com"))
+    googleReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+    if err != nil {
+        span.End()
+        WriteErrorResp(w, err.Error(), ServerError)
+        return
+    }
+    res, err := http.DefaultClient.Do(googleReq)
+    setSpanError(span, err)
+    if err == nil {
+        span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+    }
+    span.End()
     if err != nil {
         WriteErrorResp(w, err.Error(), ExternalServiceError)
         return
@@ -364,6 +528,10 @@ func HandleCreateAccount(w http.ResponseWriter, r *http.Request, googleID []stri
             return
         }
     } else {
+        if err := ValidateUsername(accountReq.Username); err != nil {
+            WriteErrorResp(w, err.Error(), ProtocolError)
+            return
+        }
         if exists, err := db.UsernameExists(accountReq.Username); exists || err != nil {
             WriteErrorResp(w, "Username exists.", UsernameExists)
             return
@@ -384,11 +552,7 @@ func HandleCreateAccount(w http.ResponseWriter, r *http.Request, googleID []stri
 }
 
 func HandleGetLocal(w http.ResponseWriter, r *http.Request, db *DBClient) {
-    viewerID, err := OptionalAuthenticate(w, r, db)
-    if err != nil {
-        WriteErrorResp(w, err.Error(), DatabaseError)
-        return
-    }
+    viewerID := viewerOf(r)
     body, err := ioutil.ReadAll(r.Body)
     if err != nil {
         WriteErrorResp(w, err.Error(), ServerError)
@@ -409,48 +573,24 @@ func HandleGetLocal(w http.ResponseWriter, r *http.Request, db *DBClient) {
         WriteErrorResp(w, err.Error(), DatabaseError)
         return
     }
-    respMsg := LocalSearchRespMsg{}
+    zones, err := db.GetZones()
+    if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    visibleList := []Beacon{}
     for _, post := range beaconList {
-        username, err := db.GetUsername(post.PosterID)
-        if err != nil {
-            WriteErrorResp(w, err.Error(), DatabaseError)
-            return
-        }
-        var hearted bool
-        if viewerID >= 0 {
-            hearted, err = db.HasHearted(post.ID, uint64(viewerID))
-            if err != nil {
-                WriteErrorResp(w, err.Error(), DatabaseError)
-                return
-            }
-        } else {
-            hearted = false
+        if !HiddenByZones(zones, post) {
+            visibleList = append(visibleList, post)
         }
-        commentCount, err := db.GetCommentCount(post.ID)
+    }
+    beaconList = visibleList
+    respMsg := LocalSearchRespMsg{}
+    for _, post := range beaconList {
+        nextPost, err := ToRespThumbnailMsg(w, post, viewerID, db)
         if err != nil {
-            WriteErrorResp(w, err.Error(), DatabaseError)
             return
         }
-        nextPost := RespThumbnailMsg{
-            SubmitBeaconMsg: SubmitBeaconMsg{
-                SubmitPostMsg: SubmitPostMsg{
-                    Id: post.ID,
-                    Poster: post.PosterID,
-                    Text: post.Description,
-                },
-                LocationMsg: LocationMsg{
-                    Latitude: post.Location.Latitude,
-                    Longitude: post.Location.Longitude,
-                },
-            },
-            RespPostMsg: RespPostMsg{
-                Hearts: post.Hearts,
-                Time: FormatTime(post.Time),
-                Username: username,
-                Hearted: hearted,
-            },
-            CommentCount: commentCount,
-        }
         respMsg.Beacons = append(respMsg.Beacons, nextPost)
     }
     respJson, err := json.Marshal(respMsg)
@@ -484,12 +624,23 @@ func HandleGetLocal(w http.ResponseWriter, r *http.Request, db *DBClient) {
 }
 
 
-func HandlePostComment(w http.ResponseWriter, r *http.Request, db *DBClient) {
-    userID, err := Authenticate(w, r, db)
-    if err != nil {
-        WriteErrorResp(w, err.Error(), AuthenticationError)
-        return
-    }
+// Runs text through the filter, masking it in place. Writes an
+// error and returns false if the text is rejected outright.
+func ApplyContentFilter(w http.ResponseWriter, filter *ContentFilter, text *string, pending *bool) bool {
+    result := filter.Filter(*text)
+    switch result.Action {
+    case FilterReject:
+        WriteErrorResp(w, "Text matched " + strings.Join(result.Reasons, ", ") + ".", ContentRejected)
+        return false
+    case FilterReview:
+        *pending = true
+    }
+    *text = result.Text
+    return true
+}
+
+func HandlePostComment(w http.ResponseWriter, r *http.Request, policy *PostPolicy, db *DBClient) {
+    userID := AuthenticatedUser(r)
     body, err := ioutil.ReadAll(r.Body)
     if err != nil {
         WriteErrorResp(w, err.Error(), ServerError)
@@ -501,15 +652,45 @@ func HandlePostComment(w http.ResponseWriter, r *http.Request, db *DBClient) {
         WriteErrorResp(w, err.Error(), JsonError)
         return
     }
+    // A beacon held for review can't be commented on by those who
+    // can't see it, and answers as if it were missing.
+    parent, err := db.GetThread(commentMsg.BeaconID)
+    if err == nil && parent.Pending {
+        var visible bool
+        if visible, err = canSeePending(r, parent.PosterID, db); err == nil && !visible {
+            err = ErrPostNotFound
+        }
+    }
+    if err == ErrPostNotFound {
+        WriteErrorResp(w, "Beacon not found.", PostNotFound)
+        return
+    }
+    if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
     comment := Comment{
         PosterID: userID,
         BeaconID: commentMsg.BeaconID,
         Text: commentMsg.Text,
     }
-    db.AddComment(&comment, userID)
+    if !ApplyContentFilter(w, policy.Filter, &comment.Text, &comment.Pending) {
+        return
+    }
+    err = db.AddComment(&comment, userID)
+    if err == ErrPostNotFound {
+        WriteErrorResp(w, "Beacon not found.", PostNotFound)
+        return
+    }
     if err != nil {
         WriteErrorResp(w, err.Error(), DatabaseError)
         return
     }
-    w.WriteHeader(200)
+    commentsPosted.Inc()
+    respJson, err := json.Marshal(PostID{ID: comment.ID, Pending: comment.Pending})
+    if err != nil {
+        WriteErrorResp(w, err.Error(), JsonError)
+        return
+    }
+    io.WriteString(w, string(respJson))
 }
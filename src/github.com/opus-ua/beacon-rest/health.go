@@ -0,0 +1,198 @@
+package beaconrest
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sync"
+    "time"
+    . "github.com/opus-ua/beacon-db"
+)
+
+const (
+    // A dependency that hasn't answered by then is reported down.
+    READY_CHECK_TIMEOUT = 2 * time.Second
+    // A dependency slower than this is reported slow but still ready.
+    READY_SLOW_LATENCY = 250 * time.Millisecond
+    // How long a check of Google's tokeninfo is trusted before it is
+    // made again.
+    TOKENINFO_CHECK_TTL = time.Minute
+)
+
+const TOKENINFO_URL = "https://www.googleapis.com/oauth2/v3/tokeninfo"
+
+const (
+    CheckOK = "ok"
+    CheckSlow = "slow"
+    CheckDegraded = "degraded"
+    CheckDown = "down"
+)
+
+// Worse statuses rank higher.
+var checkRanks = map[string]int{CheckOK: 0, CheckSlow: 1, CheckDegraded: 2, CheckDown: 3}
+
+type CheckMsg struct {
+    Status    string  `json:"status"`
+    LatencyMS float64 `json:"latency_ms"`
+    Error     string  `json:"error,omitempty"`
+}
+
+type ReadyMsg struct {
+    Status string              `json:"status"`
+    Checks map[string]CheckMsg `json:"checks"`
+}
+
+// A dependency the server can't answer requests without, or, if
+// optional, one only some requests need.
+type readyCheck struct {
+    name string
+    ping func(ctx context.Context) error
+    optional bool
+}
+
+// Remembers the result of a check for ttl, so that probes don't call
+// a service outside our control every time.
+type cachedCheck struct {
+    ping func(ctx context.Context) error
+    ttl time.Duration
+    mutex sync.Mutex
+    checked time.Time
+    err error
+}
+
+func (c *cachedCheck) Ping(ctx context.Context) error {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if !c.checked.IsZero() && time.Since(c.checked) < c.ttl {
+        return c.err
+    }
+    c.err = c.ping(ctx)
+    c.checked = time.Now()
+    return c.err
+}
+
+// Returns a check that url can be reached. Any answer short of a
+// server error counts, since tokeninfo rejects a request without a
+// token with a 400.
+func pingURL(url string) func(ctx context.Context) error {
+    return func(ctx context.Context) error {
+        req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+        if err != nil {
+            return err
+        }
+        res, err := http.DefaultClient.Do(req)
+        if err != nil {
+            return err
+        }
+        res.Body.Close()
+        if res.StatusCode >= 500 {
+            return fmt.Errorf("Answered with status %d.", res.StatusCode)
+        }
+        return nil
+    }
+}
+
+// Account creation verifies sign-in tokens with Google. Without it the
+// rest of the API still works, so it is optional.
+var tokenInfoCheck = &cachedCheck{ping: pingURL(TOKENINFO_URL), ttl: TOKENINFO_CHECK_TTL}
+
+func readyChecks(db *DBClient) []readyCheck {
+    checks := []readyCheck{
+        {name: "redis", ping: func(ctx context.Context) error { return db.PingRedis() }},
+        {name: "google", ping: tokenInfoCheck.Ping, optional: true},
+    }
+    if db.UsesPostgres() {
+        checks = append(checks, readyCheck{name: "postgres", ping: db.PingPostgres})
+    }
+    return checks
+}
+
+// Runs every check at once, giving up on those that take longer than
+// READY_CHECK_TIMEOUT.
+func CheckReady(db *DBClient) ReadyMsg {
+    ctx, cancel := context.WithTimeout(context.Background(), READY_CHECK_TIMEOUT)
+    defer cancel()
+    checks := readyChecks(db)
+    msg := ReadyMsg{Status: CheckOK, Checks: map[string]CheckMsg{}}
+    var mutex sync.Mutex
+    var wg sync.WaitGroup
+    for _, check := range checks {
+        wg.Add(1)
+        go func(check readyCheck) {
+            defer wg.Done()
+            result := runCheck(ctx, check)
+            mutex.Lock()
+            defer mutex.Unlock()
+            msg.Checks[check.name] = result
+            status := result.Status
+            if status == CheckDown && check.optional {
+                status = CheckDegraded
+            }
+            if checkRanks[status] > checkRanks[msg.Status] {
+                msg.Status = status
+            }
+        }(check)
+    }
+    wg.Wait()
+    return msg
+}
+
+func runCheck(ctx context.Context, check readyCheck) CheckMsg {
+    start := time.Now()
+    done := make(chan error, 1)
+    go func() {
+        done <- check.ping(ctx)
+    }()
+    var err error
+    select {
+    case err = <-done:
+    case <-ctx.Done():
+        err = errors.New("Timed out.")
+    }
+    latency := time.Since(start)
+    result := CheckMsg{
+        Status: CheckOK,
+        LatencyMS: float64(latency) / float64(time.Millisecond),
+    }
+    if err != nil {
+        result.Status = CheckDown
+        result.Error = err.Error()
+    } else if latency > READY_SLOW_LATENCY {
+        result.Status = CheckSlow
+    }
+    return result
+}
+
+// Answers as long as the process is serving requests.
+func (bm *BeaconServer) HandleHealth(uri string) {
+    bm.HandleGet(uri, func(w http.ResponseWriter, r *http.Request, db *DBClient) {
+        w.Header().Set("Content-Type", "application/json")
+        w.Write([]byte(`{"status":"ok"}`))
+    })
+}
+
+// Answers 200 if every required dependency is up, even if slow, and
+// 503 with the same breakdown otherwise.
+func (bm *BeaconServer) HandleReady(uri string) {
+    bm.HandleGet(uri, func(w http.ResponseWriter, r *http.Request, db *DBClient) {
+        msg := CheckReady(db)
+        for name, check := range msg.Checks {
+            if check.Status == CheckDown {
+                RequestLog(w).Warn("Dependency is down.", "dependency", name, "error", check.Error)
+            }
+        }
+        respJson, err := json.Marshal(msg)
+        if err != nil {
+            WriteErrorResp(w, err.Error(), ServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Cache-Control", "no-store")
+        if msg.Status == CheckDown {
+            w.WriteHeader(http.StatusServiceUnavailable)
+        }
+        w.Write(respJson)
+    })
+}
@@ -0,0 +1,38 @@
+package beaconrest
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func TestCachedTokenInfoCheck(t *testing.T) {
+    status := http.StatusBadRequest
+    hits := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        hits++
+        w.WriteHeader(status)
+    }))
+    defer server.Close()
+    check := &cachedCheck{ping: pingURL(server.URL), ttl: time.Hour}
+    for i := 0; i < 3; i++ {
+        if err := check.Ping(context.Background()); err != nil {
+            t.Fatalf("Service that rejected a missing token was reported down: %s", err.Error())
+        }
+    }
+    if hits != 1 {
+        t.Fatalf("Service was called %d times within the TTL, not once.", hits)
+    }
+    status = http.StatusServiceUnavailable
+    check.checked = time.Time{}
+    if err := check.Ping(context.Background()); err == nil {
+        t.Fatalf("Service answering 503 was reported up.")
+    }
+    server.Close()
+    check.checked = time.Time{}
+    if err := check.Ping(context.Background()); err == nil {
+        t.Fatalf("Unreachable service was reported up.")
+    }
+}
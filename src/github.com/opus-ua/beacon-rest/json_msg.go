@@ -2,6 +2,8 @@ package beaconrest
 
 type SubmitPostMsg struct {
     Id           uint64 `json:"id"`
+    // Ignored in requests, which are attributed to the user given by
+    // BasicAuth.
     Poster       uint64 `json:"userid"`
     Text         string `json:"text"`
 }
@@ -18,9 +20,17 @@ type LocationMsg struct {
     Longitude    float64 `json:"longitude"`
 }
 
+type DeviceFixMsg struct {
+    LocationMsg
+    Accuracy     float64 `json:"accuracy"`
+}
+
 type SubmitBeaconMsg struct {
     SubmitPostMsg
     LocationMsg
+    Precision    string        `json:"precision,omitempty"`
+    KeepExact    bool          `json:"keepexact,omitempty"`
+    Fix          *DeviceFixMsg `json:"fix,omitempty"`
 }
 
 type SubmitCommentMsg SubmitPostMsg
@@ -47,6 +57,10 @@ type CreateAccountReqMsg struct {
     Token   string `json:"token"`
 }
 
+type ChangeUsernameMsg struct {
+    Username string `json:"username"`
+}
+
 type CreateAccountRespMsg struct {
     ID uint64 `json:"id"`
     Secret string `json:"secret"`
@@ -81,4 +95,77 @@ type PostCommentMsg struct {
 
 type PostID struct {
     ID          uint64 `json:"id"`
+    Pending     bool   `json:"pending,omitempty"`
+}
+
+type ZoneMsg struct {
+    ID          uint64        `json:"id"`
+    Name        string        `json:"name"`
+    Rule        string        `json:"rule"`
+    Center      *LocationMsg  `json:"center,omitempty"`
+    Radius      float64       `json:"radius,omitempty"`
+    Polygon     []LocationMsg `json:"polygon,omitempty"`
+}
+
+type ZoneListMsg struct {
+    Zones       []ZoneMsg `json:"zones"`
+}
+
+type PendingListMsg struct {
+    Beacons     []uint64 `json:"beacons"`
+    Comments    []uint64 `json:"comments"`
+}
+
+type UserProfileMsg struct {
+    ID              uint64             `json:"id"`
+    Username        string             `json:"username"`
+    Created         int64              `json:"created"`
+    Age             int64              `json:"age"`
+    HeartsReceived  uint32             `json:"hearts-received"`
+    HeartsSubmitted uint32             `json:"hearts-submitted"`
+    BeaconCount     uint64             `json:"beacon-count"`
+    Beacons         []RespThumbnailMsg `json:"beacons"`
+}
+
+type PostListMsg struct {
+    Posts []uint64 `json:"posts"`
+}
+
+type ExportMsg struct {
+    Token  string `json:"token"`
+    Status string `json:"status"`
+}
+
+type ExportBeaconMsg struct {
+    ID            uint64       `json:"id"`
+    Text          string       `json:"text"`
+    Location      LocationMsg  `json:"location"`
+    ExactLocation *LocationMsg `json:"exact-location,omitempty"`
+    Precision     string       `json:"precision"`
+    Hearts        uint32       `json:"hearts"`
+    Flags         uint32       `json:"flags"`
+    Time          int64        `json:"time"`
+    Pending       bool         `json:"pending"`
+    Image         string       `json:"image"`
+}
+
+type ExportCommentMsg struct {
+    ID       uint64 `json:"id"`
+    BeaconID uint64 `json:"beaconid"`
+    Text     string `json:"text"`
+    Hearts   uint32 `json:"hearts"`
+    Flags    uint32 `json:"flags"`
+    Time     int64  `json:"time"`
+    Pending  bool   `json:"pending"`
+}
+
+type HeartStateMsg struct {
+    ID      uint64 `json:"id"`
+    Hearts  uint32 `json:"hearts"`
+    Hearted bool   `json:"hearted"`
+}
+
+type FlagStateMsg struct {
+    ID      uint64 `json:"id"`
+    Flagged bool   `json:"flagged"`
 }
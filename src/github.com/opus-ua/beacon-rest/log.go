@@ -1,88 +1,234 @@
 package beaconrest
 
 import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "log/slog"
     "net/http"
-    "time"
-    "strings"
-    "log"
-    "fmt"
     "strconv"
+    "time"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/trace"
 )
 
-/*
-    Credit for this gist goes to cespare (github)
-*/
+// The instrumentation scope of the spans beacon-rest starts.
+const REST_TRACER_NAME = "github.com/opus-ua/beacon-rest"
+
+// Looked up on every span so that a provider set later is used.
+func startSpan(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+    return otel.Tracer(REST_TRACER_NAME).Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// Marks the span as failed if err is set.
+func setSpanError(span trace.Span, err error) {
+    if err != nil {
+        span.RecordError(err)
+        span.SetStatus(codes.Error, err.Error())
+    }
+}
+
+// Requests are tagged with the id in this header, or a new one if it
+// is missing or unusable. The id is echoed in the response.
+const REQUEST_ID_HEADER = "X-Request-ID"
 
-type ApacheLogRecord struct {
+const (
+    MAX_REQUEST_ID_LENGTH = 128
+    REQUEST_ID_BYTES = 16
+)
+
+type requestIDKey struct{}
+
+// What is known about a request being served. Every line logged
+// through RequestLog carries it.
+type RequestLogRecord struct {
     http.ResponseWriter
 
+    id string
     ip string
-    time    time.Time
     method, uri, protocol string
+    userAgent string
+    // The uri template the request was routed to, once it has been.
+    route string
+    // Negative until the request is authenticated.
+    userID int64
     status int
     responseBytes int64
-    elapsedTime time.Duration
-    userAgent string
+    // Empty unless the request is sampled for tracing.
+    traceID string
 }
 
-func (r *ApacheLogRecord) Log() {
-    requestLine := fmt.Sprintf("%s %s %s", r.method, r.uri, r.protocol)
-    timeInt := r.elapsedTime.Nanoseconds() / int64(time.Millisecond)
-    timeStr := fmt.Sprintf("%sms", strconv.FormatInt(timeInt, 10))
-    if timeInt < 10 {
-        timeInt = r.elapsedTime.Nanoseconds() / int64(time.Microsecond)
-        timeStr = fmt.Sprintf("%sμs", strconv.FormatInt(timeInt, 10))
-    }
-    ApacheFormatPattern := "%s \"%s\" \"%s %d %d bytes\" %s\n"
-    log.Printf(ApacheFormatPattern, r.ip, r.userAgent, requestLine,
-                r.status, r.responseBytes, timeStr)
-}
-
-func (r *ApacheLogRecord) Write(p []byte) (int, error) {
+func (r *RequestLogRecord) Write(p []byte) (int, error) {
     written, err := r.ResponseWriter.Write(p)
     r.responseBytes += int64(written)
     return written, err
 }
 
-func (r *ApacheLogRecord) WriteHeader(status int) {
+func (r *RequestLogRecord) WriteHeader(status int) {
     r.status = status
     r.ResponseWriter.WriteHeader(status)
 }
 
-type ApacheLoggingHandler struct {
+func (r *RequestLogRecord) Unwrap() http.ResponseWriter {
+    return r.ResponseWriter
+}
+
+func (r *RequestLogRecord) logger() *slog.Logger {
+    logger := slog.Default().With("request_id", r.id)
+    if r.traceID != "" {
+        logger = logger.With("trace_id", r.traceID)
+    }
+    if r.route != "" {
+        logger = logger.With("route", r.route)
+    }
+    if r.userID >= 0 {
+        logger = logger.With("user_id", r.userID)
+    }
+    return logger
+}
+
+func (r *RequestLogRecord) Log(elapsed time.Duration) {
+    level := slog.LevelInfo
+    if r.status >= 500 {
+        level = slog.LevelError
+    }
+    r.logger().Log(context.Background(), level, "request",
+        "ip", r.ip,
+        "method", r.method,
+        "uri", r.uri,
+        "protocol", r.protocol,
+        "status", r.status,
+        "bytes", r.responseBytes,
+        "duration", elapsed,
+        "user_agent", r.userAgent)
+}
+
+func requestRecord(w http.ResponseWriter) *RequestLogRecord {
+    record, _ := w.(*RequestLogRecord)
+    return record
+}
+
+// Returns a logger tagged with the id, route and user of the request
+// being answered through w, or the default logger if w was not set up
+// by the logging handler.
+func RequestLog(w http.ResponseWriter) *slog.Logger {
+    if record := requestRecord(w); record != nil {
+        return record.logger()
+    }
+    return slog.Default()
+}
+
+// The id of the request being answered through w, or "".
+func ResponseRequestID(w http.ResponseWriter) string {
+    if record := requestRecord(w); record != nil {
+        return record.id
+    }
+    return ""
+}
+
+// The id the logging handler gave r, or "".
+func RequestID(r *http.Request) string {
+    id, _ := r.Context().Value(requestIDKey{}).(string)
+    return id
+}
+
+func setLogRoute(w http.ResponseWriter, route string) {
+    if record := requestRecord(w); record != nil {
+        record.route = route
+    }
+}
+
+func setLogUser(w http.ResponseWriter, userID uint64) {
+    if record := requestRecord(w); record != nil {
+        record.userID = int64(userID)
+    }
+}
+
+// Only visible ASCII is accepted from clients so ids can't forge log
+// fields.
+func validRequestID(id string) bool {
+    if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+        return false
+    }
+    for i := 0; i < len(id); i++ {
+        if id[i] <= ' ' || id[i] > '~' || id[i] == '"' || id[i] == '\\' {
+            return false
+        }
+    }
+    return true
+}
+
+func newRequestID() string {
+    idBytes := make([]byte, REQUEST_ID_BYTES)
+    rand.Read(idBytes)
+    return hex.EncodeToString(idBytes)
+}
+
+type RequestLoggingHandler struct {
     handler http.Handler
 }
 
-func NewApacheLoggingHandler(handler http.Handler) http.Handler {
-   return &ApacheLoggingHandler{
+// Tags each request with an id and logs it once answered.
+func NewRequestLoggingHandler(handler http.Handler) http.Handler {
+    return &RequestLoggingHandler{
         handler: handler,
-   }
+    }
 }
 
-func (h *ApacheLoggingHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-    clientIP := r.RemoteAddr
-    if colon := strings.LastIndex(clientIP, ":"); colon != -1 {
-        clientIP = clientIP[:colon]
+func (h *RequestLoggingHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+    id := r.Header.Get(REQUEST_ID_HEADER)
+    if !validRequestID(id) {
+        id = newRequestID()
     }
-
-    record := &ApacheLogRecord{
+    rw.Header().Set(REQUEST_ID_HEADER, id)
+    record := &RequestLogRecord{
         ResponseWriter: rw,
-        ip: clientIP,
-        time: time.Time{},
+        id: id,
+        ip: ClientIP(r),
         method: r.Method,
         uri: r.RequestURI,
         protocol: r.Proto,
-        status: http.StatusOK,
-        elapsedTime: time.Duration(0),
         userAgent: r.UserAgent(),
+        userID: -1,
+        status: http.StatusOK,
+    }
+    ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+    ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+    ctx, span := startSpan(ctx, r.Method, trace.SpanKindServer,
+        attribute.String("http.request.method", r.Method),
+        attribute.String("url.path", r.URL.Path),
+        attribute.String("client.address", record.ip),
+        attribute.String("request_id", id))
+    if span.IsRecording() {
+        record.traceID = span.SpanContext().TraceID().String()
     }
+    r = r.WithContext(ctx)
 
     startTime := time.Now()
     h.handler.ServeHTTP(record, r)
-    finishTime := time.Now()
-
-    record.time = finishTime.UTC()
-    record.elapsedTime = finishTime.Sub(startTime)
+    elapsed := time.Since(startTime)
+    record.Log(elapsed)
+    observeRequest(record.route, record.method, record.status, elapsed)
+    endRequestSpan(span, record)
+}
 
-    record.Log()
+// Names the span after the route, as OpenTelemetry suggests, since
+// paths carry ids.
+func endRequestSpan(span trace.Span, record *RequestLogRecord) {
+    if record.route != "" {
+        span.SetName(record.method + " " + record.route)
+        span.SetAttributes(attribute.String("http.route", record.route))
+    }
+    span.SetAttributes(attribute.Int("http.response.status_code", record.status))
+    if record.userID >= 0 {
+        span.SetAttributes(attribute.Int64("user.id", record.userID))
+    }
+    if record.status >= 500 {
+        setSpanError(span, errors.New(strconv.Itoa(record.status) + " " + http.StatusText(record.status)))
+    }
+    span.End()
 }
@@ -0,0 +1,146 @@
+package beaconrest
+
+import (
+    "log"
+    "net"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    . "github.com/opus-ua/beacon-db"
+)
+
+var (
+    httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "beacon_http_requests_total",
+        Help: "Requests answered, by route, method and status.",
+    }, []string{"route", "method", "status"})
+    httpRequestSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+        Name: "beacon_http_request_duration_seconds",
+        Help: "Time taken to answer requests.",
+        Buckets: prometheus.DefBuckets,
+    }, []string{"route", "method"})
+    errorResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "beacon_error_responses_total",
+        Help: "Error responses written, by error code.",
+    }, []string{"code"})
+    imageSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+        Name: "beacon_image_processing_seconds",
+        Help: "Time taken to make thumbnails of posted images.",
+        Buckets: prometheus.DefBuckets,
+    })
+    // Counted by this process since it started. Totals across every
+    // instance are the sum of these.
+    beaconsPosted = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "beacon_beacons_posted_total",
+        Help: "Beacons posted to this process since it started, including those held for review.",
+    })
+    commentsPosted = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "beacon_comments_posted_total",
+        Help: "Comments posted to this process since it started, including those held for review.",
+    })
+    heartActions = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "beacon_heart_actions_total",
+        Help: "Requests to heart or unheart a post made to this process since it started.",
+    }, []string{"action"})
+    activeUsers = &activeUsersCollector{
+        desc: prometheus.NewDesc("beacon_active_users",
+            "Users who made an authenticated request in the last 24 hours.", nil, nil),
+    }
+)
+
+func init() {
+    prometheus.MustRegister(httpRequests, httpRequestSeconds, errorResponses, imageSeconds,
+        beaconsPosted, commentsPosted, heartActions, activeUsers)
+}
+
+// Methods outside this set are counted as "other" so clients can't
+// create new series at will.
+var knownMethods = map[string]bool{
+    "GET": true, "HEAD": true, "POST": true, "PUT": true,
+    "DELETE": true, "PATCH": true, "OPTIONS": true,
+}
+
+func observeRequest(route string, method string, status int, elapsed time.Duration) {
+    if route == "" {
+        route = "none"
+    }
+    if !knownMethods[method] {
+        method = "other"
+    }
+    httpRequests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+    httpRequestSeconds.WithLabelValues(route, method).Observe(elapsed.Seconds())
+}
+
+// Reads the count of active users from Redis on every scrape, so it is
+// shared by every instance. Left out of the scrape if Redis fails.
+type activeUsersCollector struct {
+    desc *prometheus.Desc
+    mutex sync.Mutex
+    db *DBClient
+}
+
+func (c *activeUsersCollector) Describe(ch chan<- *prometheus.Desc) {
+    ch <- c.desc
+}
+
+func (c *activeUsersCollector) Collect(ch chan<- prometheus.Metric) {
+    c.mutex.Lock()
+    db := c.db
+    c.mutex.Unlock()
+    if db == nil {
+        return
+    }
+    count, err := db.CountActiveUsers()
+    if err != nil {
+        return
+    }
+    ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count))
+}
+
+// Reports the active users of db, replacing the database of any
+// server made before.
+func registerActiveUsers(db *DBClient) {
+    activeUsers.mutex.Lock()
+    activeUsers.db = db
+    activeUsers.mutex.Unlock()
+}
+
+// Tags the request with the user for logging and counts the user as
+// active.
+func authenticated(w http.ResponseWriter, userID uint64, db *DBClient) {
+    setLogUser(w, userID)
+    if err := db.MarkActive(userID); err != nil {
+        RequestLog(w).Debug("Could not mark user active.", "error", err.Error())
+    }
+}
+
+// Serves /metrics on its own listener from the next call to Start, so
+// that it can be kept off the public address. Empty serves no metrics.
+func (bm *BeaconServer) SetMetricsAddr(addr string) {
+    bm.metricsAddr = addr
+}
+
+func (bm *BeaconServer) startMetrics() (*http.Server, error) {
+    listener, err := net.Listen("tcp", bm.metricsAddr)
+    if err != nil {
+        return nil, err
+    }
+    mux := http.NewServeMux()
+    mux.Handle("/metrics", promhttp.Handler())
+    server := &http.Server{
+        Handler: mux,
+        ReadTimeout: bm.limits.ReadTimeout,
+        WriteTimeout: bm.limits.WriteTimeout,
+        IdleTimeout: bm.limits.IdleTimeout,
+        MaxHeaderBytes: bm.limits.MaxHeaderBytes,
+    }
+    go func() {
+        if err := server.Serve(listener); err != http.ErrServerClosed {
+            log.Printf("Metrics listener stopped. %s", err.Error())
+        }
+    }()
+    return server, nil
+}
@@ -0,0 +1,97 @@
+package beaconrest
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "time"
+    . "github.com/opus-ua/beacon-post"
+)
+
+// What to do with a post that breaks a posting policy.
+type ViolationAction uint8
+
+const (
+    RejectViolations ViolationAction = iota
+    ReviewViolations
+)
+
+var violationActionNames = map[ViolationAction]string{
+    RejectViolations: "reject",
+    ReviewViolations: "review",
+}
+
+func (a ViolationAction) String() string {
+    return violationActionNames[a]
+}
+
+func (a ViolationAction) MarshalText() ([]byte, error) {
+    return []byte(a.String()), nil
+}
+
+func (a *ViolationAction) UnmarshalText(text []byte) error {
+    for action, name := range violationActionNames {
+        if name == string(text) {
+            *a = action
+            return nil
+        }
+    }
+    return errors.New("Unknown violation action.")
+}
+
+// Limits on how far a beacon may be from the device posting it.
+// MaxDistance is in kilometers, MaxAccuracy in meters and MaxSpeed
+// in kilometers per hour. A zero limit is not enforced. Beacons
+// without a fix are refused unless RequireFix is turned off, which
+// only servers with clients too old to send one should do, since it
+// lets any client skip the checks by leaving the fix out.
+type ProximityPolicy struct {
+    RequireFix  bool            `toml:"require_fix"`
+    MaxDistance float64         `toml:"max_distance"`
+    MaxAccuracy float64         `toml:"max_accuracy"`
+    MaxSpeed    float64         `toml:"max_speed"`
+    Action      ViolationAction `toml:"action"`
+}
+
+var DefaultProximityPolicy = ProximityPolicy{
+    RequireFix:  true,
+    MaxDistance: 1.0,
+    MaxAccuracy: 1000.0,
+    MaxSpeed:    1000.0,
+    Action:      RejectViolations,
+}
+
+// A device's own report of where it is.
+type DeviceFix struct {
+    Location Geotag
+    Accuracy float64
+}
+
+// Returns a description of the first rule the post breaks, or the
+// empty string if it breaks none. last is the device fix from the
+// user's previous post, if one is known.
+func (p *ProximityPolicy) Violation(loc Geotag, fix *DeviceFix, last *DeviceFix, lastTime time.Time, now time.Time) string {
+    if fix == nil {
+        if p.RequireFix {
+            return "Beacon was posted without a device fix."
+        }
+        return ""
+    }
+    if p.MaxAccuracy > 0.0 && fix.Accuracy > p.MaxAccuracy {
+        return fmt.Sprintf("Device fix accuracy of %.0fm is too coarse.", fix.Accuracy)
+    }
+    slack := math.Max(fix.Accuracy, 0.0) / 1000.0
+    if p.MaxDistance > 0.0 {
+        if dist := Distance(loc, fix.Location) - slack; dist > p.MaxDistance {
+            return fmt.Sprintf("Beacon is %.2fkm from the device.", dist)
+        }
+    }
+    if p.MaxSpeed > 0.0 && last != nil {
+        dist := math.Max(Distance(last.Location, fix.Location)-slack, 0.0)
+        hours := math.Max(now.Sub(lastTime).Hours(), 1.0/3600.0)
+        if speed := dist / hours; speed > p.MaxSpeed {
+            return fmt.Sprintf("Device moved %.2fkm since the last post, at %.0fkm/h.", dist, speed)
+        }
+    }
+    return ""
+}
@@ -0,0 +1,24 @@
+package beaconrest
+
+import (
+    "testing"
+    "time"
+    . "github.com/opus-ua/beacon-post"
+)
+
+func TestRequireFixByDefault(t *testing.T) {
+    policy := DefaultProximityPolicy
+    loc := Geotag{Latitude: 45.0, Longitude: 45.0}
+    now := time.Now()
+    if policy.Violation(loc, nil, nil, now, now) == "" {
+        t.Fatalf("Beacon without a device fix passed the default policy.")
+    }
+    fix := &DeviceFix{Location: Geotag{Latitude: 45.0001, Longitude: 45.0001}, Accuracy: 20.0}
+    if violation := policy.Violation(loc, fix, nil, now, now); violation != "" {
+        t.Fatalf("Beacon next to the device was refused. %s", violation)
+    }
+    policy.RequireFix = false
+    if violation := policy.Violation(loc, nil, nil, now, now); violation != "" {
+        t.Fatalf("Beacon without a device fix was refused for older clients. %s", violation)
+    }
+}
@@ -0,0 +1,252 @@
+package beaconrest
+
+import (
+    "context"
+    "fmt"
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    . "github.com/opus-ua/beacon-db"
+)
+
+// A token bucket holding at most Burst tokens and gaining one
+// token every Per. A zero RateLimit never limits anything.
+type RateLimit struct {
+    Burst int           `toml:"burst"`
+    Per   time.Duration `toml:"per"`
+}
+
+func (l RateLimit) Enabled() bool {
+    return l.Burst > 0 && l.Per > 0
+}
+
+// Limits applied to a single endpoint. IP and Endpoint buckets are
+// charged before credentials are checked, Endpoint being a single
+// bucket shared by every caller. User buckets are only charged once
+// the auth middleware of the route has verified the user, so nobody
+// can use up another user's limit.
+type EndpointLimits struct {
+    User     RateLimit `toml:"user"`
+    IP       RateLimit `toml:"ip"`
+    Endpoint RateLimit `toml:"endpoint"`
+}
+
+var heartLimits = EndpointLimits{
+    User: RateLimit{Burst: 60, Per: time.Second},
+    IP:   RateLimit{Burst: 200, Per: 250 * time.Millisecond},
+}
+
+var flagLimits = EndpointLimits{
+    User: RateLimit{Burst: 10, Per: time.Minute},
+    IP:   RateLimit{Burst: 30, Per: 20 * time.Second},
+}
+
+// Limits keyed by the uri template the endpoint is registered under.
+var DefaultRateLimits = map[string]EndpointLimits{
+    "/createaccount": EndpointLimits{
+        IP: RateLimit{Burst: 5, Per: 10 * time.Minute},
+    },
+    "/beacon": EndpointLimits{
+        User: RateLimit{Burst: 5, Per: time.Minute},
+        IP:   RateLimit{Burst: 20, Per: 15 * time.Second},
+    },
+    "/comment": EndpointLimits{
+        User: RateLimit{Burst: 10, Per: 10 * time.Second},
+        IP:   RateLimit{Burst: 40, Per: 3 * time.Second},
+    },
+    "/heart/{id}":           heartLimits,
+    "/unheart/{id}":         heartLimits,
+    "/beacon/{id}/heart":    heartLimits,
+    "/beacon/{id}/unheart":  heartLimits,
+    "/comment/{id}/heart":   heartLimits,
+    "/comment/{id}/unheart": heartLimits,
+    "/flag/{id}":            flagLimits,
+    "/beacon/{id}/flag":     flagLimits,
+    "/comment/{id}/flag":    flagLimits,
+    "/me/export": EndpointLimits{
+        User: RateLimit{Burst: 2, Per: time.Hour},
+        IP:   RateLimit{Burst: 10, Per: 10 * time.Minute},
+    },
+    "/export/{token}": EndpointLimits{
+        IP: RateLimit{Burst: 30, Per: 10 * time.Second},
+    },
+}
+
+type RateLimitStore interface {
+    // Takes a token from the named bucket. If none is left, returns
+    // false along with how long until one will be.
+    Take(bucket string, limit RateLimit) (bool, time.Duration, error)
+}
+
+// Keeps buckets in Redis so that limits hold across several nodes.
+type RedisRateLimitStore struct {
+    db *DBClient
+}
+
+func NewRedisRateLimitStore(db *DBClient) *RedisRateLimitStore {
+    return &RedisRateLimitStore{db: db}
+}
+
+func (s *RedisRateLimitStore) Take(bucket string, limit RateLimit) (bool, time.Duration, error) {
+    return s.db.TakeToken(bucket, limit.Burst, limit.Per)
+}
+
+type memoryBucket struct {
+    tokens int
+    last   time.Time
+    limit  RateLimit
+}
+
+// Keeps buckets in process memory. Only suitable for a single node.
+type MemoryRateLimitStore struct {
+    mutex   sync.Mutex
+    buckets map[string]*memoryBucket
+}
+
+const memoryBucketSweepSize = 10000
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+    return &MemoryRateLimitStore{buckets: map[string]*memoryBucket{}}
+}
+
+func (b *memoryBucket) refill(now time.Time) {
+    refill := int(now.Sub(b.last) / b.limit.Per)
+    if refill > 0 {
+        b.tokens += refill
+        b.last = b.last.Add(time.Duration(refill) * b.limit.Per)
+    }
+    if b.tokens >= b.limit.Burst {
+        b.tokens = b.limit.Burst
+        b.last = now
+    }
+}
+
+func (s *MemoryRateLimitStore) Take(bucket string, limit RateLimit) (bool, time.Duration, error) {
+    if !limit.Enabled() {
+        return true, 0, nil
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    now := time.Now()
+    if len(s.buckets) >= memoryBucketSweepSize {
+        s.sweep(now)
+    }
+    b, ok := s.buckets[bucket]
+    if !ok || b.limit != limit {
+        b = &memoryBucket{tokens: limit.Burst, last: now, limit: limit}
+        s.buckets[bucket] = b
+    }
+    b.refill(now)
+    if b.tokens > 0 {
+        b.tokens--
+        return true, 0, nil
+    }
+    return false, limit.Per - now.Sub(b.last), nil
+}
+
+// Full buckets carry no state worth keeping.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+    for key, b := range s.buckets {
+        b.refill(now)
+        if b.tokens >= b.limit.Burst {
+            delete(s.buckets, key)
+        }
+    }
+}
+
+type RateLimiter struct {
+    store  RateLimitStore
+    limits map[string]EndpointLimits
+}
+
+func NewRateLimiter(store RateLimitStore, limits map[string]EndpointLimits) *RateLimiter {
+    return &RateLimiter{store: store, limits: limits}
+}
+
+func (rl *RateLimiter) Store() RateLimitStore {
+    return rl.store
+}
+
+func ClientIP(r *http.Request) string {
+    clientIP := r.RemoteAddr
+    if colon := strings.LastIndex(clientIP, ":"); colon != -1 {
+        clientIP = clientIP[:colon]
+    }
+    return clientIP
+}
+
+// Charges the request against the IP and Endpoint buckets of the
+// endpoint. Writes a 429 and returns false if either is empty. Runs
+// before credentials are checked, so that a flood of bad ones is
+// throttled before it reaches the database. Returns r with what
+// AllowUser needs to charge the user bucket later.
+func (rl *RateLimiter) Allow(w http.ResponseWriter, r *http.Request, endpoint string) (*http.Request, bool) {
+    if rl == nil {
+        return r, true
+    }
+    limits, ok := rl.limits[endpoint]
+    if !ok {
+        return r, true
+    }
+    if limits.IP.Enabled() {
+        bucket := fmt.Sprintf("%s:ip:%s", endpoint, ClientIP(r))
+        if !rl.take(w, bucket, limits.IP) {
+            return r, false
+        }
+    }
+    if limits.Endpoint.Enabled() {
+        if !rl.take(w, endpoint, limits.Endpoint) {
+            return r, false
+        }
+    }
+    if limits.User.Enabled() {
+        limit := &userLimit{limiter: rl, endpoint: endpoint, limit: limits.User}
+        r = r.WithContext(context.WithValue(r.Context(), userLimitKey{}, limit))
+    }
+    return r, true
+}
+
+type userLimitKey struct{}
+
+// The user bucket of the endpoint a request was routed to.
+type userLimit struct {
+    limiter *RateLimiter
+    endpoint string
+    limit RateLimit
+    charged bool
+}
+
+// Charges the user bucket of the endpoint r was routed to, once per
+// request, after the auth middleware has verified userID. Writes a
+// 429 and returns false if the bucket is empty.
+func AllowUser(w http.ResponseWriter, r *http.Request, userID uint64) bool {
+    limit, ok := r.Context().Value(userLimitKey{}).(*userLimit)
+    if !ok || limit.charged {
+        return true
+    }
+    limit.charged = true
+    bucket := fmt.Sprintf("%s:u:%d", limit.endpoint, userID)
+    return limit.limiter.take(w, bucket, limit.limit)
+}
+
+func (rl *RateLimiter) take(w http.ResponseWriter, bucket string, limit RateLimit) bool {
+    allowed, wait, err := rl.store.Take(bucket, limit)
+    if err != nil {
+        // Don't turn a rate limiter outage into a full outage.
+        RequestLog(w).Warn("Rate limiter unavailable.", "error", err.Error())
+        return true
+    }
+    if !allowed {
+        retryAfter := int64(math.Ceil(wait.Seconds()))
+        if retryAfter < 1 {
+            retryAfter = 1
+        }
+        w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+        WriteErrorResp(w, fmt.Sprintf("Rate limit exceeded for '%s'.", bucket), RateLimited)
+        return false
+    }
+    return true
+}
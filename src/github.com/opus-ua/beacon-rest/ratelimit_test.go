@@ -0,0 +1,147 @@
+package beaconrest
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "testing"
+    "time"
+    . "github.com/opus-ua/beacon-db"
+)
+
+// A server on db with two public routes and one behind RequireUser,
+// limited through store. A DBClient{} has no connection, so any lookup
+// through it fails the request.
+func newLimitedServer(db *DBClient, store RateLimitStore, limits map[string]EndpointLimits) *httptest.Server {
+    bs := &BeaconServer{db: db, limits: DefaultServerLimits}
+    bs.RouteGroup = &RouteGroup{server: bs}
+    bs.HandleGet("/ping", func(w http.ResponseWriter, r *http.Request, db *DBClient) {
+        w.Write([]byte("pong"))
+    })
+    bs.HandleGet("/free", func(w http.ResponseWriter, r *http.Request, db *DBClient) {
+        w.Write([]byte("free"))
+    })
+    bs.Group("", RequireUser).HandleGet("/private", func(w http.ResponseWriter, r *http.Request, db *DBClient) {
+        w.Write([]byte("private"))
+    })
+    bs.SetRateLimiter(NewRateLimiter(store, limits))
+    return httptest.NewServer(NewRequestLoggingHandler(bs.limitBody(http.HandlerFunc(bs.dispatch))))
+}
+
+func TestRateLimited(t *testing.T) {
+    server := newLimitedServer(&DBClient{}, NewMemoryRateLimitStore(), map[string]EndpointLimits{
+        "/ping": EndpointLimits{IP: RateLimit{Burst: 2, Per: time.Minute}},
+    })
+    defer server.Close()
+    for i := 0; i < 2; i++ {
+        resp, err := http.Get(server.URL + "/ping")
+        if err != nil {
+            t.Fatalf("Could not connect to test server.")
+        }
+        resp.Body.Close()
+        if resp.StatusCode != 200 {
+            t.Fatalf("Request %d within the limit gave status %d.", i + 1, resp.StatusCode)
+        }
+    }
+    resp, err := http.Get(server.URL + "/ping")
+    if err != nil {
+        t.Fatalf("Could not connect to test server.")
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusTooManyRequests {
+        t.Fatalf("Request over the limit gave status %d, not 429.", resp.StatusCode)
+    }
+    var msg JSONError
+    if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil || msg.Code != RateLimited {
+        t.Fatalf("Request over the limit did not give a rate limit error.")
+    }
+    // One token comes back every minute.
+    if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "60" {
+        t.Fatalf("Retry-After was '%s', not '60'.", retryAfter)
+    }
+    resp, err = http.Get(server.URL + "/free")
+    if err != nil {
+        t.Fatalf("Could not connect to test server.")
+    }
+    resp.Body.Close()
+    if resp.StatusCode != 200 {
+        t.Fatalf("Route without limits gave status %d.", resp.StatusCode)
+    }
+}
+
+func TestIPLimitedBeforeAuth(t *testing.T) {
+    store := NewMemoryRateLimitStore()
+    limit := RateLimit{Burst: 1, Per: time.Minute}
+    server := newLimitedServer(&DBClient{}, store, map[string]EndpointLimits{
+        "/private": EndpointLimits{IP: limit},
+    })
+    defer server.Close()
+    store.Take("/private:ip:127.0.0.1", limit)
+    req, _ := http.NewRequest("GET", server.URL + "/private", nil)
+    req.SetBasicAuth("999", "0")
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatalf("Credentials were checked before the rate limit.")
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusTooManyRequests {
+        t.Fatalf("Request over the IP limit gave status %d, not 429.", resp.StatusCode)
+    }
+    req, _ = http.NewRequest("GET", server.URL + "/ping", nil)
+    req.SetBasicAuth("999", "0")
+    resp, err = http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatalf("Credentials were checked on a public route.")
+    }
+    resp.Body.Close()
+    if resp.StatusCode != 200 {
+        t.Fatalf("Public route with credentials gave status %d.", resp.StatusCode)
+    }
+}
+
+// Redis database 14 is left to the tests of this package, so that they
+// don't race the flushes of the tests of other packages.
+const REST_TEST_REDIS_DB = 14
+
+func TestUserLimitedAfterAuth(t *testing.T) {
+    config := DefaultRedisConfig
+    config.DB = REST_TEST_REDIS_DB
+    db, err := NewDB(config, false, false)
+    if err != nil {
+        t.Fatalf(err.Error())
+    }
+    db.Flush()
+    defer db.Close()
+    defer db.Flush()
+    userID, err := db.CreateUser("limited", []byte("secret"), "limited@gmail.com")
+    if err != nil {
+        t.Fatalf(err.Error())
+    }
+    server := newLimitedServer(db, NewMemoryRateLimitStore(), map[string]EndpointLimits{
+        "/private": EndpointLimits{User: RateLimit{Burst: 1, Per: time.Minute}},
+    })
+    defer server.Close()
+    get := func(key string) int {
+        req, _ := http.NewRequest("GET", server.URL + "/private", nil)
+        req.SetBasicAuth(strconv.FormatUint(userID, 10), key)
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatalf("Could not connect to test server.")
+        }
+        resp.Body.Close()
+        return resp.StatusCode
+    }
+    // Others naming the user can't use up their limit.
+    for i := 0; i < 3; i++ {
+        if status := get("junk"); status != 400 {
+            t.Fatalf("Request with a wrong key gave status %d, not 400.", status)
+        }
+    }
+    if status := get("secret"); status != 200 {
+        t.Fatalf("Request within the user limit gave status %d.", status)
+    }
+    if status := get("secret"); status != http.StatusTooManyRequests {
+        t.Fatalf("Request over the user limit gave status %d, not 429.", status)
+    }
+}
@@ -0,0 +1,323 @@
+package beaconrest
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    . "github.com/opus-ua/beacon-db"
+)
+
+// Types a uri parameter may be declared with, as in {id:int}. An
+// untyped parameter matches any non-empty segment.
+var uriParamTypes = map[string]func(string) bool{
+    "": func(segment string) bool {
+        return true
+    },
+    "int": func(segment string) bool {
+        _, err := strconv.ParseUint(segment, 10, 64)
+        return err == nil
+    },
+}
+
+type uriParamsKey struct{}
+
+// A uri template such as /beacon/{id:int}/heart and its handlers by
+// method. Segments in braces match any one path segment of their
+// type.
+type route struct {
+    // The template without types, used to name the route in logs,
+    // metrics and traces.
+    uri      string
+    segments []string
+    // Parameter names and types by segment. Empty names are literal
+    // segments.
+    params   []string
+    types    []string
+    methods  map[string]BeaconHandler
+}
+
+func newRoute(template string) *route {
+    segments := strings.Split(template, "/")
+    rt := &route{
+        segments: segments,
+        params:   make([]string, len(segments)),
+        types:    make([]string, len(segments)),
+        methods:  map[string]BeaconHandler{},
+    }
+    for i, segment := range segments {
+        if !IsURIParam(segment) {
+            continue
+        }
+        name := segment[1:len(segment) - 1]
+        paramType := ""
+        if colon := strings.Index(name, ":"); colon != -1 {
+            name, paramType = name[:colon], name[colon + 1:]
+        }
+        if _, ok := uriParamTypes[paramType]; !ok || name == "" {
+            panic(fmt.Sprintf("Bad parameter '%s' in uri '%s'.", segment, template))
+        }
+        rt.params[i] = name
+        rt.types[i] = paramType
+        segments[i] = "{" + name + "}"
+    }
+    rt.uri = strings.Join(segments, "/")
+    return rt
+}
+
+// Returns the parameters of path if it matches the template.
+func (rt *route) match(path string) (map[string]string, bool) {
+    segments := strings.Split(path, "/")
+    if len(segments) != len(rt.segments) {
+        return nil, false
+    }
+    params := map[string]string{}
+    for i, segment := range rt.segments {
+        if rt.params[i] == "" {
+            if segment != segments[i] {
+                return nil, false
+            }
+            continue
+        }
+        if segments[i] == "" || !uriParamTypes[rt.types[i]](segments[i]) {
+            return nil, false
+        }
+        params[rt.params[i]] = segments[i]
+    }
+    return params, true
+}
+
+// Whether rt should be tried before other, which matches the same
+// paths. Literal segments win over parameters, left to right, so
+// /me/username is tried before /me/{field}.
+func (rt *route) before(other *route) bool {
+    for i := range rt.segments {
+        if (rt.params[i] == "") != (other.params[i] == "") {
+            return rt.params[i] == ""
+        }
+    }
+    return false
+}
+
+// The methods rt answers, including those answered implicitly.
+func (rt *route) allow() []string {
+    allowed := []string{}
+    for method := range rt.methods {
+        allowed = append(allowed, method)
+    }
+    if _, ok := rt.methods["GET"]; ok {
+        if _, ok := rt.methods["HEAD"]; !ok {
+            allowed = append(allowed, "HEAD")
+        }
+    }
+    if _, ok := rt.methods["OPTIONS"]; !ok {
+        allowed = append(allowed, "OPTIONS")
+    }
+    return allowed
+}
+
+// GET handlers answer HEAD unless HEAD has one of its own. The server
+// drops the body.
+func (rt *route) handler(method string) (BeaconHandler, bool) {
+    handler, ok := rt.methods[method]
+    if !ok && method == "HEAD" {
+        handler, ok = rt.methods["GET"]
+    }
+    return handler, ok
+}
+
+func IsURIParam(segment string) bool {
+    return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// The value of the named uri parameter of the route r was dispatched
+// to, or "" if it has none.
+func URIParam(r *http.Request, name string) string {
+    params, _ := r.Context().Value(uriParamsKey{}).(map[string]string)
+    return params[name]
+}
+
+// The value of a uri parameter declared as {name:int}. Such a route
+// only matches paths where it parses.
+func IntURIParam(r *http.Request, name string) uint64 {
+    value, _ := strconv.ParseUint(URIParam(r, name), 10, 64)
+    return value
+}
+
+// The routes of one server.
+type router struct {
+    routes []*route
+}
+
+func (rtr *router) add(template string, method string, handler BeaconHandler) *route {
+    rt := newRoute(template)
+    for _, existing := range rtr.routes {
+        if existing.uri != rt.uri {
+            continue
+        }
+        if _, ok := existing.methods[method]; ok {
+            panic(fmt.Sprintf("%s %s is registered twice.", method, rt.uri))
+        }
+        existing.methods[method] = handler
+        return existing
+    }
+    rt.methods[method] = handler
+    rtr.routes = append(rtr.routes, rt)
+    return rt
+}
+
+// Returns the routes matching path, most specific first, with the
+// parameters of each.
+func (rtr *router) lookup(path string) ([]*route, []map[string]string) {
+    type found struct {
+        rt *route
+        params map[string]string
+    }
+    matches := []found{}
+    for _, rt := range rtr.routes {
+        if params, ok := rt.match(path); ok {
+            matches = append(matches, found{rt, params})
+        }
+    }
+    sort.SliceStable(matches, func(i, j int) bool {
+        return matches[i].rt.before(matches[j].rt)
+    })
+    routes := make([]*route, len(matches))
+    params := make([]map[string]string, len(matches))
+    for i, match := range matches {
+        routes[i], params[i] = match.rt, match.params
+    }
+    return routes, params
+}
+
+// Answers with the handler of the most specific route matching the
+// path and method, a 405 listing the allowed methods if routes match
+// the path but not the method, or a 404 if none match.
+func (bm *BeaconServer) dispatch(w http.ResponseWriter, r *http.Request) {
+    routes, params := bm.router.lookup(r.URL.Path)
+    if len(routes) == 0 {
+        WriteErrorResp(w, fmt.Sprintf("No endpoint matches '%s'.", r.URL.Path), EndpointNotFound)
+        return
+    }
+    for i, rt := range routes {
+        handler, ok := rt.handler(r.Method)
+        if !ok {
+            continue
+        }
+        setLogRoute(w, rt.uri)
+        r = r.WithContext(context.WithValue(r.Context(), uriParamsKey{}, params[i]))
+        r, ok = bm.limiter.Allow(w, r, rt.uri)
+        if !ok {
+            return
+        }
+        handler(w, r, bm.db.WithContext(r.Context()))
+        return
+    }
+    allowed := map[string]bool{}
+    for _, rt := range routes {
+        for _, method := range rt.allow() {
+            allowed[method] = true
+        }
+    }
+    methods := []string{}
+    for method := range allowed {
+        methods = append(methods, method)
+    }
+    sort.Strings(methods)
+    setLogRoute(w, routes[0].uri)
+    w.Header().Set("Allow", strings.Join(methods, ", "))
+    if r.Method == "OPTIONS" {
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    msg := fmt.Sprintf("Only method %s supported.", strings.Join(methods, ", "))
+    WriteErrorResp(w, msg, MethodNotAllowed)
+}
+
+// Wraps the handlers of a route group, as in
+// group.Use(func(next BeaconHandler) BeaconHandler { ... }).
+type Middleware func(BeaconHandler) BeaconHandler
+
+// Routes registered through a group share its uri prefix and are
+// wrapped in its middleware, outermost first. The middleware runs
+// after the IP and endpoint rate limits.
+type RouteGroup struct {
+    server     *BeaconServer
+    prefix     string
+    middleware []Middleware
+}
+
+// Returns a group of routes under prefix, wrapped in the middleware of
+// this group and then in middleware.
+func (g *RouteGroup) Group(prefix string, middleware ...Middleware) *RouteGroup {
+    return &RouteGroup{
+        server:     g.server,
+        prefix:     g.prefix + prefix,
+        middleware: append(append([]Middleware{}, g.middleware...), middleware...),
+    }
+}
+
+// Adds middleware to routes registered from now on.
+func (g *RouteGroup) Use(middleware ...Middleware) {
+    g.middleware = append(g.middleware, middleware...)
+}
+
+// Registers a handler for one method on a uri template. A template
+// may be given several handlers as long as their methods differ.
+func (g *RouteGroup) HandleMethod(uri string, method string, handler BeaconHandler) {
+    for i := len(g.middleware) - 1; i >= 0; i-- {
+        handler = g.middleware[i](handler)
+    }
+    g.server.router.add(g.prefix + uri, method, handler)
+}
+
+func (g *RouteGroup) HandleGet(uri string, handler BeaconHandler) {
+    g.HandleMethod(uri, "GET", handler)
+}
+
+func (g *RouteGroup) HandlePost(uri string, handler BeaconHandler) {
+    g.HandleMethod(uri, "POST", handler)
+}
+
+// Registers a handler for a uri template with a single parameter,
+// which must be an integer.
+func (g *RouteGroup) HandleIntParam(uri string, method string, handler IntParamBeaconHandler) {
+    segments := strings.Split(uri, "/")
+    name := ""
+    for i, segment := range segments {
+        if !IsURIParam(segment) {
+            continue
+        }
+        if name != "" {
+            panic(fmt.Sprintf("Uri '%s' has more than one parameter.", uri))
+        }
+        name = strings.TrimSuffix(segment[1:len(segment) - 1], ":int")
+        segments[i] = "{" + name + ":int}"
+    }
+    if name == "" {
+        panic(fmt.Sprintf("Uri '%s' has no parameter.", uri))
+    }
+    g.HandleMethod(strings.Join(segments, "/"), method, func(w http.ResponseWriter, r *http.Request, db *DBClient) {
+        handler(w, r, IntURIParam(r, name), db)
+    })
+}
+
+func (g *RouteGroup) HandleAuth(uri string, method string, handler AuthBeaconHandler) {
+    g.HandleMethod(uri, method, func(w http.ResponseWriter, r *http.Request, db *DBClient) {
+        handler(w, r, g.server.authCodes, db)
+    })
+}
+
+func (g *RouteGroup) HandleAccount(uri string, method string, handler AccountBeaconHandler) {
+    g.HandleMethod(uri, method, func(w http.ResponseWriter, r *http.Request, db *DBClient) {
+        handler(w, r, &g.server.accounts, db)
+    })
+}
+
+func (g *RouteGroup) HandlePolicy(uri string, method string, handler PolicyBeaconHandler) {
+    g.HandleMethod(uri, method, func(w http.ResponseWriter, r *http.Request, db *DBClient) {
+        handler(w, r, &g.server.policy, db)
+    })
+}
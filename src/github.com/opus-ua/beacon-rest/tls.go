@@ -0,0 +1,198 @@
+package beaconrest
+
+import (
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// The default of how often the certificate is checked for changes.
+const CERT_RELOAD_INTERVAL = 10 * time.Second
+
+// Serving over TLS. The server speaks HTTP/2 to clients that offer it.
+type TLSConfig struct {
+    CertFile string `toml:"cert"`
+    KeyFile string `toml:"key"`
+    // Sent as Strict-Transport-Security on every response. Zero sends
+    // no header.
+    HSTSMaxAge time.Duration `toml:"hsts_max_age"`
+    HSTSIncludeSubdomains bool `toml:"hsts_include_subdomains"`
+    // Plain HTTP requests to this host:port are redirected to HTTPS.
+    RedirectAddr string `toml:"redirect_addr"`
+    // How often the certificate and key files are checked for changes.
+    ReloadInterval time.Duration `toml:"reload_interval"`
+}
+
+var DefaultTLSConfig = TLSConfig{
+    ReloadInterval: CERT_RELOAD_INTERVAL,
+}
+
+func (config TLSConfig) Enabled() bool {
+    return config.CertFile != "" || config.KeyFile != ""
+}
+
+func (config TLSConfig) Validate() error {
+    if !config.Enabled() {
+        if config.HSTSMaxAge != 0 || config.RedirectAddr != "" {
+            return errors.New("HSTS and the HTTPS redirect need a TLS certificate.")
+        }
+        return nil
+    }
+    if config.CertFile == "" || config.KeyFile == "" {
+        return errors.New("TLS needs both a certificate and a key.")
+    }
+    if config.HSTSMaxAge < 0 {
+        return errors.New("HSTS max age is negative.")
+    }
+    if config.ReloadInterval <= 0 {
+        return errors.New("TLS reload interval must be positive.")
+    }
+    if _, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile); err != nil {
+        return fmt.Errorf("Could not load TLS certificate. %s", err.Error())
+    }
+    return nil
+}
+
+func (config TLSConfig) hstsHeader() string {
+    header := fmt.Sprintf("max-age=%d", int64(config.HSTSMaxAge / time.Second))
+    if config.HSTSIncludeSubdomains {
+        header += "; includeSubDomains"
+    }
+    return header
+}
+
+// Hands out a certificate and key pair, reloading them from disk when
+// asked to or, once Watch is called, whenever either file changes. A
+// pair that fails to load leaves the previous one in use.
+type CertReloader struct {
+    certFile string
+    keyFile string
+    mutex sync.RWMutex
+    cert *tls.Certificate
+    certMod time.Time
+    keyMod time.Time
+    stop chan struct{}
+}
+
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+    r := &CertReloader{certFile: certFile, keyFile: keyFile}
+    if err := r.Reload(); err != nil {
+        return nil, err
+    }
+    return r, nil
+}
+
+func (r *CertReloader) Reload() error {
+    certMod, keyMod := r.modTimes()
+    cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+    if err != nil {
+        return err
+    }
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.cert = &cert
+    r.certMod, r.keyMod = certMod, keyMod
+    return nil
+}
+
+func (r *CertReloader) modTimes() (time.Time, time.Time) {
+    var certMod, keyMod time.Time
+    if info, err := os.Stat(r.certFile); err == nil {
+        certMod = info.ModTime()
+    }
+    if info, err := os.Stat(r.keyFile); err == nil {
+        keyMod = info.ModTime()
+    }
+    return certMod, keyMod
+}
+
+func (r *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+    return r.cert, nil
+}
+
+// Polls the certificate and key files until Close is called.
+func (r *CertReloader) Watch(interval time.Duration) {
+    r.mutex.Lock()
+    if r.stop != nil {
+        r.mutex.Unlock()
+        return
+    }
+    stop := make(chan struct{})
+    r.stop = stop
+    r.mutex.Unlock()
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-stop:
+                return
+            case <-ticker.C:
+                r.reloadIfChanged()
+            }
+        }
+    }()
+}
+
+func (r *CertReloader) reloadIfChanged() {
+    certMod, keyMod := r.modTimes()
+    r.mutex.RLock()
+    changed := !certMod.Equal(r.certMod) || !keyMod.Equal(r.keyMod)
+    r.mutex.RUnlock()
+    if !changed {
+        return
+    }
+    if err := r.Reload(); err != nil {
+        log.Printf("Could not reload TLS certificate. %s", err.Error())
+        return
+    }
+    log.Printf("Reloaded TLS certificate from '%s'.", r.certFile)
+}
+
+func (r *CertReloader) Close() {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if r.stop != nil {
+        close(r.stop)
+        r.stop = nil
+    }
+}
+
+// Adds the Strict-Transport-Security header to every response sent
+// over TLS. Browsers ignore it over plain HTTP.
+func hstsHandler(header string, handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.TLS != nil {
+            w.Header().Set("Strict-Transport-Security", header)
+        }
+        handler.ServeHTTP(w, r)
+    })
+}
+
+// Redirects every request to the same uri over HTTPS on the port of
+// tlsAddr. A 308 keeps the method and body, so clients that posted over
+// plain HTTP don't retry as a GET.
+func redirectHandler(tlsAddr string) http.Handler {
+    _, port, _ := net.SplitHostPort(tlsAddr)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        host, _, err := net.SplitHostPort(r.Host)
+        if err != nil {
+            host = strings.Trim(r.Host, "[]")
+        }
+        if port != "" && port != "443" {
+            host = net.JoinHostPort(host, port)
+        } else if strings.Contains(host, ":") {
+            host = "[" + host + "]"
+        }
+        http.Redirect(w, r, "https://" + host + r.URL.RequestURI(), http.StatusPermanentRedirect)
+    })
+}
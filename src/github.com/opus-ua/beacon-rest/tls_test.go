@@ -0,0 +1,135 @@
+package beaconrest
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "io/ioutil"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func writeTestCert(t *testing.T, dir string, name string) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatalf(err.Error())
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject:      pkix.Name{CommonName: name},
+        NotBefore:    time.Now(),
+        NotAfter:     time.Now().Add(time.Hour),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatalf(err.Error())
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatalf(err.Error())
+    }
+    certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+    keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+    if err = ioutil.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0600); err != nil {
+        t.Fatalf(err.Error())
+    }
+    if err = ioutil.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600); err != nil {
+        t.Fatalf(err.Error())
+    }
+}
+
+func certName(t *testing.T, certs *CertReloader) string {
+    cert, _ := certs.GetCertificate(nil)
+    parsed, err := x509.ParseCertificate(cert.Certificate[0])
+    if err != nil {
+        t.Fatalf(err.Error())
+    }
+    return parsed.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+    dir := t.TempDir()
+    certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+    writeTestCert(t, dir, "first")
+    certs, err := NewCertReloader(certFile, keyFile)
+    if err != nil {
+        t.Fatalf(err.Error())
+    }
+    if name := certName(t, certs); name != "first" {
+        t.Fatalf("Loaded certificate '%s', not 'first'.", name)
+    }
+    writeTestCert(t, dir, "second")
+    if err = certs.Reload(); err != nil {
+        t.Fatalf(err.Error())
+    }
+    if name := certName(t, certs); name != "second" {
+        t.Fatalf("Certificate was not reloaded.")
+    }
+    ioutil.WriteFile(keyFile, []byte("not a key"), 0600)
+    if err = certs.Reload(); err == nil {
+        t.Fatalf("Broken key was loaded.")
+    }
+    if name := certName(t, certs); name != "second" {
+        t.Fatalf("Broken key replaced the working certificate.")
+    }
+    writeTestCert(t, dir, "third")
+    certs.Watch(10 * time.Millisecond)
+    defer certs.Close()
+    for i := 0; i < 50 && certName(t, certs) != "third"; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if name := certName(t, certs); name != "third" {
+        t.Fatalf("Changed certificate was not picked up by Watch.")
+    }
+}
+
+func TestHSTSHandler(t *testing.T) {
+    config := TLSConfig{HSTSMaxAge: 24 * time.Hour, HSTSIncludeSubdomains: true}
+    handler := hstsHandler(config.hstsHeader(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    req := httptest.NewRequest("GET", "https://example.com/version", nil)
+    req.TLS = &tls.ConnectionState{}
+    rec := httptest.NewRecorder()
+    handler.ServeHTTP(rec, req)
+    if header := rec.Header().Get("Strict-Transport-Security"); header != "max-age=86400; includeSubDomains" {
+        t.Fatalf("Strict-Transport-Security over TLS was '%s'.", header)
+    }
+    req = httptest.NewRequest("GET", "http://example.com/version", nil)
+    rec = httptest.NewRecorder()
+    handler.ServeHTTP(rec, req)
+    if header := rec.Header().Get("Strict-Transport-Security"); header != "" {
+        t.Fatalf("Strict-Transport-Security was sent over plain HTTP.")
+    }
+}
+
+func TestRedirectHandler(t *testing.T) {
+    for _, c := range []struct {
+        tlsAddr string
+        url string
+        target string
+    }{
+        {":443", "http://example.com/beacon/1?a=b&c=d", "https://example.com/beacon/1?a=b&c=d"},
+        {":8443", "http://example.com:8080/local?lat=1.5&long=2", "https://example.com:8443/local?lat=1.5&long=2"},
+        {"", "http://example.com/", "https://example.com/"},
+        {":443", "http://[::1]:8080/user/2", "https://[::1]/user/2"},
+        {":8443", "http://[::1]/user/2", "https://[::1]:8443/user/2"},
+    } {
+        for _, method := range []string{"GET", "POST"} {
+            rec := httptest.NewRecorder()
+            redirectHandler(c.tlsAddr).ServeHTTP(rec, httptest.NewRequest(method, c.url, nil))
+            if rec.Code != http.StatusPermanentRedirect {
+                t.Fatalf("Redirect of %s '%s' gave status %d, not 308.", method, c.url, rec.Code)
+            }
+            if location := rec.Header().Get("Location"); location != c.target {
+                t.Fatalf("'%s' was redirected to '%s', not '%s'.", c.url, location, c.target)
+            }
+        }
+    }
+}
@@ -0,0 +1,161 @@
+package beaconrest
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "io"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+    "unicode"
+    "unicode/utf8"
+    . "github.com/opus-ua/beacon-post"
+    . "github.com/opus-ua/beacon-db"
+)
+
+const (
+    DEFAULT_PAGE_SIZE = 20
+    MAX_PAGE_SIZE = 100
+    MAX_USERNAME_LENGTH = 32
+)
+
+// Rules for managing accounts. UsernameCooldown is how long a user
+// must wait between changes of username.
+type AccountPolicy struct {
+    UsernameCooldown time.Duration
+    DeletePosts      DeletePolicy
+}
+
+var DefaultAccountPolicy = AccountPolicy{
+    UsernameCooldown: 30 * 24 * time.Hour,
+    DeletePosts:      AnonymizePosts,
+}
+
+func ValidateUsername(username string) error {
+    if username == "" || strings.TrimSpace(username) != username {
+        return errors.New("Username may not be empty or start or end with spaces.")
+    }
+    if utf8.RuneCountInString(username) > MAX_USERNAME_LENGTH {
+        return errors.New("Username is too long.")
+    }
+    for _, c := range username {
+        if !unicode.IsPrint(c) {
+            return errors.New("Username may only contain printable characters.")
+        }
+    }
+    if username == DeletedUsername {
+        return errors.New("Username is reserved.")
+    }
+    return nil
+}
+
+// Reads the offset and count query parameters used by paginated
+// endpoints.
+func ParsePage(w http.ResponseWriter, r *http.Request) (uint64, uint64, error) {
+    query := r.URL.Query()
+    offset := uint64(0)
+    count := uint64(DEFAULT_PAGE_SIZE)
+    var err error
+    if offsetStr := query.Get("offset"); offsetStr != "" {
+        offset, err = strconv.ParseUint(offsetStr, 10, 64)
+        if err != nil {
+            return 0, 0, WriteErrorResp(w, "Could not parse offset.", ProtocolError)
+        }
+    }
+    if countStr := query.Get("count"); countStr != "" {
+        count, err = strconv.ParseUint(countStr, 10, 64)
+        if err != nil {
+            return 0, 0, WriteErrorResp(w, "Could not parse count.", ProtocolError)
+        }
+    }
+    if count > MAX_PAGE_SIZE {
+        count = MAX_PAGE_SIZE
+    }
+    return offset, count, nil
+}
+
+func WriteUserProfile(w http.ResponseWriter, r *http.Request, userID uint64, viewerID int64, db *DBClient) {
+    offset, count, err := ParsePage(w, r)
+    if err != nil {
+        return
+    }
+    // Only the user sees their own beacons held for review, in the
+    // list and in the count alike.
+    profile, err := db.GetUserProfile(userID, offset, count, viewerID == int64(userID))
+    if err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    respMsg := UserProfileMsg{
+        ID:              profile.ID,
+        Username:        profile.Username,
+        Created:         FormatTime(profile.AccountCreated),
+        Age:             int64(time.Since(profile.AccountCreated) / time.Second),
+        HeartsReceived:  profile.HeartsReceived,
+        HeartsSubmitted: profile.HeartsSubmitted,
+        BeaconCount:     profile.BeaconCount,
+        Beacons:         []RespThumbnailMsg{},
+    }
+    for _, post := range profile.Beacons {
+        beaconMsg, err := ToRespThumbnailMsg(w, post, viewerID, db)
+        if err != nil {
+            return
+        }
+        respMsg.Beacons = append(respMsg.Beacons, beaconMsg)
+    }
+    respJson, err := json.Marshal(respMsg)
+    if err != nil {
+        WriteErrorResp(w, err.Error(), ServerError)
+        return
+    }
+    io.WriteString(w, string(respJson))
+}
+
+func HandleGetUser(w http.ResponseWriter, r *http.Request, id uint64, db *DBClient) {
+    WriteUserProfile(w, r, id, viewerOf(r), db)
+}
+
+func HandleGetMe(w http.ResponseWriter, r *http.Request, db *DBClient) {
+    userID := AuthenticatedUser(r)
+    WriteUserProfile(w, r, userID, int64(userID), db)
+}
+
+func HandleChangeUsername(w http.ResponseWriter, r *http.Request, policy *AccountPolicy, db *DBClient) {
+    userID := AuthenticatedUser(r)
+    var req ChangeUsernameMsg
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        WriteErrorResp(w, err.Error(), JsonError)
+        return
+    }
+    if err := ValidateUsername(req.Username); err != nil {
+        WriteErrorResp(w, err.Error(), ProtocolError)
+        return
+    }
+    wait, err := db.ChangeUsername(userID, req.Username, policy.UsernameCooldown)
+    switch err {
+    case nil:
+    case ErrUsernameTaken:
+        WriteErrorResp(w, err.Error(), UsernameExists)
+        return
+    case ErrUsernameCooldown:
+        retryAfter := int64(math.Ceil(wait.Seconds()))
+        w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+        WriteErrorResp(w, err.Error(), UsernameCooldown)
+        return
+    default:
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    w.WriteHeader(200)
+}
+
+func HandleDeleteMe(w http.ResponseWriter, r *http.Request, policy *AccountPolicy, db *DBClient) {
+    userID := AuthenticatedUser(r)
+    if err := db.DeleteUser(userID, policy.DeletePosts); err != nil {
+        WriteErrorResp(w, err.Error(), DatabaseError)
+        return
+    }
+    w.WriteHeader(200)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+// Grants or revokes administrator rights. Unlike the other
+// subcommands this uses Postgres when it is configured, since that is
+// where the server looks admins up. Returns the exit status.
+func RunAdmin(config Config, args []string) int {
+	adminFlags := flag.NewFlagSet("admin", flag.ExitOnError)
+	adminFlags.Usage = func() {
+		fmt.Printf("Usage: beacon admin grant|revoke <user-id>\n")
+	}
+	adminFlags.Parse(args)
+	if adminFlags.NArg() != 2 || (adminFlags.Arg(0) != "grant" && adminFlags.Arg(0) != "revoke") {
+		adminFlags.Usage()
+		return 2
+	}
+	grant := adminFlags.Arg(0) == "grant"
+	userID, err := strconv.ParseUint(adminFlags.Arg(1), 10, 64)
+	if err != nil {
+		fmt.Printf("Invalid user id '%s'.\n", adminFlags.Arg(1))
+		return 2
+	}
+	db, err := OpenDB(config)
+	if err != nil {
+		fmt.Printf("Could not open the database. %s\n", err.Error())
+		return 1
+	}
+	defer db.Close()
+	if config.Postgres != "" {
+		if err = db.UsePostgres(config.Postgres, config.RedisCache); err != nil {
+			fmt.Printf("Could not connect to Postgres. %s\n", err.Error())
+			return 1
+		}
+	}
+	exists, err := db.UserExists(userID)
+	if err != nil {
+		fmt.Printf("Could not look up user %d. %s\n", userID, err.Error())
+		return 1
+	}
+	if !exists {
+		fmt.Printf("No user with id %d.\n", userID)
+		return 1
+	}
+	if err = db.SetAdmin(userID, grant); err != nil {
+		fmt.Printf("Could not change rights of user %d. %s\n", userID, err.Error())
+		return 1
+	}
+	if grant {
+		fmt.Printf("User %d is now an administrator.\n", userID)
+	} else {
+		fmt.Printf("User %d is no longer an administrator.\n", userID)
+	}
+	return 0
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	. "github.com/opus-ua/beacon-db"
+	"io"
+	"os"
+)
+
+func printBackupStats(verb string, stats BackupStats) {
+	fmt.Printf("%s %d users, %d zones, %d posts, %d images, %d geo entries\n",
+		verb, stats.Users, stats.Zones, stats.Posts, stats.Images, stats.Geo)
+}
+
+// Writes a backup of the database to the file named by the first
+// argument. The backup is written next to it first and only moved in
+// place once complete. Returns the exit status.
+func RunBackup(config Config, args []string) int {
+	backupFlags := flag.NewFlagSet("backup", flag.ExitOnError)
+	backupFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: beacon backup FILE\n")
+	}
+	backupFlags.Parse(args)
+	if backupFlags.NArg() != 1 {
+		backupFlags.Usage()
+		return 2
+	}
+	db, err := OpenDB(config)
+	if err != nil {
+		fmt.Printf("Could not open the database. %s\n", err.Error())
+		return 1
+	}
+	path := backupFlags.Arg(0)
+	tmpPath := path + ".partial"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		fmt.Printf("Could not create backup. %s\n", err.Error())
+		return 1
+	}
+	stats, err := db.Backup(f, func(stats BackupStats) {
+		printBackupStats("Backed up", stats)
+	})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		fmt.Printf("Could not back up database. %s\n", err.Error())
+		return 1
+	}
+	printBackupStats(fmt.Sprintf("Wrote %s with", path), stats)
+	return 0
+}
+
+// Restores a backup from the file named by the first argument, or
+// from stdin if it is "-". Returns the exit status.
+func RunRestore(config Config, args []string) int {
+	restoreFlags := flag.NewFlagSet("restore", flag.ExitOnError)
+	merge := restoreFlags.Bool("merge", false, "add to a database that is not empty, giving records new IDs")
+	restoreFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: beacon restore [--merge] FILE\n")
+		restoreFlags.PrintDefaults()
+	}
+	restoreFlags.Parse(args)
+	if restoreFlags.NArg() != 1 {
+		restoreFlags.Usage()
+		return 2
+	}
+	db, err := OpenDB(config)
+	if err != nil {
+		fmt.Printf("Could not open the database. %s\n", err.Error())
+		return 1
+	}
+	var r io.Reader = os.Stdin
+	if path := restoreFlags.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Printf("Could not open backup. %s\n", err.Error())
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	stats, err := db.Restore(r, *merge, func(stats BackupStats) {
+		printBackupStats("Restored", stats)
+	})
+	if err != nil {
+		fmt.Printf("Could not restore database. %s\n", err.Error())
+		printBackupStats("Restored", stats)
+		return 1
+	}
+	if *merge {
+		fmt.Printf("Merged %d users into existing accounts, renamed %d, skipped %d records.\n",
+			stats.Merged, stats.Renamed, stats.Skipped)
+	}
+	return 0
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	. "github.com/opus-ua/beacon-db"
+	. "github.com/opus-ua/beacon-post"
+	. "github.com/opus-ua/beacon-rest"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Read when neither --config nor $BEACON_CONFIG names a file, but only
+// if it exists.
+const DEFAULT_CONFIG_PATH = "/etc/beacon/beacon.toml"
+
+// Metrics are only served to the local host unless configured
+// otherwise.
+const DEFAULT_METRICS_ADDR = "localhost:8766"
+
+// Every flag but the single letter ones can also be set through the
+// environment variable named by this prefix and the flag in upper
+// case, so --redis-addr is $BEACON_REDIS_ADDR.
+const ENV_PREFIX = "BEACON_"
+
+// Everything the server is configured with. Each setting comes from,
+// in increasing priority, its default, the config file, the
+// environment and the command line.
+type Config struct {
+	Port uint   `toml:"port"`
+	Bind string `toml:"bind"`
+	Dev  bool   `toml:"dev"`
+	// /metrics is served on this host:port, apart from the API. Empty
+	// serves no metrics.
+	MetricsAddr string `toml:"metrics_addr"`
+	// The log is appended to this file as well as written to stdout.
+	// Empty means stdout only.
+	Log string `toml:"log"`
+	// "logfmt" or "json".
+	LogFormat            string                    `toml:"log_format"`
+	LogLevel             slog.Level                `toml:"log_level"`
+	ReleaseGoogleID      string                    `toml:"release_google_id"`
+	DebugGoogleID        string                    `toml:"debug_google_id"`
+	FilterRules          string                    `toml:"filter_rules"`
+	FilterReloadInterval time.Duration             `toml:"filter_reload_interval"`
+	Postgres             string                    `toml:"postgres"`
+	RedisCache           bool                      `toml:"redis_cache"`
+	UsernameCooldown     time.Duration             `toml:"username_cooldown"`
+	DeletePosts          string                    `toml:"delete_posts"`
+	Server               ServerLimits              `toml:"server"`
+	TLS                  TLSConfig                 `toml:"tls"`
+	Tracing              TracingConfig             `toml:"tracing"`
+	Redis                RedisConfig               `toml:"redis"`
+	Proximity            ProximityPolicy           `toml:"proximity"`
+	RateLimits           map[string]EndpointLimits `toml:"rate_limits"`
+
+	// The file the config was read from, if any.
+	source string
+}
+
+// The Google IDs default to those built in by the Makefile.
+func DefaultConfig() Config {
+	rateLimits := map[string]EndpointLimits{}
+	for uri, limits := range DefaultRateLimits {
+		rateLimits[uri] = limits
+	}
+	return Config{
+		Port:                 DEFAULT_PORT,
+		MetricsAddr:          DEFAULT_METRICS_ADDR,
+		Log:                  "/var/log/beacon",
+		LogFormat:            "logfmt",
+		LogLevel:             slog.LevelInfo,
+		ReleaseGoogleID:      releaseGoogleID,
+		DebugGoogleID:        debugGoogleID,
+		FilterReloadInterval: FILTER_RELOAD_INTERVAL,
+		UsernameCooldown:     DefaultAccountPolicy.UsernameCooldown,
+		DeletePosts:          DefaultAccountPolicy.DeletePosts.String(),
+		Server:               DefaultServerLimits,
+		TLS:                  DefaultTLSConfig,
+		Tracing:              DefaultTracingConfig,
+		Redis:                DefaultRedisConfig,
+		Proximity:            DefaultProximityPolicy,
+		RateLimits:           rateLimits,
+	}
+}
+
+// A comma separated list of host:port addresses.
+type addrList []string
+
+func (addrs *addrList) String() string {
+	return strings.Join(*addrs, ",")
+}
+
+func (addrs *addrList) Set(value string) error {
+	*addrs = strings.Split(value, ",")
+	return nil
+}
+
+// Rate limits are only read from the config file.
+func (config *Config) flagSet(configPath *string, showVersion *bool) *flag.FlagSet {
+	flags := flag.NewFlagSet("beacon", flag.ContinueOnError)
+	flags.StringVar(configPath, "config", *configPath, "read settings from this TOML file")
+	flags.BoolVar(showVersion, "version", false, "show version information")
+	flags.UintVar(&config.Port, "port", config.Port, "the app will listen on this port")
+	flags.UintVar(&config.Port, "p", config.Port, "the app will listen on this port")
+	flags.StringVar(&config.Bind, "bind", config.Bind, "listen on this address only rather than on every interface")
+	flags.BoolVar(&config.Dev, "dev", config.Dev, "start in dev mode")
+	flags.StringVar(&config.MetricsAddr, "metrics-addr", config.MetricsAddr, "serve /metrics on this host:port, or nowhere if empty")
+	flags.StringVar(&config.Log, "log", config.Log, "also append the log to this file, or only write it to stdout if empty")
+	flags.StringVar(&config.LogFormat, "log-format", config.LogFormat, "write log lines as 'logfmt' or 'json'")
+	flags.TextVar(&config.LogLevel, "log-level", config.LogLevel, "least severe log lines written, 'debug', 'info', 'warn' or 'error'")
+	flags.StringVar(&config.ReleaseGoogleID, "release-google-id", config.ReleaseGoogleID, "Google client ID of the release app")
+	flags.StringVar(&config.DebugGoogleID, "debug-google-id", config.DebugGoogleID, "Google client ID of the debug app")
+	flags.StringVar(&config.FilterRules, "filter-rules", config.FilterRules, "load content filter rules from this file")
+	flags.DurationVar(&config.FilterReloadInterval, "filter-reload-interval", config.FilterReloadInterval, "how often --filter-rules is checked for changes")
+	flags.StringVar(&config.Postgres, "postgres", config.Postgres, "keep users and posts in the Postgres database at this connection string")
+	flags.BoolVar(&config.RedisCache, "redis-cache", config.RedisCache, "with --postgres, cache threads and users in Redis")
+	flags.DurationVar(&config.UsernameCooldown, "username-cooldown", config.UsernameCooldown, "time users must wait between username changes")
+	flags.StringVar(&config.DeletePosts, "delete-posts", config.DeletePosts, "what happens to posts of deleted accounts, 'anonymize' or 'delete'")
+	flags.DurationVar(&config.Server.ReadTimeout, "read-timeout", config.Server.ReadTimeout, "time allowed to read a request, 0 for no limit")
+	flags.DurationVar(&config.Server.WriteTimeout, "write-timeout", config.Server.WriteTimeout, "time allowed to write a response, 0 for no limit")
+	flags.DurationVar(&config.Server.IdleTimeout, "idle-timeout", config.Server.IdleTimeout, "close keep-alive connections idle this long, 0 for no limit")
+	flags.IntVar(&config.Server.MaxHeaderBytes, "max-header-bytes", config.Server.MaxHeaderBytes, "largest request header accepted")
+	flags.Int64Var(&config.Server.MaxBodyBytes, "max-body-bytes", config.Server.MaxBodyBytes, "largest request body accepted, 0 for no limit")
+	flags.DurationVar(&config.Server.ShutdownTimeout, "shutdown-timeout", config.Server.ShutdownTimeout, "time given to requests in flight to finish after SIGINT or SIGTERM")
+	flags.StringVar(&config.TLS.CertFile, "tls-cert", config.TLS.CertFile, "serve HTTPS with the certificate chain in this PEM file")
+	flags.StringVar(&config.TLS.KeyFile, "tls-key", config.TLS.KeyFile, "private key of --tls-cert")
+	flags.DurationVar(&config.TLS.HSTSMaxAge, "hsts-max-age", config.TLS.HSTSMaxAge, "with TLS, tell browsers to only use HTTPS for this long, 0 to not")
+	flags.BoolVar(&config.TLS.HSTSIncludeSubdomains, "hsts-include-subdomains", config.TLS.HSTSIncludeSubdomains, "extend --hsts-max-age to subdomains")
+	flags.StringVar(&config.TLS.RedirectAddr, "https-redirect", config.TLS.RedirectAddr, "with TLS, redirect plain HTTP on this host:port to HTTPS")
+	flags.DurationVar(&config.TLS.ReloadInterval, "tls-reload-interval", config.TLS.ReloadInterval, "how often --tls-cert and --tls-key are checked for changes")
+	flags.StringVar(&config.Tracing.Endpoint, "otlp-endpoint", config.Tracing.Endpoint, "send traces as OTLP/HTTP to the collector at this URL, such as http://localhost:4318")
+	flags.Float64Var(&config.Tracing.SampleRatio, "trace-sample-ratio", config.Tracing.SampleRatio, "share of new traces recorded, from 0 to 1")
+	flags.StringVar(&config.Tracing.ServiceName, "trace-service-name", config.Tracing.ServiceName, "service name traces are reported under")
+	flags.StringVar(&config.Redis.Addr, "redis-addr", config.Redis.Addr, "host:port of the Redis server")
+	flags.StringVar(&config.Redis.Password, "redis-password", config.Redis.Password, "Redis password")
+	flags.Int64Var(&config.Redis.DB, "redis-db", config.Redis.DB, "Redis database index")
+	flags.BoolVar(&config.Redis.TLS, "redis-tls", config.Redis.TLS, "connect to Redis over TLS")
+	flags.StringVar(&config.Redis.TLSCAFile, "redis-tls-ca", config.Redis.TLSCAFile, "verify the Redis server against the CA certificates in this PEM file")
+	flags.IntVar(&config.Redis.PoolSize, "redis-pool-size", config.Redis.PoolSize, "maximum number of Redis connections")
+	flags.DurationVar(&config.Redis.DialTimeout, "redis-dial-timeout", config.Redis.DialTimeout, "time allowed to connect to Redis")
+	flags.DurationVar(&config.Redis.ReadTimeout, "redis-read-timeout", config.Redis.ReadTimeout, "time allowed for each Redis read")
+	flags.DurationVar(&config.Redis.WriteTimeout, "redis-write-timeout", config.Redis.WriteTimeout, "time allowed for each Redis write")
+	flags.DurationVar(&config.Redis.PoolTimeout, "redis-pool-timeout", config.Redis.PoolTimeout, "time to wait for a free Redis connection")
+	flags.DurationVar(&config.Redis.IdleTimeout, "redis-idle-timeout", config.Redis.IdleTimeout, "close Redis connections idle this long")
+	flags.StringVar(&config.Redis.SentinelMaster, "redis-sentinel-master", config.Redis.SentinelMaster, "name of the master monitored by --redis-sentinels")
+	flags.Var((*addrList)(&config.Redis.SentinelAddrs), "redis-sentinels", "comma separated sentinel addresses, used instead of --redis-addr")
+	flags.Var((*addrList)(&config.Redis.ClusterAddrs), "redis-cluster", "comma separated cluster node addresses, used instead of --redis-addr")
+	flags.DurationVar(&config.Redis.ThreadCacheTTL, "redis-thread-cache-ttl", config.Redis.ThreadCacheTTL, "time threads stay cached in Redis")
+	flags.DurationVar(&config.Redis.ExportExpiry, "redis-export-expiry", config.Redis.ExportExpiry, "time account exports are kept for download")
+	flags.DurationVar(&config.Redis.LastFixExpiry, "redis-last-fix-expiry", config.Redis.LastFixExpiry, "time the last device fix of a user is kept for the proximity checks")
+	flags.BoolVar(&config.Proximity.RequireFix, "proximity-require-fix", config.Proximity.RequireFix, "refuse beacons posted without a device fix (turn off only for clients too old to send one)")
+	flags.Float64Var(&config.Proximity.MaxDistance, "proximity-max-distance", config.Proximity.MaxDistance, "kilometers a beacon may be from the device, 0 for any")
+	flags.Float64Var(&config.Proximity.MaxAccuracy, "proximity-max-accuracy", config.Proximity.MaxAccuracy, "coarsest device fix accepted in meters, 0 for any")
+	flags.Float64Var(&config.Proximity.MaxSpeed, "proximity-max-speed", config.Proximity.MaxSpeed, "fastest km/h a device may move between posts, 0 for any")
+	flags.TextVar(&config.Proximity.Action, "proximity-action", config.Proximity.Action, "what happens to beacons that are too far, 'reject' or 'review'")
+	return flags
+}
+
+func envName(flagName string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// An endpoint given in the file replaces all of its default limits.
+func (config *Config) loadFile(path string) error {
+	rateLimits := config.RateLimits
+	config.RateLimits = nil
+	meta, err := toml.DecodeFile(path, config)
+	if err != nil {
+		return err
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("Unknown setting '%s'.", undecoded[0].String())
+	}
+	for uri, limits := range config.RateLimits {
+		rateLimits[uri] = limits
+	}
+	config.RateLimits = rateLimits
+	config.source = path
+	return nil
+}
+
+// Returned once the flag set has explained what was wrong.
+var ErrUsage = errors.New("Invalid command line.")
+
+// Builds the config from args and the environment as given by
+// lookupEnv. Returns the arguments left after the flags, which name
+// the subcommand if there is one. showVersion is set by --version.
+func LoadConfig(args []string, lookupEnv func(string) (string, bool), showVersion *bool) (Config, []string, error) {
+	// The flags are only parsed in full once the file has been read,
+	// but the file to read may itself be given by a flag.
+	configPath, explicit := lookupEnv("BEACON_CONFIG")
+	scratch := DefaultConfig()
+	flags := scratch.flagSet(&configPath, new(bool))
+	flags.SetOutput(ioutil.Discard)
+	flags.Parse(args)
+	if configPath != "" {
+		explicit = true
+	} else {
+		configPath = DEFAULT_CONFIG_PATH
+	}
+	defaultPath := configPath
+	config := DefaultConfig()
+	if _, err := os.Stat(configPath); explicit || err == nil {
+		if err = config.loadFile(configPath); err != nil {
+			return config, nil, fmt.Errorf("Could not read config file '%s'. %s", configPath, err.Error())
+		}
+	}
+	flags = config.flagSet(&defaultPath, showVersion)
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if len(f.Name) == 1 || f.Name == "config" || f.Name == "version" || err != nil {
+			return
+		}
+		name := envName(f.Name)
+		if value, ok := lookupEnv(name); ok {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("Invalid $%s. %s", name, setErr.Error())
+			}
+		}
+	})
+	if err != nil {
+		return config, nil, err
+	}
+	if err = flags.Parse(args); err == flag.ErrHelp {
+		return config, nil, err
+	} else if err != nil {
+		return config, nil, ErrUsage
+	}
+	return config, flags.Args(), nil
+}
+
+func validRateLimit(limit RateLimit) bool {
+	return limit.Burst >= 0 && limit.Per >= 0
+}
+
+// Checks everything that can be checked without connecting anywhere.
+func (config Config) Validate() error {
+	if config.Port == 0 || config.Port > 65535 {
+		return fmt.Errorf("Port %d is out of range.", config.Port)
+	}
+	if config.LogFormat != "logfmt" && config.LogFormat != "json" {
+		return fmt.Errorf("Unknown log_format '%s'.", config.LogFormat)
+	}
+	if _, err := ParseDeletePolicy(config.DeletePosts); err != nil {
+		return fmt.Errorf("Invalid delete_posts '%s'. %s", config.DeletePosts, err.Error())
+	}
+	if config.UsernameCooldown < 0 {
+		return errors.New("username_cooldown is negative.")
+	}
+	if config.FilterReloadInterval <= 0 {
+		return errors.New("filter_reload_interval must be positive.")
+	}
+	if config.RedisCache && config.Postgres == "" {
+		return errors.New("redis_cache needs postgres to be set.")
+	}
+	server := config.Server
+	if server.ReadTimeout < 0 || server.WriteTimeout < 0 || server.IdleTimeout < 0 || server.ShutdownTimeout < 0 {
+		return errors.New("Server timeouts may not be negative.")
+	}
+	if server.MaxHeaderBytes < 0 || server.MaxBodyBytes < 0 {
+		return errors.New("Server size limits may not be negative.")
+	}
+	if err := config.TLS.Validate(); err != nil {
+		return err
+	}
+	if err := config.Tracing.Validate(); err != nil {
+		return err
+	}
+	if err := config.Redis.Validate(); err != nil {
+		return err
+	}
+	proximity := config.Proximity
+	if proximity.MaxDistance < 0 || proximity.MaxAccuracy < 0 || proximity.MaxSpeed < 0 {
+		return errors.New("Proximity limits may not be negative.")
+	}
+	for uri, limits := range config.RateLimits {
+		if !strings.HasPrefix(uri, "/") {
+			return fmt.Errorf("Rate limited endpoint '%s' does not start with '/'.", uri)
+		}
+		if !validRateLimit(limits.User) || !validRateLimit(limits.IP) || !validRateLimit(limits.Endpoint) {
+			return fmt.Errorf("Rate limits of '%s' may not be negative.", uri)
+		}
+	}
+	if config.FilterRules != "" {
+		filter, err := NewContentFilter(DefaultFilterConfig)
+		if err == nil {
+			err = filter.LoadFile(config.FilterRules)
+		}
+		if err != nil {
+			return fmt.Errorf("Could not load filter rules from '%s'. %s", config.FilterRules, err.Error())
+		}
+	}
+	return nil
+}
+
+const REDACTED = "********"
+
+// Returns a copy that is safe to print.
+func (config Config) Redacted() Config {
+	if config.Redis.Password != "" {
+		config.Redis.Password = REDACTED
+	}
+	config.Postgres = redactDSN(config.Postgres)
+	return config
+}
+
+// A password in a key=value connection string, either bare or single
+// quoted with backslash escapes.
+var dsnPassword = regexp.MustCompile(`(?i)(^|\s)(password\s*=\s*)('(?:[^'\\]|\\.)*'?|\S*)`)
+
+// Hides the password of a Postgres connection string given either as
+// a URL or as key=value pairs.
+func redactDSN(dsn string) string {
+	if !strings.Contains(dsn, "://") {
+		return dsnPassword.ReplaceAllString(dsn, "${1}${2}"+REDACTED)
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return REDACTED
+	}
+	query := u.Query()
+	if query.Get("password") != "" {
+		query.Set("password", REDACTED)
+		u.RawQuery = query.Encode()
+	}
+	return u.Redacted()
+}
+
+// Validates the config and prints it as TOML with secrets hidden.
+// Returns the exit status.
+func RunConfig(config Config, args []string) int {
+	if len(args) != 1 || args[0] != "check" {
+		fmt.Fprintf(os.Stderr, "Usage: beacon config check\n")
+		return 2
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Printf("Invalid config. %s\n", err.Error())
+		return 1
+	}
+	if config.source != "" {
+		fmt.Printf("# Read from %s\n", config.source)
+	} else {
+		fmt.Printf("# No config file was read.\n")
+	}
+	if config.ReleaseGoogleID == "" && config.DebugGoogleID == "" {
+		fmt.Printf("# Warning: no Google client IDs are set, so no accounts can be created.\n")
+	}
+	if err := toml.NewEncoder(os.Stdout).Encode(config.Redacted()); err != nil {
+		fmt.Printf("Could not print config. %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	. "github.com/opus-ua/beacon-db"
+)
+
+// Checks the database for inconsistencies and, with --repair, fixes
+// them. Returns the exit status: 0 if the database is consistent or
+// was fully repaired, 1 otherwise.
+func RunFsck(config Config, args []string) int {
+	fsckFlags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fsckFlags.Bool("repair", false, "fix the inconsistencies found")
+	fsckFlags.Parse(args)
+	db, err := OpenDB(config)
+	if err != nil {
+		fmt.Printf("Could not open the database. %s\n", err.Error())
+		return 1
+	}
+	res, err := db.Fsck(*repair, func(issue FsckIssue) {
+		status := "found"
+		if issue.Repaired {
+			status = "repaired"
+		}
+		fmt.Printf("%-8s %-16s %s: %s\n", status, issue.Kind, issue.Key, issue.Detail)
+	})
+	if err != nil {
+		fmt.Printf("Could not check database. %s\n", err.Error())
+		return 1
+	}
+	if res.Total() == 0 {
+		fmt.Printf("No inconsistencies found.\n")
+		return 0
+	}
+	unrepaired := 0
+	for _, kind := range res.Kinds() {
+		fmt.Printf("%s: %d found, %d repaired\n", kind, res.Found[kind], res.Repaired[kind])
+		unrepaired += res.Found[kind] - res.Repaired[kind]
+	}
+	if unrepaired > 0 {
+		return 1
+	}
+	return 0
+}
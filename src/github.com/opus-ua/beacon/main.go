@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	. "github.com/opus-ua/beacon-db"
+	. "github.com/opus-ua/beacon-post"
 	. "github.com/opus-ua/beacon-rest"
+	"go.opentelemetry.io/otel"
 	"io"
 	"log"
+	"log/slog"
+	"net"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 var version string = "0.0.0"
@@ -16,55 +26,192 @@ var debugGoogleID string = ""
 var DEFAULT_PORT uint = 8765
 
 var (
-	port        uint
 	gitHash     string
 	showVersion bool
-	devMode     bool
 )
 
-func init() {
-	flag.UintVar(&port, "port", DEFAULT_PORT, "the app will listen on this port")
-	flag.UintVar(&port, "p", DEFAULT_PORT, "the app will listen on this port")
-	flag.BoolVar(&showVersion, "version", false, "show version information")
-	flag.BoolVar(&devMode, "dev", false, "start in dev mode")
-	flag.Parse()
-}
-
-func StartServer(dev bool, testing bool) {
-	log.Printf("Listening on port %d.\n", port)
+func StartServer(config Config, testing bool) {
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid config. %s", err.Error())
+	}
+	if config.TLS.Enabled() {
+		log.Printf("Listening for HTTPS on port %d.\n", config.Port)
+	} else {
+		log.Printf("Listening on port %d.\n", config.Port)
+	}
 	cores := runtime.NumCPU()
 	log.Printf("Core Count: %d", cores)
 	versionInfo := VersionInfo{
 		Number:  version,
 		Hash:    gitHash,
-		DevMode: devMode,
+		DevMode: config.Dev,
 	}
-	server := NewBeaconServer(dev, testing, versionInfo, []string{releaseGoogleID, debugGoogleID})
-	err := server.Start(port)
+	server, err := NewBeaconServer(config.Dev, testing, config.Redis, versionInfo,
+		[]string{config.ReleaseGoogleID, config.DebugGoogleID})
 	if err != nil {
-		if port == DEFAULT_PORT {
-			log.Printf("Is an instance of Beacon already running?\n")
+		log.Fatalf("Could not configure Redis. %s", err.Error())
+	}
+	deletePolicy, _ := ParseDeletePolicy(config.DeletePosts)
+	server.SetAccountPolicy(AccountPolicy{
+		UsernameCooldown: config.UsernameCooldown,
+		DeletePosts:      deletePolicy,
+	})
+	server.SetServerLimits(config.Server)
+	server.SetMetricsAddr(config.MetricsAddr)
+	server.SetProximityPolicy(config.Proximity)
+	server.SetRateLimits(config.RateLimits)
+	if config.Postgres != "" {
+		if err := server.UsePostgres(config.Postgres, config.RedisCache); err != nil {
+			log.Fatalf("Could not connect to Postgres. %s", err.Error())
+		}
+		log.Printf("Storing users and posts in Postgres.")
+	}
+	if err := server.CheckSchema(); err != nil {
+		log.Fatalf("Refusing to start on this database. %s", err.Error())
+	}
+	if err := server.SetTLS(config.TLS); err != nil {
+		log.Fatalf("Could not set up TLS. %s", err.Error())
+	}
+	if config.FilterRules != "" {
+		if err := server.LoadFilterRules(config.FilterRules, config.FilterReloadInterval); err != nil {
+			log.Fatalf("Could not load filter rules from '%s'. %s", config.FilterRules, err.Error())
+		}
+	}
+	if config.Tracing.Endpoint != "" {
+		provider, err := config.Tracing.NewTracerProvider()
+		if err != nil {
+			log.Fatalf("Could not set up tracing. %s", err.Error())
+		}
+		otel.SetTracerProvider(provider)
+		log.Printf("Sending traces to '%s'.", config.Tracing.Endpoint)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.Start(net.JoinHostPort(config.Bind, strconv.FormatUint(uint64(config.Port), 10)))
+	}()
+	for {
+		select {
+		case err = <-stopped:
+			if config.Port == DEFAULT_PORT {
+				log.Printf("Is an instance of Beacon already running?\n")
+			}
+			log.Fatal(err.Error())
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if err := server.ReloadCertificate(); err != nil {
+					log.Printf("Could not reload TLS certificate. %s", err.Error())
+				} else if config.TLS.Enabled() {
+					log.Printf("Reloaded TLS certificate from '%s'.", config.TLS.CertFile)
+				}
+				continue
+			}
+			log.Printf("Received %s. Draining requests for up to %s.", sig, config.Server.ShutdownTimeout)
+			StopServer(server, config.Server.ShutdownTimeout)
+			return
 		}
-		log.Fatal(err.Error())
 	}
 }
 
+// Shuts the server down, abandoning whatever is left after timeout.
+// A second signal kills the process at once.
+func StopServer(server *BeaconServer, timeout time.Duration) {
+	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+	ctx := context.Background()
+	cancel := context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	err := server.Shutdown(ctx)
+	// Spans of the requests just drained are still to be sent.
+	if traceErr := shutdownTracing(ctx); traceErr != nil {
+		log.Printf("Could not send the last traces. %s", traceErr.Error())
+	}
+	if err != nil {
+		log.Printf("Shutdown was not clean. %s", err.Error())
+		return
+	}
+	log.Printf("Shut down.")
+}
+
+// Connects to Redis, and to Postgres if it is configured, for the
+// subcommands, which run against the configured database just as the
+// server does.
+func OpenDB(config Config) (*DBClient, error) {
+	db, err := NewDB(config.Redis, false, false)
+	if err != nil || config.Postgres == "" {
+		return db, err
+	}
+	if err = db.UsePostgres(config.Postgres, config.RedisCache); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Could not connect to Postgres. %s", err.Error())
+	}
+	return db, nil
+}
+
+// Sends the log to stdout and, unless path is empty, to the end of
+// the file at path, as lines of logfmt or json. Lines from the log
+// package are logged at the info level.
+func OpenLog(path string, format string, level slog.Level) error {
+	var out io.Writer = os.Stdout
+	if path != "" {
+		logFile, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		out = io.MultiWriter(logFile, os.Stdout)
+	}
+	options := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(out, options)))
+	} else {
+		slog.SetDefault(slog.New(slog.NewTextHandler(out, options)))
+	}
+	return nil
+}
+
 func PrintVersion() {
 	fmt.Printf("Version: %s\n", version)
 	fmt.Printf("Git Hash: %s\n", gitHash)
 }
 
 func main() {
-	logFile, err := os.OpenFile("/var/log/beacon", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	config, args, err := LoadConfig(os.Args[1:], os.LookupEnv, &showVersion)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err == ErrUsage {
+		os.Exit(2)
+	}
 	if err != nil {
-		fmt.Printf("Could not open log file '/var/log/beacon'. %s", err.Error())
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(2)
+	}
+	if len(args) > 0 {
+		switch args[0] {
+		case "config":
+			os.Exit(RunConfig(config, args[1:]))
+		case "fsck":
+			os.Exit(RunFsck(config, args[1:]))
+		case "migrate":
+			os.Exit(RunMigrate(config, args[1:]))
+		case "backup":
+			os.Exit(RunBackup(config, args[1:]))
+		case "restore":
+			os.Exit(RunRestore(config, args[1:]))
+		case "admin":
+			os.Exit(RunAdmin(config, args[1:]))
+		}
+	}
+	if err = OpenLog(config.Log, config.LogFormat, config.LogLevel); err != nil {
+		fmt.Printf("Could not open log file '%s'. %s", config.Log, err.Error())
 		os.Exit(1)
 	}
-	logWriter := io.MultiWriter(logFile, os.Stdout)
-	log.SetOutput(logWriter)
 	if showVersion {
 		PrintVersion()
 	} else {
-		StartServer(devMode, false)
+		StartServer(config, false)
 	}
 }
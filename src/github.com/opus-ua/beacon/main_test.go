@@ -1,21 +1,39 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	. "github.com/opus-ua/beacon-rest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
 	"io"
 	"io/ioutil"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"net/textproto"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestMain(m *testing.M) {
-	go StartServer(true, true)
+	config := DefaultConfig()
+	config.Dev = true
+	// Most tests post the way clients too old to send a device fix do.
+	config.Proximity.RequireFix = false
+	go StartServer(config, true)
 	time.Sleep(50 * time.Millisecond)
 	res := m.Run()
 	os.Exit(res)
@@ -68,7 +86,7 @@ var jsonData = `
     }
 `
 
-func TestPostBeacon(t *testing.T) {
+func PostBeacon(jsonData string, t *testing.T) *http.Response {
 	imgData = strings.Replace(imgData, "\n", "", -1)
 	imgBytes, err := hex.DecodeString(imgData)
 	if err != nil {
@@ -91,8 +109,13 @@ func TestPostBeacon(t *testing.T) {
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		t.Error(err.Error())
+		t.Fatalf(err.Error())
 	}
+	return resp
+}
+
+func TestPostBeacon(t *testing.T) {
+	resp := PostBeacon(jsonData, t)
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		t.Error(err.Error())
@@ -102,6 +125,37 @@ func TestPostBeacon(t *testing.T) {
 	}
 }
 
+func TestPostBeaconAsOtherUser(t *testing.T) {
+	resp := PostBeacon(strings.Replace(jsonData, `"userid": 1`, `"userid": 2`, 1), t)
+	var posted struct {
+		ID uint64 `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&posted); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Could not post beacon, status %d.", resp.StatusCode)
+	}
+	resp, err := http.Get("http://localhost:8765/beacon/" + strconv.FormatUint(posted.ID, 10))
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Could not get beacon, status %d.", resp.StatusCode)
+	}
+	jsonPart, err := multipart.NewReader(resp.Body, params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatalf("Beacon response had no json part.")
+	}
+	var beacon struct {
+		Poster uint64 `json:"userid"`
+	}
+	if err = json.NewDecoder(jsonPart).Decode(&beacon); err != nil {
+		t.Fatalf("Could not parse beacon.")
+	}
+	if beacon.Poster != 1 {
+		t.Fatalf("Beacon posted by user 1 naming user 2 was attributed to %d.", beacon.Poster)
+	}
+}
+
 func TestGetBeacon(t *testing.T) {
 	resp, err := http.Get("http://localhost:8765/beacon/1")
 	if err != nil {
@@ -114,13 +168,44 @@ func TestGetBeacon(t *testing.T) {
 
 func TestHeartPost(t *testing.T) {
 	client := &http.Client{}
-	req, _ := http.NewRequest("POST", "http://localhost:8765/heart/1", &bytes.Buffer{})
-	req.Header.Add("Content-Type", "application/json")
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "http://localhost:8765/heart/1", &bytes.Buffer{})
+		req.Header.Add("Content-Type", "application/json")
+		req.SetBasicAuth("1", "0")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Could not connect to beacon backend.")
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("Response status code was %d.", resp.StatusCode)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Could not parse response body.")
+		}
+		if !strings.Contains(string(body), `"hearts":1,"hearted":true`) {
+			t.Fatalf("Response did not contain correct content: \n%s", string(body))
+		}
+	}
+}
+
+func TestHeartComment(t *testing.T) {
+	client := &http.Client{}
+	req, _ := http.NewRequest("POST", "http://localhost:8765/comment/1/heart", &bytes.Buffer{})
 	req.SetBasicAuth("1", "0")
 	resp, err := client.Do(req)
 	if err != nil {
 		t.Fatalf("Could not connect to beacon backend.")
 	}
+	if resp.StatusCode != 404 {
+		t.Fatalf("Hearting a beacon as a comment gave status %d, not 404.", resp.StatusCode)
+	}
+	req, _ = http.NewRequest("POST", "http://localhost:8765/comment/2/heart", &bytes.Buffer{})
+	req.SetBasicAuth("1", "0")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
 	if resp.StatusCode != 200 {
 		t.Fatalf("Response status code was %d.", resp.StatusCode)
 	}
@@ -139,3 +224,619 @@ func TestFlagPost(t *testing.T) {
 		t.Fatalf("Response status code was %d.", resp.StatusCode)
 	}
 }
+
+func TestBodyTooLarge(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), int(DefaultConfig().Server.MaxBodyBytes)+1)
+	req, _ := http.NewRequest("POST", "http://localhost:8765/comment", bytes.NewReader(body))
+	req.SetBasicAuth("1", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	if resp.StatusCode != 413 {
+		t.Fatalf("Oversized body gave status %d, not 413.", resp.StatusCode)
+	}
+}
+
+func TestRouting(t *testing.T) {
+	resp, err := http.Get("http://localhost:8765/heart/1")
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 405 || resp.Header.Get("Allow") != "OPTIONS, POST" {
+		t.Fatalf("GET of a POST route gave status %d and Allow '%s'.", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+	if !strings.Contains(string(body), `"code":45`) {
+		t.Fatalf("405 response was not a JSON error: %s", string(body))
+	}
+	for _, path := range []string{"/nothing", "/beacon/one", "/beacon/-1", "/beacon/1/", "/export/"} {
+		resp, err = http.Get("http://localhost:8765" + path)
+		if err != nil {
+			t.Fatalf("Could not connect to beacon backend.")
+		}
+		body, _ = ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != 404 || !strings.Contains(string(body), `"code":44`) {
+			t.Fatalf("%s gave status %d: %s", path, resp.StatusCode, string(body))
+		}
+	}
+	resp, err = http.Get("http://localhost:8765/beacon/1?comments=true")
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Query string broke routing, status %d.", resp.StatusCode)
+	}
+	resp, err = http.Head("http://localhost:8765/version")
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("HEAD of a GET route gave status %d.", resp.StatusCode)
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	for _, c := range []struct {
+		method, path, user string
+		status, code       int
+	}{
+		{"POST", "/heart/1", "", 400, AuthenticationError},
+		{"POST", "/heart/1", "999", 400, AuthenticationError},
+		{"GET", "/beacon/1", "999", 400, AuthenticationError},
+		{"GET", "/zones", "", 400, AuthenticationError},
+		{"GET", "/zones", "2", 403, PermissionDenied},
+	} {
+		req, _ := http.NewRequest(c.method, "http://localhost:8765"+c.path, &bytes.Buffer{})
+		if c.user != "" {
+			req.SetBasicAuth(c.user, "0")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Could not connect to beacon backend.")
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		// A second error written by the handler would follow the first.
+		var msg JSONError
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		if err = decoder.Decode(&msg); err != nil || decoder.More() {
+			t.Fatalf("%s %s as '%s' did not give a single error: %s", c.method, c.path, c.user, string(body))
+		}
+		if resp.StatusCode != c.status || msg.Code != c.code {
+			t.Fatalf("%s %s as '%s' gave status %d and code %d.", c.method, c.path, c.user, resp.StatusCode, msg.Code)
+		}
+	}
+	resp, err := http.Get("http://localhost:8765/beacon/1")
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Anonymous GET of a beacon gave status %d.", resp.StatusCode)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost:8765/beacon/99999", nil)
+	req.Header.Set("X-Request-ID", "client-chosen-id")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	if id := resp.Header.Get("X-Request-ID"); id != "client-chosen-id" {
+		t.Fatalf("Request ID was not propagated, got '%s'.", id)
+	}
+	var errMsg struct {
+		RequestID string `json:"request_id"`
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if err = json.Unmarshal(body, &errMsg); err != nil || errMsg.RequestID != "client-chosen-id" {
+		t.Fatalf("Error body did not carry the request ID: %s", string(body))
+	}
+	req.Header.Set("X-Request-ID", "spaces are not allowed")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	if id := resp.Header.Get("X-Request-ID"); len(id) != 32 {
+		t.Fatalf("Invalid request ID was not replaced, got '%s'.", id)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	TestHeartPost(t)
+	resp, err := http.Get("http://" + DEFAULT_METRICS_ADDR + "/metrics")
+	if err != nil {
+		t.Fatalf("Could not connect to the metrics listener.")
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	for _, line := range []string{
+		`beacon_http_requests_total{method="POST",route="/heart/{id}",status="200"}`,
+		`beacon_heart_actions_total{action="heart"}`,
+		`beacon_db_operation_seconds_bucket{backend="redis",op="HeartPost",le="+Inf"}`,
+		`# TYPE beacon_active_users gauge`,
+		`# TYPE beacon_redis_pool_connections gauge`,
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Fatalf("Metrics did not contain '%s':\n%s", line, string(body))
+		}
+	}
+	resp, err = http.Get("http://localhost:8765/metrics")
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Metrics were served on the public port with status %d.", resp.StatusCode)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var mutex sync.Mutex
+	var exported []*tracepb.Span
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != OTLP_TRACES_PATH || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("Collector got %s with type '%s'.", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var msg collectorpb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &msg); err != nil {
+			t.Errorf("Could not parse exported spans. %s", err.Error())
+		}
+		mutex.Lock()
+		for _, resource := range msg.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				exported = append(exported, scope.Spans...)
+			}
+		}
+		mutex.Unlock()
+	}))
+	defer collector.Close()
+	config := DefaultTracingConfig
+	config.Endpoint = collector.URL
+	// Sampling is left to the caller's traceparent.
+	config.SampleRatio = 0
+	provider, err := config.NewTracerProvider()
+	if err != nil {
+		t.Fatalf("Could not make tracer provider. %s", err.Error())
+	}
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentID := "00f067aa0ba902b7"
+	req, _ := http.NewRequest("POST", "http://localhost:8765/heart/1", &bytes.Buffer{})
+	req.Header.Set("Traceparent", "00-"+traceID+"-"+parentID+"-01")
+	req.SetBasicAuth("1", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err = provider.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Could not flush spans. %s", err.Error())
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	foundServer, foundDB := false, false
+	names := []string{}
+	for _, span := range exported {
+		names = append(names, span.Name)
+		if hex.EncodeToString(span.TraceId) != traceID {
+			t.Fatalf("Span '%s' is not part of the caller's trace.", span.Name)
+		}
+		if span.Name == "POST /heart/{id}" && span.Kind == tracepb.Span_SPAN_KIND_SERVER {
+			foundServer = hex.EncodeToString(span.ParentSpanId) == parentID
+		}
+		if span.Name == "db.HeartPost" && span.Kind == tracepb.Span_SPAN_KIND_CLIENT {
+			foundDB = true
+		}
+	}
+	if !foundServer || !foundDB {
+		t.Fatalf("Missing server or database span: %s", strings.Join(names, ", "))
+	}
+}
+
+func TestReady(t *testing.T) {
+	resp, err := http.Get("http://localhost:8765/healthz")
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Health check gave status %d.", resp.StatusCode)
+	}
+	resp, err = http.Get("http://localhost:8765/readyz")
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	var ready struct {
+		Status string `json:"status"`
+		Checks map[string]struct {
+			Status string `json:"status"`
+		} `json:"checks"`
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if err = json.Unmarshal(body, &ready); err != nil {
+		t.Fatalf("Could not parse readiness: %s", string(body))
+	}
+	if resp.StatusCode != 200 || ready.Checks["redis"].Status == "down" {
+		t.Fatalf("Server with Redis up was not ready: %s", string(body))
+	}
+	if _, ok := ready.Checks["postgres"]; ok {
+		t.Fatalf("Postgres was checked without being used.")
+	}
+}
+
+func TestBlockedZone(t *testing.T) {
+	zoneJson := `{"name": "School", "rule": "deny",
+		"center": {"latitude": 10.0, "longitude": 10.0}, "radius": 1.0}`
+	req, _ := http.NewRequest("POST", "http://localhost:8765/zone", strings.NewReader(zoneJson))
+	req.Header.Add("Content-Type", "application/json")
+	req.SetBasicAuth("1", "0")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Response status code was %d.", resp.StatusCode)
+	}
+	blockedJson := strings.Replace(jsonData, "45.0", "10.0", -1)
+	resp = PostBeacon(blockedJson, t)
+	if resp.StatusCode != 403 {
+		t.Fatalf("Response status code was %d, not 403.", resp.StatusCode)
+	}
+}
+
+func TestPendingBeaconHidden(t *testing.T) {
+	zoneJson := `{"name": "Library", "rule": "review",
+		"center": {"latitude": 20.0, "longitude": 20.0}, "radius": 1.0}`
+	req, _ := http.NewRequest("POST", "http://localhost:8765/zone", strings.NewReader(zoneJson))
+	req.Header.Add("Content-Type", "application/json")
+	req.SetBasicAuth("1", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Response status code was %d.", resp.StatusCode)
+	}
+	resp = PostBeacon(strings.Replace(jsonData, "45.0", "20.0", -1), t)
+	var posted PostID
+	if err = json.NewDecoder(resp.Body).Decode(&posted); err != nil || !posted.Pending {
+		t.Fatalf("Beacon in a review zone was not held.")
+	}
+	req, _ = http.NewRequest("GET", "http://localhost:8765/beacon/"+strconv.FormatUint(posted.ID, 10), nil)
+	req.SetBasicAuth("2", "0")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	var msg JSONError
+	json.NewDecoder(resp.Body).Decode(&msg)
+	if resp.StatusCode != 404 || msg.Code != PostNotFound {
+		t.Fatalf("Pending beacon shown to another user gave status %d and code %d.", resp.StatusCode, msg.Code)
+	}
+	req, _ = http.NewRequest("GET", "http://localhost:8765/beacon/99999", nil)
+	req.SetBasicAuth("2", "0")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	var missing JSONError
+	json.NewDecoder(resp.Body).Decode(&missing)
+	if resp.StatusCode != 404 || missing.Code != PostNotFound || missing.Msg != msg.Msg {
+		t.Fatalf("Missing beacon gave status %d and code %d, unlike a pending one.", resp.StatusCode, missing.Code)
+	}
+	if status, _ := PostComment("2", posted.ID, "Is this here?", t); status != 404 {
+		t.Fatalf("Comment on a pending beacon of another user gave status %d, not 404.", status)
+	}
+	if status, _ := PostComment("2", 99999, "Is this here?", t); status != 404 {
+		t.Fatalf("Comment on a missing beacon gave status %d, not 404.", status)
+	}
+	if status, commented := PostComment("1", posted.ID, "It is.", t); status != 200 || commented.ID == 0 {
+		t.Fatalf("Poster could not comment on their pending beacon, status %d.", status)
+	}
+}
+
+func PostComment(user string, beaconID uint64, text string, t *testing.T) (int, PostID) {
+	commentJson, _ := json.Marshal(PostCommentMsg{BeaconID: beaconID, Text: text})
+	req, _ := http.NewRequest("POST", "http://localhost:8765/comment", bytes.NewReader(commentJson))
+	req.Header.Add("Content-Type", "application/json")
+	req.SetBasicAuth(user, "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	defer resp.Body.Close()
+	var posted PostID
+	if resp.StatusCode == 200 {
+		if err = json.NewDecoder(resp.Body).Decode(&posted); err != nil {
+			t.Fatalf("Comment response was not an id.")
+		}
+	}
+	return resp.StatusCode, posted
+}
+
+func TestPendingComment(t *testing.T) {
+	status, posted := PostComment("1", 1, "More at http://example.com", t)
+	if status != 200 || !posted.Pending {
+		t.Fatalf("Comment with a link was not held, status %d.", status)
+	}
+	req, _ := http.NewRequest("GET", "http://localhost:8765/pending", nil)
+	req.SetBasicAuth("1", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	var pending PendingListMsg
+	if err = json.NewDecoder(resp.Body).Decode(&pending); err != nil {
+		t.Fatalf("Could not parse pending list.")
+	}
+	resp.Body.Close()
+	listed := false
+	for _, id := range pending.Comments {
+		listed = listed || id == posted.ID
+	}
+	for _, id := range pending.Beacons {
+		if id == posted.ID {
+			t.Fatalf("Held comment was listed as a beacon.")
+		}
+	}
+	if !listed {
+		t.Fatalf("Held comment was not listed: %+v", pending)
+	}
+	req, _ = http.NewRequest("POST", "http://localhost:8765/approve/"+strconv.FormatUint(posted.ID, 10), nil)
+	req.SetBasicAuth("1", "0")
+	if resp, err = http.DefaultClient.Do(req); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Could not approve held comment.")
+	}
+}
+
+func TestDeleteMissingZone(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://localhost:8765/deletezone/99999", nil)
+	req.SetBasicAuth("1", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	var msg JSONError
+	json.NewDecoder(resp.Body).Decode(&msg)
+	if resp.StatusCode != 404 || msg.Code != ZoneNotFound {
+		t.Fatalf("Deleting a missing zone gave status %d and code %d.", resp.StatusCode, msg.Code)
+	}
+}
+
+func TestPostFarFromDevice(t *testing.T) {
+	farJson := strings.Replace(jsonData, `"latitude": 45.0`, `"latitude": 45.0,
+        "fix": {"longitude": 46.0, "latitude": 46.0, "accuracy": 20.0}`, 1)
+	resp := PostBeacon(farJson, t)
+	if resp.StatusCode != 403 {
+		t.Fatalf("Response status code was %d, not 403.", resp.StatusCode)
+	}
+}
+
+func TestCommentFilter(t *testing.T) {
+	commentJson := `{"beaconid": 1, "text": "Email me at someone@example.com"}`
+	req, _ := http.NewRequest("POST", "http://localhost:8765/comment", strings.NewReader(commentJson))
+	req.Header.Add("Content-Type", "application/json")
+	req.SetBasicAuth("1", "0")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Response status code was %d.", resp.StatusCode)
+	}
+	resp, err = http.Get("http://localhost:8765/beacon/1")
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not parse response body.")
+	}
+	if strings.Contains(string(body), "someone@example.com") ||
+		!strings.Contains(string(body), "Email me at *") {
+		t.Fatalf("Email address in comment was not masked.")
+	}
+}
+
+func TestGetMe(t *testing.T) {
+	client := &http.Client{}
+	req, _ := http.NewRequest("GET", "http://localhost:8765/me?count=5", nil)
+	req.SetBasicAuth("1", "0")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Response status code was %d.", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not parse response body.")
+	}
+	if !strings.Contains(string(body), `"username":"dev1"`) {
+		t.Fatalf("Response did not contain correct content: \n%s", string(body))
+	}
+}
+
+func TestDeleteMe(t *testing.T) {
+	client := &http.Client{}
+	req, _ := http.NewRequest("PUT", "http://localhost:8765/me/username", strings.NewReader(`{"username": "DEV2"}`))
+	req.SetBasicAuth("3", "0")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	if resp.StatusCode != 400 {
+		t.Fatalf("Response status code was %d, not 400.", resp.StatusCode)
+	}
+	req, _ = http.NewRequest("DELETE", "http://localhost:8765/me", nil)
+	req.SetBasicAuth("3", "0")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Response status code was %d.", resp.StatusCode)
+	}
+	resp, err = http.Get("http://localhost:8765/beacon/1")
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not parse response body.")
+	}
+	if !strings.Contains(string(body), `"username":"[deleted]"`) {
+		t.Fatalf("Deleted user's comment was not anonymized: \n%s", string(body))
+	}
+}
+
+func TestExportMe(t *testing.T) {
+	client := &http.Client{}
+	req, _ := http.NewRequest("POST", "http://localhost:8765/me/export", nil)
+	req.SetBasicAuth("2", "0")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Could not connect to beacon backend.")
+	}
+	if resp.StatusCode != 202 {
+		t.Fatalf("Response status code was %d, not 202.", resp.StatusCode)
+	}
+	var export struct {
+		Token string `json:"token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&export); err != nil {
+		t.Fatalf("Could not parse response body.")
+	}
+	download := func(user string) *http.Response {
+		req, _ := http.NewRequest("GET", "http://localhost:8765/export/"+export.Token, nil)
+		if user != "" {
+			req.SetBasicAuth(user, "0")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Could not connect to beacon backend.")
+		}
+		return resp
+	}
+	if resp = download(""); resp.StatusCode != 400 {
+		t.Fatalf("Export was served without BasicAuth, status %d.", resp.StatusCode)
+	}
+	if resp = download("1"); resp.StatusCode != 404 {
+		t.Fatalf("Export was served to another user, status %d.", resp.StatusCode)
+	}
+	for i := 0; i < 50 && resp.StatusCode != 200; i++ {
+		time.Sleep(10 * time.Millisecond)
+		resp = download("2")
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Response status code was %d.", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not parse response body.")
+	}
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("Export was not a ZIP archive.")
+	}
+	if len(archive.File) == 0 || archive.File[0].Name != "user.json" {
+		t.Fatalf("Export did not contain the user record.")
+	}
+	if resp = download("2"); resp.StatusCode != 404 {
+		t.Fatalf("Export could be downloaded twice.")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "beacon-config")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`port = 9000
+bind = "127.0.0.1"
+username_cooldown = "1h"
+
+[redis]
+addr = "file:6379"
+db = 3
+thread_cache_ttl = "5m"
+
+[rate_limits."/beacon"]
+user = { burst = 1, per = "1m" }
+`)
+	f.Close()
+	env := map[string]string{
+		"BEACON_CONFIG":                 f.Name(),
+		"BEACON_PORT":                   "9001",
+		"BEACON_REDIS_ADDR":             "env:6379",
+		"BEACON_FILTER_RELOAD_INTERVAL": "30s",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	var showVersion bool
+	config, args, err := LoadConfig([]string{"--port", "9002", "fsck", "--repair"}, lookupEnv, &showVersion)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if config.Port != 9002 || config.Redis.Addr != "env:6379" || config.Redis.DB != 3 || config.Bind != "127.0.0.1" {
+		t.Fatalf("Settings were not layered file, env, flags: %+v", config)
+	}
+	if config.UsernameCooldown != time.Hour || config.Redis.ThreadCacheTTL != 5*time.Minute {
+		t.Fatalf("Duration was not read from the file.")
+	}
+	if config.FilterReloadInterval != 30*time.Second || config.Redis.ExportExpiry != DefaultConfig().Redis.ExportExpiry {
+		t.Fatalf("Intervals were not layered file, env, defaults.")
+	}
+	if config.RateLimits["/beacon"].User.Burst != 1 || config.RateLimits["/beacon"].IP.Burst != 0 {
+		t.Fatalf("Rate limits of /beacon were not replaced.")
+	}
+	if config.RateLimits["/comment"].User.Burst == 0 {
+		t.Fatalf("Default rate limits were lost.")
+	}
+	if strings.Join(args, " ") != "fsck --repair" {
+		t.Fatalf("Subcommand arguments were '%v'.", args)
+	}
+	if err = config.Validate(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	env["BEACON_REDIS_DB"] = "three"
+	if _, _, err = LoadConfig([]string{}, lookupEnv, &showVersion); err == nil {
+		t.Fatalf("Invalid environment variable was accepted.")
+	}
+	delete(env, "BEACON_REDIS_DB")
+	ioutil.WriteFile(f.Name(), []byte("prot = 9000\n"), 0600)
+	if _, _, err = LoadConfig([]string{}, lookupEnv, &showVersion); err == nil {
+		t.Fatalf("Unknown setting was accepted.")
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	dsns := map[string]string{
+		"host=db password=secret dbname=beacon":                "host=db password=" + REDACTED + " dbname=beacon",
+		"host=db PASSWORD = 'sec ret\\' x' dbname=beacon":      "host=db PASSWORD = " + REDACTED + " dbname=beacon",
+		"postgres://beacon:secret@db/beacon":                   "postgres://beacon:xxxxx@db/beacon",
+		"postgres://beacon@db/beacon?password=secret&ssl=true": "postgres://beacon@db/beacon?password=" + url.QueryEscape(REDACTED) + "&ssl=true",
+		"host=db dbname=beacon":                                "host=db dbname=beacon",
+	}
+	for dsn, want := range dsns {
+		config := DefaultConfig()
+		config.Postgres = dsn
+		config.Redis.Password = "secret"
+		redacted := config.Redacted()
+		if redacted.Postgres != want {
+			t.Fatalf("'%s' was redacted to '%s', not '%s'.", dsn, redacted.Postgres, want)
+		}
+		if redacted.Redis.Password != REDACTED {
+			t.Fatalf("Redis password was not redacted.")
+		}
+	}
+}
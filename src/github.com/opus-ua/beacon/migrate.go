@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	. "github.com/opus-ua/beacon-db"
+)
+
+// Brings the database schema up to date. Returns the exit status.
+func RunMigrate(config Config, args []string) int {
+	migrateFlags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := migrateFlags.Bool("dry-run", false, "report what would change without changing anything")
+	migrateFlags.Parse(args)
+	db, err := OpenDB(config)
+	if err != nil {
+		fmt.Printf("Could not open the database. %s\n", err.Error())
+		return 1
+	}
+	version, err := db.GetSchemaVersion()
+	if err != nil {
+		fmt.Printf("Could not read schema version. %s\n", err.Error())
+		return 1
+	}
+	if version == LatestSchemaVersion() {
+		fmt.Printf("Schema is up to date at version %d.\n", version)
+		return 0
+	}
+	fmt.Printf("Migrating schema from version %d to %d.\n", version, LatestSchemaVersion())
+	verb := "changed"
+	if *dryRun {
+		verb = "would change"
+	}
+	version, err = db.Migrate(*dryRun, func(progress MigrateProgress) {
+		status := "..."
+		if progress.Done {
+			status = "done"
+		}
+		fmt.Printf("%d %s: %d keys scanned, %d %s %s\n", progress.Migration.Version,
+			progress.Migration.Name, progress.Scanned, progress.Changed, verb, status)
+	})
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		fmt.Printf("Schema left at version %d.\n", version)
+		return 1
+	}
+	if *dryRun {
+		fmt.Printf("Dry run finished. Nothing was changed.\n")
+		return 0
+	}
+	fmt.Printf("Schema is now at version %d.\n", version)
+	return 0
+}
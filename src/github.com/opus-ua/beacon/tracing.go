@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Appended to the endpoint to post spans to.
+const OTLP_TRACES_PATH = "/v1/traces"
+
+// Where and how traces are sent. No traces are sent unless Endpoint
+// is set.
+type TracingConfig struct {
+	// Base URL of an OTLP/HTTP collector, such as
+	// http://localhost:4318. Spans are posted to its /v1/traces.
+	Endpoint    string        `toml:"endpoint"`
+	SampleRatio float64       `toml:"sample_ratio"`
+	ServiceName string        `toml:"service_name"`
+	Interval    time.Duration `toml:"interval"`
+	Timeout     time.Duration `toml:"timeout"`
+}
+
+var DefaultTracingConfig = TracingConfig{
+	SampleRatio: 1,
+	ServiceName: "beacon",
+	Interval:    5 * time.Second,
+	Timeout:     10 * time.Second,
+}
+
+func (config TracingConfig) Validate() error {
+	if config.SampleRatio < 0 || config.SampleRatio > 1 {
+		return fmt.Errorf("Trace sample ratio %g is not between 0 and 1.", config.SampleRatio)
+	}
+	if config.Interval < 0 || config.Timeout < 0 {
+		return errors.New("Tracing intervals may not be negative.")
+	}
+	if config.Endpoint == "" {
+		return nil
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("OTLP endpoint '%s' is not an http or https URL.", config.Endpoint)
+	}
+	return nil
+}
+
+// Returns a provider batching spans to the configured collector, or
+// one that records nothing if there is none. A sampled or unsampled
+// parent decides for its children; traces the server starts are
+// recorded with probability SampleRatio.
+func (config TracingConfig) NewTracerProvider() (*sdktrace.TracerProvider, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Endpoint == "" {
+		return sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.NeverSample())), nil
+	}
+	endpoint, _ := url.Parse(config.Endpoint)
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + OTLP_TRACES_PATH
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(endpoint.String()),
+		otlptracehttp.WithTimeout(config.Timeout))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter, sdktrace.WithBatchTimeout(config.Interval)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", config.ServiceName))),
+	), nil
+}
+
+// Spans follow W3C trace context in and out of the server.
+func init() {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// Sends whatever spans are left, if the global provider sends any.
+func shutdownTracing(ctx context.Context) error {
+	if provider, ok := otel.GetTracerProvider().(interface {
+		Shutdown(context.Context) error
+	}); ok {
+		return provider.Shutdown(ctx)
+	}
+	return nil
+}